@@ -1,18 +1,23 @@
 
 /**
- * This function accepts a daily, weekly, or monthly record set and
+ * This function accepts a daily, weekly, or monthly snapshot series and
  * converts it into an array that can be used for generating a timeline.
  * 
- * Example value for 'record' is Records.Daily.
+ * Example value for 'series' is profile.snapshots.daily.
  * Output should look like: [{x: <unix_ts>, y: <value>}, {...}]
  */
-function timeline(metric, records) {
+function timeline(metric, series) {
 	output = [];
 	
-	for (date in records) {
-		console.log(records[date]);
-		x = Math.round( new Date(date).getTime() / 1000 ); 
-		y = records[date].Stats[metric].Value;
+	for (var i = 0; i < series.length; i++) {
+		// Metrics without a single value (no data, per-champion breakdowns)
+		// can't be graphed.
+		if (!(metric in series[i].metrics) || !('value' in series[i].metrics[metric])) {
+			continue;
+		}
+
+		x = Math.round( new Date(series[i].date).getTime() / 1000 ); 
+		y = series[i].metrics[metric].value;
 		
 		output.push( {x: x, y: y} );
 	}
@@ -34,29 +39,40 @@ function timeline(metric, records) {
 				
 		// This should make a request to get the JSON response for the provided
 		// summoner.
-		$scope.requestSummoner = function() {			
-			$http.get("/summoner/?name=brigado").success(function(data) {		
-			//$http.get("summoners/" + $scope.requestedSummoner).success(function(data) {
-				$scope.validSummoner = data.KnownSummoner;
-				$scope.summonerData = data.Records;
+		// The summoner comes from the page's URL, e.g. /?name=brigado.
+		var match = /[?&]name=([^&]*)/.exec(window.location.search);
+		$scope.requestedSummoner = match ? decodeURIComponent(match[1]) : "";
+
+		$scope.requestSummoner = function() {
+			if ($scope.requestedSummoner.length == 0) {
+				return;
+			}
+
+			$http.get("/api/v1/summoners/" + encodeURIComponent($scope.requestedSummoner)).success(function(data) {
+				$scope.validSummoner = true;
+				$scope.summonerData = data;
 				
 				dates = [];
 				// Use a hash table as a set to get the full list of metrics.
 				metrics = {}
 				// Get a list of all of the known dates and metrics. Each metric
 				// should become a graph.
-				for (var date in data.Records.Daily) {
-					snapshot = data.Records.Daily[date]
-					dates.push( date );
+				for (var i = 0; i < data.snapshots.daily.length; i++) {
+					snapshot = data.snapshots.daily[i];
+					dates.push( snapshot.date );
 					
-					for (var i = 0; i < snapshot.Stats.length; i++) {
-						metric = snapshot.Stats[i]
-						metrics[metric.Name] = true;
+					for (var metric in snapshot.metrics) {
+						metrics[metric] = true;
 					}
 				}
+				$scope.dates = dates;
+				$scope.metrics = Object.keys(metrics);
 
 				console.log("Broadcasting update request");
 				$scope.$broadcast("summonerUpdate", null);				
+			}).error(function(data) {
+				$scope.validSummoner = false;
+				console.log("Couldn't load summoner:", data.error ? data.error.message : data);
 			});
 		}
 		
@@ -94,7 +110,10 @@ function timeline(metric, records) {
 			console.log("Updating " + $attrs.metric);
 			// Convert the user's performance data into a time series if this is a
 			// chart-based metric.
-			tlData = timeline($attrs.metric, $scope.summonerData.Daily);
+			tlData = timeline($attrs.metric, $scope.summonerData.snapshots.daily);
+			if (tlData.length == 0) {
+				return;
+			}
 			$scope.metric.value = tlData[tlData.length - 1].y;
 			$scope.metric.context = "above average for your rank";
 
@@ -5,12 +5,6 @@ function top_x(game_array, x) {
 	return game_array.slice(0, x)
 }
 
-function sort_games(game_array) {
-	game_array.sort(function(a, b) { return b.results.percent - a.results.percent });
-
-	return game_array
-}
-
 function filter_on_available(game_array, min_count) {
 	var filtered = [];
 	
@@ -143,7 +137,10 @@ function filter_on_available(game_array, min_count) {
 			var enemy_names = teams.enemies.map(function(champ) { return champ.shortname; })
 			
 			// Retrieve some sample data and format it to be easier to read.
-			$http.get("team/?allies=" + ally_names + "&enemies=" + enemy_names).success(function(data) {
+			// Add ?debug to the page's URL to see how each result was computed.
+			var debug = window.location.search.indexOf("debug") >= 0 ? "&debug=1" : "";
+
+			$http.get("team/?allies=" + ally_names + "&enemies=" + enemy_names + debug).success(function(data) {
 				// TODO: check .successful status of query and handle failed cases better.
 				$scope.stats = data;
 				
@@ -152,7 +149,8 @@ function filter_on_available(game_array, min_count) {
 					$scope.stats.next_champ[i].results.percent = Math.round( (results.matching / results.available) * 1000 ) / 10;
 				}
 				
-				allies = top_x( sort_games( filter_on_available(data.next_champ, 5) ), 8 )
+				// The backend returns candidates already ranked.
+				allies = top_x( filter_on_available(data.next_champ, 5), 8 )
 				$scope.allies = []
 				
 				// Attach champion data to each allie record.
@@ -167,6 +165,32 @@ function filter_on_available(game_array, min_count) {
 				}
 				
 				$scope.stats.results.percent = Math.round( ($scope.stats.results.matching / $scope.stats.results.available) * 1000 ) / 10;
+
+				// Interval bounds and lift come back as fractions; show them
+				// with the same precision as the headline percentage.
+				if ($scope.stats.stats) {
+					$scope.stats.stats.lower = Math.round( ($scope.stats.stats.lower_bound || 0) * 1000 ) / 10;
+					$scope.stats.stats.upper = Math.round( ($scope.stats.stats.upper_bound || 0) * 1000 ) / 10;
+					$scope.stats.stats.baseline = Math.round( ($scope.stats.stats.baseline_win_rate || 0) * 1000 ) / 10;
+					$scope.stats.stats.lift = Math.round( ($scope.stats.stats.lift || 0) * 1000 ) / 10;
+				}
+				// Pair up the sample's compact and Riot game ID's so each one
+				// can link to its stored game record.
+				if ($scope.stats.trace) {
+					var trace = $scope.stats.trace;
+					trace.samples = [];
+					for (i = 0; i < (trace.sample_games || []).length; i++) {
+						trace.samples.push({ id: trace.sample_games[i], riot_id: (trace.sample_riot_ids || [])[i] });
+					}
+
+					for (i = 0; i < (trace.steps || []).length; i++) {
+						for (j = 0; j < $scope.championList.length; j++) {
+							if ($scope.championList[j].id == trace.steps[i].champion) {
+								trace.steps[i].champion_name = $scope.championList[j].name;
+							}
+						}
+					}
+				}
 				$scope.stats.results.matching = formatNumber($scope.stats.results.matching)
 				$scope.stats.results.available = formatNumber($scope.stats.results.available)
 				$scope.stats.results.total = formatNumber($scope.stats.results.total)
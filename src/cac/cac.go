@@ -7,15 +7,11 @@ package main
  */
 
 import (
-	gproto "code.google.com/p/goprotobuf/proto"
 	data "datamodel"
 	"flag"
 	"fmt"
-	beanstalk "github.com/iwanbk/gobeanstalk"
 	"log"
-	"lolutil"
-	"math"
-	"proto"
+	"os"
 	"time"
 )
 
@@ -27,104 +23,154 @@ import (
 var (
 	SUMMONER_FILE 	= flag.String("summoners", "", "The file containing the list of summoners to handle.")
 	MAX_PER_NODE  	= flag.Int("max_node", 100, "The maximum number of summoners that should be directed to a single worker")
-	LABEL			= flag.String("label", "daily", "")
+	LABEL			= flag.String("label", "daily", "Comma-separated snapshot labels: daily, weekly, monthly, last7days, last30days or last20games.")
 	START_DATE		= flag.String("target_date", "", "The specific date to be analyzed or a date from within the range to be analyzed.")
+	END_DATE		= flag.String("end_date", "", "If set, every date from target_date through end_date is analyzed.")
+	REQUEUE			= flag.Bool("requeue", false, "Queue jobs again even if they're pending or done. Failed jobs are always queued again.")
+	FORCE			= flag.Bool("force", false, "Queue summoners even if their snapshots are already up to date, and have -workers recompute every metric.")
+	INTERVAL		= flag.Duration("interval", time.Hour, "How often the daemon checks for new jobs to queue.")
+	QUEUE			= flag.String("queue", "", "The job queue: a beanstalkd address, file:PATH for an embedded queue kept in PATH, or mem: for one that isn't kept. Defaults to beanstalkd from the service registry.")
+	WORKERS			= flag.Int("workers", 0, "The number of join-summoners workers to run in this process, for development.")
 )
 
-func daysIn(m time.Month, year int) int { 
-    // This is equivalent to time.daysIn(m, year). 
-    return time.Date(year, m+1, 0, 0, 0, 0, 0, time.UTC).Day() 
-} 
- 
-func getDates(label string, date_string string) []string {
-	date, _ := time.Parse("2006-01-02", date_string)
-	var dates []string
-
-	// Set the number of strings that we want for a given label
-	if label == "daily" {
-		// Add a single time string
-		dates = append(dates, date_string)
-	} else if label == "weekly" {
-		// Find the start date of the week first.
-		week_start := date
-		for week_start.Weekday() != time.Sunday {
-			week_start = week_start.AddDate(0, 0, -1)
+/**
+ * Whether a flag was set on the command line, rather than left at its
+ * default.
+ */
+func flag_set(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
 		}
+	})
+	return set
+}
+
+/**
+ * Queues the jobs for each target, leaving out summoners that are already
+ * up to date unless -force is set. beanstalkd is connected to for each run
+ * so that the daemon survives beanstalkd restarting.
+ */
+func queue_targets(retriever *data.LoLRetriever, targets []jobTarget) error {
+	log.Println("Connecting to the queue...")
+	queue, err := open_queue()
+	if err != nil {
+		return err
+	}
+	defer close_queue(queue)
+	log.Println("Connected.")
 
-		// Then count seven dates.
-		for i := 0; i < 7; i++ {
-			dates = append(dates, week_start.Format("2006-01-02")) 
-			week_start = week_start.AddDate(0, 0, 1)
+	put := func(body []byte) (uint64, error) {
+		// Send the message at priority 10, with no delay, and with a ten-minute
+		// time-to-live before being returned to the queue in case of a worker
+		// failure. Workers touch their jobs while they're running.
+		return queue.Put(body, JOB_PRIORITY, 0, JOB_TTR)
+	}
+
+	sids := load_summoners(*retriever, *SUMMONER_FILE)
+
+	pending := make([][]uint32, len(targets))
+	if *FORCE {
+		for i := range targets {
+			pending[i] = sids
 		}
-	} else if label == "monthly" {
-                // Find the start date of the month first.
-                month_start := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, nil)
-
-                // Then count seven dates.
-                for i := 0; i < daysIn(month_start.Month(), month_start.Year()); i++ {
-                        dates = append(dates, month_start.Format("2006-01-02")) 
-			month_start = month_start.AddDate(0, 0, 1)
-                }
 	} else {
-		log.Fatal("Unknown label:", label)
+		pending = pending_summoners(targets, sids, retriever.GetSummoners)
 	}
 
-<<<<<<< HEAD
-	// Generate all of the quickdates and add them to a single slice.
-	for i := 0; i < num_strings; i++ {
-		dates = append(dates, date_string)
-
-		// Parse the current time and add a day. Then reformat it as a string.
-		next_date, _ := time.Parse("2006-01-02", date_string)
-		next_date = next_date.Add(24 * time.Hour)
-		date_string = next_date.Format("2006-01-02")
+	queued := 0
+	for i, target := range targets {
+		log.Println(fmt.Sprintf("%s snapshot for %s: %d of %d summoners need updating",
+			target.Label.Name,
+			target.Key,
+			len(pending[i]),
+			len(sids)))
+
+		// Initialize a job for each segment of summoners.
+		for _, record := range plan_jobs(target, sids, pending[i], *MAX_PER_NODE) {
+			if queue_job(retriever, put, record, *REQUEUE) {
+				queued++
+			}
+		}
 	}
 
-=======
->>>>>>> d9ad7df3f76fb88840bdfe08fca3b05cbec52b1d
-	log.Println(dates)
-	return dates
+	log.Println(fmt.Sprintf("Queued %d jobs. Run `cac status` to check on them.", queued))
+	return nil
 }
 
 func main() {
 	flag.Parse()
 
 	retriever := data.LoLRetriever{}
-	cm := lolutil.LoadCandidates(retriever, *SUMMONER_FILE)
-
-	log.Println("Connecting to beanstalkd...")
-	bs, cerr := beanstalk.Dial("localhost:11300")
-	if cerr != nil {
-		log.Fatal(cerr)
+	if err := retriever.Init(); err != nil {
+		log.Fatal("Couldn't open the game store:", err)
 	}
-	log.Println("Connected.")
 
-	for i := 0; i < (int)(math.Ceil((float64)(cm.Count())/(float64)(*MAX_PER_NODE))); i++ {
-		var summoners []uint32
+	switch flag.Arg(0) {
+	// `cac status` reports on the jobs that have been queued so far, for
+	// every label unless one is given.
+	case "status":
+		jobs := make([]data.JobRecord, 0)
+		if flag_set("label") {
+			labels, err := parse_labels(*LABEL)
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, label := range labels {
+				jobs = append(jobs, retriever.GetJobs(label.Name)...)
+			}
+		} else {
+			jobs = retriever.GetJobs("")
+		}
+		print_status(os.Stdout, summarize(jobs, time.Now()))
 
-		// Build up the list of summoners that should be included in this
-		// request.
-		for j := 0; j < *MAX_PER_NODE; j++ {
-			val := cm.Pop()
+	case "daemon":
+		names := DAEMON_LABELS
+		if flag_set("label") {
+			names = *LABEL
+		}
+		labels, err := parse_labels(names)
+		if err != nil {
+			log.Fatal(err)
+		}
 
-			if val != 0 {
-				summoners = append(summoners, val)
-			}
+		start_workers()
+		run_daemon(labels, *INTERVAL, func(targets []jobTarget) error {
+			return queue_targets(&retriever, targets)
+		})
+
+	case "":
+		labels, lerr := parse_labels(*LABEL)
+		if lerr != nil {
+			log.Fatal(lerr)
+		}
+		dates, derr := date_range(*START_DATE, *END_DATE)
+		if derr != nil {
+			log.Fatal("Invalid dates:", derr)
 		}
 
-		// Initialize a JoinRequest for this segment of summoners.
-		jr := proto.JoinRequest{
-			Label:      LABEL,
-			Quickdates: getDates(*LABEL, *START_DATE),
-			Summoners:  summoners,
+		targets, terr := plan_targets(labels, dates)
+		if terr != nil {
+			log.Fatal(terr)
+		}
+		start_workers()
+		if err := queue_targets(&retriever, targets); err != nil {
+			log.Fatal(err)
 		}
 
-		message, _ := gproto.Marshal(&jr)
+		if *WORKERS > 0 {
+			queue, err := open_queue()
+			if err != nil {
+				log.Fatal(err)
+			}
+			wait_until_idle(queue)
+		}
+		if embedded != nil {
+			embedded.Close()
+		}
 
-		// Send the message at priority 10, with no delay, and with a ten-minute
-		// time-to-live before being returned to the queue in case of a worker
-		// failure.
-		id, _ := bs.Put([]byte(message), 10, 0, 10*time.Minute)
-		log.Println(fmt.Sprintf("Message %d sent.", id))
+	default:
+		log.Fatal("Unknown command:", flag.Arg(0))
 	}
 }
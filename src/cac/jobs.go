@@ -0,0 +1,127 @@
+package main
+
+/**
+ * Job records for the requests cac queues. Every request gets an ID made
+ * from its label, date and candidate summoners (see plan_jobs), so
+ * running cac twice for the same thing doesn't queue the same work twice;
+ * jobs that failed are queued again, and -requeue queues everything again
+ * (other than jobs that are running right now). Running jobs whose worker
+ * seems to have died are queued again either way.
+ */
+
+import (
+	gproto "code.google.com/p/goprotobuf/proto"
+	data "datamodel"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"proto"
+	"sort"
+	"time"
+)
+
+// How long a worker has to finish (or touch) a job before it's handed to
+// another worker.
+const JOB_TTR = 10 * time.Minute
+
+const JOB_PRIORITY = 10
+
+// Running jobs that haven't been touched for this long have most likely
+// lost their worker.
+const STALLED_AFTER = JOB_TTR
+
+/**
+ * The ID for the job that builds LABEL snapshots keyed by DATE for the
+ * given summoners. The order of the summoners doesn't matter.
+ */
+func job_id(label string, date string, summoners []uint32) string {
+	sorted := make([]int, 0, len(summoners))
+	for _, sid := range summoners {
+		sorted = append(sorted, int(sid))
+	}
+	sort.Ints(sorted)
+
+	hash := fnv.New64a()
+	buf := make([]byte, 4)
+	for _, sid := range sorted {
+		binary.BigEndian.PutUint32(buf, uint32(sid))
+		hash.Write(buf)
+	}
+
+	return fmt.Sprintf("%s:%s:%016x", label, date, hash.Sum64())
+}
+
+/**
+ * Whether a running job looks like it's been abandoned as of NOW.
+ */
+func stalled(job data.JobRecord, now time.Time) bool {
+	return job.State == data.JOB_RUNNING && now.Sub(time.Unix(int64(job.Heartbeat), 0)) > STALLED_AFTER
+}
+
+/**
+ * Whether a job that already has a record should be queued again.
+ */
+func should_requeue(existing data.JobRecord, requeue bool, now time.Time) bool {
+	switch existing.State {
+	case data.JOB_FAILED:
+		return true
+	case data.JOB_RUNNING:
+		return stalled(existing, now)
+	default:
+		return requeue
+	}
+}
+
+/**
+ * Creates the record for a job and puts it on the queue, unless the same
+ * job has already been queued. Returns whether the job was queued.
+ */
+func queue_job(retriever *data.LoLRetriever, put func(body []byte) (uint64, error), record data.JobRecord, requeue bool) bool {
+	record.State = data.JOB_PENDING
+
+	created, err := retriever.CreateJob(&record)
+	if err != nil {
+		log.Println(fmt.Sprintf("Couldn't create job %s: %v", record.JobId, err))
+		return false
+	}
+
+	if !created {
+		existing, _ := retriever.GetJob(record.JobId)
+		if !should_requeue(existing, requeue, time.Now()) {
+			log.Println(fmt.Sprintf("Job %s is already %s; skipping", record.JobId, existing.State))
+			return false
+		}
+		if stalled(existing, time.Now()) {
+			log.Println(fmt.Sprintf("Job %s stopped running at %d; queueing it again", record.JobId, existing.Heartbeat))
+		}
+
+		// Start over. The attempts so far are kept.
+		record.Created = existing.Created
+		record.Attempts = existing.Attempts
+		if err := retriever.StoreJob(&record); err != nil {
+			log.Println(fmt.Sprintf("Couldn't reset job %s: %v", record.JobId, err))
+			return false
+		}
+	}
+
+	jr := proto.JoinRequest{
+		Label:      gproto.String(record.Label),
+		Quickdates: record.Quickdates,
+		Summoners:  record.Summoners,
+		JobId:      gproto.String(record.JobId),
+	}
+	message, _ := gproto.Marshal(&jr)
+
+	id, err := put(message)
+	if err != nil {
+		// Leave it marked as failed so that it's queued again next time.
+		retriever.FinishJob(record.JobId, data.JOB_FAILED, fmt.Sprintf("couldn't queue: %v", err))
+		log.Println(fmt.Sprintf("Couldn't queue job %s: %v", record.JobId, err))
+		return false
+	}
+
+	retriever.SetJobQueueId(record.JobId, id)
+	log.Println(fmt.Sprintf("Message %d sent for job %s.", id, record.JobId))
+	return true
+}
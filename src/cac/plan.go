@@ -0,0 +1,212 @@
+package main
+
+/**
+ * Working out which jobs to queue. Each label and date range turns into a
+ * set of targets, one for each snapshot key (a month of dates is a single
+ * monthly snapshot but thirty daily ones), and every candidate summoner is
+ * split into jobs of at most -max_node summoners for each target.
+ * Summoners whose snapshot for a target is already up to date are then
+ * left out of its jobs (see Label.UpToDate), so backfills and recomputes
+ * only queue the work that's left, while each job keeps the same ID from
+ * one run to the next.
+ */
+
+import (
+	data "datamodel"
+	"fmt"
+	"lolutil"
+	"snapshot"
+	"sort"
+	"strings"
+	"time"
+)
+
+/**
+ * A snapshot to build: the label and the quickdates it covers.
+ */
+type jobTarget struct {
+	Label      snapshot.Label
+	Key        string
+	Quickdates []string
+}
+
+/**
+ * Parses a comma-separated list of labels.
+ */
+func parse_labels(names string) ([]snapshot.Label, error) {
+	labels := make([]snapshot.Label, 0)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+
+		label, known := snapshot.LookupLabel(name)
+		if !known {
+			return nil, fmt.Errorf("unknown label '%s'", name)
+		}
+		labels = append(labels, label)
+	}
+
+	if len(labels) == 0 {
+		return nil, fmt.Errorf("no labels")
+	}
+	return labels, nil
+}
+
+/**
+ * Every date from START through END, inclusive. If END is empty it's just
+ * START.
+ */
+func date_range(start string, end string) ([]string, error) {
+	if len(end) == 0 {
+		end = start
+	}
+
+	first, err := time.Parse(snapshot.DATE_FORMAT, start)
+	if err != nil {
+		return nil, err
+	}
+	last, err := time.Parse(snapshot.DATE_FORMAT, end)
+	if err != nil {
+		return nil, err
+	}
+	if last.Before(first) {
+		return nil, fmt.Errorf("%s is before %s", end, start)
+	}
+
+	dates := make([]string, 0)
+	for day := first; !day.After(last); day = day.AddDate(0, 0, 1) {
+		dates = append(dates, day.Format(snapshot.DATE_FORMAT))
+	}
+	return dates, nil
+}
+
+/**
+ * The snapshots for each label that cover any of the dates, oldest first.
+ */
+func plan_targets(labels []snapshot.Label, dates []string) ([]jobTarget, error) {
+	targets := make([]jobTarget, 0)
+	for _, label := range labels {
+		seen := make(map[string]bool)
+		for _, date := range dates {
+			quickdates, err := label.Dates(date)
+			if err != nil {
+				return nil, err
+			}
+
+			key := label.Key(quickdates)
+			if !seen[key] {
+				seen[key] = true
+				targets = append(targets, jobTarget{Label: label, Key: key, Quickdates: quickdates})
+			}
+		}
+	}
+	return targets, nil
+}
+
+/**
+ * The summoners that still need a snapshot for each target, by target.
+ * Summoner records are fetched a batch at a time and checked against
+ * every target.
+ */
+func pending_summoners(targets []jobTarget, sids []uint32, fetch func(sids []uint32) map[uint32]data.SummonerRecord) [][]uint32 {
+	pending := make([][]uint32, len(targets))
+
+	for start := 0; start < len(sids); start += data.STORE_BATCH_SIZE {
+		end := start + data.STORE_BATCH_SIZE
+		if end > len(sids) {
+			end = len(sids)
+		}
+
+		summoners := fetch(sids[start:end])
+		for _, sid := range sids[start:end] {
+			summoner, exists := summoners[sid]
+			for i, target := range targets {
+				if !exists || !target.Label.UpToDate(summoner, target.Quickdates) {
+					pending[i] = append(pending[i], sid)
+				}
+			}
+		}
+	}
+	return pending
+}
+
+/**
+ * Splits summoners into groups of at most SIZE.
+ */
+func chunk_summoners(sids []uint32, size int) [][]uint32 {
+	if size < 1 {
+		size = 1
+	}
+
+	chunks := make([][]uint32, 0)
+	for start := 0; start < len(sids); start += size {
+		end := start + size
+		if end > len(sids) {
+			end = len(sids)
+		}
+		chunks = append(chunks, sids[start:end])
+	}
+	return chunks
+}
+
+/**
+ * The jobs for TARGET. Candidates are chunked in order of ID, so the same
+ * candidates always make up the same jobs and get the same job ID's no
+ * matter how many of them are pending; each job then only lists its
+ * PENDING summoners, and jobs without any are left out.
+ */
+func plan_jobs(target jobTarget, sids []uint32, pending []uint32, size int) []data.JobRecord {
+	sorted := make([]int, 0, len(sids))
+	for _, sid := range sids {
+		sorted = append(sorted, int(sid))
+	}
+	sort.Ints(sorted)
+
+	ordered := make([]uint32, 0, len(sorted))
+	for _, sid := range sorted {
+		ordered = append(ordered, uint32(sid))
+	}
+
+	needed := make(map[uint32]bool)
+	for _, sid := range pending {
+		needed[sid] = true
+	}
+
+	jobs := make([]data.JobRecord, 0)
+	for _, chunk := range chunk_summoners(ordered, size) {
+		summoners := make([]uint32, 0, len(chunk))
+		for _, sid := range chunk {
+			if needed[sid] {
+				summoners = append(summoners, sid)
+			}
+		}
+		if len(summoners) == 0 {
+			continue
+		}
+
+		jobs = append(jobs, data.JobRecord{
+			JobId:      job_id(target.Label.Name, target.Key, chunk),
+			Label:      target.Label.Name,
+			Date:       target.Key,
+			Quickdates: target.Quickdates,
+			Summoners:  summoners,
+		})
+	}
+	return jobs
+}
+
+/**
+ * Every candidate summoner: the ones in the seed file and the ones that
+ * are already known.
+ */
+func load_summoners(retriever data.LoLRetriever, seedfile string) []uint32 {
+	cm := lolutil.LoadCandidates(retriever, seedfile)
+
+	sids := make([]uint32, 0, cm.Count())
+	for cm.Count() > 0 {
+		sids = append(sids, cm.Pop())
+	}
+	return sids
+}
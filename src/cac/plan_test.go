@@ -0,0 +1,137 @@
+package main
+
+import (
+	data "datamodel"
+	"reflect"
+	"snapshot"
+	"testing"
+	"time"
+)
+
+func labels(t *testing.T, names string) []snapshot.Label {
+	labels, err := parse_labels(names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return labels
+}
+
+func keys(targets []jobTarget) []string {
+	found := make([]string, 0)
+	for _, target := range targets {
+		found = append(found, target.Label.Name+" "+target.Key)
+	}
+	return found
+}
+
+func TestParseLabels(t *testing.T) {
+	if found := labels(t, "daily, weekly,"); len(found) != 2 || found[1].Name != "weekly" {
+		t.Error("Unexpected labels:", found)
+	}
+	if _, err := parse_labels("daily,fortnightly"); err == nil {
+		t.Error("Expected an error for an unknown label")
+	}
+	if _, err := parse_labels(""); err == nil {
+		t.Error("Expected an error for no labels")
+	}
+}
+
+func TestDateRange(t *testing.T) {
+	dates, err := date_range("2014-08-30", "2014-09-02")
+	if err != nil || !reflect.DeepEqual(dates, []string{"2014-08-30", "2014-08-31", "2014-09-01", "2014-09-02"}) {
+		t.Error("Unexpected dates:", dates, err)
+	}
+	if dates, _ := date_range("2014-09-18", ""); !reflect.DeepEqual(dates, []string{"2014-09-18"}) {
+		t.Error("A single date should be its own range:", dates)
+	}
+	if _, err := date_range("2014-09-18", "2014-09-17"); err == nil {
+		t.Error("Expected an error for a backwards range")
+	}
+}
+
+func TestPlanTargets(t *testing.T) {
+	dates, _ := date_range("2014-09-12", "2014-09-22")
+	targets, err := plan_targets(labels(t, "daily,weekly,monthly"), dates)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := keys(targets)
+	if len(found) != 15 || found[0] != "daily 2014-09-12" || found[10] != "daily 2014-09-22" {
+		t.Error("Expected a daily snapshot for each date:", found)
+	}
+	if !reflect.DeepEqual(found[11:], []string{"weekly 2014-09-07", "weekly 2014-09-14", "weekly 2014-09-21", "monthly 2014-09-01"}) {
+		t.Error("Expected a snapshot for each week and month:", found)
+	}
+}
+
+func TestPendingSummoners(t *testing.T) {
+	label, _ := snapshot.LookupLabel("daily")
+	targets, _ := plan_targets([]snapshot.Label{label}, []string{"2014-09-01", "2014-09-02"})
+
+	// Summoner 1 is up to date for the first day, 2 isn't and 3 is new.
+	current := data.PlayerSnapshot{CreationTimestamp: uint64(time.Now().Unix())}
+	snapshot.Update(&current, nil, true)
+	stale := data.PlayerSnapshot{CreationTimestamp: current.CreationTimestamp}
+
+	fetch := func(sids []uint32) map[uint32]data.SummonerRecord {
+		return map[uint32]data.SummonerRecord{
+			1: {SummonerId: 1, Daily: map[string]*data.PlayerSnapshot{"2014-09-01": &current}},
+			2: {SummonerId: 2, Daily: map[string]*data.PlayerSnapshot{"2014-09-01": &stale}},
+		}
+	}
+
+	pending := pending_summoners(targets, []uint32{1, 2, 3}, fetch)
+	if !reflect.DeepEqual(pending[0], []uint32{2, 3}) || !reflect.DeepEqual(pending[1], []uint32{1, 2, 3}) {
+		t.Error("Unexpected pending summoners:", pending)
+	}
+}
+
+func TestChunkSummoners(t *testing.T) {
+	chunks := chunk_summoners([]uint32{1, 2, 3, 4, 5}, 2)
+	if len(chunks) != 3 || len(chunks[2]) != 1 {
+		t.Error("Unexpected chunks:", chunks)
+	}
+}
+
+func TestPlanJobs(t *testing.T) {
+	label, _ := snapshot.LookupLabel("daily")
+	targets, _ := plan_targets([]snapshot.Label{label}, []string{"2014-09-01"})
+	sids := []uint32{5, 3, 1, 4, 2}
+
+	all := plan_jobs(targets[0], sids, sids, 2)
+	if len(all) != 3 || !reflect.DeepEqual(all[0].Summoners, []uint32{1, 2}) || all[0].Date != "2014-09-01" {
+		t.Fatal("Unexpected jobs:", all)
+	}
+
+	// Once some summoners are up to date, the jobs that are left keep
+	// their ID's and the ones with nothing to do are dropped.
+	jobs := plan_jobs(targets[0], sids, []uint32{2, 5}, 2)
+	if len(jobs) != 2 || jobs[0].JobId != all[0].JobId || jobs[1].JobId != all[2].JobId {
+		t.Error("Job ID's changed:", jobs, all)
+	}
+	if !reflect.DeepEqual(jobs[0].Summoners, []uint32{2}) || !reflect.DeepEqual(jobs[1].Summoners, []uint32{5}) {
+		t.Error("Unexpected summoners:", jobs)
+	}
+}
+
+func TestScheduledTargets(t *testing.T) {
+	all := labels(t, "daily,weekly,monthly,last7days")
+
+	// 2014-09-18 was a Thursday.
+	found := keys(scheduled_targets(all, time.Date(2014, 9, 18, 3, 0, 0, 0, time.Local)))
+	if !reflect.DeepEqual(found, []string{"daily 2014-09-17", "weekly 2014-09-07", "monthly 2014-08-01", "last7days 2014-09-17"}) {
+		t.Error("Unexpected schedule:", found)
+	}
+
+	// On the first day of a week or month, the one that just ended is
+	// complete.
+	found = keys(scheduled_targets(all, time.Date(2014, 9, 1, 0, 30, 0, 0, time.Local)))
+	if !reflect.DeepEqual(found, []string{"daily 2014-08-31", "weekly 2014-08-24", "monthly 2014-08-01", "last7days 2014-08-31"}) {
+		t.Error("Unexpected schedule:", found)
+	}
+	found = keys(scheduled_targets(all[1:2], time.Date(2014, 9, 14, 0, 30, 0, 0, time.Local)))
+	if !reflect.DeepEqual(found, []string{"weekly 2014-09-07"}) {
+		t.Error("Unexpected schedule:", found)
+	}
+}
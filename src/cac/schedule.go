@@ -0,0 +1,62 @@
+package main
+
+/**
+ * `cac daemon` queues the latest snapshots on a schedule: yesterday's
+ * daily snapshot, last week's weekly one and last month's monthly one (or
+ * whichever labels are given with -label). It checks every -interval;
+ * because jobs that are already queued or done are skipped, and so are
+ * summoners whose snapshots are up to date, checking often only queues
+ * what's new and picks up jobs that failed.
+ *
+ *   ./cac daemon
+ *   ./cac -label=daily,last7days -interval=30m daemon
+ */
+
+import (
+	"fmt"
+	"log"
+	"snapshot"
+	"time"
+)
+
+const DAEMON_LABELS = "daily,weekly,monthly"
+
+/**
+ * The most recent snapshot for each label that covers days that are all
+ * over by TODAY: for calendar labels that's the last complete day, week
+ * or month, and for rolling ones it's the window ending yesterday.
+ */
+func scheduled_targets(labels []snapshot.Label, today time.Time) []jobTarget {
+	today_str := today.Format(snapshot.DATE_FORMAT)
+	yesterday := today.AddDate(0, 0, -1).Format(snapshot.DATE_FORMAT)
+
+	targets := make([]jobTarget, 0, len(labels))
+	for _, label := range labels {
+		quickdates, _ := label.Dates(yesterday)
+
+		// Yesterday was in a week or month that isn't over yet, so use the
+		// one before.
+		if quickdates[len(quickdates)-1] >= today_str {
+			first, _ := time.Parse(snapshot.DATE_FORMAT, quickdates[0])
+			quickdates, _ = label.Dates(first.AddDate(0, 0, -1).Format(snapshot.DATE_FORMAT))
+		}
+
+		targets = append(targets, jobTarget{Label: label, Key: label.Key(quickdates), Quickdates: quickdates})
+	}
+	return targets
+}
+
+func run_daemon(labels []snapshot.Label, interval time.Duration, run func(targets []jobTarget) error) {
+	for {
+		targets := scheduled_targets(labels, time.Now())
+		for _, target := range targets {
+			log.Println(fmt.Sprintf("Scheduled %s snapshot for %s", target.Label.Name, target.Key))
+		}
+
+		if err := run(targets); err != nil {
+			log.Println("Couldn't queue scheduled jobs:", err)
+		}
+
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+/**
+ * `cac status` prints how the queued jobs are getting along: the number of
+ * pending, running, failed and done jobs for each label and date, how many
+ * of their summoners have been stored, and why the failed ones failed.
+ *
+ *   ./cac status
+ *   ./cac -label=weekly status
+ */
+
+import (
+	data "datamodel"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+type jobSummary struct {
+	Label string
+	Date  string
+
+	Pending int
+	Running int
+	// Running jobs that look abandoned; also counted in Running.
+	Stalled int
+	Failed  int
+	Done    int
+
+	Summoners int
+	Stored    int
+
+	// The failed jobs themselves.
+	Failures []data.JobRecord
+}
+
+/**
+ * Groups job records by label and date. The summaries are sorted by
+ * label, then date.
+ */
+func summarize(jobs []data.JobRecord, now time.Time) []*jobSummary {
+	summaries := make(map[string]*jobSummary)
+	keys := make([]string, 0)
+
+	for _, job := range jobs {
+		key := job.Label + " " + job.Date
+		summary, exists := summaries[key]
+		if !exists {
+			summary = &jobSummary{Label: job.Label, Date: job.Date}
+			summaries[key] = summary
+			keys = append(keys, key)
+		}
+
+		switch job.State {
+		case data.JOB_PENDING:
+			summary.Pending++
+		case data.JOB_RUNNING:
+			summary.Running++
+			if stalled(job, now) {
+				summary.Stalled++
+			}
+		case data.JOB_FAILED:
+			summary.Failed++
+			summary.Failures = append(summary.Failures, job)
+		case data.JOB_DONE:
+			summary.Done++
+		}
+
+		summary.Summoners += len(job.Summoners)
+		if job.State == data.JOB_DONE {
+			summary.Stored += len(job.Summoners)
+		} else {
+			summary.Stored += len(job.Done)
+		}
+	}
+
+	sort.Strings(keys)
+	sorted := make([]*jobSummary, 0, len(keys))
+	for _, key := range keys {
+		sorted = append(sorted, summaries[key])
+	}
+	return sorted
+}
+
+func print_status(out io.Writer, summaries []*jobSummary) {
+	if len(summaries) == 0 {
+		fmt.Fprintln(out, "No jobs.")
+		return
+	}
+
+	table := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(table, "LABEL\tDATE\tPENDING\tRUNNING\tFAILED\tDONE\tSUMMONERS\t")
+	for _, s := range summaries {
+		running := fmt.Sprintf("%d", s.Running)
+		if s.Stalled > 0 {
+			running = fmt.Sprintf("%d (%d stalled)", s.Running, s.Stalled)
+		}
+		fmt.Fprintf(table, "%s\t%s\t%d\t%s\t%d\t%d\t%d/%d\t\n", s.Label, s.Date, s.Pending, running, s.Failed, s.Done, s.Stored, s.Summoners)
+	}
+	table.Flush()
+
+	header := false
+	for _, s := range summaries {
+		for _, job := range s.Failures {
+			if !header {
+				fmt.Fprintln(out, "\nFailed jobs:")
+				header = true
+			}
+			fmt.Fprintf(out, "  %s (%d attempts): %s\n", job.JobId, job.Attempts, job.Reason)
+		}
+	}
+}
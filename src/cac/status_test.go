@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	data "datamodel"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJobId(t *testing.T) {
+	id := job_id("weekly", "2014-09-14", []uint32{3, 1, 2})
+	if id != job_id("weekly", "2014-09-14", []uint32{1, 2, 3}) {
+		t.Error("Job ID's shouldn't depend on the order of the summoners")
+	}
+	if !strings.HasPrefix(id, "weekly:2014-09-14:") {
+		t.Error("Unexpected job ID:", id)
+	}
+
+	if id == job_id("weekly", "2014-09-14", []uint32{1, 2, 4}) || id == job_id("daily", "2014-09-14", []uint32{1, 2, 3}) {
+		t.Error("Different jobs got the same ID")
+	}
+}
+
+func TestShouldRequeue(t *testing.T) {
+	now := time.Unix(100000, 0)
+	for state, expected := range map[string]bool{data.JOB_PENDING: false, data.JOB_RUNNING: false, data.JOB_FAILED: true, data.JOB_DONE: false} {
+		if should_requeue(data.JobRecord{State: state, Heartbeat: 99990}, false, now) != expected {
+			t.Error("Unexpected requeue decision for", state, "job")
+		}
+	}
+
+	if !should_requeue(data.JobRecord{State: data.JOB_DONE}, true, now) || should_requeue(data.JobRecord{State: data.JOB_RUNNING, Heartbeat: 99990}, true, now) {
+		t.Error("-requeue should queue everything that isn't running")
+	}
+
+	// Running jobs that have lost their worker are queued again either way.
+	if !should_requeue(data.JobRecord{State: data.JOB_RUNNING, Heartbeat: 1000}, false, now) {
+		t.Error("Stalled jobs should be queued again")
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	now := time.Unix(100000, 0)
+	jobs := []data.JobRecord{
+		{JobId: "w1", Label: "weekly", Date: "2014-09-14", State: data.JOB_DONE, Summoners: []uint32{1, 2}},
+		{JobId: "d1", Label: "daily", Date: "2014-09-18", State: data.JOB_RUNNING, Summoners: []uint32{1, 2, 3}, Done: []uint32{1}, Heartbeat: 99990},
+		{JobId: "d2", Label: "daily", Date: "2014-09-18", State: data.JOB_RUNNING, Summoners: []uint32{4}, Heartbeat: 1000},
+		{JobId: "d3", Label: "daily", Date: "2014-09-18", State: data.JOB_FAILED, Summoners: []uint32{5, 6}, Done: []uint32{5}, Reason: "connection reset", Attempts: 2},
+		{JobId: "d4", Label: "daily", Date: "2014-09-17", State: data.JOB_PENDING, Summoners: []uint32{1}},
+	}
+
+	summaries := summarize(jobs, now)
+	if len(summaries) != 3 || summaries[0].Date != "2014-09-17" || summaries[1].Date != "2014-09-18" || summaries[2].Label != "weekly" {
+		t.Fatal("Summaries should be sorted by label and date:", summaries)
+	}
+
+	daily := summaries[1]
+	if daily.Running != 2 || daily.Stalled != 1 || daily.Failed != 1 || daily.Pending != 0 || daily.Done != 0 {
+		t.Error("Unexpected counts:", daily)
+	}
+	if daily.Summoners != 6 || daily.Stored != 2 {
+		t.Error("Unexpected progress:", daily.Stored, "of", daily.Summoners)
+	}
+	if summaries[2].Stored != 2 {
+		t.Error("Every summoner in a finished job has been stored")
+	}
+
+	out := bytes.Buffer{}
+	print_status(&out, summaries)
+	if !strings.Contains(out.String(), "2 (1 stalled)") || !strings.Contains(out.String(), "d3 (2 attempts): connection reset") {
+		t.Error("Unexpected status:\n" + out.String())
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+/**
+ * Running cac and join-summoners as one process, for development:
+ *
+ *   ./cac -queue=file:cleo.queue -workers=2 -target_date=2014-09-18
+ *   ./cac -queue=file:cleo.queue -workers=2 daemon
+ *
+ * -queue picks the job queue (see jobqueue.Open); without it cac uses the
+ * beanstalkd in the service registry. An embedded queue is opened once and
+ * shared with the -workers, which are the same workers join-summoners
+ * runs (see joiner/worker.go). When it isn't running as a daemon, cac
+ * waits for the workers to finish the jobs it queued before exiting.
+ */
+
+import (
+	"errors"
+	"fmt"
+	"jobqueue"
+	"joiner"
+	"log"
+	"registry"
+	"runtime"
+	"time"
+)
+
+// How long to wait before trying to reach the queue again.
+const RETRY_DELAY = 10 * time.Second
+
+// How often to check whether the workers have finished.
+const IDLE_CHECK_INTERVAL = time.Second
+
+// The embedded queue, if -queue names one. It has to be opened before any
+// workers start.
+var embedded jobqueue.Queue
+
+/**
+ * The queue chosen with -queue. Embedded queues are shared; every call
+ * returns the same one.
+ */
+func open_queue() (jobqueue.Queue, error) {
+	if embedded != nil {
+		return embedded, nil
+	}
+
+	spec := *QUEUE
+	if len(spec) == 0 {
+		address, err := registry.Lookup("beanstalk")
+		if err != nil {
+			return nil, errors.New(fmt.Sprint("couldn't find beanstalkd in the service registry: ", err))
+		}
+		spec = address
+	}
+
+	queue, err := jobqueue.Open(spec)
+	if err == nil && jobqueue.Embedded(spec) {
+		embedded = queue
+	}
+	return queue, err
+}
+
+/**
+ * Closes a queue from open_queue, unless it's the shared one.
+ */
+func close_queue(queue jobqueue.Queue) {
+	if queue != embedded {
+		queue.Close()
+	}
+}
+
+/**
+ * Opens the embedded queue, if -queue names one, and starts the -workers.
+ */
+func start_workers() {
+	if jobqueue.Embedded(*QUEUE) {
+		if _, err := open_queue(); err != nil {
+			log.Fatal("Couldn't open the queue:", err)
+		}
+	}
+
+	for i := 0; i < *WORKERS; i++ {
+		go run_worker(i)
+	}
+}
+
+func run_worker(i int) {
+	// Summoners queued with -force are rebuilt by the workers too.
+	w := joiner.Worker{Store: &joiner.MongoStore{}, Shards: runtime.NumCPU(), Force: *FORCE}
+	for {
+		queue, err := open_queue()
+		if err != nil {
+			log.Println(fmt.Sprintf("Worker %d couldn't open the queue: %v", i, err))
+			time.Sleep(RETRY_DELAY)
+			continue
+		}
+
+		w.Queue = queue
+		err = w.Run()
+		close_queue(queue)
+		if err == jobqueue.ErrClosed {
+			return
+		}
+		log.Println(fmt.Sprintf("Worker %d couldn't reserve a request: %v", i, err))
+	}
+}
+
+/**
+ * Waits until the workers have finished every job on the queue. Only
+ * embedded queues can say how many jobs they have, so with beanstalkd
+ * this waits forever.
+ */
+func wait_until_idle(queue jobqueue.Queue) {
+	stats, countable := queue.(interface {
+		Stats() jobqueue.Stats
+	})
+	if !countable {
+		log.Println("Workers are running; stop them with Ctrl-C.")
+		select {}
+	}
+
+	for stats.Stats().Pending() > 0 {
+		time.Sleep(IDLE_CHECK_INTERVAL)
+	}
+	log.Println(fmt.Sprintf("All jobs finished (%d buried).", stats.Stats().Buried))
+}
@@ -169,6 +169,9 @@ func getFreshnessStats() FreshnessStats {
 
 func main() {
 	flag.Parse()
+	if err := (&data.LoLRetriever{}).Init(); err != nil {
+		log.Fatal("Couldn't open the game store:", err)
+	}
 	log.Println("Fetching data and calculating...")
 
 	// Use logs to find out how often we get to examine each summoner (depth)
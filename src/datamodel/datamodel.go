@@ -1,15 +1,47 @@
 package datamodel
 
 import (
+	"fmt"
 	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
 	"log"
+	"registry"
 	"strconv"
+	"sync"
 	"time"
 )
 
-// Create a single sessions with mongo that'll be shared.
-var session, serr = mgo.Dial("request.loltracker.com:27017")
+// A single session with mongo that'll be shared. It's opened on first use
+// so that the "mongo" service can be looked up in the registry after flags
+// have been parsed. If it can't be opened the error is returned, and the
+// next caller tries again.
+var session *mgo.Session
+var session_lock sync.Mutex
+
+func get_session() (*mgo.Session, error) {
+	session_lock.Lock()
+	defer session_lock.Unlock()
+
+	if session != nil {
+		return session, nil
+	}
+
+	address, err := registry.Lookup("mongo")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't find Mongo in the service registry: %s", err)
+	}
+
+	s, err := mgo.Dial(address)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to Mongo at %s: %s", address, err)
+	}
+	session = s
+
+	return session, nil
+}
+
+// The most writes sent to Mongo in a single bulk operation.
+const STORE_BATCH_SIZE = 500
 
 type Retriever interface {
 	init()
@@ -33,6 +65,13 @@ type SummonerMetadataRetriever struct {
 	collection *mgo.Collection
 }
 
+/**
+ * CRUD operations on join-summoners job records.
+ */
+type JobRetriever struct {
+	collection *mgo.Collection
+}
+
 /**
  * Retrieval operations on collections of games and summoners.
  */
@@ -45,6 +84,7 @@ type LoLRetriever struct {
 	games       GameRetriever
 	summoners   SummonerRetriever
 	summoner_md SummonerMetadataRetriever
+	jobs        JobRetriever
 
 	initialized bool
 }
@@ -56,6 +96,10 @@ type SummonerIter struct {
 	queue       chan SummonerRecord
 	initialized bool
 	reached_end bool
+	// Iterators are passed around by value, so the goroutine feeding the
+	// queue sends its error (if any) along on errs before the end.
+	errs chan error
+	err  error
 }
 
 func (i *SummonerIter) Init() {
@@ -64,6 +108,7 @@ func (i *SummonerIter) Init() {
 	}
 
 	i.queue = make(chan SummonerRecord, 20)
+	i.errs = make(chan error, 1)
 	i.initialized = true
 	i.reached_end = false
 }
@@ -72,6 +117,19 @@ func (i *SummonerIter) HasNext() bool {
 	return !i.reached_end
 }
 
+// Err returns the error that ended the iteration early, if any. It's only
+// meaningful once HasNext() returns false.
+func (i *SummonerIter) Err() error {
+	return i.err
+}
+
+// Fail ends the iteration with ERR before anything has been sent.
+func (i *SummonerIter) fail(err error) {
+	i.Init()
+	i.err = err
+	i.reached_end = true
+}
+
 func (i *SummonerIter) Next() SummonerRecord {
 	i.Init()
 
@@ -84,6 +142,10 @@ func (i *SummonerIter) Next() SummonerRecord {
 
 	if s.SummonerId == 0 {
 		i.reached_end = true
+		select {
+		case i.err = <-i.errs:
+		default:
+		}
 	}
 
 	return s
@@ -93,6 +155,7 @@ type GameIter struct {
 	queue       chan GameRecord
 	initialized bool
 	reached_end bool
+	err         error
 }
 
 func (i *GameIter) Init() {
@@ -109,6 +172,19 @@ func (i *GameIter) HasNext() bool {
 	return !i.reached_end
 }
 
+// Err returns the error that ended the iteration early, if any. It's only
+// meaningful once HasNext() returns false.
+func (i *GameIter) Err() error {
+	return i.err
+}
+
+// Fail ends the iteration with ERR before anything has been sent.
+func (i *GameIter) fail(err error) {
+	i.Init()
+	i.err = err
+	i.reached_end = true
+}
+
 func (i *GameIter) Next() GameRecord {
 	i.Init()
 
@@ -127,19 +203,38 @@ func (i *GameIter) Next() GameRecord {
 }
 
 /**
- *
+ * Connect the retriever to Mongo. Every method does this on first use, but
+ * binaries can call it up front to find out whether Mongo is reachable.
+ * A retriever that's shared between goroutines has to be initialized
+ * before it's shared.
+ */
+func (r *LoLRetriever) Init() error {
+	return r.init()
+}
+
+/**
+ * Methods that can't return the error log it and act as if nothing was
+ * found, so that a missing database doesn't take the whole process down.
  */
-func (r *LoLRetriever) init() {
+func (r *LoLRetriever) init() error {
 	if r.initialized {
-		return
+		return nil
+	}
+
+	session, err := get_session()
+	if err != nil {
+		log.Println("Retriever:", err)
+		return err
 	}
 
 	r.games.collection = session.DB("lolstat").C("games")
 	r.summoners.collection = session.DB("lolstat").C("summoners")
 	r.summoner_md.collection = session.DB("lolstat").C("summonermd")
+	r.jobs.collection = session.DB("lolstat").C("jobs")
 
 	// Mark the retriever as initialized.
 	r.initialized = true
+	return nil
 }
 
 /*********************
@@ -147,7 +242,9 @@ func (r *LoLRetriever) init() {
  ********************/
 
 func (r *LoLRetriever) CountKnownSummoners() int {
-	r.init()
+	if r.init() != nil {
+		return 0
+	}
 
 	query := r.summoners.collection.Find(bson.M{})
 	count, _ := query.Count()
@@ -156,9 +253,11 @@ func (r *LoLRetriever) CountKnownSummoners() int {
 }
 
 func (r *LoLRetriever) GetAllSummonersIter() SummonerIter {
-	r.init()
-
 	iter := SummonerIter{}
+	if err := r.init(); err != nil {
+		iter.fail(err)
+		return iter
+	}
 	iter.Init()
 
 	go func() {
@@ -194,19 +293,57 @@ func (r *LoLRetriever) GetAllSummonersIter() SummonerIter {
 }
 
 func (r *LoLRetriever) GetKnownSummonersIter() SummonerIter {
-	r.init()
+	return r.find_summoners(bson.M{}, nil)
+}
 
+/**
+ * Iterate over the summoner records that have been stored since the
+ * provided Unix timestamp (inclusive). Only the ID, metadata (which holds
+ * the name) and LastUpdated are fetched. Records come back in no
+ * particular order; the largest LastUpdated seen can be passed back in to
+ * pick up where the previous call left off, but only once the iterator
+ * has finished without an error.
+ */
+func (r *LoLRetriever) GetSummonersUpdatedSinceIter(since uint64) SummonerIter {
+	if r.init() == nil {
+		// Cached by mgo after the first call, so this is cheap.
+		if err := r.summoners.collection.EnsureIndexKey("l"); err != nil {
+			log.Println("Couldn't index summoners by update time:", err)
+		}
+	}
+
+	return r.find_summoners(bson.M{"l": bson.M{"$gte": since}}, bson.M{"_id": 1, "e": 1, "l": 1})
+}
+
+/**
+ * Iterate over the summoners matching SELECTOR, fetching only FIELDS if
+ * it's not nil. If the query fails the iterator ends early and Err()
+ * reports why.
+ */
+func (r *LoLRetriever) find_summoners(selector bson.M, fields bson.M) SummonerIter {
 	iter := SummonerIter{}
+	if err := r.init(); err != nil {
+		iter.fail(err)
+		return iter
+	}
 	iter.Init()
 
 	go func() {
-		query_iter := r.summoners.collection.Find(bson.M{}).Iter()
+		query := r.summoners.collection.Find(selector)
+		if fields != nil {
+			query = query.Select(fields)
+		}
+		query_iter := query.Iter()
 
 		summoner := SummonerRecord{}
 		for query_iter.Next(&summoner) {
 			iter.queue <- summoner
+			summoner = SummonerRecord{}
 		}
 
+		if err := query_iter.Close(); err != nil {
+			iter.errs <- err
+		}
 		iter.queue <- SummonerRecord{SummonerId: 0}
 	}()
 
@@ -214,9 +351,11 @@ func (r *LoLRetriever) GetKnownSummonersIter() SummonerIter {
 }
 
 func (r *LoLRetriever) GetQuickdateGamesIter(quickdate string) GameIter {
-	r.init()
-
 	iter := GameIter{}
+	if err := r.init(); err != nil {
+		iter.fail(err)
+		return iter
+	}
 	iter.Init()
 
 	go func() {
@@ -240,9 +379,11 @@ func (r *LoLRetriever) GetQuickdateGamesIter(quickdate string) GameIter {
 }
 
 func (r *LoLRetriever) GetGameIter() GameIter {
-	r.init()
-
 	iter := GameIter{}
+	if err := r.init(); err != nil {
+		iter.fail(err)
+		return iter
+	}
 	iter.Init()
 
 	go func() {
@@ -268,30 +409,70 @@ func (r *LoLRetriever) GetGameIter() GameIter {
  * the game was found or not with a boolean.
  */
 func (r *LoLRetriever) GetGame(gameId uint64) (GameRecord, bool) {
-	r.init()
+	record, exists, _ := r.FindGame(gameId)
+	return record, exists
+}
+
+/**
+ * Like GetGame, but also returns an error if the game store can't be
+ * reached, so that callers can tell an outage from a missing game.
+ */
+func (r *LoLRetriever) FindGame(gameId uint64) (GameRecord, bool, error) {
+	if err := r.init(); err != nil {
+		return GameRecord{}, false, err
+	}
 
 	query := r.games.collection.Find(bson.M{"_id": gameId})
-	count, _ := query.Count()
+	count, err := query.Count()
+	if err != nil {
+		return GameRecord{}, false, err
+	}
 
 	if count == 0 {
-		return GameRecord{}, false
+		return GameRecord{}, false, nil
 	} else if count > 1 {
 		log.Println("WARNING: more than one game found for GameId", gameId)
-		return GameRecord{}, false
+		return GameRecord{}, false, nil
 	} else {
 		record := GameRecord{}
-		query.One(&record)
+		if err := query.One(&record); err != nil {
+			return GameRecord{}, false, err
+		}
 
-		return record, true
+		return record, true, nil
 	}
 }
 
+/**
+ * Fetch up to LIMIT of the games with the provided ID's in a single query,
+ * newest first. Riot's game ID's increase over time, so the newest games
+ * are the ones with the largest ID's. Games that can't be found are left
+ * out.
+ */
+func (r *LoLRetriever) GetRecentGames(ids []uint64, limit int) ([]GameRecord, error) {
+	games := make([]GameRecord, 0, limit)
+	if err := r.init(); err != nil {
+		return games, err
+	}
+	if len(ids) == 0 {
+		return games, nil
+	}
+
+	query := r.games.collection.Find(bson.M{"_id": bson.M{"$in": ids}}).Sort("-_id").Limit(limit)
+	if err := query.All(&games); err != nil {
+		return make([]GameRecord, 0), err
+	}
+	return games, nil
+}
+
 /**
  * StoreGame will either update an existing record or create a new one, depending
  * on whether the game ID already exists in the database.
  */
 func (r *LoLRetriever) StoreGame(gr *GameRecord) {
-	r.init()
+	if r.init() != nil {
+		return
+	}
 
 	_, exists := r.GetGame(gr.GameId)
 
@@ -303,7 +484,9 @@ func (r *LoLRetriever) StoreGame(gr *GameRecord) {
 }
 
 func (r *LoLRetriever) RemoveGame(gr *GameRecord) {
-	r.init()
+	if r.init() != nil {
+		return
+	}
 
 	r.games.collection.Remove(gr)
 }
@@ -318,19 +501,35 @@ func (r *LoLRetriever) RemoveGame(gr *GameRecord) {
  * with a SummonerId of 0.
  */
 func (r *LoLRetriever) GetSummoner(sid uint32) (SummonerRecord, bool) {
-	r.init()
+	summoner, exists, _ := r.FindSummoner(sid)
+	return summoner, exists
+}
+
+/**
+ * Like GetSummoner, but also returns an error if the summoner store can't
+ * be reached, so that callers can tell an outage from a missing summoner.
+ */
+func (r *LoLRetriever) FindSummoner(sid uint32) (SummonerRecord, bool, error) {
+	if err := r.init(); err != nil {
+		return SummonerRecord{}, false, err
+	}
 
 	query := r.summoners.collection.Find(bson.M{"_id": sid})
-	num_summoners, _ := query.Count()
+	num_summoners, err := query.Count()
+	if err != nil {
+		return SummonerRecord{}, false, err
+	}
 
 	if num_summoners == 0 {
-		return SummonerRecord{}, false
+		return SummonerRecord{}, false, nil
 	} else if num_summoners > 1 {
 		log.Println("WARNING: more than one summoner found for #", sid)
-		return SummonerRecord{}, false
+		return SummonerRecord{}, false, nil
 	} else {
 		summoner := SummonerRecord{}
-		query.One(&summoner)
+		if err := query.One(&summoner); err != nil {
+			return SummonerRecord{}, false, err
+		}
 
 		// Check to see if there's a metadata record for this summoner
 		// and fetch + join it to the summoner record if so. If the two
@@ -346,14 +545,16 @@ func (r *LoLRetriever) GetSummoner(sid uint32) (SummonerRecord, bool) {
 			}
 		}
 
-		return summoner, true
+		return summoner, true, nil
 	}
 }
 
 func (r *LoLRetriever) StoreSummoner(summoner *SummonerRecord) {
 	// Store primary data struct in summoners collection
 	// Store name in summonerdata collection
-	r.init()
+	if r.init() != nil {
+		return
+	}
 	summoner.LastUpdated = (uint64)(time.Now().Unix())
 
 	_, exists := r.GetSummoner(summoner.SummonerId)
@@ -373,6 +574,94 @@ func (r *LoLRetriever) StoreSummoner(summoner *SummonerRecord) {
 	}
 }
 
+/**
+ * Fetch several summoners at once. Summoners that can't be found are left
+ * out of the result; metadata is joined in the same way as GetSummoner().
+ */
+func (r *LoLRetriever) GetSummoners(sids []uint32) map[uint32]SummonerRecord {
+	if r.init() != nil {
+		return map[uint32]SummonerRecord{}
+	}
+	summoners := make(map[uint32]SummonerRecord)
+
+	summoner := SummonerRecord{}
+	query_iter := r.summoners.collection.Find(bson.M{"_id": bson.M{"$in": sids}}).Iter()
+	for query_iter.Next(&summoner) {
+		summoners[summoner.SummonerId] = summoner
+		summoner = SummonerRecord{}
+	}
+
+	// Fetch any metadata that hasn't been normalized into the summoner
+	// records in one more query.
+	missing := make([]uint32, 0)
+	empty := SummonerMetadata{}
+	for sid, summoner := range summoners {
+		if summoner.Metadata == empty {
+			missing = append(missing, sid)
+		}
+	}
+
+	if len(missing) > 0 {
+		smd := SummonerMetadata{}
+		md_iter := r.summoner_md.collection.Find(bson.M{"_id": bson.M{"$in": missing}}).Iter()
+		for md_iter.Next(&smd) {
+			summoner := summoners[smd.SummonerId]
+			summoner.Metadata = smd
+			summoners[smd.SummonerId] = summoner
+		}
+	}
+
+	return summoners
+}
+
+/**
+ * Store several summoners at once using bulk upserts, STORE_BATCH_SIZE
+ * at a time. Metadata is stored alongside in the same way as
+ * StoreSummoner().
+ */
+func (r *LoLRetriever) StoreSummoners(summoners []*SummonerRecord) error {
+	if err := r.init(); err != nil {
+		return err
+	}
+	now := (uint64)(time.Now().Unix())
+	empty := SummonerMetadata{}
+
+	for start := 0; start < len(summoners); start += STORE_BATCH_SIZE {
+		end := start + STORE_BATCH_SIZE
+		if end > len(summoners) {
+			end = len(summoners)
+		}
+
+		records := r.summoners.collection.Bulk()
+		records.Unordered()
+		metadata := r.summoner_md.collection.Bulk()
+		metadata.Unordered()
+		num_metadata := 0
+
+		for _, summoner := range summoners[start:end] {
+			summoner.LastUpdated = now
+			records.Upsert(bson.M{"_id": summoner.SummonerId}, summoner)
+
+			if summoner.Metadata != empty {
+				summoner.Metadata.SummonerId = summoner.SummonerId
+				metadata.Upsert(bson.M{"_id": summoner.SummonerId}, summoner.Metadata)
+				num_metadata += 1
+			}
+		}
+
+		if _, err := records.Run(); err != nil {
+			return err
+		}
+		if num_metadata > 0 {
+			if _, err := metadata.Run(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 /**
  * Fetch the metadata for the provided summoner, which may include the
  * summoner's name.
@@ -383,7 +672,9 @@ func (r *LoLRetriever) StoreSummoner(summoner *SummonerRecord) {
  * requests at the moment.
  */
 func (r *LoLRetriever) getSummonerMetadata(sid uint32) (SummonerMetadata, bool) {
-	r.init()
+	if r.init() != nil {
+		return SummonerMetadata{}, false
+	}
 
 	query := r.summoner_md.collection.Find(bson.M{"_id": sid})
 	count, _ := query.Count()
@@ -402,7 +693,9 @@ func (r *LoLRetriever) getSummonerMetadata(sid uint32) (SummonerMetadata, bool)
 }
 
 func (r *LoLRetriever) storeSummonerMetadata(summ *SummonerRecord) {
-	r.init()
+	if r.init() != nil {
+		return
+	}
 
 	summ.Metadata.SummonerId = summ.SummonerId
 	_, exists := r.getSummonerMetadata(summ.SummonerId)
@@ -413,3 +706,134 @@ func (r *LoLRetriever) storeSummonerMetadata(summ *SummonerRecord) {
 		r.summoner_md.collection.Insert(summ.Metadata)
 	}
 }
+
+/****************
+ *** Job CRUD ***
+ ***************/
+
+/**
+ * Store a new job record. Returns false if there's already a record with
+ * the same ID, in which case nothing is written.
+ */
+func (r *LoLRetriever) CreateJob(job *JobRecord) (bool, error) {
+	if err := r.init(); err != nil {
+		return false, err
+	}
+
+	now := (uint64)(time.Now().Unix())
+	job.Created = now
+	job.Updated = now
+
+	err := r.jobs.collection.Insert(job)
+	if mgo.IsDup(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (r *LoLRetriever) GetJob(id string) (JobRecord, bool) {
+	if r.init() != nil {
+		return JobRecord{}, false
+	}
+
+	job := JobRecord{}
+	if err := r.jobs.collection.FindId(id).One(&job); err != nil {
+		return JobRecord{}, false
+	}
+	return job, true
+}
+
+/**
+ * Every job record, optionally limited to a single label.
+ */
+func (r *LoLRetriever) GetJobs(label string) []JobRecord {
+	if r.init() != nil {
+		return []JobRecord{}
+	}
+
+	selector := bson.M{}
+	if len(label) > 0 {
+		selector["l"] = label
+	}
+
+	jobs := make([]JobRecord, 0)
+	r.jobs.collection.Find(selector).Sort("l", "d").All(&jobs)
+	return jobs
+}
+
+/**
+ * Replace a job record, for when a job is queued again.
+ */
+func (r *LoLRetriever) StoreJob(job *JobRecord) error {
+	if err := r.init(); err != nil {
+		return err
+	}
+
+	job.Updated = (uint64)(time.Now().Unix())
+	return r.jobs.collection.UpdateId(job.JobId, job)
+}
+
+/**
+ * Record the queue's ID for a job once it's been queued.
+ */
+func (r *LoLRetriever) SetJobQueueId(id string, qid uint64) error {
+	if err := r.init(); err != nil {
+		return err
+	}
+
+	return r.jobs.collection.UpdateId(id, bson.M{"$set": bson.M{"i": qid}})
+}
+
+/**
+ * Mark a job as started by a worker.
+ */
+func (r *LoLRetriever) StartJob(id string) error {
+	if err := r.init(); err != nil {
+		return err
+	}
+
+	now := (uint64)(time.Now().Unix())
+	return r.jobs.collection.UpdateId(id, bson.M{
+		"$set":   bson.M{"t": JOB_RUNNING, "u": now, "h": now},
+		"$unset": bson.M{"r": ""},
+		"$inc":   bson.M{"a": 1},
+	})
+}
+
+/**
+ * Record that some of a job's summoners have been stored.
+ */
+func (r *LoLRetriever) AddJobProgress(id string, sids []uint32) error {
+	if err := r.init(); err != nil {
+		return err
+	}
+
+	now := (uint64)(time.Now().Unix())
+	return r.jobs.collection.UpdateId(id, bson.M{
+		"$addToSet": bson.M{"o": bson.M{"$each": sids}},
+		"$set":      bson.M{"u": now, "h": now},
+	})
+}
+
+/**
+ * Record that the worker running a job is still alive.
+ */
+func (r *LoLRetriever) TouchJob(id string) error {
+	if err := r.init(); err != nil {
+		return err
+	}
+
+	return r.jobs.collection.UpdateId(id, bson.M{"$set": bson.M{"h": (uint64)(time.Now().Unix())}})
+}
+
+/**
+ * Mark a job as done or failed. REASON is only kept for failures.
+ */
+func (r *LoLRetriever) FinishJob(id string, state string, reason string) error {
+	if err := r.init(); err != nil {
+		return err
+	}
+
+	now := (uint64)(time.Now().Unix())
+	return r.jobs.collection.UpdateId(id, bson.M{"$set": bson.M{"t": state, "r": reason, "u": now}})
+}
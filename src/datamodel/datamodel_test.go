@@ -1,6 +1,7 @@
 package datamodel
 
 import (
+	"errors"
 	"log"
 	"math/rand"
 	"testing"
@@ -8,13 +9,23 @@ import (
 
 // TODO: Need to add a truth check to the iterator tests to make sure everything's being fetched.
 
+// These tests run against the "mongo" service from the registry, and are
+// skipped if it can't be reached.
+func test_retriever(t *testing.T) *LoLRetriever {
+	retriever := LoLRetriever{}
+	if err := retriever.Init(); err != nil {
+		t.Skip("Mongo isn't available:", err)
+	}
+	return &retriever
+}
+
 /**
  * Test to ensure that GetKnownSummonersIter() returns a list of unique
  * summoner ID's. This test also prints the number of records returned,
  * which can be manually compared to the count() of the summoners collection.
  */
 func TestGetKnownSummonersIter(t *testing.T) {
-	retriever := LoLRetriever{}
+	retriever := test_retriever(t)
 	iter := retriever.GetKnownSummonersIter()
 
 	dedup := make(map[uint32]bool)
@@ -37,7 +48,7 @@ func TestGetKnownSummonersIter(t *testing.T) {
 }
 
 func TestGetAllSummonersIter(t *testing.T) {
-	retriever := LoLRetriever{}
+	retriever := test_retriever(t)
 	iter := retriever.GetAllSummonersIter()
 
 	dedup := make(map[uint32]bool)
@@ -60,7 +71,7 @@ func TestGetAllSummonersIter(t *testing.T) {
 }
 
 func TestGetGame(t *testing.T) {
-	retriever := LoLRetriever{}
+	retriever := test_retriever(t)
 
 	_, exists := retriever.GetGame(1)
 
@@ -76,7 +87,7 @@ func TestGetGame(t *testing.T) {
 }
 
 func TestAddRemoveGame(t *testing.T) {
-	retriever := LoLRetriever{}
+	retriever := test_retriever(t)
 
 	var gameid uint64 = 1
 	_, exists := retriever.GetGame(gameid)
@@ -101,3 +112,32 @@ func TestAddRemoveGame(t *testing.T) {
 	// Remove it.
 	retriever.RemoveGame(&gr)
 }
+
+func TestSummonerIterErr(t *testing.T) {
+	feed := SummonerIter{}
+	feed.Init()
+	// Callers get a copy of the iterator.
+	iter := feed
+
+	go func() {
+		feed.queue <- SummonerRecord{SummonerId: 1}
+		feed.errs <- errors.New("cursor lost")
+		feed.queue <- SummonerRecord{SummonerId: 0}
+	}()
+
+	count := 0
+	for iter.HasNext() {
+		if iter.Next().SummonerId != 0 {
+			count += 1
+		}
+	}
+	if count != 1 || iter.Err() == nil {
+		t.Error("Expected one summoner and an error, got", count, iter.Err())
+	}
+
+	failed := SummonerIter{}
+	failed.fail(errors.New("no database"))
+	if failed.HasNext() || failed.Err() == nil {
+		t.Error("Failed iterators should be empty and report their error")
+	}
+}
@@ -0,0 +1,47 @@
+package datamodel
+
+/**************************
+ ***** Job structures *****
+ **************************/
+
+const (
+	// Queued and waiting for a worker.
+	JOB_PENDING = "pending"
+	// Reserved by a worker, which touches the record as it goes.
+	JOB_RUNNING = "running"
+	// Buried; Reason says why.
+	JOB_FAILED = "failed"
+	JOB_DONE   = "done"
+)
+
+/**
+ * The progress record for a single join-summoners job. cac creates it
+ * when the job is queued and the worker that reserves it keeps it up to
+ * date, so the state of every job can be checked without talking to the
+ * queue.
+ */
+type JobRecord struct {
+	JobId string `json:"id" bson:"_id"`
+	// The queue's ID for the job, which changes if the job is re-queued.
+	QueueId uint64 `bson:"i"`
+
+	Label string `bson:"l"`
+	// The key of the snapshot the job builds (see snapshot/labels.go).
+	Date       string   `bson:"d"`
+	Quickdates []string `bson:"q"`
+	Summoners  []uint32 `bson:"s"`
+
+	State string `bson:"t"`
+	// Why the job failed.
+	Reason string `bson:"r,omitempty"`
+	// The summoners that have been stored so far. A job that's
+	// redelivered skips them.
+	Done []uint32 `bson:"o"`
+	// The number of times a worker has started the job.
+	Attempts uint32 `bson:"a"`
+
+	// Unix timestamps.
+	Created   uint64 `bson:"c"`
+	Updated   uint64 `bson:"u"`
+	Heartbeat uint64 `bson:"h,omitempty"`
+}
@@ -0,0 +1,259 @@
+package datamodel
+
+/**
+ * Snapshot metrics. Every metric is stored as the same structure, tagged
+ * with its kind, so that it comes back out of Mongo (or JSON) as the type
+ * it went in as. The kinds are:
+ *
+ *   scalar        a single number
+ *   ratio         a numerator and denominator, like wins / games played
+ *   distribution  a summary of a set of samples, like kills per game
+ *   champions     a metric per champion, keyed by champion ID
+ *
+ * Metrics that couldn't be computed (no games, nothing to divide by) are
+ * stored explicitly as "no data" rather than as zeroes or NaN's.
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+)
+
+const (
+	METRIC_SCALAR       = "scalar"
+	METRIC_RATIO        = "ratio"
+	METRIC_DISTRIBUTION = "distribution"
+	METRIC_CHAMPIONS    = "champions"
+)
+
+type Metric struct {
+	// One of the METRIC_* kinds. Metrics stored before kinds existed
+	// don't have one and are scalars.
+	Kind string `bson:"k,omitempty"`
+	// The version of the computation that produced this metric; zero for
+	// metrics stored before versions existed.
+	Version uint32 `bson:"r,omitempty"`
+	// Set when there wasn't anything to compute the metric from.
+	NoData bool `bson:"x,omitempty"`
+
+	// Scalars. This is the only field older metrics have.
+	Value float64 `bson:"value,omitempty"`
+	// Ratios.
+	Numerator   float64 `bson:"n,omitempty"`
+	Denominator float64 `bson:"d,omitempty"`
+	// Distributions.
+	Distribution *Distribution `bson:"s,omitempty"`
+	// Per-champion breakdowns, keyed by champion ID since bson keys have
+	// to be strings.
+	Champions map[string]Metric `bson:"c,omitempty"`
+}
+
+/**
+ * A summary of a set of samples.
+ */
+type Distribution struct {
+	Count  uint32  `json:"count" bson:"n"`
+	Mean   float64 `json:"mean" bson:"a"`
+	Min    float64 `json:"min" bson:"l"`
+	P25    float64 `json:"p25" bson:"q1"`
+	Median float64 `json:"median" bson:"q2"`
+	P75    float64 `json:"p75" bson:"q3"`
+	Max    float64 `json:"max" bson:"h"`
+}
+
+var ErrUnknownMetricKind = errors.New("unknown metric kind")
+
+func valid_number(value float64) bool {
+	return !math.IsNaN(value) && !math.IsInf(value, 0)
+}
+
+/**
+ * A metric of the given kind with no data.
+ */
+func NoDataMetric(kind string) Metric {
+	return Metric{Kind: kind, NoData: true}
+}
+
+func ScalarMetric(value float64) Metric {
+	if !valid_number(value) {
+		return NoDataMetric(METRIC_SCALAR)
+	}
+	return Metric{Kind: METRIC_SCALAR, Value: value}
+}
+
+/**
+ * A ratio keeps both of its parts, so a ratio with a zero denominator
+ * (a KDA with no deaths, say) still has data; it just doesn't have a
+ * value.
+ */
+func RatioMetric(numerator float64, denominator float64) Metric {
+	if !valid_number(numerator) || !valid_number(denominator) {
+		return NoDataMetric(METRIC_RATIO)
+	}
+	return Metric{Kind: METRIC_RATIO, Numerator: numerator, Denominator: denominator}
+}
+
+/**
+ * Summarizes SAMPLES, ignoring any that aren't numbers.
+ */
+func DistributionMetric(samples []float64) Metric {
+	sorted := make([]float64, 0, len(samples))
+	sum := 0.0
+	for _, sample := range samples {
+		if valid_number(sample) {
+			sorted = append(sorted, sample)
+			sum += sample
+		}
+	}
+	if len(sorted) == 0 {
+		return NoDataMetric(METRIC_DISTRIBUTION)
+	}
+	sort.Float64s(sorted)
+
+	return Metric{Kind: METRIC_DISTRIBUTION, Distribution: &Distribution{
+		Count:  uint32(len(sorted)),
+		Mean:   sum / float64(len(sorted)),
+		Min:    sorted[0],
+		P25:    percentile(sorted, 0.25),
+		Median: percentile(sorted, 0.5),
+		P75:    percentile(sorted, 0.75),
+		Max:    sorted[len(sorted)-1],
+	}}
+}
+
+// Percentile interpolates between the closest ranks of SORTED.
+func percentile(sorted []float64, p float64) float64 {
+	rank := p * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+/**
+ * Breaks a metric down by champion.
+ */
+func ChampionMetric(champions map[uint32]Metric) Metric {
+	if len(champions) == 0 {
+		return NoDataMetric(METRIC_CHAMPIONS)
+	}
+
+	metric := Metric{Kind: METRIC_CHAMPIONS, Champions: make(map[string]Metric)}
+	for champion, value := range champions {
+		metric.Champions[strconv.FormatUint(uint64(champion), 10)] = value
+	}
+	return metric
+}
+
+/**
+ * The metric's kind, including for metrics stored before kinds existed.
+ */
+func (m Metric) Type() string {
+	if len(m.Kind) == 0 {
+		return METRIC_SCALAR
+	}
+	return m.Kind
+}
+
+/**
+ * The single number that best describes the metric: a scalar's value, a
+ * ratio's quotient or a distribution's mean. Per-champion breakdowns and
+ * metrics without data don't have one.
+ */
+func (m Metric) Float() (float64, bool) {
+	if m.NoData {
+		return 0, false
+	}
+
+	switch m.Type() {
+	case METRIC_SCALAR:
+		return m.Value, true
+	case METRIC_RATIO:
+		if m.Denominator == 0 {
+			return 0, false
+		}
+		return m.Numerator / m.Denominator, true
+	case METRIC_DISTRIBUTION:
+		if m.Distribution == nil {
+			return 0, false
+		}
+		return m.Distribution.Mean, true
+	}
+	return 0, false
+}
+
+/**
+ * The breakdown for a single champion, if there is one.
+ */
+func (m Metric) Champion(champion uint32) (Metric, bool) {
+	value, exists := m.Champions[strconv.FormatUint(uint64(champion), 10)]
+	return value, exists
+}
+
+// The JSON form of a metric. Only the fields that make sense for the
+// metric's kind are included, and value is filled in wherever Float()
+// has an answer so that clients can graph any metric the same way.
+type metricJSON struct {
+	Type         string            `json:"type"`
+	Version      uint32            `json:"version"`
+	NoData       bool              `json:"no_data,omitempty"`
+	Value        *float64          `json:"value,omitempty"`
+	Numerator    *float64          `json:"numerator,omitempty"`
+	Denominator  *float64          `json:"denominator,omitempty"`
+	Distribution *Distribution     `json:"distribution,omitempty"`
+	Champions    map[string]Metric `json:"champions,omitempty"`
+}
+
+func (m Metric) MarshalJSON() ([]byte, error) {
+	out := metricJSON{Type: m.Type(), Version: m.Version, NoData: m.NoData}
+
+	if !m.NoData {
+		if value, ok := m.Float(); ok {
+			out.Value = &value
+		}
+
+		switch out.Type {
+		case METRIC_RATIO:
+			numerator, denominator := m.Numerator, m.Denominator
+			out.Numerator = &numerator
+			out.Denominator = &denominator
+		case METRIC_DISTRIBUTION:
+			out.Distribution = m.Distribution
+		case METRIC_CHAMPIONS:
+			out.Champions = m.Champions
+		}
+	}
+
+	return json.Marshal(out)
+}
+
+func (m *Metric) UnmarshalJSON(raw []byte) error {
+	in := metricJSON{}
+	if err := json.Unmarshal(raw, &in); err != nil {
+		return err
+	}
+
+	*m = Metric{Kind: in.Type, Version: in.Version, NoData: in.NoData}
+	switch in.Type {
+	case METRIC_SCALAR:
+		if in.Value != nil {
+			m.Value = *in.Value
+		}
+	case METRIC_RATIO:
+		if in.Numerator != nil {
+			m.Numerator = *in.Numerator
+		}
+		if in.Denominator != nil {
+			m.Denominator = *in.Denominator
+		}
+	case METRIC_DISTRIBUTION:
+		m.Distribution = in.Distribution
+	case METRIC_CHAMPIONS:
+		m.Champions = in.Champions
+	default:
+		return ErrUnknownMetricKind
+	}
+	return nil
+}
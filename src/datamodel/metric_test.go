@@ -0,0 +1,115 @@
+package datamodel
+
+import (
+	"encoding/json"
+	"labix.org/v2/mgo/bson"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func test_metrics() map[string]Metric {
+	return map[string]Metric{
+		"scalar":       ScalarMetric(2.5),
+		"zero":         ScalarMetric(0),
+		"ratio":        RatioMetric(3, 4),
+		"perfect":      RatioMetric(7, 0),
+		"distribution": DistributionMetric([]float64{4, 1, 3, 2, 5}),
+		"champions": ChampionMetric(map[uint32]Metric{
+			1:  RatioMetric(1, 2),
+			22: NoDataMetric(METRIC_RATIO),
+		}),
+		"nothing": NoDataMetric(METRIC_DISTRIBUTION),
+	}
+}
+
+func TestMetricBSON(t *testing.T) {
+	for name, metric := range test_metrics() {
+		metric.Version = 3
+		raw, err := bson.Marshal(map[string]Metric{"m": metric})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out := map[string]Metric{}
+		if err := bson.Unmarshal(raw, &out); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(out["m"], metric) {
+			t.Errorf("%s came back as %#v instead of %#v", name, out["m"], metric)
+		}
+	}
+}
+
+func TestMetricJSON(t *testing.T) {
+	for name, metric := range test_metrics() {
+		raw, err := json.Marshal(metric)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out := Metric{}
+		if err := json.Unmarshal(raw, &out); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(out, metric) {
+			t.Errorf("%s came back as %#v from %s", name, out, raw)
+		}
+	}
+
+	// Clients can graph anything with a value.
+	raw, _ := json.Marshal(RatioMetric(3, 4))
+	if string(raw) != `{"type":"ratio","version":0,"value":0.75,"numerator":3,"denominator":4}` {
+		t.Error("Unexpected JSON for a ratio:", string(raw))
+	}
+	raw, _ = json.Marshal(NoDataMetric(METRIC_SCALAR))
+	if string(raw) != `{"type":"scalar","version":0,"no_data":true}` {
+		t.Error("Unexpected JSON for a missing scalar:", string(raw))
+	}
+
+	if err := json.Unmarshal([]byte(`{"type":"histogram"}`), &Metric{}); err != ErrUnknownMetricKind {
+		t.Error("Expected an error for an unknown kind, got", err)
+	}
+}
+
+func TestLegacyMetric(t *testing.T) {
+	// Metrics used to be stored as {value: x}.
+	raw, _ := bson.Marshal(bson.M{"value": 13.0})
+	metric := Metric{}
+	bson.Unmarshal(raw, &metric)
+
+	if value, ok := metric.Float(); metric.Type() != METRIC_SCALAR || metric.Version != 0 || !ok || value != 13 {
+		t.Error("Unexpected legacy metric:", metric)
+	}
+}
+
+func TestMetricValues(t *testing.T) {
+	if metric := ScalarMetric(math.NaN()); !metric.NoData {
+		t.Error("NaN should be stored as no data")
+	}
+	if metric := RatioMetric(1, math.Inf(1)); !metric.NoData {
+		t.Error("Infinity should be stored as no data")
+	}
+	if _, ok := RatioMetric(7, 0).Float(); ok {
+		t.Error("Ratios over zero don't have a value")
+	}
+
+	distribution := DistributionMetric([]float64{4, 1, math.NaN(), 3, 2, 5}).Distribution
+	if *distribution != (Distribution{Count: 5, Mean: 3, Min: 1, P25: 2, Median: 3, P75: 4, Max: 5}) {
+		t.Error("Unexpected distribution:", distribution)
+	}
+	if metric := DistributionMetric(nil); !metric.NoData {
+		t.Error("Empty distributions should be stored as no data")
+	}
+
+	champions := test_metrics()["champions"]
+	if value, ok := champions.Champion(1); !ok || value.Numerator != 1 {
+		t.Error("Couldn't find champion 1:", champions)
+	}
+	if _, ok := champions.Champion(2); ok {
+		t.Error("Found a champion that wasn't there")
+	}
+	if _, ok := champions.Float(); ok {
+		t.Error("Per-champion metrics don't have a single value")
+	}
+}
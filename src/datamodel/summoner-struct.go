@@ -14,14 +14,10 @@ type SummonerRecord struct {
 	Daily        map[string]*PlayerSnapshot `bson:"d"`
 	Weekly       map[string]*PlayerSnapshot `bson:"w"`
 	Monthly      map[string]*PlayerSnapshot `bson:"m"`
-	Metadata     SummonerMetadata           `bson:"e"`
-}
-
-type Metric interface {
-}
-
-type SimpleNumberMetric struct {
-	Value float64
+	// Rolling-window snapshots (last7days, last20games, ...), by label and
+	// then by the last day they cover.
+	Windows  map[string]map[string]*PlayerSnapshot `bson:"r,omitempty"`
+	Metadata SummonerMetadata                      `bson:"e"`
 }
 
 /**
@@ -32,11 +28,15 @@ type PlayerSnapshot struct {
 	GamesList  []uint64 `bson:"g"`
 	// TODO: add rank to this snapshot
 
-	// The relevant gameplay statistics for the period covered by this snapshot
+	// The relevant gameplay statistics for the period covered by this snapshot,
+	// by name (see metric.go).
 	Stats map[string]Metric `bson:"t"`
 
 	// When this record was generated.
 	CreationTimestamp uint64 `bson:"c"`
+	// When join-summoners last found the record matched the summoner's
+	// games without having to rebuild it.
+	VerifiedTimestamp uint64 `bson:"v,omitempty"`
 }
 
 /**
@@ -35,6 +35,9 @@ func main() {
 
 	fmt.Println("Initializing...")
 	retriever := data.LoLRetriever{}
+	if err := retriever.Init(); err != nil {
+		log.Fatal("Couldn't open the game store:", err)
+	}
 
 	cm := lolutil.LoadCandidates(retriever, *CHAMPION_LIST)
 
@@ -194,6 +197,7 @@ func convert(response *JSONResponse) []data.GameRecord {
 		record := data.GameRecord{}
 
 		record.Timestamp = game.CreateDate
+		record.Duration = game.Stats.TimePlayed
 		record.QuickDate = timestampToQuickdate(record.Timestamp)
 		record.GameId = game.GameId
 
@@ -0,0 +1,585 @@
+package main
+
+// Version 1 of the public JSON API, served under /api/v1/. Unlike the
+// /team/ and /draft/ endpoints used by the web app, which marshal the
+// backend's protobufs directly, the API has its own response types so
+// that the backend can change without breaking external tools. Every error
+// is a JSON body of the form {"error": {"code": ..., "message": ...}} with a
+// matching HTTP status. The API is described in html/openapi.json.
+
+import (
+	gproto "code.google.com/p/goprotobuf/proto"
+	data "datamodel"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"libcleo"
+	"log"
+	"net/http"
+	"proto"
+	"query"
+	"strconv"
+	"strings"
+	"switchboard"
+)
+
+const API_PREFIX = "/api/v1/"
+
+const MAX_TEAM_SIZE = 5
+const DEFAULT_PER_PAGE = 20
+const MAX_PER_PAGE = 100
+
+// Backends are asked for every candidate up to the end of the requested
+// page, but never for more than this (there are far fewer champions).
+const MAX_CANDIDATES = 1000
+
+// Draft suggests this many bans whatever page of picks is asked for.
+const SUGGESTED_BANS = 10
+
+// Error codes, in addition to the HTTP status.
+const (
+	ERR_INVALID_PARAMETER  = "invalid_parameter"
+	ERR_UNKNOWN_CHAMPION   = "unknown_champion"
+	ERR_DUPLICATE_CHAMPION = "duplicate_champion"
+	ERR_TEAM_TOO_LARGE     = "team_too_large"
+	ERR_METHOD_NOT_ALLOWED = "method_not_allowed"
+	ERR_NOT_FOUND          = "not_found"
+	ERR_BACKEND            = "backend_error"
+	ERR_UNAVAILABLE        = "backend_unavailable"
+	ERR_INTERNAL           = "internal_error"
+)
+
+type apiError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// The request parameter at fault, if any.
+	Parameter string `json:"parameter,omitempty"`
+}
+
+type apiErrorBody struct {
+	Error *apiError `json:"error"`
+}
+
+type apiStats struct {
+	WinRate            float64 `json:"win_rate"`
+	LowerBound         float64 `json:"lower_bound"`
+	UpperBound         float64 `json:"upper_bound"`
+	SampleSize         uint32  `json:"sample_size"`
+	BaselineWinRate    float64 `json:"baseline_win_rate"`
+	BaselineSampleSize uint32  `json:"baseline_sample_size"`
+	Lift               float64 `json:"lift"`
+	ZScore             float64 `json:"z_score"`
+	Significant        bool    `json:"significant"`
+}
+
+type apiCounts struct {
+	Matching  uint32 `json:"matching"`
+	Available uint32 `json:"available"`
+	Total     uint32 `json:"total"`
+}
+
+type apiChampion struct {
+	Champion string    `json:"champion"`
+	Counts   apiCounts `json:"counts"`
+	Stats    *apiStats `json:"stats,omitempty"`
+	// Draft picks and bans only.
+	Score *float64 `json:"score,omitempty"`
+}
+
+type apiPage struct {
+	Items      []apiChampion `json:"items"`
+	Page       int           `json:"page"`
+	PerPage    int           `json:"per_page"`
+	TotalItems int           `json:"total_items"`
+	TotalPages int           `json:"total_pages"`
+}
+
+// How the backend evaluated a query; see debug traces in lolstat.
+type apiTrace struct {
+	Steps      []apiTraceStep `json:"steps"`
+	DurationUs uint64         `json:"duration_us"`
+	// Riot game ID's of some of the matching games, for /games/.
+	SampleGames []uint64 `json:"sample_games"`
+}
+
+type apiTraceStep struct {
+	Operation string `json:"operation"`
+	Phase     string `json:"phase"`
+	Target    string `json:"target"`
+	Champion  string `json:"champion,omitempty"`
+	Source    string `json:"source,omitempty"`
+
+	InputSize  uint32 `json:"input_size"`
+	OtherSize  uint32 `json:"other_size"`
+	OutputSize uint32 `json:"output_size"`
+	DurationUs uint64 `json:"duration_us"`
+}
+
+type apiTeamResponse struct {
+	Allies          []string  `json:"allies"`
+	Enemies         []string  `json:"enemies"`
+	Counts          apiCounts `json:"counts"`
+	Stats           *apiStats `json:"stats,omitempty"`
+	Recommendations apiPage   `json:"recommendations"`
+	Trace           *apiTrace `json:"trace,omitempty"`
+}
+
+type apiDraftResponse struct {
+	Allies  []string `json:"allies"`
+	Enemies []string `json:"enemies"`
+	Bans    []string `json:"bans"`
+	// Suggested picks for the allied team, best first.
+	Picks apiPage `json:"picks"`
+	// The top SUGGESTED_BANS bans, best first. Not paginated.
+	SuggestedBans []apiChampion `json:"suggested_bans"`
+}
+
+// GameStore is the part of data.LoLRetriever that the games endpoint needs.
+type gameStore interface {
+	FindGame(game_id uint64) (data.GameRecord, bool, error)
+}
+
+// Opens the game store for a single request.
+var open_games = func() gameStore { return &data.LoLRetriever{} }
+
+type apiGame struct {
+	GameId    uint64    `json:"game_id"`
+	Timestamp uint64    `json:"timestamp"`
+	Duration  uint32    `json:"duration"`
+	Teams     []apiTeam `json:"teams"`
+}
+
+type apiTeam struct {
+	Victory bool        `json:"victory"`
+	Players []apiPlayer `json:"players"`
+}
+
+type apiPlayer struct {
+	SummonerId uint32 `json:"summoner_id,omitempty"`
+	Name       string `json:"name,omitempty"`
+	Champion   string `json:"champion"`
+	// Only set if the player's stats were recorded.
+	Kills   *uint32 `json:"kills,omitempty"`
+	Deaths  *uint32 `json:"deaths,omitempty"`
+	Assists *uint32 `json:"assists,omitempty"`
+	Gold    *uint32 `json:"gold,omitempty"`
+	Minions *uint32 `json:"minions,omitempty"`
+}
+
+// Parameters shared by the team and draft endpoints, after validation.
+type teamParams struct {
+	Allies  []proto.ChampionType
+	Enemies []proto.ChampionType
+	Bans    []proto.ChampionType
+	Page    int
+	PerPage int
+	Debug   bool
+}
+
+func register_api(mux *http.ServeMux) {
+	mux.HandleFunc(API_PREFIX+"team", api_get(api_team))
+	mux.HandleFunc(API_PREFIX+"draft", api_get(api_draft))
+	mux.HandleFunc(API_PREFIX+"games/", api_get(api_game))
+	mux.HandleFunc(API_PREFIX+"openapi.json", api_get(api_spec))
+	mux.HandleFunc(API_PREFIX, api_get(func(r *http.Request) (interface{}, *apiError) {
+		return nil, &apiError{Status: http.StatusNotFound, Code: ERR_NOT_FOUND, Message: "No such endpoint: " + r.URL.Path}
+	}))
+}
+
+// Api_get wraps an API handler, which returns either a value to serialize
+// or an error, into an http.HandlerFunc that only accepts GET.
+func api_get(handler func(r *http.Request) (interface{}, *apiError)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.Header().Set("Allow", "GET, HEAD")
+			write_api_error(w, &apiError{Status: http.StatusMethodNotAllowed, Code: ERR_METHOD_NOT_ALLOWED, Message: "Only GET is supported."})
+			return
+		}
+
+		value, aerr := handler(r)
+		if aerr != nil {
+			write_api_error(w, aerr)
+			return
+		}
+
+		// The OpenAPI document is served as-is.
+		if raw, ok := value.([]byte); ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(raw)
+			return
+		}
+
+		out, err := json.Marshal(value)
+		if err != nil {
+			log.Println("API: couldn't serialize response:", err)
+			write_api_error(w, &apiError{Status: http.StatusInternalServerError, Code: ERR_INTERNAL, Message: "Couldn't serialize the response."})
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+	}
+}
+
+func write_api_error(w http.ResponseWriter, aerr *apiError) {
+	out, _ := json.Marshal(apiErrorBody{Error: aerr})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(aerr.Status)
+	w.Write(out)
+}
+
+func bad_parameter(code string, parameter string, message string) *apiError {
+	return &apiError{Status: http.StatusBadRequest, Code: code, Message: message, Parameter: parameter}
+}
+
+// Parse_team_params reads and validates the allies, enemies, bans, page,
+// per_page and debug parameters.
+func parse_team_params(r *http.Request) (teamParams, *apiError) {
+	params := teamParams{Page: 1, PerPage: DEFAULT_PER_PAGE, Debug: len(r.FormValue("debug")) > 0}
+	seen := make(map[proto.ChampionType]string)
+
+	lists := []struct {
+		name string
+		dest *[]proto.ChampionType
+	}{
+		{"allies", &params.Allies},
+		{"enemies", &params.Enemies},
+		{"bans", &params.Bans},
+	}
+
+	for _, list := range lists {
+		for _, name := range strings.Split(r.FormValue(list.name), ",") {
+			name = strings.TrimSpace(name)
+			if len(name) == 0 {
+				continue
+			}
+
+			champion := libcleo.String2ChampionType(name)
+			if champion == proto.ChampionType_UNKNOWN {
+				return params, bad_parameter(ERR_UNKNOWN_CHAMPION, list.name, fmt.Sprintf("Unknown champion '%s'.", name))
+			}
+			if previous, exists := seen[champion]; exists {
+				return params, bad_parameter(ERR_DUPLICATE_CHAMPION, list.name,
+					fmt.Sprintf("%s appears more than once (already in %s).", champion, previous))
+			}
+
+			seen[champion] = list.name
+			*list.dest = append(*list.dest, champion)
+		}
+	}
+
+	if len(params.Allies) > MAX_TEAM_SIZE {
+		return params, bad_parameter(ERR_TEAM_TOO_LARGE, "allies", fmt.Sprintf("Teams have at most %d champions.", MAX_TEAM_SIZE))
+	}
+	if len(params.Enemies) > MAX_TEAM_SIZE {
+		return params, bad_parameter(ERR_TEAM_TOO_LARGE, "enemies", fmt.Sprintf("Teams have at most %d champions.", MAX_TEAM_SIZE))
+	}
+
+	var aerr *apiError
+	if params.Page, aerr = int_param(r, "page", 1, 1, 0); aerr != nil {
+		return params, aerr
+	}
+	if params.PerPage, aerr = int_param(r, "per_page", DEFAULT_PER_PAGE, 1, MAX_PER_PAGE); aerr != nil {
+		return params, aerr
+	}
+
+	return params, nil
+}
+
+// Int_param parses an optional integer parameter within [min, max]. A max
+// of zero means there's no upper limit.
+func int_param(r *http.Request, name string, fallback int, min int, max int) (int, *apiError) {
+	raw := r.FormValue(name)
+	if len(raw) == 0 {
+		return fallback, nil
+	}
+
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < min || (max > 0 && value > max) {
+		message := fmt.Sprintf("%s must be an integer no less than %d.", name, min)
+		if max > 0 {
+			message = fmt.Sprintf("%s must be an integer between %d and %d.", name, min, max)
+		}
+		return fallback, bad_parameter(ERR_INVALID_PARAMETER, name, message)
+	}
+	return value, nil
+}
+
+func (p teamParams) query(kind proto.GameQuery_QueryType) proto.GameQuery {
+	qry := form_request(nil, nil)
+	qry.Type = kind.Enum()
+	qry.Winners = p.Allies
+	qry.Losers = p.Enemies
+	qry.Bans = p.Bans
+	return qry
+}
+
+// Limit is the number of ranked candidates needed to fill every page up to
+// and including the requested one.
+func (p teamParams) limit() uint32 {
+	if p.Page > MAX_CANDIDATES/p.PerPage {
+		return MAX_CANDIDATES
+	}
+	return uint32(p.Page * p.PerPage)
+}
+
+// Ask sends QRY to a backend and turns failures into API errors.
+func ask(qry proto.GameQuery) (proto.QueryResponse, *apiError) {
+	response, err := call_backend(qry)
+
+	if err == switchboard.ErrNoBackends {
+		return response, &apiError{Status: http.StatusServiceUnavailable, Code: ERR_UNAVAILABLE, Message: "No Cleo backend is available."}
+	} else if err != nil {
+		return response, &apiError{Status: http.StatusBadGateway, Code: ERR_BACKEND, Message: err.Error()}
+	} else if !response.GetSuccessful() {
+		return response, &apiError{Status: http.StatusBadGateway, Code: ERR_BACKEND, Message: response.GetError()}
+	}
+	return response, nil
+}
+
+func api_team(r *http.Request) (interface{}, *apiError) {
+	params, aerr := parse_team_params(r)
+	if aerr != nil {
+		return nil, aerr
+	}
+	if len(params.Bans) > 0 {
+		return nil, bad_parameter(ERR_INVALID_PARAMETER, "bans", "Bans are only supported by the draft endpoint.")
+	}
+
+	qry := params.query(proto.GameQuery_TEAM)
+	qry.Debug = gproto.Bool(params.Debug)
+	response, aerr := ask(qry)
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	explore := params.query(proto.GameQuery_RECOMMEND_ALLY)
+	explore.MinAvailable = gproto.Uint32(MIN_EXPLORER_AVAILABLE)
+	explore.Limit = gproto.Uint32(params.limit())
+	log.Println(fmt.Sprintf("%s: submitting recommendation query %s", query.GetQueryId(qry), query.GetQueryId(explore)))
+	recommendations, aerr := ask(explore)
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	return apiTeamResponse{
+		Allies:          champion_names(params.Allies),
+		Enemies:         champion_names(params.Enemies),
+		Counts:          to_api_counts(response.Results),
+		Stats:           to_api_stats(response.Stats),
+		Recommendations: paginate(to_api_champions(recommendations.NextChamp), int(recommendations.GetCandidates()), params.Page, params.PerPage),
+		Trace:           to_api_trace(response.Trace),
+	}, nil
+}
+
+func api_draft(r *http.Request) (interface{}, *apiError) {
+	params, aerr := parse_team_params(r)
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	// Picks and bans share the limit, so ask for enough of both.
+	qry := params.query(proto.GameQuery_DRAFT)
+	qry.Limit = gproto.Uint32(params.limit())
+	if qry.GetLimit() < SUGGESTED_BANS {
+		qry.Limit = gproto.Uint32(SUGGESTED_BANS)
+	}
+
+	response, aerr := ask(qry)
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	bans := response.SuggestedBans
+	if len(bans) > SUGGESTED_BANS {
+		bans = bans[:SUGGESTED_BANS]
+	}
+
+	return apiDraftResponse{
+		Allies:        champion_names(params.Allies),
+		Enemies:       champion_names(params.Enemies),
+		Bans:          champion_names(params.Bans),
+		Picks:         paginate(to_api_champions(response.NextChamp), int(response.GetCandidates()), params.Page, params.PerPage),
+		SuggestedBans: to_api_champions(bans),
+	}, nil
+}
+
+func api_game(r *http.Request) (interface{}, *apiError) {
+	raw := strings.TrimPrefix(r.URL.Path, API_PREFIX+"games/")
+	game_id, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return nil, bad_parameter(ERR_INVALID_PARAMETER, "game_id", "Game ID's must be numbers.")
+	}
+
+	game, exists, err := open_games().FindGame(game_id)
+	if err != nil {
+		log.Println(fmt.Sprintf("Couldn't look up game %d: %v", game_id, err))
+		return nil, &apiError{Status: http.StatusServiceUnavailable, Code: ERR_UNAVAILABLE, Message: "The game store isn't available."}
+	}
+	if !exists {
+		return nil, &apiError{Status: http.StatusNotFound, Code: ERR_NOT_FOUND, Message: fmt.Sprintf("Game %d doesn't exist.", game_id)}
+	}
+	return to_api_game(game), nil
+}
+
+func api_spec(r *http.Request) (interface{}, *apiError) {
+	spec, err := ioutil.ReadFile("html/openapi.json")
+	if err != nil {
+		log.Println("openapi.json not present!")
+		return nil, &apiError{Status: http.StatusInternalServerError, Code: ERR_INTERNAL, Message: "The API description isn't available."}
+	}
+	return spec, nil
+}
+
+// Paginate returns the PAGE'th page (counting from one) of a ranked list of
+// TOTAL items, of which ITEMS are the first ones. Backends only return as
+// many items as the requested page needs. Pages past the end are empty
+// rather than errors.
+func paginate(items []apiChampion, total int, page int, per_page int) apiPage {
+	if total < len(items) {
+		total = len(items)
+	}
+
+	result := apiPage{
+		Items:      make([]apiChampion, 0),
+		Page:       page,
+		PerPage:    per_page,
+		TotalItems: total,
+		TotalPages: (total + per_page - 1) / per_page,
+	}
+
+	start := (page - 1) * per_page
+	if start < len(items) {
+		end := start + per_page
+		if end > len(items) {
+			end = len(items)
+		}
+		result.Items = items[start:end]
+	}
+	return result
+}
+
+func champion_names(champions []proto.ChampionType) []string {
+	names := make([]string, 0, len(champions))
+	for _, champion := range champions {
+		names = append(names, champion.String())
+	}
+	return names
+}
+
+func to_api_counts(results *proto.QueryResponse_Results) apiCounts {
+	return apiCounts{
+		Matching:  results.GetMatching(),
+		Available: results.GetAvailable(),
+		Total:     results.GetTotal(),
+	}
+}
+
+func to_api_stats(stats *proto.QueryResponse_Statistics) *apiStats {
+	if stats == nil {
+		return nil
+	}
+
+	return &apiStats{
+		WinRate:            stats.GetWinRate(),
+		LowerBound:         stats.GetLowerBound(),
+		UpperBound:         stats.GetUpperBound(),
+		SampleSize:         stats.GetSampleSize(),
+		BaselineWinRate:    stats.GetBaselineWinRate(),
+		BaselineSampleSize: stats.GetBaselineSampleSize(),
+		Lift:               stats.GetLift(),
+		ZScore:             stats.GetZScore(),
+		Significant:        stats.GetSignificant(),
+	}
+}
+
+func to_api_trace(trace *proto.QueryResponse_Trace) *apiTrace {
+	if trace == nil {
+		return nil
+	}
+
+	result := apiTrace{
+		Steps:       make([]apiTraceStep, 0, len(trace.Steps)),
+		DurationUs:  trace.GetDurationUs(),
+		SampleGames: trace.SampleRiotIds,
+	}
+	if result.SampleGames == nil {
+		result.SampleGames = make([]uint64, 0)
+	}
+	for _, step := range trace.Steps {
+		api_step := apiTraceStep{
+			Operation:  step.GetOperation(),
+			Phase:      step.GetPhase(),
+			Target:     step.GetTarget(),
+			Source:     step.GetSource(),
+			InputSize:  step.GetInputSize(),
+			OtherSize:  step.GetOtherSize(),
+			OutputSize: step.GetOutputSize(),
+			DurationUs: step.GetDurationUs(),
+		}
+		if step.Champion != nil {
+			api_step.Champion = step.GetChampion().String()
+		}
+		result.Steps = append(result.Steps, api_step)
+	}
+	return &result
+}
+
+func to_api_game(game data.GameRecord) apiGame {
+	result := apiGame{
+		GameId:    game.GameId,
+		Timestamp: game.Timestamp,
+		Duration:  game.Duration,
+		Teams:     make([]apiTeam, 0, len(game.Teams)),
+	}
+
+	for _, team := range game.Teams {
+		if team == nil {
+			continue
+		}
+
+		api_team := apiTeam{Victory: team.Victory, Players: make([]apiPlayer, 0, len(team.Players))}
+		for _, player := range team.Players {
+			if player == nil {
+				continue
+			}
+
+			api_player := apiPlayer{Champion: libcleo.Rid2Cleo(player.Champion).String()}
+			if player.Player != nil {
+				api_player.SummonerId = player.Player.SummonerId
+				api_player.Name = player.Player.Name
+			}
+			if player.IsSet {
+				kills, deaths, assists := player.Kills, player.Deaths, player.Assists
+				gold, minions := player.GoldEarned, player.Minions
+				api_player.Kills, api_player.Deaths, api_player.Assists = &kills, &deaths, &assists
+				api_player.Gold, api_player.Minions = &gold, &minions
+			}
+			api_team.Players = append(api_team.Players, api_player)
+		}
+		result.Teams = append(result.Teams, api_team)
+	}
+	return result
+}
+
+func to_api_champions(subqueries []*proto.QueryResponse_ExploratoryChampionSubquery) []apiChampion {
+	champions := make([]apiChampion, 0, len(subqueries))
+	for _, sq := range subqueries {
+		if !sq.GetValid() {
+			continue
+		}
+
+		champion := apiChampion{
+			Champion: sq.GetExplorer().String(),
+			Counts:   to_api_counts(sq.Results),
+			Stats:    to_api_stats(sq.Stats),
+		}
+		if sq.Score != nil {
+			champion.Score = gproto.Float64(sq.GetScore())
+		}
+		champions = append(champions, champion)
+	}
+	return champions
+}
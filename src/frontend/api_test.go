@@ -0,0 +1,214 @@
+package main
+
+import (
+	gproto "code.google.com/p/goprotobuf/proto"
+	data "datamodel"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"proto"
+	"switchboard"
+	"testing"
+)
+
+func get(t *testing.T, mux http.Handler, method string, url string) (*httptest.ResponseRecorder, apiErrorBody) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	body := apiErrorBody{}
+	if w.Code != http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error == nil {
+			t.Error(url, "didn't return a JSON error body:", w.Body.String())
+		}
+	}
+	return w, body
+}
+
+func TestFormRequest(t *testing.T) {
+	qry := form_request([]string{"annie", "ashe"}, []string{"garen"})
+
+	if len(qry.Winners) != 2 || len(qry.Losers) != 1 || qry.Losers[0] != proto.ChampionType_GAREN {
+		t.Error("Enemies weren't added to Losers:", qry.Winners, qry.Losers)
+	}
+}
+
+func TestTeamValidation(t *testing.T) {
+	mux := http.NewServeMux()
+	register_api(mux)
+
+	cases := []struct {
+		url       string
+		status    int
+		code      string
+		parameter string
+	}{
+		{"/api/v1/team?allies=annie,notachampion", 400, ERR_UNKNOWN_CHAMPION, "allies"},
+		{"/api/v1/team?allies=annie&enemies=ANNIE", 400, ERR_DUPLICATE_CHAMPION, "enemies"},
+		{"/api/v1/team?allies=annie,ashe,garen,zed,yasuo,ahri", 400, ERR_TEAM_TOO_LARGE, "allies"},
+		{"/api/v1/team?allies=annie&page=0", 400, ERR_INVALID_PARAMETER, "page"},
+		{"/api/v1/team?allies=annie&per_page=1000", 400, ERR_INVALID_PARAMETER, "per_page"},
+		{"/api/v1/team?allies=annie&per_page=ten", 400, ERR_INVALID_PARAMETER, "per_page"},
+		{"/api/v1/team?allies=annie&bans=zed", 400, ERR_INVALID_PARAMETER, "bans"},
+		{"/api/v1/draft?allies=annie&bans=annie", 400, ERR_DUPLICATE_CHAMPION, "bans"},
+		{"/api/v1/games/abc", 400, ERR_INVALID_PARAMETER, "game_id"},
+		{"/api/v1/teams", 404, ERR_NOT_FOUND, ""},
+	}
+
+	for _, c := range cases {
+		w, body := get(t, mux, "GET", c.url)
+		if w.Code != c.status || body.Error == nil || body.Error.Code != c.code || body.Error.Parameter != c.parameter {
+			t.Error(c.url, "returned", w.Code, w.Body.String())
+		}
+	}
+
+	w, body := get(t, mux, "POST", "/api/v1/team?allies=annie")
+	if w.Code != http.StatusMethodNotAllowed || body.Error.Code != ERR_METHOD_NOT_ALLOWED || w.Header().Get("Allow") == "" {
+		t.Error("POST returned", w.Code, w.Body.String())
+	}
+}
+
+func TestBackendUnavailable(t *testing.T) {
+	// Find a port that nothing is listening on.
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	switchb, err = switchboard.NewClient("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer switchb.Close()
+
+	mux := http.NewServeMux()
+	register_api(mux)
+
+	w, body := get(t, mux, "GET", "/api/v1/team?allies=annie&enemies=garen")
+	if w.Code != http.StatusServiceUnavailable || body.Error.Code != ERR_UNAVAILABLE {
+		t.Error("Expected 503, got", w.Code, w.Body.String())
+	}
+}
+
+func TestLegacyInvalidTeam(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/team/?allies=notachampion", nil)
+	w := httptest.NewRecorder()
+	simple_team(w, req)
+
+	if w.Code != http.StatusBadRequest || w.Body.Len() == 0 {
+		t.Error("Invalid team query returned", w.Code, w.Body.String())
+	}
+}
+
+func TestTeamParamsLimit(t *testing.T) {
+	if limit := (teamParams{Page: 3, PerPage: 20}).limit(); limit != 60 {
+		t.Error("Expected a limit of 60, got", limit)
+	}
+	if limit := (teamParams{Page: 1 << 40, PerPage: 100}).limit(); limit != MAX_CANDIDATES {
+		t.Error("Expected the limit to be capped, got", limit)
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	items := make([]apiChampion, 45)
+	for i := range items {
+		items[i].Counts.Matching = uint32(i)
+	}
+
+	page := paginate(items, 45, 3, 20)
+	if len(page.Items) != 5 || page.Items[0].Counts.Matching != 40 || page.TotalItems != 45 || page.TotalPages != 3 {
+		t.Error("Unexpected last page:", page.Page, len(page.Items), page.TotalItems, page.TotalPages)
+	}
+
+	page = paginate(items, 45, 4, 20)
+	if page.Items == nil || len(page.Items) != 0 {
+		t.Error("Pages past the end should be empty, got", page.Items)
+	}
+
+	// Backends only send the items up to the requested page, but the
+	// totals still cover the whole list.
+	page = paginate(items[:40], 45, 2, 20)
+	if len(page.Items) != 20 || page.Items[0].Counts.Matching != 20 || page.TotalItems != 45 || page.TotalPages != 3 {
+		t.Error("Unexpected middle page:", page.Page, len(page.Items), page.TotalItems, page.TotalPages)
+	}
+
+	page = paginate(nil, 0, 1, 20)
+	if page.TotalPages != 0 || len(page.Items) != 0 {
+		t.Error("Unexpected empty page:", page)
+	}
+}
+
+type fakeGames struct {
+	games map[uint64]data.GameRecord
+	err   error
+}
+
+func (f *fakeGames) FindGame(game_id uint64) (data.GameRecord, bool, error) {
+	game, exists := f.games[game_id]
+	return game, exists && f.err == nil, f.err
+}
+
+func TestGame(t *testing.T) {
+	store := &fakeGames{games: map[uint64]data.GameRecord{1544951968: {
+		GameId:   1544951968,
+		Duration: 1800,
+		Teams: []*data.Team{
+			{Victory: true, Players: []*data.PlayerStats{{IsSet: true, Player: &data.PlayerType{SummonerId: 7, Name: "Brigado"}, Champion: 1, Kills: 4}}},
+			{Players: []*data.PlayerStats{{Champion: 2}}},
+		},
+	}}}
+	open_games = func() gameStore { return store }
+	defer func() { open_games = func() gameStore { return &data.LoLRetriever{} } }()
+
+	mux := http.NewServeMux()
+	register_api(mux)
+
+	w, _ := get(t, mux, "GET", "/api/v1/games/1544951968")
+	game := apiGame{}
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &game) != nil {
+		t.Fatal("Game returned", w.Code, w.Body.String())
+	}
+	if len(game.Teams) != 2 || !game.Teams[0].Victory || game.Teams[0].Players[0].Champion != "ANNIE" || *game.Teams[0].Players[0].Kills != 4 {
+		t.Error("Unexpected game:", w.Body.String())
+	}
+	if loser := game.Teams[1].Players[0]; loser.Kills != nil || loser.SummonerId != 0 {
+		t.Error("Players without stats shouldn't have any:", w.Body.String())
+	}
+	if w, body := get(t, mux, "GET", "/api/v1/games/1"); w.Code != http.StatusNotFound || body.Error.Code != ERR_NOT_FOUND {
+		t.Error("Missing game returned", w.Code, w.Body.String())
+	}
+
+	// An outage isn't a missing game.
+	store.err = errors.New("no reachable servers")
+	if w, body := get(t, mux, "GET", "/api/v1/games/1544951968"); w.Code != http.StatusServiceUnavailable || body.Error.Code != ERR_UNAVAILABLE {
+		t.Error("Outage returned", w.Code, w.Body.String())
+	}
+}
+
+func TestTrace(t *testing.T) {
+	if to_api_trace(nil) != nil {
+		t.Error("Queries without traces shouldn't get one")
+	}
+
+	trace := to_api_trace(&proto.QueryResponse_Trace{
+		Steps: []*proto.QueryResponse_Trace_Step{
+			{Operation: gproto.String("initialize"), Champion: proto.ChampionType_ANNIE.Enum(), OutputSize: gproto.Uint32(10)},
+			{Operation: gproto.String("merge"), InputSize: gproto.Uint32(10)},
+		},
+		SampleGames:   []uint32{3},
+		SampleRiotIds: []uint64{1544951968},
+	})
+	if len(trace.Steps) != 2 || trace.Steps[0].Champion != "ANNIE" || trace.Steps[1].Champion != "" || trace.Steps[0].OutputSize != 10 {
+		t.Error("Unexpected steps:", trace.Steps)
+	}
+	if len(trace.SampleGames) != 1 || trace.SampleGames[0] != 1544951968 {
+		t.Error("Sample games should be Riot ID's:", trace.SampleGames)
+	}
+}
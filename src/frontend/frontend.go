@@ -1,25 +1,38 @@
 package main
 
 import (
-	"bufio"
 	gproto "code.google.com/p/goprotobuf/proto"
+	data "datamodel"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"libcleo"
 	"log"
-	"net"
 	"net/http"
 	"os"
 	"proto"
 	"query"
+	"registry"
+	"strconv"
 	"strings"
 	"switchboard"
 )
 
+// Parameters for the server-rendered pages in html/templates; see pages.go.
 type ChampionPageParam struct {
-	Name   string
-	ImgURL string
+	Name      string
+	Shortname string
+	Title     string
+	ImgURL    string
+	// Links to the champion's page and, where it makes sense, to a matchup.
+	URL        string
+	MatchupURL string
+
+	// The champion's own win rate (as a percentage) in the context of the
+	// page, if there is one.
+	WinRate   float32
+	Available uint32
 }
 
 type PageParams struct {
@@ -33,22 +46,32 @@ type PageParams struct {
 	Allies  []ChampionPageParam
 	Enemies []ChampionPageParam
 
-	Valid bool
-}
+	// The best additions to the allied and enemy teams.
+	Synergies []ChampionPageParam
+	Counters  []ChampionPageParam
 
-type SubqueryBundle struct {
-	Explorer int32
-	Response proto.QueryResponse
+	// Every champion, for the index page.
+	Champions []ChampionPageParam
+
+	Valid bool
+	Error string
 }
 
 const ENABLE_EXPLORATORY_SUBQUERIES = true
 
+// The minimum number of games a champion needs to have played with the
+// current team before they'll be recommended.
+const MIN_EXPLORER_AVAILABLE = 5
+
 // TODO: this probably shouldn't be a global.
 var query_id = 0
 
 // TODO: figure out how to pass this to function handler in a way that will be
 // 	maintained between connections.
-var switchb = switchboard.SwitchboardClient{} //, _ = switchboard.NewClient("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 14002})
+var switchb *switchboard.SwitchboardClient
+
+var BACKENDS = flag.String("backends", "", "Comma-separated lolstat addresses; looked up in the registry if empty")
+var SECURITY = switchboard.RegisterSecurityFlags()
 
 // Fetch index.html (the main app). Simple, static file.
 func index_handler(w http.ResponseWriter, r *http.Request) {
@@ -74,6 +97,7 @@ func simple_team(w http.ResponseWriter, r *http.Request) {
 	enemies := strings.Split(r.FormValue("enemies"), ",")
 
 	qry := form_request(allies, enemies)
+	qry.Debug = gproto.Bool(len(r.FormValue("debug")) > 0)
 	response := proto.QueryResponse{}
 
 	is_valid := validate_request(qry)
@@ -82,43 +106,19 @@ func simple_team(w http.ResponseWriter, r *http.Request) {
 		response = request(qry)
 
 		if ENABLE_EXPLORATORY_SUBQUERIES {
-			log.Println(fmt.Sprintf("%s: submitting subqueries", query.GetQueryId(qry)))
-
-			subqueries := make(chan SubqueryBundle)
-			num_subqueries := 0
-
-			// Launch a bunch of different subqueries.
-			for _, cid := range proto.ChampionType_value {
-				check_champ := true
-
-				// Check if the champion is already present on the winner's
-				// list.
-				for _, winner := range qry.Winners {
-					if winner == cid {
-						check_champ = false
-					}
-				}
-
-				// If the champion already exists, don't fire off this
-				// subquery.
-				if check_champ {
-					go explore_subquery(qry, cid, subqueries)
-					num_subqueries += 1
-				}
-			}
-
-			// Collect all of the subquery responses.
-			for i := 0; i < num_subqueries; i++ {
-				bundle := <-subqueries
-
-				next_champ := proto.QueryResponse_ExploratoryChampionSubquery{
-					Explorer: proto.ChampionType(bundle.Explorer),
-					Results:  bundle.Results,
-					Valid:    (bundle.Response != nil),
-				}
-
-				response.NextChamp = append(response.NextChamp, next_champ)
-			}
+			// Ask the backend to rank every champion that could be added
+			// to the allied team. This happens in a single query rather
+			// than one query per champion.
+			explore := qry
+			explore.QueryId = gproto.Uint64(uint64(query_id))
+			explore.Type = proto.GameQuery_RECOMMEND_ALLY.Enum()
+			explore.MinAvailable = gproto.Uint32(MIN_EXPLORER_AVAILABLE)
+			explore.Debug = nil
+			query_id += 1
+
+			log.Println(fmt.Sprintf("%s: submitting recommendation query %s", query.GetQueryId(qry), query.GetQueryId(explore)))
+			recommendations := request(explore)
+			response.NextChamp = recommendations.NextChamp
 		}
 
 		data, err := json.Marshal(response)
@@ -130,40 +130,79 @@ func simple_team(w http.ResponseWriter, r *http.Request) {
 
 		w.Write(data)
 	} else {
-		log.Println(w, "SimpleTeam: invalid query.")
+		log.Println(fmt.Sprintf("%s: invalid team query", query.GetQueryId(qry)))
+		http.Error(w, "Unknown champion in team query.", http.StatusBadRequest)
 	}
 }
 
 /**
- * This function issues another modified query to the backend that includes
- * an explorer ID (champion ID) that was not specified by the user. This
- * will compute all of the standard stats if the user were to add this
- * champion.
+ * This function is a handler for draft queries. In addition to the allies
+ * and enemies that have already been picked it accepts a list of bans, and
+ * returns the backend's suggested picks (next_champ) and bans
+ * (suggested_bans) serialized as JSON.
  */
-func explore_subquery(qry proto.GameQuery, explorer_id int32, out chan SubqueryBundle) {
-	qry.Winners = append(qry.Winners, explorer_id)
+func draft_handler(w http.ResponseWriter, r *http.Request) {
+	allies := strings.Split(r.FormValue("allies"), ",")
+	enemies := strings.Split(r.FormValue("enemies"), ",")
+	bans := strings.Split(r.FormValue("bans"), ",")
 
-	// If the query is valid, submit it and pass the response back to the
-	// output channel.
-	if validate_request(qry) {
-		response := request(qry)
+	qry := form_request(allies, enemies)
+	qry.Type = proto.GameQuery_DRAFT.Enum()
 
-		bundle_response := SubqueryBundle{
-			Explorer: explorer_id,
-			Response: response,
+	for _, name := range bans {
+		if len(name) > 0 {
+			qry.Bans = append(qry.Bans, libcleo.String2ChampionType(name))
 		}
+	}
 
-		out <- bundle_response
-		// If it's not a valid query we should return a nil response so that
-		// we can still aggregate everything appropriately.
-	} else {
-		bundle_response := SubqueryBundle{
-			Explorer: explorer_id,
-			Response: nil,
-		}
+	if !validate_request(qry) {
+		log.Println(fmt.Sprintf("%s: invalid draft query", query.GetQueryId(qry)))
+		http.Error(w, "Unknown champion in draft query.", http.StatusBadRequest)
+		return
+	}
+
+	log.Println(fmt.Sprintf("%s: valid draft query", query.GetQueryId(qry)))
+	response := request(qry)
 
-		out <- bundle_response
+	data, err := json.Marshal(response)
+	if err != nil {
+		log.Println(fmt.Sprintf("%s: couldn't serialize draft response", query.GetQueryId(qry)))
+		http.Error(w, "Couldn't serialize response.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+/**
+ * This function returns a single stored game record as JSON, looked up by
+ * its Riot game ID (/game/<id>). Debug traces include the Riot ID's of a
+ * sample of the matching games so that they can be inspected here.
+ */
+func game_handler(w http.ResponseWriter, r *http.Request) {
+	game_id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/game/"), 10, 64)
+	if err != nil {
+		http.Error(w, "Game ID's must be numbers.", http.StatusBadRequest)
+		return
 	}
+
+	retriever := data.LoLRetriever{}
+	game, exists := retriever.GetGame(game_id)
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+
+	out, err := json.Marshal(game)
+	if err != nil {
+		log.Println(fmt.Sprintf("Couldn't serialize game %d", game_id))
+		http.Error(w, "Couldn't serialize game.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
 }
 
 // Validate current just checks to make sure that all tokens are real.
@@ -180,6 +219,12 @@ func validate_request(qry proto.GameQuery) bool {
 		}
 	}
 
+	for _, ban := range qry.Bans {
+		if ban == proto.ChampionType_UNKNOWN {
+			return false
+		}
+	}
+
 	return true
 }
 
@@ -202,7 +247,7 @@ func form_request(allies []string, enemies []string) proto.GameQuery {
 	for _, name := range enemies {
 		if len(name) > 0 {
 			log.Println(fmt.Sprintf("%s: enemy required = %s", query.GetQueryId(qry), libcleo.String2ChampionType(name)))
-			qry.Winners = append(qry.Losers, libcleo.String2ChampionType(name))
+			qry.Losers = append(qry.Losers, libcleo.String2ChampionType(name))
 		}
 	}
 
@@ -210,50 +255,103 @@ func form_request(allies []string, enemies []string) proto.GameQuery {
 }
 
 func request(qry proto.GameQuery) proto.QueryResponse {
+	response, err := call_backend(qry)
+
+	// If the backend fails or sends back an error, don't freak out. We
+	// got this.
+	if err == switchboard.ErrNoBackends {
+		return proto.QueryResponse{Successful: gproto.Bool(false), Error: gproto.String("No Cleo server is available.")}
+	} else if err != nil {
+		return proto.QueryResponse{Successful: gproto.Bool(false), Error: gproto.String(err.Error())}
+	}
+	return response
+}
+
+// Call_backend sends a query to one of the backends. Unlike request it
+// keeps the error, so callers can tell a missing backend
+// (switchboard.ErrNoBackends) apart from a failed query.
+func call_backend(qry proto.GameQuery) (proto.QueryResponse, error) {
 	//  Get a switchboard socket to talk to server
 	conn, cerr := switchb.GetStream()
 
 	if cerr != nil {
 		log.Println(fmt.Sprintf("%s: couldn't connect to a Cleo server.", query.GetQueryId(qry)))
-		return proto.QueryResponse{Successful: gproto.Bool(false)}
+		return proto.QueryResponse{}, cerr
 	}
+	defer (*conn).Close()
 
-	// Form a GameQuery.
-	data, _ := gproto.Marshal(&qry)
-	log.Println(fmt.Sprintf("%s: query sent", query.GetQueryId(qry)))
-
-	rw := bufio.NewReadWriter(bufio.NewReader(*conn), bufio.NewWriter(*conn))
-	rw.WriteString(string(data) + "|")
-	rw.Flush()
-
-	// Unmarshal the response.
+	log.Println(fmt.Sprintf("%s: query sent, awaiting response...", query.GetQueryId(qry)))
 	response := proto.QueryResponse{}
-	log.Println(fmt.Sprintf("%s: awaiting response...", query.GetQueryId(qry)))
 
-	reply, _ := rw.ReadString('|')
-
-	// If we get a zero-length reply this means the backend crashed. Don't
-	//  freak out. We got this.
-	if len(reply) == 0 {
-		return response
+	if err := query.Call(*conn, &qry, &response, 0); err != nil {
+		log.Println(fmt.Sprintf("%s: query failed: %s", query.GetQueryId(qry), err))
+		return proto.QueryResponse{}, err
 	}
 
-	gproto.Unmarshal([]byte(reply[:len(reply)-1]), &response)
 	log.Println(fmt.Sprintf("%s: valid response received", query.GetQueryId(qry)))
+	return response, nil
+}
 
-	return response
+// Connect_backends connects to the -backends addresses if they were given.
+// Otherwise it connects to every lolstat in the service registry and keeps
+// following the registry, so lolstats that register later (or after the
+// frontend starts) are picked up. Backends that aren't up yet are retried
+// in the background.
+func connect_backends(reg registry.Registry, security switchboard.Security) (*switchboard.SwitchboardClient, error) {
+	options := switchboard.ClientOptions{Security: security}
+	if len(*BACKENDS) > 0 {
+		addresses, err := switchboard.SplitAddresses(*BACKENDS)
+		if err != nil {
+			return nil, err
+		}
+		return switchboard.NewClientWithOptions("tcp", options, addresses...)
+	}
+
+	addresses, err := registry.Addresses(reg, "lolstat")
+	if err == registry.ErrNotFound {
+		log.Println("No lolstat backends are registered yet.")
+	} else if err != nil {
+		return nil, err
+	}
+
+	client, err := switchboard.NewClientWithOptions("tcp", options, addresses...)
+	if err != nil {
+		return nil, err
+	}
+	registry.Follow(reg, "lolstat", client, 0)
+	return client, nil
 }
 
 func main() {
 	http.HandleFunc("/", index_handler)
 	http.HandleFunc("/team/", simple_team)
+	http.HandleFunc("/draft/", draft_handler)
+	http.HandleFunc("/game/", game_handler)
+	register_api(http.DefaultServeMux)
 
-	// Initialize the connection to
-	cerr := error(nil)
-	switchb, cerr = switchboard.NewClient("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 14002})
+	pages, perr := new_pages("html/static/data/metadata.json", "html/templates")
+	if perr != nil {
+		log.Fatal("Couldn't load page templates:", perr)
+	}
+	http.Handle(PAGES_PREFIX, pages)
+
+	flag.Parse()
+
+	security, serr := SECURITY.Client()
+	if serr != nil {
+		log.Fatal("Invalid switchboard security settings:", serr)
+	}
 
+	reg, rerr := registry.OpenDefault(security)
+	if rerr != nil {
+		log.Fatal("Couldn't open the service registry:", rerr)
+	}
+
+	// Initialize the connection to the lolstat backends.
+	cerr := error(nil)
+	switchb, cerr = connect_backends(reg, security)
 	if cerr != nil {
-		log.Fatal("Couldn't find any available backends.")
+		log.Fatal("Couldn't connect to the lolstat backends:", cerr)
 	}
 
 	// Serve any files in static/ directly from the filesystem.
@@ -0,0 +1,329 @@
+package main
+
+// Server-rendered pages for each champion (/champions/<name>) and each
+// matchup between two champions (/champions/<name>/vs/<name>), along with
+// an index of every champion (/champions/). Unlike the Angular app they
+// work without JavaScript, so they can be linked to and crawled.
+//
+// Champion names, titles and images come from the metadata.json that the
+// packer writes alongside each index, and the numbers come from the
+// backend. The templates live in html/templates.
+
+import (
+	gproto "code.google.com/p/goprotobuf/proto"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"proto"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const PAGES_PREFIX = "/champions/"
+
+// The number of synergy and counter picks shown on each page.
+const TOP_PICKS = 5
+
+// A single champion from metadata.json. See StaticEntry in the packer.
+type championEntry struct {
+	Id        uint32 `json:"id"`
+	Name      string `json:"name"`
+	Shortname string `json:"shortname"`
+	Title     string `json:"title"`
+	Img       string `json:"img"`
+	Games     uint32 `json:"games"`
+}
+
+type championMetadata struct {
+	LastUpdated int64           `json:"lastUpdated"`
+	NumGames    int             `json:"numGames"`
+	Champions   []championEntry `json:"champions"`
+
+	by_shortname map[string]*championEntry
+	by_id        map[proto.ChampionType]*championEntry
+}
+
+// MetadataStore reloads metadata.json whenever the packer replaces it.
+type metadataStore struct {
+	filename string
+	modified time.Time
+	current  *championMetadata
+	lock     sync.Mutex
+}
+
+type championPages struct {
+	metadata  *metadataStore
+	templates *template.Template
+	// Sends queries to the backend. This is ask (see api.go) except in
+	// tests.
+	ask func(qry proto.GameQuery) (proto.QueryResponse, *apiError)
+}
+
+func new_pages(metadata_file string, template_dir string) (*championPages, error) {
+	templates, err := template.ParseGlob(filepath.Join(template_dir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &championPages{
+		metadata:  &metadataStore{filename: metadata_file},
+		templates: templates,
+		ask:       ask,
+	}, nil
+}
+
+func read_metadata(filename string) (*championMetadata, error) {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := championMetadata{}
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return nil, err
+	}
+
+	sort.Sort(byChampionName(meta.Champions))
+
+	meta.by_shortname = make(map[string]*championEntry)
+	meta.by_id = make(map[proto.ChampionType]*championEntry)
+	for i := range meta.Champions {
+		entry := &meta.Champions[i]
+		meta.by_shortname[entry.Shortname] = entry
+		meta.by_id[proto.ChampionType(entry.Id)] = entry
+	}
+
+	return &meta, nil
+}
+
+func (s *metadataStore) get() (*championMetadata, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	info, err := os.Stat(s.filename)
+	if err != nil {
+		// Keep serving the last good copy if there is one.
+		if s.current != nil {
+			return s.current, nil
+		}
+		return nil, err
+	}
+
+	if s.current == nil || info.ModTime() != s.modified {
+		meta, err := read_metadata(s.filename)
+		if err != nil {
+			if s.current != nil {
+				log.Println("Couldn't reload champion metadata:", err)
+				return s.current, nil
+			}
+			return nil, err
+		}
+
+		s.current = meta
+		s.modified = info.ModTime()
+		log.Println(fmt.Sprintf("Loaded metadata for %d champions.", len(meta.Champions)))
+	}
+	return s.current, nil
+}
+
+type byChampionName []championEntry
+
+func (x byChampionName) Len() int           { return len(x) }
+func (x byChampionName) Less(i, j int) bool { return x[i].Name < x[j].Name }
+func (x byChampionName) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+
+func (p *championPages) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	meta, err := p.metadata.get()
+	if err != nil {
+		log.Println("Champion metadata isn't available:", err)
+		p.render_error(w, http.StatusServiceUnavailable, "Champion data isn't available yet.")
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, PAGES_PREFIX), "/")
+	parts := strings.Split(path, "/")
+
+	switch {
+	case len(path) == 0:
+		p.index_page(w, meta)
+	case len(parts) == 1:
+		p.champion_page(w, meta, parts[0])
+	case len(parts) == 3 && parts[1] == "vs":
+		p.matchup_page(w, meta, parts[0], parts[2])
+	default:
+		p.render_error(w, http.StatusNotFound, "There's no page here.")
+	}
+}
+
+func (p *championPages) index_page(w http.ResponseWriter, meta *championMetadata) {
+	params := PageParams{Title: "Champions", Total: uint32(meta.NumGames), Valid: true}
+	for i := range meta.Champions {
+		params.Champions = append(params.Champions, page_champion(&meta.Champions[i]))
+	}
+
+	p.render(w, "champions.html", params)
+}
+
+func (p *championPages) champion_page(w http.ResponseWriter, meta *championMetadata, name string) {
+	champion, exists := meta.by_shortname[strings.ToLower(name)]
+	if !exists {
+		p.render_error(w, http.StatusNotFound, fmt.Sprintf("There's no champion called '%s'.", name))
+		return
+	}
+
+	team := []proto.ChampionType{proto.ChampionType(champion.Id)}
+	params, aerr := p.team_params(meta, team, nil)
+	if aerr != nil {
+		p.render_error(w, aerr.Status, aerr.Message)
+		return
+	}
+
+	params.Title = champion.Name
+	for i := range params.Counters {
+		params.Counters[i].MatchupURL = PAGES_PREFIX + champion.Shortname + "/vs/" + params.Counters[i].Shortname
+	}
+
+	p.render(w, "champion.html", params)
+}
+
+func (p *championPages) matchup_page(w http.ResponseWriter, meta *championMetadata, ally_name string, enemy_name string) {
+	ally, ally_exists := meta.by_shortname[strings.ToLower(ally_name)]
+	enemy, enemy_exists := meta.by_shortname[strings.ToLower(enemy_name)]
+	if !ally_exists || !enemy_exists || ally == enemy {
+		p.render_error(w, http.StatusNotFound, fmt.Sprintf("There's no matchup between '%s' and '%s'.", ally_name, enemy_name))
+		return
+	}
+
+	params, aerr := p.team_params(meta,
+		[]proto.ChampionType{proto.ChampionType(ally.Id)},
+		[]proto.ChampionType{proto.ChampionType(enemy.Id)})
+	if aerr != nil {
+		p.render_error(w, aerr.Status, aerr.Message)
+		return
+	}
+
+	params.Title = fmt.Sprintf("%s vs %s", ally.Name, enemy.Name)
+	p.render(w, "matchup.html", params)
+}
+
+// Team_params fills in the win rate of ALLIES against ENEMIES along with
+// the best champions to add to each side.
+func (p *championPages) team_params(meta *championMetadata, allies []proto.ChampionType, enemies []proto.ChampionType) (PageParams, *apiError) {
+	params := PageParams{}
+
+	qry := form_request(nil, nil)
+	qry.Winners = allies
+	qry.Losers = enemies
+
+	response, aerr := p.ask(qry)
+	if aerr != nil {
+		return params, aerr
+	}
+
+	synergy := qry
+	synergy.Type = proto.GameQuery_RECOMMEND_ALLY.Enum()
+	synergy.MinAvailable = gproto.Uint32(MIN_EXPLORER_AVAILABLE)
+	synergy.Limit = gproto.Uint32(TOP_PICKS)
+	synergies, aerr := p.ask(synergy)
+	if aerr != nil {
+		return params, aerr
+	}
+
+	counter := qry
+	counter.Type = proto.GameQuery_RECOMMEND_ENEMY.Enum()
+	counter.MinAvailable = gproto.Uint32(MIN_EXPLORER_AVAILABLE)
+	counter.Limit = gproto.Uint32(TOP_PICKS)
+	counters, aerr := p.ask(counter)
+	if aerr != nil {
+		return params, aerr
+	}
+
+	params.Matching = response.Results.GetMatching()
+	params.Available = response.Results.GetAvailable()
+	params.Total = response.Results.GetTotal()
+	if params.Available > 0 {
+		params.Matching_Percentage = 100 * float32(params.Matching) / float32(params.Available)
+	}
+
+	for _, champion := range allies {
+		if entry, exists := meta.by_id[champion]; exists {
+			params.Allies = append(params.Allies, page_champion(entry))
+		}
+	}
+	for _, champion := range enemies {
+		if entry, exists := meta.by_id[champion]; exists {
+			params.Enemies = append(params.Enemies, page_champion(entry))
+		}
+	}
+	if len(params.Allies) != len(allies) || len(params.Enemies) != len(enemies) {
+		return params, &apiError{Status: http.StatusNotFound, Code: ERR_NOT_FOUND, Message: "Unknown champion."}
+	}
+
+	params.Synergies = top_picks(meta, synergies.NextChamp, false)
+	params.Counters = top_picks(meta, counters.NextChamp, true)
+	params.Valid = true
+
+	return params, nil
+}
+
+// Top_picks turns recommendations into page parameters, in the order the
+// backend ranked them. The win rates in recommendations are always the
+// allies'; for enemies (AS_ENEMY) they're turned around.
+func top_picks(meta *championMetadata, candidates []*proto.QueryResponse_ExploratoryChampionSubquery, as_enemy bool) []ChampionPageParam {
+	valid := make([]*proto.QueryResponse_ExploratoryChampionSubquery, 0, len(candidates))
+	for _, candidate := range candidates {
+		if _, exists := meta.by_id[candidate.GetExplorer()]; exists && candidate.GetValid() {
+			valid = append(valid, candidate)
+		}
+	}
+
+	if len(valid) > TOP_PICKS {
+		valid = valid[:TOP_PICKS]
+	}
+
+	picks := make([]ChampionPageParam, 0, len(valid))
+	for _, candidate := range valid {
+		pick := page_champion(meta.by_id[candidate.GetExplorer()])
+		pick.Available = candidate.Results.GetAvailable()
+		if pick.Available > 0 {
+			pick.WinRate = 100 * float32(candidate.Results.GetMatching()) / float32(pick.Available)
+			if as_enemy {
+				pick.WinRate = 100 - pick.WinRate
+			}
+		}
+		picks = append(picks, pick)
+	}
+	return picks
+}
+
+func page_champion(entry *championEntry) ChampionPageParam {
+	return ChampionPageParam{
+		Name:      entry.Name,
+		Shortname: entry.Shortname,
+		Title:     entry.Title,
+		ImgURL:    entry.Img,
+		URL:       PAGES_PREFIX + entry.Shortname,
+	}
+}
+
+func (p *championPages) render(w http.ResponseWriter, name string, params PageParams) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := p.templates.ExecuteTemplate(w, name, params); err != nil {
+		log.Println(fmt.Sprintf("Couldn't render %s: %s", name, err))
+	}
+}
+
+func (p *championPages) render_error(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := p.templates.ExecuteTemplate(w, "error.html", PageParams{Title: http.StatusText(status), Error: message}); err != nil {
+		log.Println("Couldn't render an error page:", err)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	gproto "code.google.com/p/goprotobuf/proto"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"proto"
+	"strings"
+	"testing"
+)
+
+const test_metadata = `{"lastUpdated": 1400000000, "numGames": 1000, "champions": [
+	{"id": %d, "name": "Annie", "shortname": "annie", "title": "the Dark Child", "img": "annie.png", "games": 100},
+	{"id": %d, "name": "Ashe", "shortname": "ashe", "title": "the Frost Archer", "img": "ashe.png", "games": 100},
+	{"id": %d, "name": "Garen", "shortname": "garen", "title": "The Might of Demacia", "img": "garen.png", "games": 100},
+	{"id": %d, "name": "<Zed>", "shortname": "zed", "title": "the Master of Shadows", "img": "zed.png", "games": 100}
+]}`
+
+func candidate(champion proto.ChampionType, matching uint32, available uint32, upper float64) *proto.QueryResponse_ExploratoryChampionSubquery {
+	return &proto.QueryResponse_ExploratoryChampionSubquery{
+		Explorer: champion.Enum(),
+		Valid:    gproto.Bool(true),
+		Results:  &proto.QueryResponse_Results{Matching: gproto.Uint32(matching), Available: gproto.Uint32(available)},
+		Stats:    &proto.QueryResponse_Statistics{UpperBound: gproto.Float64(upper)},
+	}
+}
+
+// Test_pages serves pages from the real templates with a fake backend.
+func test_pages(t *testing.T) (*championPages, *[]proto.GameQuery, func()) {
+	dir, err := ioutil.TempDir("", "pages")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := fmt.Sprintf(test_metadata, proto.ChampionType_ANNIE, proto.ChampionType_ASHE, proto.ChampionType_GAREN, proto.ChampionType_ZED)
+
+	filename := filepath.Join(dir, "metadata.json")
+	if err := ioutil.WriteFile(filename, []byte(metadata), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pages, err := new_pages(filename, "../../html/templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queries := &[]proto.GameQuery{}
+	pages.ask = func(qry proto.GameQuery) (proto.QueryResponse, *apiError) {
+		*queries = append(*queries, qry)
+		response := proto.QueryResponse{Successful: gproto.Bool(true)}
+
+		switch qry.GetType() {
+		case proto.GameQuery_TEAM:
+			response.Results = &proto.QueryResponse_Results{Matching: gproto.Uint32(60), Available: gproto.Uint32(100), Total: gproto.Uint32(1000)}
+		case proto.GameQuery_RECOMMEND_ALLY:
+			response.NextChamp = append(response.NextChamp, candidate(proto.ChampionType_ASHE, 30, 40, 0.9))
+		case proto.GameQuery_RECOMMEND_ENEMY:
+			// Ranked best for the enemies first, like the backend does.
+			response.NextChamp = append(response.NextChamp,
+				candidate(proto.ChampionType_ZED, 2, 10, 0.4),
+				candidate(proto.ChampionType_GAREN, 4, 10, 0.6),
+				candidate(proto.ChampionType_ASHE, 8, 10, 0.95))
+		}
+		return response, nil
+	}
+
+	return pages, queries, func() { os.RemoveAll(dir) }
+}
+
+func fetch(pages http.Handler, url string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", url, nil)
+	w := httptest.NewRecorder()
+	pages.ServeHTTP(w, req)
+	return w
+}
+
+func TestChampionPage(t *testing.T) {
+	pages, queries, cleanup := test_pages(t)
+	defer cleanup()
+
+	w := fetch(pages, "/champions/Annie")
+	body := w.Body.String()
+	if w.Code != http.StatusOK {
+		t.Fatal("Champion page returned", w.Code, body)
+	}
+
+	for _, expected := range []string{"Annie, the Dark Child", "60.0% win rate", "/champions/ashe", "75.0% over 40 games", "/champions/annie/vs/zed", "&lt;Zed&gt;"} {
+		if !strings.Contains(body, expected) {
+			t.Error("Champion page is missing", expected)
+		}
+	}
+
+	// Zed beats Annie the most, so he's the first counter, at 80%.
+	zed := strings.Index(body, "/champions/annie/vs/zed")
+	garen := strings.Index(body, "/champions/annie/vs/garen")
+	if zed > garen || !strings.Contains(body, "80.0% over 10 games") {
+		t.Error("Counters are in the wrong order")
+	}
+	if strings.Contains(body, "<Zed>") {
+		t.Error("Champion names weren't escaped")
+	}
+
+	// Pages only need the top picks from the backend.
+	for _, qry := range *queries {
+		if qry.GetType() != proto.GameQuery_TEAM && qry.GetLimit() != TOP_PICKS {
+			t.Error("Asked for", qry.GetLimit(), "candidates")
+		}
+	}
+}
+
+func TestMatchupPage(t *testing.T) {
+	pages, _, cleanup := test_pages(t)
+	defer cleanup()
+
+	w := fetch(pages, "/champions/annie/vs/garen")
+	body := w.Body.String()
+	if w.Code != http.StatusOK {
+		t.Fatal("Matchup page returned", w.Code, body)
+	}
+	if !strings.Contains(body, "Annie wins 60.0% of the time") || !strings.Contains(body, "/champions/garen/vs/annie") {
+		t.Error("Unexpected matchup page:", body)
+	}
+}
+
+func TestPageErrors(t *testing.T) {
+	pages, _, cleanup := test_pages(t)
+	defer cleanup()
+
+	for _, url := range []string{"/champions/teemo", "/champions/annie/vs/teemo", "/champions/annie/vs/annie", "/champions/annie/garen"} {
+		w := fetch(pages, url)
+		if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "All champions") {
+			t.Error(url, "returned", w.Code)
+		}
+	}
+
+	pages.ask = func(qry proto.GameQuery) (proto.QueryResponse, *apiError) {
+		return proto.QueryResponse{}, &apiError{Status: http.StatusServiceUnavailable, Message: "No Cleo backend is available."}
+	}
+	if w := fetch(pages, "/champions/annie"); w.Code != http.StatusServiceUnavailable {
+		t.Error("Backend failure returned", w.Code)
+	}
+}
+
+func TestChampionIndex(t *testing.T) {
+	pages, queries, cleanup := test_pages(t)
+	defer cleanup()
+
+	w := fetch(pages, "/champions/")
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, "1000 games indexed") {
+		t.Fatal("Index returned", w.Code, body)
+	}
+	if strings.Index(body, "/champions/annie") > strings.Index(body, "/champions/garen") {
+		t.Error("Champions aren't sorted by name")
+	}
+	if len(*queries) != 0 {
+		t.Error("The index shouldn't need the backend")
+	}
+}
@@ -55,6 +55,9 @@ func main() {
 	}
 
 	retriever := data.LoLRetriever{}
+	if err := retriever.Init(); err != nil {
+		log.Fatal("Couldn't open the game store:", err)
+	}
 
 	for {
 		summoners_iter := retriever.GetAllSummonersIter()
@@ -0,0 +1,49 @@
+package jobqueue
+
+import (
+	beanstalk "github.com/iwanbk/gobeanstalk"
+	"time"
+)
+
+// Beanstalk is a connection to a beanstalkd server. Like the connection
+// itself, it shouldn't be shared between goroutines.
+type Beanstalk struct {
+	conn *beanstalk.Conn
+}
+
+func DialBeanstalk(address string) (*Beanstalk, error) {
+	conn, err := beanstalk.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	return &Beanstalk{conn: conn}, nil
+}
+
+func (b *Beanstalk) Put(body []byte, pri uint32, delay time.Duration, ttr time.Duration) (uint64, error) {
+	return b.conn.Put(body, pri, delay, ttr)
+}
+
+func (b *Beanstalk) Reserve() (*Job, error) {
+	j, err := b.conn.Reserve()
+	if err != nil {
+		return nil, err
+	}
+	return &Job{ID: j.ID, Body: j.Body}, nil
+}
+
+func (b *Beanstalk) Delete(id uint64) error {
+	return b.conn.Delete(id)
+}
+
+func (b *Beanstalk) Bury(id uint64, pri uint32) error {
+	return b.conn.Bury(id, pri)
+}
+
+func (b *Beanstalk) Touch(id uint64) error {
+	return b.conn.Touch(id)
+}
+
+func (b *Beanstalk) Close() error {
+	b.conn.Quit()
+	return nil
+}
@@ -0,0 +1,176 @@
+package jobqueue
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// File is an embedded queue that's kept in a journal: each put, delete and
+// bury is appended to the file (and synced) before it's made. Opening the
+// file replays the journal and then rewrites it with just the jobs that
+// are left. Reservations and touches aren't kept, so jobs that were
+// reserved when the process stopped are ready again when it starts, the
+// same as with beanstalkd.
+type File struct {
+	*Memory
+	path string
+	file *os.File
+}
+
+type journalEntry struct {
+	Op  string `json:"op"`
+	Id  uint64 `json:"id"`
+	Pri uint32 `json:"pri,omitempty"`
+	// Nanoseconds.
+	Ttr int64 `json:"ttr,omitempty"`
+	// For delayed jobs, when they become ready (Unix nanoseconds).
+	Ready int64  `json:"ready,omitempty"`
+	Body  []byte `json:"body,omitempty"`
+}
+
+func put_entry(job *memoryJob) journalEntry {
+	entry := journalEntry{Op: "put", Id: job.ID, Pri: job.pri, Ttr: int64(job.ttr), Body: job.Body}
+	if job.state == delayed {
+		entry.Ready = job.until.UnixNano()
+	}
+	return entry
+}
+
+func OpenFile(path string) (*File, error) {
+	q := &File{Memory: NewMemory(), path: path}
+
+	if err := q.replay(); err != nil {
+		return nil, err
+	}
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	q.file = file
+	q.journal = q.append
+	return q, nil
+}
+
+func (q *File) Close() error {
+	q.Memory.Close()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.file.Close()
+}
+
+func (q *File) replay() error {
+	file, err := os.Open(q.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	for {
+		entry := journalEntry{}
+		if err := decoder.Decode(&entry); err == io.EOF {
+			return nil
+		} else if err != nil {
+			// Most likely the last entry was cut short by a crash, in which
+			// case the change it describes was never made.
+			log.Println(fmt.Sprintf("Ignoring the rest of %s: %v", q.path, err))
+			return nil
+		}
+
+		q.apply(entry)
+	}
+}
+
+func (q *File) apply(entry journalEntry) {
+	switch entry.Op {
+	case "put":
+		job := &memoryJob{Job: Job{ID: entry.Id, Body: entry.Body}, pri: entry.Pri, ttr: time.Duration(entry.Ttr), state: ready}
+		if entry.Ready != 0 {
+			job.state = delayed
+			job.until = time.Unix(0, entry.Ready)
+		}
+		q.jobs[job.ID] = job
+		if job.ID > q.last {
+			q.last = job.ID
+		}
+	case "delete":
+		delete(q.jobs, entry.Id)
+	case "bury":
+		if job, exists := q.jobs[entry.Id]; exists {
+			job.state = buried
+			job.pri = entry.Pri
+		}
+	}
+}
+
+// Rewrites the journal with only the jobs that are left. The new journal
+// replaces the old one in a single rename, so a crash part way through
+// leaves one or the other.
+func (q *File) compact() error {
+	ids := make([]int, 0, len(q.jobs))
+	for id := range q.jobs {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+
+	entries := make([]journalEntry, 0, len(ids))
+	for _, id := range ids {
+		job := q.jobs[uint64(id)]
+		entries = append(entries, put_entry(job))
+		if job.state == buried {
+			entries = append(entries, journalEntry{Op: "bury", Id: job.ID, Pri: job.pri})
+		}
+	}
+
+	// Keep the last ID, even if its job is gone, so that ID's aren't
+	// reused.
+	if q.last > 0 && (len(ids) == 0 || uint64(ids[len(ids)-1]) != q.last) {
+		entries = append(entries, journalEntry{Op: "put", Id: q.last}, journalEntry{Op: "delete", Id: q.last})
+	}
+
+	temp := q.path + ".tmp"
+	file, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(file)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	file.Close()
+
+	return os.Rename(temp, q.path)
+}
+
+// Called with the lock held.
+func (q *File) append(entry journalEntry) error {
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if _, err := q.file.Write(append(encoded, '\n')); err != nil {
+		return err
+	}
+	return q.file.Sync()
+}
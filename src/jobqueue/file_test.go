@@ -0,0 +1,108 @@
+package jobqueue
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func test_file(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "jobqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "queue"), func() { os.RemoveAll(dir) }
+}
+
+func TestFilePersists(t *testing.T) {
+	path, cleanup := test_file(t)
+	defer cleanup()
+
+	q, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, _ := q.Put([]byte("done"), 10, 0, time.Minute)
+	failed, _ := q.Put([]byte("failed"), 10, 0, time.Minute)
+	running, _ := q.Put([]byte("running"), 10, 0, time.Minute)
+	q.Put([]byte("later"), 10, time.Hour, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		reserve(t, q)
+	}
+	q.Delete(done)
+	q.Bury(failed, 5)
+	q.Close()
+
+	// The job that was running when the queue closed is ready again.
+	q, err = OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := q.Stats(); stats.Ready != 1 || stats.Delayed != 1 || stats.Buried != 1 || stats.Reserved != 0 {
+		t.Error("Unexpected stats after reopening:", stats)
+	}
+	if job := reserve(t, q); job.ID != running || string(job.Body) != "running" {
+		t.Error("Expected the job that was running, got", job)
+	}
+
+	// ID's aren't reused.
+	q.Delete(running)
+	q.Close()
+	q, _ = OpenFile(path)
+	if id, _ := q.Put([]byte("new"), 10, 0, time.Minute); id <= running+1 {
+		t.Error("Expected a new ID, got", id)
+	}
+	q.Close()
+}
+
+func TestFileTornWrite(t *testing.T) {
+	path, cleanup := test_file(t)
+	defer cleanup()
+
+	q, _ := OpenFile(path)
+	q.Put([]byte("job"), 10, 0, time.Minute)
+	q.Close()
+
+	// A crash in the middle of writing an entry.
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	file.WriteString(`{"op":"put","id":2,"bo`)
+	file.Close()
+
+	q, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if stats := q.Stats(); stats.Ready != 1 {
+		t.Error("Unexpected stats:", stats)
+	}
+	if id, _ := q.Put([]byte("next"), 10, 0, time.Minute); id != 2 {
+		t.Error("Expected the half-written job to be forgotten, got ID", id)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	path, cleanup := test_file(t)
+	defer cleanup()
+
+	if q, err := Open("mem:"); err != nil || !Embedded("mem:") {
+		t.Error("Couldn't open an in-memory queue:", err)
+	} else if _, ok := q.(*Memory); !ok {
+		t.Error("Expected a Memory queue, got", q)
+	}
+
+	q, err := Open("file:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if _, ok := q.(*File); !ok || !Embedded("file:"+path) {
+		t.Error("Expected a File queue, got", q)
+	}
+	if Embedded("localhost:11300") {
+		t.Error("beanstalkd isn't embedded")
+	}
+}
@@ -0,0 +1,65 @@
+package jobqueue
+
+// A job queue with the parts of the beanstalkd protocol that cac and
+// join-summoners use. There are three implementations:
+//
+//   - Beanstalk, a client for a beanstalkd server. This is what runs in
+//     production, where cac and the join-summoners workers are separate
+//     processes.
+//   - File, an embedded queue that keeps its jobs in a journal on disk so
+//     that they survive restarts. It lives inside a single process, so
+//     it's meant for running cac and its workers together in development
+//     (cac -workers).
+//   - Memory, an embedded queue that isn't persisted at all, for tests.
+//
+// Jobs work the way they do in beanstalkd: a reserved job that isn't
+// deleted, buried or touched within its time-to-run goes back on the
+// queue, and buried jobs stay put until they're deleted.
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrNotFound = errors.New("no such job, or it isn't reserved")
+var ErrClosed = errors.New("queue is closed")
+
+type Job struct {
+	ID   uint64
+	Body []byte
+}
+
+type Queue interface {
+	// Put adds a job, which can be reserved once DELAY has passed. Jobs
+	// with lower priorities are reserved first. The worker that reserves
+	// it has TTR to finish or touch it before it's handed to someone else.
+	Put(body []byte, pri uint32, delay time.Duration, ttr time.Duration) (uint64, error)
+	// Reserve waits for a job and reserves it.
+	Reserve() (*Job, error)
+	Delete(id uint64) error
+	// Bury sets a reserved job aside so that it isn't reserved again.
+	Bury(id uint64, pri uint32) error
+	// Touch gives a reserved job another TTR.
+	Touch(id uint64) error
+	Close() error
+}
+
+// Open returns the queue described by SPEC: "mem:" for an in-memory
+// queue, "file:PATH" for an embedded queue kept in PATH, and otherwise the
+// address of a beanstalkd server.
+func Open(spec string) (Queue, error) {
+	switch {
+	case spec == "mem:":
+		return NewMemory(), nil
+	case strings.HasPrefix(spec, "file:"):
+		return OpenFile(strings.TrimPrefix(spec, "file:"))
+	}
+	return DialBeanstalk(spec)
+}
+
+// Embedded is true if SPEC describes a queue that lives in this process,
+// which has to be shared by everything in it that uses the queue.
+func Embedded(spec string) bool {
+	return spec == "mem:" || strings.HasPrefix(spec, "file:")
+}
@@ -0,0 +1,254 @@
+package jobqueue
+
+import (
+	"sync"
+	"time"
+)
+
+// Like beanstalkd, jobs get at least a second to run.
+const MIN_TTR = time.Second
+
+type jobState int
+
+const (
+	ready jobState = iota
+	delayed
+	reserved
+	buried
+)
+
+type memoryJob struct {
+	Job
+	pri   uint32
+	ttr   time.Duration
+	state jobState
+	// When a delayed job becomes ready, or a reserved one times out.
+	until time.Time
+}
+
+// Stats counts the jobs in a queue by state.
+type Stats struct {
+	Ready    int
+	Delayed  int
+	Reserved int
+	Buried   int
+}
+
+// Pending is the number of jobs that haven't been finished or buried.
+func (s Stats) Pending() int {
+	return s.Ready + s.Delayed + s.Reserved
+}
+
+// Memory is an in-memory queue. It's safe to share between goroutines;
+// any of them can delete, bury or touch a job that another reserved.
+type Memory struct {
+	lock   sync.Mutex
+	wake   *sync.Cond
+	jobs   map[uint64]*memoryJob
+	last   uint64
+	closed bool
+
+	// If set, called with each change to the queue before it's made; the
+	// change is abandoned if it fails. See File.
+	journal func(entry journalEntry) error
+	// Replaceable for tests.
+	now func() time.Time
+}
+
+func NewMemory() *Memory {
+	q := &Memory{jobs: make(map[uint64]*memoryJob), now: time.Now}
+	q.wake = sync.NewCond(&q.lock)
+	return q
+}
+
+func (q *Memory) Put(body []byte, pri uint32, delay time.Duration, ttr time.Duration) (uint64, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.closed {
+		return 0, ErrClosed
+	}
+	if ttr < MIN_TTR {
+		ttr = MIN_TTR
+	}
+
+	job := &memoryJob{Job: Job{ID: q.last + 1, Body: copy_body(body)}, pri: pri, ttr: ttr, state: ready}
+	if delay > 0 {
+		job.state = delayed
+		job.until = q.now().Add(delay)
+	}
+
+	if err := q.record(put_entry(job)); err != nil {
+		return 0, err
+	}
+
+	q.last = job.ID
+	q.jobs[job.ID] = job
+	q.wake.Broadcast()
+	return job.ID, nil
+}
+
+// Reserve returns the ready job with the lowest priority (and then the
+// lowest ID), waiting for one if there aren't any.
+func (q *Memory) Reserve() (*Job, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for {
+		if q.closed {
+			return nil, ErrClosed
+		}
+
+		now := q.now()
+		var next *memoryJob
+		var wake time.Time
+		for _, job := range q.jobs {
+			q.update(job, now)
+
+			switch job.state {
+			case ready:
+				if next == nil || job.pri < next.pri || (job.pri == next.pri && job.ID < next.ID) {
+					next = job
+				}
+			case delayed, reserved:
+				if wake.IsZero() || job.until.Before(wake) {
+					wake = job.until
+				}
+			}
+		}
+
+		if next != nil {
+			next.state = reserved
+			next.until = now.Add(next.ttr)
+			return &Job{ID: next.ID, Body: copy_body(next.Body)}, nil
+		}
+
+		// Wait for a Put, or for the next delayed or reserved job to be
+		// ready. The timer takes the lock so that it can't go off before
+		// Wait() is waiting.
+		var timer *time.Timer
+		if !wake.IsZero() {
+			timer = time.AfterFunc(wake.Sub(now), func() {
+				q.lock.Lock()
+				defer q.lock.Unlock()
+				q.wake.Broadcast()
+			})
+		}
+		q.wake.Wait()
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (q *Memory) Delete(id uint64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if _, exists := q.jobs[id]; !exists {
+		return ErrNotFound
+	}
+	if err := q.record(journalEntry{Op: "delete", Id: id}); err != nil {
+		return err
+	}
+
+	delete(q.jobs, id)
+	return nil
+}
+
+func (q *Memory) Bury(id uint64, pri uint32) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	job, err := q.reserved(id)
+	if err != nil {
+		return err
+	}
+	if err := q.record(journalEntry{Op: "bury", Id: id, Pri: pri}); err != nil {
+		return err
+	}
+
+	job.state = buried
+	job.pri = pri
+	return nil
+}
+
+func (q *Memory) Touch(id uint64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	job, err := q.reserved(id)
+	if err != nil {
+		return err
+	}
+
+	job.until = q.now().Add(job.ttr)
+	return nil
+}
+
+// Close wakes up anything waiting in Reserve, which returns ErrClosed.
+func (q *Memory) Close() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.closed = true
+	q.wake.Broadcast()
+	return nil
+}
+
+func (q *Memory) Stats() Stats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	stats := Stats{}
+	now := q.now()
+	for _, job := range q.jobs {
+		q.update(job, now)
+
+		switch job.state {
+		case ready:
+			stats.Ready++
+		case delayed:
+			stats.Delayed++
+		case reserved:
+			stats.Reserved++
+		case buried:
+			stats.Buried++
+		}
+	}
+	return stats
+}
+
+// Makes delayed jobs that are due and reserved jobs that have run out of
+// time ready.
+func (q *Memory) update(job *memoryJob, now time.Time) {
+	if (job.state == delayed || job.state == reserved) && !now.Before(job.until) {
+		job.state = ready
+	}
+}
+
+func (q *Memory) reserved(id uint64) (*memoryJob, error) {
+	job, exists := q.jobs[id]
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	q.update(job, q.now())
+	if job.state != reserved {
+		return nil, ErrNotFound
+	}
+	return job, nil
+}
+
+func (q *Memory) record(entry journalEntry) error {
+	if q.journal == nil {
+		return nil
+	}
+	return q.journal(entry)
+}
+
+func copy_body(body []byte) []byte {
+	copied := make([]byte, len(body))
+	copy(copied, body)
+	return copied
+}
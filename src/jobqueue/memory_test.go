@@ -0,0 +1,133 @@
+package jobqueue
+
+import (
+	"testing"
+	"time"
+)
+
+// A queue whose clock only moves when it's told to.
+func test_memory() (*Memory, *time.Time) {
+	q := NewMemory()
+	now := time.Unix(1000, 0)
+	q.now = func() time.Time { return now }
+	return q, &now
+}
+
+func reserve(t *testing.T, q Queue) *Job {
+	job, err := q.Reserve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func TestReserveOrder(t *testing.T) {
+	q, _ := test_memory()
+	q.Put([]byte("first"), 10, 0, time.Minute)
+	q.Put([]byte("urgent"), 1, 0, time.Minute)
+	q.Put([]byte("second"), 10, 0, time.Minute)
+
+	for _, expected := range []string{"urgent", "first", "second"} {
+		if job := reserve(t, q); string(job.Body) != expected {
+			t.Error("Expected", expected, "got", string(job.Body))
+		}
+	}
+	if stats := q.Stats(); stats.Reserved != 3 || stats.Ready != 0 {
+		t.Error("Unexpected stats:", stats)
+	}
+}
+
+func TestTimeToRun(t *testing.T) {
+	q, now := test_memory()
+	id, _ := q.Put([]byte("job"), 10, 0, time.Minute)
+	reserve(t, q)
+
+	*now = now.Add(50 * time.Second)
+	if err := q.Touch(id); err != nil {
+		t.Fatal(err)
+	}
+
+	// The touch bought it another minute.
+	*now = now.Add(50 * time.Second)
+	if stats := q.Stats(); stats.Reserved != 1 {
+		t.Error("A touched job shouldn't time out:", stats)
+	}
+
+	*now = now.Add(time.Minute)
+	if job := reserve(t, q); job.ID != id {
+		t.Error("Expected the job that timed out to be reserved again")
+	}
+}
+
+func TestDelay(t *testing.T) {
+	q, now := test_memory()
+	q.Put([]byte("later"), 10, time.Hour, time.Minute)
+	if stats := q.Stats(); stats.Delayed != 1 {
+		t.Error("Unexpected stats:", stats)
+	}
+
+	*now = now.Add(time.Hour)
+	if job := reserve(t, q); string(job.Body) != "later" {
+		t.Error("Expected the delayed job once it was ready")
+	}
+}
+
+func TestBuryAndDelete(t *testing.T) {
+	q, _ := test_memory()
+	first, _ := q.Put([]byte("first"), 10, 0, time.Minute)
+	second, _ := q.Put([]byte("second"), 10, 0, time.Minute)
+
+	if err := q.Bury(first, 10); err != ErrNotFound {
+		t.Error("Only reserved jobs can be buried, got", err)
+	}
+
+	reserve(t, q)
+	if err := q.Bury(first, 20); err != nil {
+		t.Fatal(err)
+	}
+	if job := reserve(t, q); job.ID != second {
+		t.Error("A buried job was reserved again")
+	}
+
+	if err := q.Delete(second); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Delete(second); err != ErrNotFound {
+		t.Error("Expected ErrNotFound, got", err)
+	}
+	if stats := q.Stats(); stats.Buried != 1 || stats.Pending() != 0 {
+		t.Error("Unexpected stats:", stats)
+	}
+}
+
+func TestReserveWaits(t *testing.T) {
+	q := NewMemory()
+	reserved := make(chan *Job)
+	go func() {
+		job, _ := q.Reserve()
+		reserved <- job
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	q.Put([]byte("job"), 10, 0, time.Minute)
+	if job := <-reserved; job == nil || string(job.Body) != "job" {
+		t.Error("Expected Reserve to return the new job, got", job)
+	}
+
+	// Delayed jobs wake it up too.
+	q.Put([]byte("delayed"), 10, 20*time.Millisecond, time.Minute)
+	if job := reserve(t, q); string(job.Body) != "delayed" {
+		t.Error("Expected the delayed job, got", string(job.Body))
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Close()
+	}()
+	if _, err := q.Reserve(); err != ErrClosed {
+		t.Error("Expected ErrClosed, got", err)
+	}
+	if _, err := q.Put([]byte("job"), 10, 0, time.Minute); err != ErrClosed {
+		t.Error("Expected ErrClosed, got", err)
+	}
+}
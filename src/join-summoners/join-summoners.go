@@ -6,164 +6,80 @@ package main
  * key that contains a bunch of records with summary stats for a
  * given day.
  *
- * ./join-summoners --date=2014-08-07
+ * ./join-summoners --shards=4
+ *
+ * Which bucket a snapshot goes in, which games it covers and how many
+ * snapshots are kept all come from the request's label (see
+ * snapshot/labels.go).
+ *
+ * Snapshots that already exist for the same set of games only have the
+ * metrics that are new or out of date recomputed (see snapshot/metrics.go);
+ * pass --force to recompute everything.
+ *
+ * Jobs that fail are buried along with the reason, and each job's progress
+ * is recorded so that `cac status` can report on it. The work itself is
+ * done by the joiner package, which cac can also run in-process for
+ * development (see cac -workers).
  */
 
 import (
-	gproto "code.google.com/p/goprotobuf/proto"
-	data "datamodel"
 	"flag"
-	"fmt"
-	beanstalk "github.com/iwanbk/gobeanstalk"
+	"jobqueue"
+	"joiner"
 	"log"
-	"proto"
-	"snapshot"
-	"sort"
-	"sync"
+	"registry"
+	"runtime"
 	"time"
 )
 
-var GR_GROUP sync.WaitGroup
+var FORCE = flag.Bool("force", false, "Recompute every metric, even in snapshots that are up to date")
+var SHARDS = flag.Int("shards", runtime.NumCPU(), "The number of summoner shards to build snapshots in parallel")
+
+// The longest wait between attempts to reach beanstalkd.
+const MAX_RECONNECT_DELAY = time.Minute
 
 /**
- * Goroutine that generates a report for a single summoner ID. It reads
- * through all game records and retains those that were played by the
- * target summoner ID. It then condenses them into a single PlayerSnapshot
- * and saves it to MongoDB.
+ * Connects to beanstalkd, retrying with a growing delay until it works.
  */
-func handle_summoner(request proto.JoinRequest, sid uint32) {
-	games := make([]*data.GameRecord, 0, 10)
-	game_ids := make([]uint64, 0, 10)
-
-	// Keep reading from the channel until nil comes through, then we're
-	// done receiving info. If the summoner this goroutine is responsible
-	// for played in the game, keep it. Otherwise forget about it.
-	retriever := data.LoLRetriever{}
-
-	for _, qd := range request.Quickdates {
-		games_iter := retriever.GetQuickdateGamesIter(qd)
-
-		for games_iter.HasNext() {
-			result := games_iter.Next()
-
-			// Skip this record if the gameid is zero.
-			if result.GameId == 0 {
-				continue
-			}
-
-			keeper := false
-			for _, team := range result.Teams {
-				for _, player := range team.Players {
-					if player.Player.SummonerId == sid {
-						keeper = true
-					}
-				}
-			}
-
-			if keeper {
-				games = append(games, &result)
-				game_ids = append(game_ids, result.GameId)
-			}
+func connect(address string) jobqueue.Queue {
+	delay := time.Second
+	for {
+		log.Println("Establishing connection to beanstalk...")
+		bs, err := jobqueue.DialBeanstalk(address)
+		if err == nil {
+			return bs
 		}
-	}
-
-	// Now all games have been processed. We need to save the set of
-	// games to a PlayerSnapshot for today.
-	snap := data.PlayerSnapshot{}
-
-	snap.CreationTimestamp = (uint64)(time.Now().Unix())
-	snap.SummonerId = (uint32)(sid)
-	snap.GamesList = game_ids
-
-	snap.Stats = make(map[string]data.Metric)
-
-	// Update each snapshot with new computations.
-	for _, comp := range snapshot.Computations {
-		name, metric := comp(snap, games)
-		snap.Stats[name] = metric
-	}
 
-	// Fetch the summoner that this applies to.
-	summoner, exists := retriever.GetSummoner(sid)
-
-	// If the summoner doesn't exist, create it.
-	if !exists {
-		log.Println(fmt.Sprintf("Notice: Couldn't find summoner #%d; creating new instance.", sid))
-		summoner = data.SummonerRecord{}
-		summoner.SummonerId = sid
-	}
-
-	// Append the snapshot.
-	if summoner.Daily == nil {
-		summoner.Daily = make(map[string]*data.PlayerSnapshot)
-	}
-
-	sort.Strings(request.Quickdates)
-	quickdate_label := request.Quickdates[0]
-	// Store the snapshot in the right bucket, depending on the label name.
-	if *request.Label == "daily" {
-		summoner.Daily[quickdate_label] = &snap
-	} else if *request.Label == "weekly" {
-		summoner.Weekly[quickdate_label] = &snap
-	} else if *request.Label == "monthly" {
-		summoner.Monthly[quickdate_label] = &snap
-	} else {
-		log.Fatal("Unknown time label:", request.Label)
+		log.Println("Couldn't connect to beanstalkd:", err)
+		time.Sleep(delay)
+		if delay *= 2; delay > MAX_RECONNECT_DELAY {
+			delay = MAX_RECONNECT_DELAY
+		}
 	}
-
-	// Store the revised summoner.
-	retriever.StoreSummoner(&summoner)
-
-	log.Println(fmt.Sprintf("Saved %s snapshot for summoner #%d on %s",
-		*request.Label,
-		sid,
-		request.Quickdates[0]))
-
-	GR_GROUP.Done()
 }
 
 /**
- * The main function reads in all of the summoner ID's that this process
- * will be responsible for and forks off a separate goroutine for each
- * of them. It then reads all relevant games (see get_games) and passes
- * pointers to each of the goroutines for filtering.
- *
- * Finally, it waits for all goroutines to terminate before terminating
- * itself.
+ * The main function takes requests off of the queue one at a time and
+ * joins each of them (see joiner/join.go): the games for each quickdate
+ * are read once, and the summoners are split across shards to build their
+ * snapshots.
  */
 func main() {
 	flag.Parse()
 
-	log.Println("Establishing connection to beanstalk...")
-	bs, cerr := beanstalk.Dial("localhost:11300")
-
-	if cerr != nil {
-		log.Fatal(cerr)
+	address, rerr := registry.Lookup("beanstalk")
+	if rerr != nil {
+		log.Fatal("Couldn't find beanstalkd in the service registry:", rerr)
 	}
 
+	w := joiner.Worker{Store: &joiner.MongoStore{}, Shards: *SHARDS, Force: *FORCE}
 	for {
-		// Wait until there's a message available.
-		j, err := bs.Reserve()
-		log.Println("Received request", j.ID)
-
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		// Unmarshal the request and kick off a bunch of goroutines, one
-		// per summoner included in the request.
-		request := proto.JoinRequest{}
-		gproto.Unmarshal(j.Body, &request)
-
-		for _, summoner := range request.Summoners {
-			go handle_summoner(request, summoner)
-			GR_GROUP.Add(1)
-		}
-
-		// Wait until all summoners are done before moving on to the next request.
-		GR_GROUP.Wait()
+		w.Queue = connect(address)
 
-		// The task is done; we can delete it from the queue.
-		bs.Delete(j.ID)
+		// Most likely the connection dropped. Any job this worker had
+		// reserved goes back on the queue by itself.
+		err := w.Run()
+		log.Println("Couldn't reserve a request:", err)
+		w.Queue.Close()
 	}
 }
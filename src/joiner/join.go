@@ -0,0 +1,311 @@
+package joiner
+
+/**
+ * Builds summoner snapshots for join requests; this is the work that
+ * join-summoners does, and that cac's -workers do in development (see
+ * worker.go for how jobs are run).
+ *
+ * The join itself: each quickdate's games are read once and routed to the
+ * summoners in the request who played in them; the summoners are then
+ * split into shards that build their snapshots in parallel, and the
+ * summoners that changed are written back with bulk stores.
+ */
+
+import (
+	data "datamodel"
+	"fmt"
+	"log"
+	"proto"
+	"snapshot"
+	"sync"
+	"time"
+)
+
+/**
+ * Where games and summoners come from and go to. The real one is Mongo
+ * (see MongoStore below).
+ */
+type joinStore interface {
+	// Calls VISIT with each game played on the quickdate.
+	each_game(quickdate string, visit func(game *data.GameRecord))
+	get_summoners(sids []uint32) map[uint32]data.SummonerRecord
+	store_summoners(summoners []*data.SummonerRecord) error
+}
+
+// The zero value is ready to use.
+type MongoStore struct {
+	retriever data.LoLRetriever
+}
+
+func (m *MongoStore) each_game(quickdate string, visit func(game *data.GameRecord)) {
+	games_iter := m.retriever.GetQuickdateGamesIter(quickdate)
+
+	for games_iter.HasNext() {
+		result := games_iter.Next()
+
+		// Skip this record if the gameid is zero.
+		if result.GameId != 0 {
+			visit(&result)
+		}
+	}
+}
+
+func (m *MongoStore) get_summoners(sids []uint32) map[uint32]data.SummonerRecord {
+	return m.retriever.GetSummoners(sids)
+}
+
+func (m *MongoStore) store_summoners(summoners []*data.SummonerRecord) error {
+	return m.retriever.StoreSummoners(summoners)
+}
+
+// The most summoners stored at once. Progress is reported after each
+// batch, so a job that dies partway through doesn't need to start over.
+const JOIN_BATCH_SIZE = 50
+
+/**
+ * Builds the snapshots for every summoner in the request and stores the
+ * ones that changed. Returns the number of summoners stored. If FORCE is
+ * set every metric is recomputed, even in snapshots that are up to date.
+ *
+ * If PROGRESS is set it's called with each batch of summoners once
+ * they've been stored, and with the summoners that were already up to
+ * date once everything else has been.
+ */
+func join(store joinStore, request proto.JoinRequest, label snapshot.Label, shards int, force bool, progress func(sids []uint32)) (int, error) {
+	sids := unique_summoners(request.Summoners)
+	games := route_games(store, request.Quickdates, sids)
+	summoners := store.get_summoners(sids)
+
+	if shards < 1 {
+		shards = 1
+	}
+
+	// Summoner i is handled by shard i % shards. Each shard only touches
+	// its own summoners and its own slot in UPDATED, UNCHANGED and
+	// FAILURES.
+	updated := make([][]*data.SummonerRecord, shards)
+	unchanged := make([][]uint32, shards)
+	failures := make([]error, shards)
+	var group sync.WaitGroup
+	for shard := 0; shard < shards; shard++ {
+		group.Add(1)
+		go func(shard int) {
+			defer group.Done()
+
+			// A panic in here would take the whole process down, so it's
+			// turned into an error for the job instead.
+			sid := uint32(0)
+			defer func() {
+				if r := recover(); r != nil {
+					failures[shard] = fmt.Errorf("panic building snapshot for summoner #%d: %v", sid, r)
+				}
+			}()
+
+			for i := shard; i < len(sids); i += shards {
+				sid = sids[i]
+				summoner, exists := summoners[sid]
+
+				// If the summoner doesn't exist, create it.
+				if !exists {
+					log.Println(fmt.Sprintf("Notice: Couldn't find summoner #%d; creating new instance.", sid))
+					summoner = data.SummonerRecord{}
+					summoner.SummonerId = sid
+				}
+
+				if update_summoner(&summoner, label, request.Quickdates, games[sid], force) {
+					updated[shard] = append(updated[shard], &summoner)
+				} else {
+					unchanged[shard] = append(unchanged[shard], sid)
+				}
+			}
+		}(shard)
+	}
+	group.Wait()
+
+	for _, err := range failures {
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	all := make([]*data.SummonerRecord, 0, len(sids))
+	for _, records := range updated {
+		all = append(all, records...)
+	}
+
+	// Store the revised summoners.
+	for start := 0; start < len(all); start += JOIN_BATCH_SIZE {
+		end := start + JOIN_BATCH_SIZE
+		if end > len(all) {
+			end = len(all)
+		}
+
+		if err := store.store_summoners(all[start:end]); err != nil {
+			return start, err
+		}
+		if progress != nil {
+			batch := make([]uint32, 0, end-start)
+			for _, summoner := range all[start:end] {
+				batch = append(batch, summoner.SummonerId)
+			}
+			progress(batch)
+		}
+	}
+
+	if progress != nil {
+		done := make([]uint32, 0)
+		for _, sids := range unchanged {
+			done = append(done, sids...)
+		}
+		if len(done) > 0 {
+			progress(done)
+		}
+	}
+
+	return len(all), nil
+}
+
+/**
+ * Reads each quickdate's games once and hands each game to every
+ * summoner in SIDS that played in it. Summoners who didn't play at all
+ * don't get an entry.
+ */
+func route_games(store joinStore, quickdates []string, sids []uint32) map[uint32][]*data.GameRecord {
+	wanted := make(map[uint32]bool)
+	for _, sid := range sids {
+		wanted[sid] = true
+	}
+
+	games := make(map[uint32][]*data.GameRecord)
+	seen_dates := make(map[string]bool)
+	for _, qd := range quickdates {
+		if seen_dates[qd] {
+			continue
+		}
+		seen_dates[qd] = true
+
+		store.each_game(qd, func(game *data.GameRecord) {
+			// A summoner should only show up once per game, but make sure
+			// the game isn't counted twice if they don't.
+			routed := make(map[uint32]bool)
+			for _, team := range game.Teams {
+				for _, player := range team.Players {
+					if player.Player == nil {
+						continue
+					}
+
+					sid := player.Player.SummonerId
+					if wanted[sid] && !routed[sid] {
+						routed[sid] = true
+						games[sid] = append(games[sid], game)
+					}
+				}
+			}
+		})
+	}
+
+	return games
+}
+
+func unique_summoners(summoners []uint32) []uint32 {
+	seen := make(map[uint32]bool)
+	sids := make([]uint32, 0, len(summoners))
+	for _, sid := range summoners {
+		if !seen[sid] {
+			seen[sid] = true
+			sids = append(sids, sid)
+		}
+	}
+	return sids
+}
+
+/**
+ * Condenses a summoner's games into a single PlayerSnapshot in the
+ * label's bucket. Returns whether the summoner record changed.
+ */
+func update_summoner(summoner *data.SummonerRecord, label snapshot.Label, quickdates []string, games []*data.GameRecord, force bool) bool {
+	sid := summoner.SummonerId
+
+	// Some labels only cover the summoner's most recent games.
+	games = label.Select(sid, games)
+	game_ids := make([]uint64, 0, len(games))
+	for _, game := range games {
+		game_ids = append(game_ids, game.GameId)
+	}
+
+	quickdate_label := label.Key(quickdates)
+	bucket := label.Bucket(summoner)
+
+	// Now all games have been processed. If there's already a snapshot
+	// for the same games then only the metrics that are missing or out of
+	// date need to be computed; otherwise it's a new snapshot.
+	snap := data.PlayerSnapshot{}
+	all := true
+	if existing, exists := bucket[quickdate_label]; exists && existing != nil && same_games(existing.GamesList, game_ids) && !force {
+		snap = *existing
+		all = false
+	}
+
+	snap.SummonerId = sid
+	snap.GamesList = game_ids
+
+	changed := snapshot.Update(&snap, games, all)
+	if len(changed) == 0 {
+		// A snapshot built before its last day was over has now been
+		// checked against every game; record that so cac stops queueing
+		// it.
+		now := time.Now()
+		if !label.UpToDate(*summoner, quickdates) && label.Over(quickdates, now) {
+			snap.VerifiedTimestamp = (uint64)(now.Unix())
+			bucket[quickdate_label] = &snap
+
+			log.Println(fmt.Sprintf("Verified %s snapshot for summoner #%d on %s",
+				label.Name,
+				sid,
+				quickdate_label))
+			return true
+		}
+
+		log.Println(fmt.Sprintf("%s snapshot for summoner #%d on %s is up to date",
+			label.Name,
+			sid,
+			quickdate_label))
+		return false
+	}
+
+	snap.CreationTimestamp = (uint64)(time.Now().Unix())
+	bucket[quickdate_label] = &snap
+
+	// Drop snapshots that have aged out.
+	if removed := label.Trim(summoner); len(removed) > 0 {
+		log.Println(fmt.Sprintf("Removed %d old %s snapshots for summoner #%d", len(removed), label.Name, sid))
+	}
+
+	log.Println(fmt.Sprintf("Built %s snapshot for summoner #%d on %s (%d metrics updated)",
+		label.Name,
+		sid,
+		quickdate_label,
+		len(changed)))
+	return true
+}
+
+/**
+ * Whether two lists contain the same game ID's, in any order.
+ */
+func same_games(first []uint64, second []uint64) bool {
+	if len(first) != len(second) {
+		return false
+	}
+
+	counts := make(map[uint64]int)
+	for _, gid := range first {
+		counts[gid]++
+	}
+	for _, gid := range second {
+		counts[gid]--
+		if counts[gid] < 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,259 @@
+package joiner
+
+import (
+	gproto "code.google.com/p/goprotobuf/proto"
+	data "datamodel"
+	"errors"
+	"fmt"
+	"proto"
+	"reflect"
+	"snapshot"
+	"sort"
+	"sync"
+	"testing"
+)
+
+type fakeStore struct {
+	lock  sync.Mutex
+	games map[string][]data.GameRecord
+	// The number of times each quickdate was read.
+	reads     map[string]int
+	summoners map[uint32]data.SummonerRecord
+	// Each call to store_summoners.
+	stores [][]*data.SummonerRecord
+	err    error
+	// Job progress records; see worker_test.go.
+	jobs map[string]*data.JobRecord
+	// Called before each store, if set.
+	before_store func()
+}
+
+func (f *fakeStore) each_game(quickdate string, visit func(game *data.GameRecord)) {
+	f.reads[quickdate]++
+	for _, game := range f.games[quickdate] {
+		// Every read gets its own copy, like the real thing.
+		copied := game
+		visit(&copied)
+	}
+}
+
+func (f *fakeStore) get_summoners(sids []uint32) map[uint32]data.SummonerRecord {
+	found := make(map[uint32]data.SummonerRecord)
+	for _, sid := range sids {
+		if summoner, exists := f.summoners[sid]; exists {
+			found[sid] = summoner
+		}
+	}
+	return found
+}
+
+func (f *fakeStore) store_summoners(summoners []*data.SummonerRecord) error {
+	if f.before_store != nil {
+		f.before_store()
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.stores = append(f.stores, summoners)
+	if f.err == nil {
+		for _, summoner := range summoners {
+			f.summoners[summoner.SummonerId] = *summoner
+		}
+	}
+	return f.err
+}
+
+func player(sid uint32, champion uint32, kills uint32) *data.PlayerStats {
+	return &data.PlayerStats{IsSet: true, Player: &data.PlayerType{SummonerId: sid}, Champion: champion, Kills: kills, Deaths: 1}
+}
+
+// Ten summoners playing in overlapping games over three days.
+func test_store() *fakeStore {
+	store := &fakeStore{
+		games:     make(map[string][]data.GameRecord),
+		reads:     make(map[string]int),
+		summoners: make(map[uint32]data.SummonerRecord),
+		jobs:      make(map[string]*data.JobRecord),
+	}
+
+	gid := uint64(0)
+	for day := 1; day <= 3; day++ {
+		qd := fmt.Sprintf("2014-09-%02d", day)
+		for first := uint32(1); first <= 6; first++ {
+			gid++
+			store.games[qd] = append(store.games[qd], data.GameRecord{
+				GameId:    gid,
+				Timestamp: gid * 1000,
+				Duration:  1800,
+				Teams: []*data.Team{
+					{Victory: gid%2 == 0, Players: []*data.PlayerStats{player(first, first, uint32(day)), player(first+1, 2, 1)}},
+					{Victory: gid%2 == 1, Players: []*data.PlayerStats{player(first+2, 3, 2), player(first+4, 4, 0)}},
+				},
+			})
+		}
+	}
+
+	store.summoners[1] = data.SummonerRecord{SummonerId: 1, Metadata: data.SummonerMetadata{SummonerName: "Brigado"}}
+	return store
+}
+
+func test_request(label string, summoners ...uint32) proto.JoinRequest {
+	return proto.JoinRequest{
+		Label:      gproto.String(label),
+		Quickdates: []string{"2014-09-01", "2014-09-02", "2014-09-03"},
+		Summoners:  summoners,
+	}
+}
+
+/**
+ * The way join-summoners used to build a snapshot: one summoner at a time,
+ * reading every game for every quickdate.
+ */
+func reference_snapshot(store *fakeStore, request proto.JoinRequest, label snapshot.Label, sid uint32) *data.PlayerSnapshot {
+	games := make([]*data.GameRecord, 0)
+	for _, qd := range request.Quickdates {
+		for _, game := range store.games[qd] {
+			keeper := false
+			for _, team := range game.Teams {
+				for _, player := range team.Players {
+					if player.Player.SummonerId == sid {
+						keeper = true
+					}
+				}
+			}
+
+			if keeper {
+				copied := game
+				games = append(games, &copied)
+			}
+		}
+	}
+	games = label.Select(sid, games)
+
+	snap := data.PlayerSnapshot{SummonerId: sid}
+	for _, game := range games {
+		snap.GamesList = append(snap.GamesList, game.GameId)
+	}
+	snapshot.Update(&snap, games, true)
+	return &snap
+}
+
+func TestJoinMatchesReference(t *testing.T) {
+	for _, name := range []string{"weekly", "last7days", "last20games"} {
+		label, _ := snapshot.LookupLabel(name)
+		store := test_store()
+		request := test_request(name, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+
+		stored, err := join(store, request, label, 3, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Summoners 9 and 10 didn't play, but still get (empty) snapshots.
+		if stored != 10 || len(store.stores) != 1 {
+			t.Error("Expected a single store of ten summoners, got", stored, len(store.stores))
+		}
+
+		// Every day was only read once.
+		for qd, reads := range store.reads {
+			if reads != 1 {
+				t.Error(qd, "was read", reads, "times")
+			}
+		}
+
+		key := label.Key(request.Quickdates)
+		for _, sid := range request.Summoners {
+			summoner := store.summoners[sid]
+			actual := label.Bucket(&summoner)[key]
+			expected := reference_snapshot(test_store(), request, label, sid)
+
+			if actual == nil {
+				t.Fatal("No snapshot for", sid)
+			}
+			actual.CreationTimestamp = 0
+			if !reflect.DeepEqual(actual, expected) {
+				t.Errorf("%s snapshot for %d doesn't match:\n%#v\n%#v", name, sid, actual, expected)
+			}
+		}
+
+		// Existing records are updated rather than replaced.
+		if store.summoners[1].Metadata.SummonerName != "Brigado" {
+			t.Error("Summoner metadata was lost")
+		}
+	}
+}
+
+func TestJoinSkipsUpToDate(t *testing.T) {
+	label, _ := snapshot.LookupLabel("daily")
+	store := test_store()
+	request := test_request("daily", 1, 2)
+	request.Quickdates = []string{"2014-09-02"}
+
+	join(store, request, label, 2, false, nil)
+	if stored, _ := join(store, request, label, 2, false, nil); stored != 0 || len(store.stores) != 1 {
+		t.Error("Nothing should have been stored the second time, got", stored)
+	}
+}
+
+func TestJoinVerifiesEarlySnapshots(t *testing.T) {
+	label, _ := snapshot.LookupLabel("daily")
+	store := test_store()
+	request := test_request("daily", 1)
+	request.Quickdates = []string{"2014-09-02"}
+	join(store, request, label, 1, false, nil)
+
+	// Built before the day was over, so games could have been missed.
+	summoner := store.summoners[1]
+	label.Bucket(&summoner)["2014-09-02"].CreationTimestamp = 1
+	if label.UpToDate(summoner, request.Quickdates) {
+		t.Fatal("Snapshot shouldn't be up to date yet")
+	}
+
+	if stored, _ := join(store, request, label, 1, false, nil); stored != 1 {
+		t.Error("The verified snapshot should have been stored, got", stored)
+	}
+	if summoner := store.summoners[1]; !label.UpToDate(summoner, request.Quickdates) || label.Bucket(&summoner)["2014-09-02"].CreationTimestamp != 1 {
+		t.Error("Snapshot should be verified without being rebuilt:", label.Bucket(&summoner)["2014-09-02"])
+	}
+	if stored, _ := join(store, request, label, 1, false, nil); stored != 0 {
+		t.Error("Nothing should have been stored the third time, got", stored)
+	}
+}
+
+func TestRouteGames(t *testing.T) {
+	store := test_store()
+	// Duplicate dates and summoners are only handled once.
+	games := route_games(store, []string{"2014-09-01", "2014-09-01"}, unique_summoners([]uint32{1, 1, 3, 99}))
+
+	if store.reads["2014-09-01"] != 1 {
+		t.Error("Quickdate was read", store.reads["2014-09-01"], "times")
+	}
+
+	ids := func(sid uint32) []int {
+		found := make([]int, 0)
+		for _, game := range games[sid] {
+			found = append(found, int(game.GameId))
+		}
+		sort.Ints(found)
+		return found
+	}
+	if found := ids(1); !reflect.DeepEqual(found, []int{1}) {
+		t.Error("Unexpected games for 1:", found)
+	}
+	if found := ids(3); !reflect.DeepEqual(found, []int{1, 2, 3}) {
+		t.Error("Unexpected games for 3:", found)
+	}
+	if _, exists := games[99]; exists {
+		t.Error("Summoner 99 didn't play")
+	}
+}
+
+func TestJoinStoreError(t *testing.T) {
+	label, _ := snapshot.LookupLabel("daily")
+	store := test_store()
+	store.err = errors.New("connection reset")
+
+	if _, err := join(store, test_request("daily", 1), label, 1, false, nil); err != store.err {
+		t.Error("Expected the store's error, got", err)
+	}
+}
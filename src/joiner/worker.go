@@ -0,0 +1,249 @@
+package joiner
+
+/**
+ * Running a single job. A reserved job ends up either deleted, once every
+ * summoner in it has been stored, or buried with the reason it failed; it
+ * is never left to time out. While the job runs it's touched regularly
+ * so that the queue doesn't hand it to another worker, and its progress
+ * record (see datamodel/job-struct.go) says which summoners are done. A
+ * job that's delivered again after a crash picks up where it left off.
+ */
+
+import (
+	gproto "code.google.com/p/goprotobuf/proto"
+	data "datamodel"
+	"errors"
+	"fmt"
+	"jobqueue"
+	"log"
+	"proto"
+	"snapshot"
+	"time"
+)
+
+// How often running jobs are touched. This needs to be well under the
+// time-to-run that cac gives jobs.
+const TOUCH_INTERVAL = time.Minute
+
+const BURY_PRIORITY = 10
+
+/**
+ * Job progress records.
+ */
+type jobTracker interface {
+	get_job(id string) (data.JobRecord, bool)
+	start_job(id string) error
+	job_progress(id string, sids []uint32) error
+	touch_job(id string) error
+	finish_job(id string, state string, reason string) error
+}
+
+/**
+ * Everything a worker reads and writes besides the queue. MongoStore is
+ * the real one.
+ */
+type Store interface {
+	joinStore
+	jobTracker
+}
+
+func (m *MongoStore) get_job(id string) (data.JobRecord, bool) {
+	return m.retriever.GetJob(id)
+}
+
+func (m *MongoStore) start_job(id string) error {
+	return m.retriever.StartJob(id)
+}
+
+func (m *MongoStore) job_progress(id string, sids []uint32) error {
+	return m.retriever.AddJobProgress(id, sids)
+}
+
+func (m *MongoStore) touch_job(id string) error {
+	return m.retriever.TouchJob(id)
+}
+
+func (m *MongoStore) finish_job(id string, state string, reason string) error {
+	return m.retriever.FinishJob(id, state, reason)
+}
+
+type Worker struct {
+	Queue jobqueue.Queue
+	Store Store
+	// The number of summoner shards; see join().
+	Shards int
+	// How often running jobs are touched; TOUCH_INTERVAL if it's zero.
+	Touch time.Duration
+	// Recompute every metric, even in snapshots that are up to date.
+	Force bool
+}
+
+/**
+ * Reserves and runs jobs until Reserve fails, and returns its error.
+ */
+func (w *Worker) Run() error {
+	for {
+		// Wait until there's a message available.
+		j, err := w.Queue.Reserve()
+		if err != nil {
+			return err
+		}
+		log.Println("Received request", j.ID)
+
+		w.Process(j)
+	}
+}
+
+/**
+ * Handles a single reserved job from start to finish.
+ */
+func (w *Worker) Process(j *jobqueue.Job) {
+	qid := j.ID
+	request := proto.JoinRequest{}
+	if err := gproto.Unmarshal(j.Body, &request); err != nil {
+		w.bury(qid, "", fmt.Sprintf("couldn't parse request: %v", err))
+		return
+	}
+
+	// Requests queued before jobs had ID's aren't tracked.
+	id := request.GetJobId()
+	if len(id) > 0 {
+		record, exists := w.Store.get_job(id)
+		if !exists {
+			log.Println(fmt.Sprintf("No progress record for job %s; running it untracked", id))
+			id = ""
+		} else if record.State == data.JOB_DONE {
+			// Delivered again after it finished; there's nothing to do.
+			log.Println(fmt.Sprintf("Job %s is already done", id))
+			w.Queue.Delete(qid)
+			return
+		} else {
+			request.Summoners = remaining_summoners(request.Summoners, record.Done)
+		}
+	}
+
+	label, known := snapshot.LookupLabel(request.GetLabel())
+	if !known {
+		w.bury(qid, id, fmt.Sprintf("unknown label '%s'", request.GetLabel()))
+		return
+	}
+	if len(request.Quickdates) == 0 {
+		w.bury(qid, id, "no quickdates")
+		return
+	}
+
+	if len(id) > 0 {
+		if err := w.Store.start_job(id); err != nil {
+			log.Println(fmt.Sprintf("Couldn't mark job %s as started: %v", id, err))
+		}
+	}
+
+	stop := w.heartbeat(qid, id)
+	stored, err := w.run(request, label, id)
+	stop()
+
+	if err != nil {
+		w.bury(qid, id, err.Error())
+		return
+	}
+
+	if len(id) > 0 {
+		if err := w.Store.finish_job(id, data.JOB_DONE, ""); err != nil {
+			log.Println(fmt.Sprintf("Couldn't mark job %s as done: %v", id, err))
+		}
+	}
+	log.Println(fmt.Sprintf("Saved %d of %d summoners for request %d", stored, len(request.Summoners), qid))
+
+	// The task is done; we can delete it from the queue.
+	w.Queue.Delete(qid)
+}
+
+/**
+ * Runs the join, turning a panic into an error so that the job gets
+ * buried rather than taking the worker down with it.
+ */
+func (w *Worker) run(request proto.JoinRequest, label snapshot.Label, id string) (stored int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New(fmt.Sprint("panic: ", r))
+		}
+	}()
+
+	return join(w.Store, request, label, w.Shards, w.Force, func(sids []uint32) {
+		if len(id) == 0 {
+			return
+		}
+		if err := w.Store.job_progress(id, sids); err != nil {
+			log.Println(fmt.Sprintf("Couldn't record progress for job %s: %v", id, err))
+		}
+	})
+}
+
+/**
+ * Touches the job every so often until the returned function is called.
+ * Nothing else uses the queue while the heartbeat is running.
+ */
+func (w *Worker) heartbeat(qid uint64, id string) func() {
+	stopped := make(chan bool)
+	done := make(chan bool)
+
+	go func() {
+		defer close(done)
+		interval := w.Touch
+		if interval == 0 {
+			interval = TOUCH_INTERVAL
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stopped:
+				return
+			case <-ticker.C:
+				if err := w.Queue.Touch(qid); err != nil {
+					log.Println(fmt.Sprintf("Couldn't touch request %d: %v", qid, err))
+				}
+				if len(id) > 0 {
+					w.Store.touch_job(id)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(stopped)
+		<-done
+	}
+}
+
+func (w *Worker) bury(qid uint64, id string, reason string) {
+	log.Println(fmt.Sprintf("Burying request %d: %s", qid, reason))
+
+	if err := w.Queue.Bury(qid, BURY_PRIORITY); err != nil {
+		log.Println(fmt.Sprintf("Couldn't bury request %d: %v", qid, err))
+	}
+	if len(id) > 0 {
+		if err := w.Store.finish_job(id, data.JOB_FAILED, reason); err != nil {
+			log.Println(fmt.Sprintf("Couldn't mark job %s as failed: %v", id, err))
+		}
+	}
+}
+
+/**
+ * The summoners in a job that haven't been stored yet.
+ */
+func remaining_summoners(summoners []uint32, done []uint32) []uint32 {
+	finished := make(map[uint32]bool)
+	for _, sid := range done {
+		finished[sid] = true
+	}
+
+	remaining := make([]uint32, 0, len(summoners))
+	for _, sid := range summoners {
+		if !finished[sid] {
+			remaining = append(remaining, sid)
+		}
+	}
+	return remaining
+}
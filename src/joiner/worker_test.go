@@ -0,0 +1,256 @@
+package joiner
+
+import (
+	gproto "code.google.com/p/goprotobuf/proto"
+	data "datamodel"
+	"errors"
+	"jobqueue"
+	"proto"
+	"snapshot"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A metric that can't handle games without a duration, for making
+// snapshots panic.
+func init() {
+	snapshot.Register(snapshot.MetricDefinition{
+		Name:    "test_duration",
+		Kind:    data.METRIC_SCALAR,
+		Version: 1,
+		Compute: func(snap data.PlayerSnapshot, games []*data.GameRecord) data.Metric {
+			for _, game := range games {
+				if game.Duration == 0 {
+					panic("game without a duration")
+				}
+			}
+			return data.NoDataMetric(data.METRIC_SCALAR)
+		},
+	})
+}
+
+// Counts touches, which the queue itself doesn't keep track of.
+type touchCounter struct {
+	*jobqueue.Memory
+	lock    sync.Mutex
+	touched int
+}
+
+func (q *touchCounter) Touch(id uint64) error {
+	q.lock.Lock()
+	q.touched++
+	q.lock.Unlock()
+	return q.Memory.Touch(id)
+}
+
+func (f *fakeStore) get_job(id string) (data.JobRecord, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	job, exists := f.jobs[id]
+	if !exists {
+		return data.JobRecord{}, false
+	}
+	return *job, true
+}
+
+func (f *fakeStore) start_job(id string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.jobs[id].State = data.JOB_RUNNING
+	f.jobs[id].Attempts++
+	return nil
+}
+
+func (f *fakeStore) job_progress(id string, sids []uint32) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.jobs[id].Done = append(f.jobs[id].Done, sids...)
+	return nil
+}
+
+func (f *fakeStore) touch_job(id string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.jobs[id].Heartbeat++
+	return nil
+}
+
+func (f *fakeStore) finish_job(id string, state string, reason string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.jobs[id].State = state
+	f.jobs[id].Reason = reason
+	return nil
+}
+
+func (f *fakeStore) jobs_done() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	done := 0
+	for _, job := range f.jobs {
+		if job.State == data.JOB_DONE {
+			done++
+		}
+	}
+	return done
+}
+
+/**
+ * A worker with a single tracked job for summoners 1 to 4.
+ */
+func test_worker() (*Worker, *touchCounter, *fakeStore, []byte) {
+	queue := &touchCounter{Memory: jobqueue.NewMemory()}
+	store := test_store()
+	store.jobs["job"] = &data.JobRecord{JobId: "job", State: data.JOB_PENDING}
+
+	request := test_request("weekly", 1, 2, 3, 4)
+	request.JobId = gproto.String("job")
+	body, _ := gproto.Marshal(&request)
+
+	return &Worker{Queue: queue, Store: store, Shards: 2, Touch: time.Hour}, queue, store, body
+}
+
+/**
+ * Puts BODY on the queue, reserves it and runs it.
+ */
+func process(t *testing.T, w *Worker, queue *touchCounter, body []byte) {
+	queue.Put(body, 10, 0, time.Minute)
+	j, err := queue.Reserve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Process(j)
+}
+
+func TestProcessJob(t *testing.T) {
+	w, queue, store, body := test_worker()
+	process(t, w, queue, body)
+
+	if stats := queue.Stats(); stats.Pending() != 0 || stats.Buried != 0 {
+		t.Error("Expected the job to be deleted, got", stats)
+	}
+
+	job := store.jobs["job"]
+	if job.State != data.JOB_DONE || job.Attempts != 1 || len(job.Done) != 4 {
+		t.Error("Unexpected job record:", job)
+	}
+}
+
+func TestProcessJobResumes(t *testing.T) {
+	w, queue, store, body := test_worker()
+	// A previous attempt stored the first two summoners and then died.
+	store.jobs["job"].State = data.JOB_RUNNING
+	store.jobs["job"].Done = []uint32{1, 2}
+
+	process(t, w, queue, body)
+	if len(store.stores) != 1 || len(store.stores[0]) != 2 {
+		t.Fatal("Expected only the two remaining summoners to be stored, got", store.stores)
+	}
+	for _, summoner := range store.stores[0] {
+		if summoner.SummonerId < 3 {
+			t.Error("Summoner", summoner.SummonerId, "was already done")
+		}
+	}
+
+	// Once the job's done, delivering it again doesn't do anything.
+	process(t, w, queue, body)
+	if stats := queue.Stats(); len(store.stores) != 1 || stats.Pending() != 0 || stats.Buried != 0 {
+		t.Error("A finished job was run again")
+	}
+}
+
+func TestProcessJobBuries(t *testing.T) {
+	w, queue, store, body := test_worker()
+	store.err = errors.New("connection reset")
+
+	process(t, w, queue, body)
+	if stats := queue.Stats(); stats.Pending() != 0 || stats.Buried != 1 {
+		t.Error("Expected the job to be buried, got", stats)
+	}
+	if job := store.jobs["job"]; job.State != data.JOB_FAILED || job.Reason != "connection reset" {
+		t.Error("Unexpected job record:", job)
+	}
+
+	// Panics are failures too.
+	w, queue, store, body = test_worker()
+	store.before_store = func() { panic("oops") }
+	process(t, w, queue, body)
+	if queue.Stats().Buried != 1 || store.jobs["job"].Reason != "panic: oops" {
+		t.Error("Expected the panic to bury the job, got", store.jobs["job"])
+	}
+
+	// Including panics while snapshots are being built.
+	w, queue, store, body = test_worker()
+	store.games["2014-09-01"][0].Duration = 0
+	process(t, w, queue, body)
+	if job := store.jobs["job"]; queue.Stats().Buried != 1 || !strings.HasPrefix(job.Reason, "panic building snapshot for summoner #") || len(store.stores) != 0 {
+		t.Error("Expected a panicking metric to bury the job, got", job)
+	}
+
+	// So are requests that can't be handled.
+	w, queue, store, _ = test_worker()
+	request := test_request("fortnightly", 1)
+	request.JobId = gproto.String("job")
+	unknown, _ := gproto.Marshal(&request)
+	process(t, w, queue, unknown)
+	if queue.Stats().Buried != 1 || store.jobs["job"].State != data.JOB_FAILED || len(store.stores) != 0 {
+		t.Error("Expected a job with an unknown label to be buried, got", store.jobs["job"])
+	}
+
+	process(t, w, queue, []byte("not a request"))
+	if queue.Stats().Buried != 2 {
+		t.Error("Expected a request that can't be parsed to be buried")
+	}
+}
+
+func TestProcessJobTouches(t *testing.T) {
+	w, queue, store, body := test_worker()
+	w.Touch = time.Millisecond
+	store.before_store = func() { time.Sleep(20 * time.Millisecond) }
+
+	process(t, w, queue, body)
+	if queue.touched == 0 || store.jobs["job"].Heartbeat == 0 {
+		t.Error("A long job was never touched")
+	}
+}
+
+func TestUntrackedJob(t *testing.T) {
+	w, queue, store, _ := test_worker()
+	body, _ := gproto.Marshal(&proto.JoinRequest{
+		Label:      gproto.String("daily"),
+		Quickdates: []string{"2014-09-01"},
+		Summoners:  []uint32{1},
+	})
+
+	process(t, w, queue, body)
+	if queue.Stats().Pending() != 0 || store.jobs["job"].State != data.JOB_PENDING {
+		t.Error("Requests without a job ID should still be handled")
+	}
+}
+
+func TestRun(t *testing.T) {
+	w, queue, store, body := test_worker()
+	queue.Put(body, 10, 0, time.Minute)
+
+	finished := make(chan error)
+	go func() {
+		finished <- w.Run()
+	}()
+
+	// Run keeps going until the queue is closed.
+	for store.jobs_done() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	queue.Close()
+	if err := <-finished; err != jobqueue.ErrClosed {
+		t.Error("Expected ErrClosed, got", err)
+	}
+}
@@ -0,0 +1,71 @@
+package libcleo
+
+// LiveSummaries is the runtime form of the game summaries side-store (see
+// summaries.proto). The PCGL only knows which games a champion won or
+// lost; the summaries hold the per-game details like duration and each
+// player's kills, deaths and assists. They're stored in columns so that
+// scanning a single field over a large set of games stays cheap.
+
+import (
+	"proto"
+)
+
+type LiveSummaries struct {
+	Columns *proto.PackedGameSummaries
+}
+
+// Has returns whether the side-store has a summary for the game.
+func (s *LiveSummaries) Has(id GameId) bool {
+	return int(id) < len(s.Columns.Timestamp) && s.Columns.Timestamp[id] != 0
+}
+
+// Players returns the range of entries in the player columns that belong
+// to the game.
+func (s *LiveSummaries) Players(id GameId) (int, int) {
+	if int(id)+1 >= len(s.Columns.PlayerStart) {
+		return 0, 0
+	}
+	return int(s.Columns.PlayerStart[id]), int(s.Columns.PlayerStart[id+1])
+}
+
+// SummaryPlayer holds the stats for a single player when building the
+// side-store.
+type SummaryPlayer struct {
+	Champion proto.ChampionType
+	Victory  bool
+	HasStats bool
+	Kills    uint32
+	Deaths   uint32
+	Assists  uint32
+	Gold     uint32
+	Minions  uint32
+}
+
+// Append adds the next game to the side-store. Games have to be added in
+// order of their compact ID's; use AppendMissing for gaps.
+func (s *LiveSummaries) Append(timestamp uint64, duration uint32, players []SummaryPlayer) {
+	c := s.Columns
+	if len(c.PlayerStart) == 0 {
+		c.PlayerStart = append(c.PlayerStart, 0)
+	}
+
+	c.Timestamp = append(c.Timestamp, timestamp)
+	c.Duration = append(c.Duration, duration)
+
+	for _, player := range players {
+		c.Champion = append(c.Champion, player.Champion)
+		c.Victory = append(c.Victory, player.Victory)
+		c.HasStats = append(c.HasStats, player.HasStats)
+		c.Kills = append(c.Kills, player.Kills)
+		c.Deaths = append(c.Deaths, player.Deaths)
+		c.Assists = append(c.Assists, player.Assists)
+		c.Gold = append(c.Gold, player.Gold)
+		c.Minions = append(c.Minions, player.Minions)
+	}
+	c.PlayerStart = append(c.PlayerStart, uint32(len(c.Champion)))
+}
+
+// AppendMissing adds an empty entry for a game without a summary.
+func (s *LiveSummaries) AppendMissing() {
+	s.Append(0, 0, nil)
+}
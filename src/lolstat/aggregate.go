@@ -0,0 +1,213 @@
+package main
+
+// Aggregate queries compute summary statistics (mean, median, percentiles)
+// of a per-game value over the set of games that a team or text query
+// matches, like "the average game length when Zed beats Ahri" or "Jinx's
+// KDA in games with Thresh". The PCGL only stores game ID's, so the values
+// come from the game summaries side-store.
+
+import (
+	gproto "code.google.com/p/goprotobuf/proto"
+	"container/list"
+	"errors"
+	"fmt"
+	"libcleo"
+	"log"
+	"math"
+	"proto"
+	"sort"
+)
+
+// Reported when a query doesn't ask for any.
+var DEFAULT_PERCENTILES = []float64{25, 75, 90}
+
+var ErrNoSummaries = errors.New("game summaries aren't loaded")
+
+func aggregate(id string, pcgl *libcleo.LivePCGL, summaries *libcleo.LiveSummaries, qry *proto.GameQuery, trace *tracer) *proto.QueryResponse {
+	if summaries == nil {
+		return &proto.QueryResponse{Successful: gproto.Bool(false), Error: gproto.String(ErrNoSummaries.Error())}
+	}
+	if err := check_percentiles(qry.GetAggregate().GetPercentiles()); err != nil {
+		return &proto.QueryResponse{Successful: gproto.Bool(false), Error: gproto.String(err.Error())}
+	}
+
+	var matching, available []libcleo.GameId
+	if len(qry.GetText()) > 0 {
+		var err error
+		if matching, available, _, err = evaluate_text(id, pcgl, summaries, qry.GetText()); err != nil {
+			return &proto.QueryResponse{Successful: gproto.Bool(false), Error: gproto.String(err.Error())}
+		}
+	} else {
+		matching_list, available_list := evaluate(id, pcgl, qry.Winners, qry.Losers, trace)
+		matching, available = to_slice(matching_list), to_slice(available_list)
+	}
+
+	trace.sample(matching)
+
+	games := matching
+	if qry.GetAggregate().GetIncludeLosses() {
+		games = available
+	}
+
+	values := make([]float64, 0, len(games))
+	missing := uint32(0)
+	m := 0
+
+	for _, game := range games {
+		// Both lists are sorted, so this tracks whether the allies won
+		// the game without a search.
+		for m < len(matching) && matching[m] < game {
+			m += 1
+		}
+		allies_won := m < len(matching) && matching[m] == game
+
+		value, ok := metric_value(summaries, game, allies_won, qry.GetAggregate())
+		if !ok {
+			missing += 1
+			continue
+		}
+		values = append(values, value)
+	}
+
+	log.Println(fmt.Sprintf("%s: aggregated %d games (%d missing)", id, len(values), missing))
+
+	percentiles := qry.GetAggregate().GetPercentiles()
+	if len(percentiles) == 0 {
+		percentiles = DEFAULT_PERCENTILES
+	}
+
+	result := summarize(values, percentiles)
+	result.Missing = gproto.Uint32(missing)
+
+	return &proto.QueryResponse{
+		Successful: gproto.Bool(true),
+		Results: &proto.QueryResponse_Results{
+			Available: gproto.Uint32(uint32(len(available))),
+			Matching:  gproto.Uint32(uint32(len(matching))),
+			Total:     gproto.Uint32(uint32(len(pcgl.All))),
+		},
+		Aggregate: result,
+	}
+}
+
+// Metric_value reads the requested metric for a single game. Player metrics
+// come from the requested champion's player if there is one, or are summed
+// over the allied team otherwise. Returns false if the side-store doesn't
+// have what's needed.
+func metric_value(summaries *libcleo.LiveSummaries, game libcleo.GameId, allies_won bool, agg *proto.GameQuery_Aggregate) (float64, bool) {
+	if !summaries.Has(game) {
+		return 0, false
+	}
+
+	c := summaries.Columns
+	if agg.GetMetric() == proto.GameQuery_Aggregate_DURATION {
+		return float64(c.Duration[game]), true
+	}
+
+	var kills, deaths, assists, gold, minions uint32
+	found := false
+
+	start, end := summaries.Players(game)
+	for i := start; i < end; i++ {
+		if agg.Champion != nil {
+			if c.Champion[i] != agg.GetChampion() {
+				continue
+			}
+		} else if c.Victory[i] != allies_won {
+			continue
+		}
+
+		// Partial team totals would be misleading, so a single player
+		// without stats rules out the whole game.
+		if !c.HasStats[i] {
+			return 0, false
+		}
+
+		kills += c.Kills[i]
+		deaths += c.Deaths[i]
+		assists += c.Assists[i]
+		gold += c.Gold[i]
+		minions += c.Minions[i]
+		found = true
+	}
+
+	if !found {
+		return 0, false
+	}
+
+	switch agg.GetMetric() {
+	case proto.GameQuery_Aggregate_KILLS:
+		return float64(kills), true
+	case proto.GameQuery_Aggregate_DEATHS:
+		return float64(deaths), true
+	case proto.GameQuery_Aggregate_ASSISTS:
+		return float64(assists), true
+	case proto.GameQuery_Aggregate_KDA:
+		return float64(kills+assists) / math.Max(float64(deaths), 1), true
+	case proto.GameQuery_Aggregate_GOLD:
+		return float64(gold), true
+	case proto.GameQuery_Aggregate_MINIONS:
+		return float64(minions), true
+	}
+
+	return 0, false
+}
+
+// Summarize computes the summary statistics for a set of values. Values is
+// sorted in place.
+func summarize(values []float64, percentiles []float64) *proto.QueryResponse_AggregateResult {
+	result := proto.QueryResponse_AggregateResult{Count: gproto.Uint32(uint32(len(values)))}
+	if len(values) == 0 {
+		return &result
+	}
+
+	sort.Float64s(values)
+
+	sum := 0.0
+	for _, value := range values {
+		sum += value
+	}
+
+	result.Mean = gproto.Float64(sum / float64(len(values)))
+	result.Median = gproto.Float64(percentile(values, 50))
+	result.Min = gproto.Float64(values[0])
+	result.Max = gproto.Float64(values[len(values)-1])
+
+	for _, p := range percentiles {
+		result.Percentiles = append(result.Percentiles, &proto.QueryResponse_AggregateResult_Percentile{
+			Percentile: gproto.Float64(p),
+			Value:      gproto.Float64(percentile(values, p)),
+		})
+	}
+
+	return &result
+}
+
+// Check_percentiles makes sure every requested percentile is a number
+// between 0 and 100.
+func check_percentiles(percentiles []float64) error {
+	for _, p := range percentiles {
+		if math.IsNaN(p) || p < 0 || p > 100 {
+			return fmt.Errorf("percentile %v isn't between 0 and 100", p)
+		}
+	}
+	return nil
+}
+
+// Percentile interpolates linearly between the two closest ranks of the
+// sorted values. P has to be in [0, 100]; see check_percentiles.
+func percentile(sorted []float64, p float64) float64 {
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+func to_slice(games *list.List) []libcleo.GameId {
+	ids := make([]libcleo.GameId, 0, games.Len())
+	for e := games.Front(); e != nil; e = e.Next() {
+		ids = append(ids, e.Value.(libcleo.GameId))
+	}
+	return ids
+}
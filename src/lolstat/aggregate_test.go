@@ -0,0 +1,86 @@
+package main
+
+import gproto "code.google.com/p/goprotobuf/proto"
+import "libcleo"
+import "math"
+import "proto"
+import "testing"
+
+func TestPercentile(t *testing.T) {
+	values := []float64{4, 1, 3, 2}
+	result := summarize(values, []float64{25, 100})
+
+	if result.GetCount() != 4 || !close_to(result.GetMean(), 2.5) || !close_to(result.GetMedian(), 2.5) {
+		t.Error("Unexpected summary:", result)
+	}
+	if !close_to(result.Percentiles[0].GetValue(), 1.75) || !close_to(result.Percentiles[1].GetValue(), 4) {
+		t.Error("Unexpected percentiles:", result.Percentiles)
+	}
+
+	if empty := summarize(nil, []float64{50}); empty.GetCount() != 0 || empty.Mean != nil {
+		t.Error("Empty summaries shouldn't have values:", empty)
+	}
+}
+
+// Summaries for the recommend_pcgl() games. Ahri and Zed won games 0-2,
+// Zed's stats are missing from game 1 and game 3 has no summary.
+func aggregate_summaries() *libcleo.LiveSummaries {
+	summaries := libcleo.LiveSummaries{Columns: &proto.PackedGameSummaries{}}
+
+	for i, duration := range []uint32{1200, 1800, 2400} {
+		summaries.Append(1409529600000, duration, []libcleo.SummaryPlayer{
+			{Champion: proto.ChampionType_AHRI, Victory: true, HasStats: true, Kills: uint32(i + 1), Deaths: 1, Assists: 2},
+			{Champion: proto.ChampionType_ZED, Victory: true, HasStats: i != 1, Kills: 5},
+		})
+	}
+	summaries.AppendMissing()
+
+	return &summaries
+}
+
+func TestAggregate(t *testing.T) {
+	pcgl := recommend_pcgl()
+	summaries := aggregate_summaries()
+
+	qry := proto.GameQuery{
+		Winners:   []proto.ChampionType{proto.ChampionType_AHRI},
+		Type:      proto.GameQuery_AGGREGATE.Enum(),
+		Aggregate: &proto.GameQuery_Aggregate{Metric: proto.GameQuery_Aggregate_DURATION.Enum()},
+	}
+
+	response := aggregate("test", pcgl, summaries, &qry, nil)
+	if !close_to(response.GetAggregate().GetMean(), 1800) {
+		t.Error("Unexpected duration:", response.GetAggregate())
+	}
+
+	// Ahri's own KDA over every game she played that has a summary.
+	qry.Aggregate = &proto.GameQuery_Aggregate{
+		Metric:        proto.GameQuery_Aggregate_KDA.Enum(),
+		Champion:      proto.ChampionType_AHRI.Enum(),
+		IncludeLosses: gproto.Bool(true),
+	}
+	response = aggregate("test", pcgl, summaries, &qry, nil)
+	if response.GetAggregate().GetCount() != 3 || !close_to(response.GetAggregate().GetMedian(), 4) {
+		t.Error("Unexpected KDA:", response.GetAggregate())
+	}
+
+	// Team totals skip games where a teammate's stats are missing.
+	qry.Aggregate = &proto.GameQuery_Aggregate{Metric: proto.GameQuery_Aggregate_KILLS.Enum()}
+	response = aggregate("test", pcgl, summaries, &qry, nil)
+	if response.GetAggregate().GetCount() != 2 || response.GetAggregate().GetMissing() != 1 || !close_to(response.GetAggregate().GetMean(), 7) {
+		t.Error("Unexpected kills:", response.GetAggregate())
+	}
+
+	// Percentiles have to make sense.
+	for _, p := range []float64{math.NaN(), -1, 101, math.Inf(1)} {
+		qry.Aggregate.Percentiles = []float64{50, p}
+		if response = aggregate("test", pcgl, summaries, &qry, nil); response.GetSuccessful() || len(response.GetError()) == 0 {
+			t.Error("Expected percentile", p, "to be rejected, got", response)
+		}
+	}
+	qry.Aggregate.Percentiles = nil
+
+	if response = aggregate("test", pcgl, nil, &qry, nil); response.GetSuccessful() {
+		t.Error("Aggregates should fail without summaries")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+// The result cache keeps the responses to recent queries so that popular
+// team compositions (and the frontend's exploratory subqueries, which are
+// the same on every page load) don't re-intersect lists from scratch. It's
+// a plain LRU keyed by a canonical form of the query. Every entry belongs
+// to a single index generation and the whole cache is dropped when a newer
+// generation comes along. Queries that started on an older generation and
+// finish after a reload neither read nor fill the cache.
+
+import (
+	gproto "code.google.com/p/goprotobuf/proto"
+	"container/list"
+	"expvar"
+	"proto"
+	"sort"
+	"sync"
+)
+
+const DEFAULT_CACHE_SIZE = 10000
+
+var cache_hits = expvar.NewInt("cache_hits")
+var cache_misses = expvar.NewInt("cache_misses")
+var cache_entries = expvar.NewInt("cache_entries")
+
+type cacheEntry struct {
+	key      string
+	response *proto.QueryResponse
+}
+
+type resultCache struct {
+	capacity   int
+	generation int64
+
+	// Most recently used entries are at the front.
+	entries *list.List
+	lookup  map[string]*list.Element
+	lock    sync.Mutex
+}
+
+func new_cache(capacity int) *resultCache {
+	return &resultCache{
+		capacity: capacity,
+		entries:  list.New(),
+		lookup:   make(map[string]*list.Element),
+	}
+}
+
+// Get returns a copy of the cached response for KEY, if there is one from
+// the current GENERATION.
+func (c *resultCache) get(key string, generation int64) (*proto.QueryResponse, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.check_generation(generation) {
+		cache_misses.Add(1)
+		return nil, false
+	}
+
+	element, exists := c.lookup[key]
+	if !exists {
+		cache_misses.Add(1)
+		return nil, false
+	}
+
+	cache_hits.Add(1)
+	c.entries.MoveToFront(element)
+	return gproto.Clone(element.Value.(*cacheEntry).response).(*proto.QueryResponse), true
+}
+
+func (c *resultCache) put(key string, generation int64, response *proto.QueryResponse) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.check_generation(generation) {
+		return
+	}
+
+	if element, exists := c.lookup[key]; exists {
+		element.Value.(*cacheEntry).response = response
+		c.entries.MoveToFront(element)
+		return
+	}
+
+	c.lookup[key] = c.entries.PushFront(&cacheEntry{key: key, response: response})
+	for c.entries.Len() > c.capacity {
+		oldest := c.entries.Back()
+		delete(c.lookup, oldest.Value.(*cacheEntry).key)
+		c.entries.Remove(oldest)
+	}
+
+	cache_entries.Set(int64(c.entries.Len()))
+}
+
+// Check_generation drops every entry if the indices have been reloaded
+// since they were cached, and returns false if GENERATION is older than
+// the cached one. The lock must be held.
+func (c *resultCache) check_generation(generation int64) bool {
+	if generation < c.generation {
+		return false
+	}
+	if generation == c.generation {
+		return true
+	}
+
+	c.generation = generation
+	c.entries.Init()
+	c.lookup = make(map[string]*list.Element)
+	cache_entries.Set(0)
+	return true
+}
+
+// Cache_key returns the canonical form of a query: the same query with the
+// request ID's removed and the teams sorted, so that "ahri,zed" and
+// "zed,ahri" share an entry. Debug queries aren't cached, since their
+// traces describe a specific evaluation.
+func cache_key(qry *proto.GameQuery) (string, bool) {
+	if qry.GetDebug() {
+		return "", false
+	}
+
+	canonical := gproto.Clone(qry).(*proto.GameQuery)
+	canonical.QueryProcess = nil
+	canonical.QueryId = nil
+
+	sort.Sort(championList(canonical.Winners))
+	sort.Sort(championList(canonical.Losers))
+	sort.Sort(championList(canonical.Bans))
+
+	key, err := gproto.Marshal(canonical)
+	if err != nil {
+		return "", false
+	}
+	return string(key), true
+}
+
+type championList []proto.ChampionType
+
+func (x championList) Len() int {
+	return len(x)
+}
+
+func (x championList) Less(i, j int) bool {
+	return x[i] < x[j]
+}
+
+func (x championList) Swap(i, j int) {
+	x[i], x[j] = x[j], x[i]
+}
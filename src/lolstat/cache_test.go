@@ -0,0 +1,84 @@
+package main
+
+import gproto "code.google.com/p/goprotobuf/proto"
+import "proto"
+import "testing"
+
+func TestCacheKey(t *testing.T) {
+	first := proto.GameQuery{
+		QueryId: gproto.Uint64(1),
+		Winners: []proto.ChampionType{proto.ChampionType_ZED, proto.ChampionType_AHRI},
+	}
+	second := proto.GameQuery{
+		QueryId: gproto.Uint64(2),
+		Winners: []proto.ChampionType{proto.ChampionType_AHRI, proto.ChampionType_ZED},
+	}
+
+	first_key, _ := cache_key(&first)
+	second_key, _ := cache_key(&second)
+	if first_key != second_key {
+		t.Error("Team order and query ID's shouldn't change the key")
+	}
+	// The original query shouldn't be reordered.
+	if first.Winners[0] != proto.ChampionType_ZED {
+		t.Error("Cache_key modified the query")
+	}
+
+	second.Losers = second.Winners
+	second.Winners = nil
+	if second_key, _ = cache_key(&second); first_key == second_key {
+		t.Error("Winners and losers should have different keys")
+	}
+
+	if _, cacheable := cache_key(&proto.GameQuery{Debug: gproto.Bool(true)}); cacheable {
+		t.Error("Debug queries shouldn't be cached")
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	cache := new_cache(2)
+	hits, misses := cache_hits.Value(), cache_misses.Value()
+
+	cache.put("a", 1, &proto.QueryResponse{Successful: gproto.Bool(true)})
+	cache.put("b", 1, &proto.QueryResponse{})
+	// Using "a" makes "b" the least recently used entry.
+	if response, hit := cache.get("a", 1); !hit || !response.GetSuccessful() {
+		t.Error("Expected a hit for a")
+	}
+	cache.put("c", 1, &proto.QueryResponse{})
+
+	if _, hit := cache.get("b", 1); hit {
+		t.Error("Expected b to be evicted")
+	}
+	if _, hit := cache.get("c", 1); !hit {
+		t.Error("Expected a hit for c")
+	}
+
+	// A new generation drops everything.
+	if _, hit := cache.get("a", 2); hit {
+		t.Error("Expected a miss after the generation changed")
+	}
+
+	if cache_hits.Value()-hits != 2 || cache_misses.Value()-misses != 2 {
+		t.Error("Unexpected counters:", cache_hits.Value()-hits, cache_misses.Value()-misses)
+	}
+}
+
+// A query that started before a reload and finishes after it doesn't
+// touch the new generation's entries.
+func TestCacheOldGeneration(t *testing.T) {
+	cache := new_cache(10)
+	cache.put("a", 2, &proto.QueryResponse{Successful: gproto.Bool(true)})
+
+	cache.put("b", 1, &proto.QueryResponse{})
+	if _, hit := cache.get("b", 1); hit {
+		t.Error("Expected an old generation's response not to be cached")
+	}
+	if _, hit := cache.get("a", 1); hit {
+		t.Error("Expected a miss for an old generation")
+	}
+
+	if response, hit := cache.get("a", 2); !hit || !response.GetSuccessful() {
+		t.Error("The old generation's put dropped the new generation's entries")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+// The draft advisor suggests picks and bans during champion select. Given
+// the allied picks, enemy picks and bans made so far, every open champion
+// is scored by combining historical win rates:
+//
+//   - the champion's own win rate,
+//   - its win rate alongside each allied pick (synergy), and
+//   - its win rate against each enemy pick (counters).
+//
+// Pairwise records are often thin, so each one is shrunk toward the
+// champion's individual win rate by DRAFT_PRIOR_WEIGHT pseudo-games. A pair
+// with only a handful of games barely moves the score, while a pair with
+// hundreds of games dominates it. The individual rate is shrunk toward 50%
+// in the same way.
+
+import (
+	gproto "code.google.com/p/goprotobuf/proto"
+	"fmt"
+	"libcleo"
+	"log"
+	"math"
+	"proto"
+	"sort"
+)
+
+// The number of pseudo-games used when backing off from a pairwise rate to
+// an individual rate (or from an individual rate to 50%).
+const DRAFT_PRIOR_WEIGHT = 20.0
+
+// The number of picks and bans returned if the query doesn't specify a
+// limit.
+const DEFAULT_DRAFT_LIMIT = 10
+
+type draftRecord struct {
+	wins  uint32
+	games uint32
+}
+
+// Smoothed returns the win rate of the record after adding
+// DRAFT_PRIOR_WEIGHT pseudo-games that were won at a rate of PRIOR.
+func (r draftRecord) smoothed(prior float64) float64 {
+	return (float64(r.wins) + prior*DRAFT_PRIOR_WEIGHT) / (float64(r.games) + DRAFT_PRIOR_WEIGHT)
+}
+
+type draftList []*proto.QueryResponse_ExploratoryChampionSubquery
+
+func (x draftList) Len() int {
+	return len(x)
+}
+
+func (x draftList) Less(i, j int) bool {
+	return x[i].GetScore() > x[j].GetScore()
+}
+
+func (x draftList) Swap(i, j int) {
+	x[i], x[j] = x[j], x[i]
+}
+
+// Draft returns a ranked list of suggested picks for the winning (allied)
+// team and a ranked list of suggested bans. Bans are the champions that
+// would most help the enemy team if they picked them next. Both lists
+// include every candidate; handle_query applies the query's limit.
+func draft(id string, pcgl *libcleo.LivePCGL, qry *proto.GameQuery) ([]*proto.QueryResponse_ExploratoryChampionSubquery, []*proto.QueryResponse_ExploratoryChampionSubquery) {
+	// Picked and banned champions aren't available to either team.
+	taken := make(map[proto.ChampionType]bool)
+	for _, champion := range qry.Winners {
+		taken[champion] = true
+	}
+	for _, champion := range qry.Losers {
+		taken[champion] = true
+	}
+	for _, champion := range qry.Bans {
+		taken[champion] = true
+	}
+
+	log.Println(fmt.Sprintf("%s: scoring %d open champions", id, len(pcgl.Champions)-len(taken)))
+	picks := make(draftList, 0, len(pcgl.Champions))
+	bans := make(draftList, 0, len(pcgl.Champions))
+
+	for champion := range pcgl.Champions {
+		if taken[champion] || champion == proto.ChampionType_UNKNOWN {
+			continue
+		}
+
+		picks = append(picks, draft_candidate(pcgl, champion, qry.Winners, qry.Losers))
+		bans = append(bans, draft_candidate(pcgl, champion, qry.Losers, qry.Winners))
+	}
+
+	sort.Stable(picks)
+	sort.Stable(bans)
+
+	return picks, bans
+}
+
+// Draft_candidate scores CHAMPION as an addition to ALLIES when playing
+// against ENEMIES. The reported results are the champion's individual
+// record; the score is the estimated win probability of the combination.
+func draft_candidate(pcgl *libcleo.LivePCGL, champion proto.ChampionType, allies []proto.ChampionType, enemies []proto.ChampionType) *proto.QueryResponse_ExploratoryChampionSubquery {
+	record := pcgl.Champions[champion]
+	individual := draftRecord{
+		wins:  uint32(len(record.Winning)),
+		games: uint32(len(record.Winning) + len(record.Losing)),
+	}
+	base := individual.smoothed(0.5)
+
+	// Pairwise rates are combined as adjustments to the log-odds of the
+	// individual rate. A pair that has fully backed off to the individual
+	// rate contributes nothing.
+	score := logit(base)
+
+	for _, ally := range allies {
+		pair := draftRecord{}
+		pair.wins = count_overlap(record.Winning, pcgl.Champions[ally].Winning)
+		pair.games = pair.wins + count_overlap(record.Losing, pcgl.Champions[ally].Losing)
+
+		score += logit(pair.smoothed(base)) - logit(base)
+	}
+
+	for _, enemy := range enemies {
+		pair := draftRecord{}
+		pair.wins = count_overlap(record.Winning, pcgl.Champions[enemy].Losing)
+		pair.games = pair.wins + count_overlap(record.Losing, pcgl.Champions[enemy].Winning)
+
+		score += logit(pair.smoothed(base)) - logit(base)
+	}
+
+	return &proto.QueryResponse_ExploratoryChampionSubquery{
+		Explorer: champion.Enum(),
+		Valid:    gproto.Bool(true),
+		Results: &proto.QueryResponse_Results{
+			Matching:  gproto.Uint32(individual.wins),
+			Available: gproto.Uint32(individual.games),
+			Total:     gproto.Uint32(uint32(len(pcgl.All))),
+		},
+		Stats: compute_statistics(individual.wins, individual.games, 0, 0),
+		Score: gproto.Float64(logistic(score)),
+	}
+}
+
+// Count_overlap returns the number of game ID's that appear in both FIRST
+// and SECOND. Assumes that both lists are ordered.
+func count_overlap(first []libcleo.GameId, second []libcleo.GameId) uint32 {
+	var count uint32 = 0
+	i, j := 0, 0
+
+	for i < len(first) && j < len(second) {
+		if first[i] < second[j] {
+			i += 1
+		} else if first[i] > second[j] {
+			j += 1
+		} else {
+			count += 1
+			i += 1
+			j += 1
+		}
+	}
+
+	return count
+}
+
+func logit(p float64) float64 {
+	return math.Log(p / (1 - p))
+}
+
+func logistic(x float64) float64 {
+	return 1 / (1 + math.Exp(-x))
+}
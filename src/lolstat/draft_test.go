@@ -0,0 +1,60 @@
+package main
+
+import "libcleo"
+import "proto"
+import "testing"
+
+func TestCountOverlap(t *testing.T) {
+	a := []libcleo.GameId{1, 3, 5, 7, 9}
+	b := []libcleo.GameId{2, 3, 4, 5, 10}
+
+	if count_overlap(a, b) != 2 {
+		t.Fail()
+	}
+
+	if count_overlap(a, []libcleo.GameId{}) != 0 {
+		t.Fail()
+	}
+}
+
+func TestDraftExcludesTaken(t *testing.T) {
+	qry := proto.GameQuery{
+		Winners: []proto.ChampionType{proto.ChampionType_AHRI},
+		Losers:  []proto.ChampionType{proto.ChampionType_THRESH},
+		Bans:    []proto.ChampionType{proto.ChampionType_JINX},
+		Type:    proto.GameQuery_DRAFT.Enum(),
+	}
+
+	picks, bans := draft("test", recommend_pcgl(), &qry)
+
+	if len(picks) != 1 || picks[0].GetExplorer() != proto.ChampionType_ZED {
+		t.Error("Zed is the only open champion to pick.")
+	}
+
+	if len(bans) != 1 || bans[0].GetExplorer() != proto.ChampionType_ZED {
+		t.Error("Zed is the only open champion to ban.")
+	}
+}
+
+func TestDraftBackoff(t *testing.T) {
+	pcgl := recommend_pcgl()
+
+	// With no picks the score is just the smoothed individual rate.
+	alone := draft_candidate(pcgl, proto.ChampionType_ZED, nil, nil)
+	if !close_to(alone.GetScore(), (3+0.5*DRAFT_PRIOR_WEIGHT)/(4+DRAFT_PRIOR_WEIGHT)) {
+		t.Error("Unexpected individual score:", alone.GetScore())
+	}
+
+	// Zed has never played with Thresh so the pair backs off completely
+	// to the individual rate.
+	unpaired := draft_candidate(pcgl, proto.ChampionType_ZED, []proto.ChampionType{proto.ChampionType_THRESH}, nil)
+	if !close_to(unpaired.GetScore(), alone.GetScore()) {
+		t.Error("Empty pairs should back off to the individual rate.")
+	}
+
+	// Zed has won 3 of 4 alongside Ahri, which should nudge the score up.
+	paired := draft_candidate(pcgl, proto.ChampionType_ZED, []proto.ChampionType{proto.ChampionType_AHRI}, nil)
+	if paired.GetScore() <= alone.GetScore() {
+		t.Error("A winning pair should improve the score.")
+	}
+}
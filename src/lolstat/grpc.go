@@ -0,0 +1,86 @@
+package main
+
+// Lolstat also serves team and recommendation queries as a gRPC service
+// (see the Query service in query.proto) so that other tools can call it
+// without speaking the framed protocol. Both share the same handlers and
+// result cache.
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log"
+	"net"
+	"proto"
+	"query"
+	"switchboard"
+)
+
+const GRPC_PORT = 14102
+
+type queryService struct {
+	set   *indexSet
+	cache *resultCache
+}
+
+func serve_grpc(port int, set *indexSet, cache *resultCache, security switchboard.Security) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.Println("Couldn't open gRPC port:", err)
+		return
+	}
+
+	log.Println(fmt.Sprintf("gRPC query service listening on port %d", port))
+	log.Println("gRPC server stopped:", new_grpc_server(set, cache, security).Serve(listener))
+}
+
+// The service is secured the same way as the switchboard port.
+func new_grpc_server(set *indexSet, cache *resultCache, security switchboard.Security) *grpc.Server {
+	server := grpc.NewServer(security.GRPCServerOptions()...)
+	proto.RegisterQueryServer(server, &queryService{set: set, cache: cache})
+
+	return server
+}
+
+func (s *queryService) Team(ctx context.Context, qry *proto.GameQuery) (*proto.QueryResponse, error) {
+	if qry.GetType() != proto.GameQuery_TEAM {
+		return nil, status.Errorf(codes.InvalidArgument, "Team only answers TEAM queries, not %s", qry.GetType())
+	}
+	return s.run(ctx, qry)
+}
+
+func (s *queryService) Recommend(ctx context.Context, qry *proto.GameQuery) (*proto.QueryResponse, error) {
+	if qry.GetType() != proto.GameQuery_RECOMMEND_ALLY && qry.GetType() != proto.GameQuery_RECOMMEND_ENEMY {
+		return nil, status.Errorf(codes.InvalidArgument, "Recommend only answers RECOMMEND_ALLY and RECOMMEND_ENEMY queries, not %s", qry.GetType())
+	}
+	return s.run(ctx, qry)
+}
+
+// Run answers the query unless the caller's deadline passes first. The
+// evaluation itself can't be interrupted, so it finishes (and is cached)
+// in the background.
+func (s *queryService) run(ctx context.Context, qry *proto.GameQuery) (*proto.QueryResponse, error) {
+	for _, champion := range append(qry.Winners, qry.Losers...) {
+		if champion == proto.ChampionType_UNKNOWN {
+			return nil, status.Error(codes.InvalidArgument, "unknown champion in query")
+		}
+	}
+
+	id := query.GetQueryId(*qry)
+	done := make(chan *proto.QueryResponse, 1)
+	go func() {
+		done <- answer(id, s.set, s.cache, qry)
+	}()
+
+	select {
+	case response := <-done:
+		if !response.GetSuccessful() {
+			return nil, status.Error(codes.Internal, response.GetError())
+		}
+		return response, nil
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import "context"
+import "google.golang.org/grpc"
+import "google.golang.org/grpc/codes"
+import "google.golang.org/grpc/status"
+import "net"
+import "proto"
+import "switchboard"
+import "testing"
+import "time"
+
+func TestQueryService(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set := indexSet{current: &indices{pcgl: recommend_pcgl(), generation: 1}}
+	server := new_grpc_server(&set, new_cache(10), switchboard.Security{})
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client := proto.NewQueryClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	response, err := client.Team(ctx, &proto.GameQuery{Winners: []proto.ChampionType{proto.ChampionType_AHRI}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.GetResults().GetMatching() != 3 || response.GetResults().GetAvailable() != 4 {
+		t.Error("Unexpected results:", response.GetResults())
+	}
+
+	// Recommend only takes recommendation queries.
+	_, err = client.Recommend(ctx, &proto.GameQuery{Winners: []proto.ChampionType{proto.ChampionType_AHRI}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Error("Expected an invalid argument error, got", err)
+	}
+
+	response, err = client.Recommend(ctx, &proto.GameQuery{
+		Winners: []proto.ChampionType{proto.ChampionType_AHRI},
+		Type:    proto.GameQuery_RECOMMEND_ALLY.Enum(),
+	})
+	if err != nil || find_candidate(response.NextChamp, proto.ChampionType_JINX) == nil {
+		t.Error("Expected Jinx to be recommended:", response, err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+// Indices holds everything lolstat searches: the PCGL and the optional
+// side-stores that packer writes next to it. When packer writes a new PCGL
+// the whole set is reloaded and swapped in at once, and its generation
+// changes so that anything derived from the old set (like cached results)
+// can be thrown away.
+
+import (
+	"libcleo"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often to check for a new PCGL.
+const RELOAD_INTERVAL = 1 * time.Minute
+
+type indices struct {
+	pcgl      *libcleo.LivePCGL
+	summaries *libcleo.LiveSummaries
+	game_ids  []uint64
+
+	// The modification time of the PCGL file, in nanoseconds.
+	generation int64
+}
+
+type indexSet struct {
+	current *indices
+	lock    sync.RWMutex
+
+	pcgl_file      string
+	summaries_file string
+	game_ids_file  string
+}
+
+func load_indices(pcgl_file string, summaries_file string, game_ids_file string) *indexSet {
+	set := indexSet{pcgl_file: pcgl_file, summaries_file: summaries_file, game_ids_file: game_ids_file}
+	current, err := set.read(pcgl_generation(pcgl_file))
+	if err != nil {
+		log.Fatal("Couldn't read PCGL from ", pcgl_file, ": ", err)
+	}
+	set.current = current
+
+	return &set
+}
+
+// Get returns the current indices. Callers should use the same indices for
+// the whole of a query.
+func (s *indexSet) get() *indices {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.current
+}
+
+func (s *indexSet) read(generation int64) (*indices, error) {
+	pcgl, err := read_pcgl(s.pcgl_file)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Read", len(pcgl.All), "events into PCGL.")
+
+	return &indices{
+		pcgl:       &pcgl,
+		summaries:  read_summaries(s.summaries_file),
+		game_ids:   read_game_ids(s.game_ids_file),
+		generation: generation,
+	}, nil
+}
+
+// Watch reloads the indices whenever the PCGL file changes. It never
+// returns.
+func (s *indexSet) watch(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		s.reload()
+	}
+}
+
+// Reload swaps in a fresh set of indices if the PCGL file has changed. If
+// the new PCGL can't be read (it may be missing or only partly written)
+// the current indices are kept and the reload is tried again next time.
+func (s *indexSet) reload() {
+	generation := pcgl_generation(s.pcgl_file)
+	if generation == 0 || generation == s.get().generation {
+		return
+	}
+
+	log.Println("PCGL has changed; reloading indices.")
+	next, err := s.read(generation)
+	if err != nil {
+		log.Println("Couldn't reload PCGL; keeping the current indices:", err)
+		return
+	}
+
+	s.lock.Lock()
+	s.current = next
+	s.lock.Unlock()
+}
+
+func pcgl_generation(filename string) int64 {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return 0
+	}
+	return info.ModTime().UnixNano()
+}
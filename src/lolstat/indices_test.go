@@ -0,0 +1,52 @@
+package main
+
+import gproto "code.google.com/p/goprotobuf/proto"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "proto"
+import "testing"
+import "time"
+
+func write_test_pcgl(t *testing.T, filename string, games []uint32) {
+	bytes, _ := gproto.Marshal(&proto.PackedChampionGameList{All: games})
+	if err := ioutil.WriteFile(filename, bytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadKeepsIndicesOnBadPCGL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lolstat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pcgl_file := filepath.Join(dir, "latest.pcgl")
+	write_test_pcgl(t, pcgl_file, []uint32{3, 1, 2})
+	set := load_indices(pcgl_file, filepath.Join(dir, "missing"), filepath.Join(dir, "missing"))
+	old := set.get()
+
+	// A partly written PCGL shouldn't replace the current one.
+	ioutil.WriteFile(pcgl_file, []byte{0xff, 0xff}, 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(pcgl_file, later, later)
+	set.reload()
+	if set.get() != old {
+		t.Error("Unreadable PCGL replaced the current indices")
+	}
+
+	// Neither should a missing one.
+	os.Remove(pcgl_file)
+	set.reload()
+	if set.get() != old {
+		t.Error("Missing PCGL replaced the current indices")
+	}
+
+	write_test_pcgl(t, pcgl_file, []uint32{4, 5})
+	os.Chtimes(pcgl_file, later, later)
+	set.reload()
+	if len(set.get().pcgl.All) != 2 {
+		t.Error("Expected the new PCGL to be loaded, got", len(set.get().pcgl.All), "games")
+	}
+}
@@ -3,6 +3,8 @@ package main
 // Lolstat is the core binary that evaluates and responds to queries. It can
 // currently handle queries of the form:
 //   "How many games has [champion combination X] won against [champion combination Y]?
+//   "Which champion should be added to [champion combination X] when playing
+//    against [champion combination Y]?"
 //
 // It depends on the fetcher and packer binaries to prepare indices that it
 // can use for fast searching, and only stores the game ID for each game
@@ -13,16 +15,27 @@ package main
 import (
 	gproto "code.google.com/p/goprotobuf/proto"
 	"container/list"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"libcleo"
 	"log"
+	"net/http"
 	"proto"
 	"query"
+	"query/plugins"
+	"registry"
 	"sort"
-	//	"time"
+	"switchboard"
+	"time"
 )
 
+var SECURITY = switchboard.RegisterSecurityFlags()
+var ADVERTISE = flag.String("advertise", "", "Address to register in the service registry; defaults to this host")
+var SHARD = flag.Uint("shard", 0, "Shard number to register in the service registry")
+
+const PORT = 14002
+
 // Build a wrapper data structure that can be used to enable fast sorting
 // on the game ID's.
 type idList []libcleo.GameId
@@ -65,14 +78,16 @@ func get_sorted(x []uint32) []libcleo.GameId {
 
 // Reads in a ChampionGameList file that can be used for searching.
 // TODO: Retrieve the file.
-func read_pcgl(filename string) libcleo.LivePCGL {
+func read_pcgl(filename string) (libcleo.LivePCGL, error) {
 	packed_pcgl := proto.PackedChampionGameList{}
 	// Unmarshal data.
 	bytes, err := ioutil.ReadFile(filename)
 	if err != nil {
-		log.Fatal("Couldn't read PCGL;", filename, "does not exist.")
+		return libcleo.LivePCGL{}, err
+	}
+	if err := gproto.Unmarshal(bytes, &packed_pcgl); err != nil {
+		return libcleo.LivePCGL{}, err
 	}
-	gproto.Unmarshal(bytes, &packed_pcgl)
 
 	// Convert to format that's faster to search through.
 	pcgl := libcleo.LivePCGL{}
@@ -94,35 +109,104 @@ func read_pcgl(filename string) libcleo.LivePCGL {
 
 	pcgl.All = get_sorted(packed_pcgl.All)
 
-	return pcgl
+	return pcgl, nil
+}
+
+// Reads in the game summaries side-store written by packer. The side-store
+// is optional; if it's missing then nil is returned and queries that need
+// per-game details (aggregates and some text query filters) will fail.
+func read_summaries(filename string) *libcleo.LiveSummaries {
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Println("No game summaries loaded;", filename, "does not exist.")
+		return nil
+	}
+
+	packed := proto.PackedGameSummaries{}
+	if err := gproto.Unmarshal(bytes, &packed); err != nil {
+		log.Println("Couldn't parse game summaries:", err)
+		return nil
+	}
+
+	return &libcleo.LiveSummaries{Columns: &packed}
+}
+
+// Reads in packer's map from compact game ID's to Riot game ID's, which is
+// only used to label the sample games in debug traces. Returns nil if the
+// file is missing.
+func read_game_ids(filename string) []uint64 {
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Println("No game ID map loaded;", filename, "does not exist.")
+		return nil
+	}
+
+	packed := proto.PackedGameIdMap{}
+	if err := gproto.Unmarshal(bytes, &packed); err != nil {
+		log.Println("Couldn't parse game ID map:", err)
+		return nil
+	}
+
+	return packed.RiotId
 }
 
 func main() {
 	// Query connection manager
 	qm := query.QueryManager{}
 
+	flag.Parse()
+	security, serr := SECURITY.Server()
+	if serr != nil {
+		log.Fatal("Invalid switchboard security settings:", serr)
+	}
+	qm.Security = security
+
+	client_security, cserr := SECURITY.Client()
+	if cserr != nil {
+		log.Fatal("Invalid switchboard security settings:", cserr)
+	}
+	reg, rerr := registry.OpenDefault(client_security)
+	if rerr != nil {
+		log.Fatal("Couldn't open the service registry:", rerr)
+	}
+
 	// Inputs
-	query_requests := make(chan query.GameQueryRequest, 100)
-	// Outputs
-	query_completions := make(chan query.GameQueryResponse, 100)
+	query_requests := make(chan query.QueryRequest, 100)
 
 	fmt.Printf("Loading gamelog.\n")
-	pcgl := read_pcgl("latest.pcgl")
-	log.Println("Read", len(pcgl.All), "events into PCGL.")
+	set := load_indices("latest.pcgl", "latest.summaries", "latest.gidmap")
+	go set.watch(RELOAD_INTERVAL)
+
+	cache := new_cache(DEFAULT_CACHE_SIZE)
+
+	// Cache hit and miss counters are published on /debug/vars.
+	go func() {
+		log.Println("Couldn't serve debug variables:", http.ListenAndServe(":14012", nil))
+	}()
 
-	qm.Connect(14002)
+	go serve_grpc(GRPC_PORT, set, cache, security)
+
+	qm.Connect(PORT)
+
+	// Announce this backend, along with the generation of the PCGL it's
+	// serving, once it's ready for queries.
+	service := registry.Service{Name: "lolstat", Address: *ADVERTISE, Shard: uint32(*SHARD)}
+	if len(service.Address) == 0 {
+		service.Address = registry.LocalAddress(PORT)
+	}
+	registry.Announce(reg, service, func() int64 { return set.get().generation }, 0)
 
 	// Kick off some goroutines that can handle queries.
 	for i := 0; i < 1; i++ {
-		go query_handler(query_requests, &pcgl, query_completions, &qm)
+		go query_handler(query_requests, set, cache, &qm)
 	}
 
 	// Infinitely loop through queries as they come in. Currently this
 	// will only handle one at a time but should be trivial to parallelize
 	// once the time is right.
-	for {
-		query_requests <- qm.Await()
-		//		time.Sleep(1 * time.Second)
+	requests := qm.Requests(func() gproto.Message { return &proto.GameQuery{} })
+	for request := range requests {
+		query_requests <- request
 	}
 }
 
@@ -130,6 +214,81 @@ func main() {
 // the provided query. They are run as goroutines and can handle a single
 // query at a time. They each make a copy of the lists in the CGl so that
 // all queries are independent and unaffected by others.
+func query_handler(input chan query.QueryRequest, set *indexSet, cache *resultCache, qm *query.QueryManager) {
+	for {
+		request := <-input
+		qry := request.Query.(*proto.GameQuery)
+		id := query.GetQueryId(*qry)
+
+		response := answer(id, set, cache, qry)
+
+		log.Println(fmt.Sprintf("%s: response generated", id))
+		qm.Reply(&request, response)
+	}
+}
+
+// Answer responds to a single query, from the cache if possible. It's
+// shared by the framed protocol and the gRPC service.
+func answer(id string, set *indexSet, cache *resultCache, qry *proto.GameQuery) *proto.QueryResponse {
+	// Use the same indices for the whole query even if they're reloaded
+	// part way through.
+	idx := set.get()
+
+	key, cacheable := cache_key(qry)
+	if cacheable {
+		if response, hit := cache.get(key, idx.generation); hit {
+			log.Println(fmt.Sprintf("%s: cached response", id))
+			return response
+		}
+	}
+
+	log.Println(fmt.Sprintf("%s: handling query", id))
+	trace := new_tracer(qry)
+	response := handle_query(id, idx.pcgl, idx.summaries, qry, trace)
+	response.Trace = trace.finish(idx.game_ids)
+
+	// Failed queries aren't cached since they may be caused by a missing
+	// side-store that'll be there after the next reload.
+	if cacheable && response.GetSuccessful() {
+		cache.put(key, idx.generation, response)
+	}
+
+	return response
+}
+
+// Handle_query dispatches a query to the right evaluator for its type.
+func handle_query(id string, pcgl *libcleo.LivePCGL, summaries *libcleo.LiveSummaries, qry *proto.GameQuery, trace *tracer) *proto.QueryResponse {
+	switch qry.GetType() {
+	case proto.GameQuery_DRAFT:
+		// Draft queries suggest both picks and bans.
+		picks, bans := draft(id, pcgl, qry)
+
+		return &proto.QueryResponse{
+			Successful:    gproto.Bool(true),
+			NextChamp:     limit_candidates(picks, qry, DEFAULT_DRAFT_LIMIT),
+			SuggestedBans: limit_candidates(bans, qry, DEFAULT_DRAFT_LIMIT),
+			Candidates:    gproto.Uint32(uint32(len(picks))),
+		}
+	case proto.GameQuery_RECOMMEND_ALLY, proto.GameQuery_RECOMMEND_ENEMY:
+		// Recommendation queries rank candidate champions instead of
+		// evaluating a single team.
+		candidates := recommend(id, pcgl, qry)
+
+		return &proto.QueryResponse{
+			Successful: gproto.Bool(true),
+			NextChamp:  limit_candidates(candidates, qry, DEFAULT_RECOMMENDATION_LIMIT),
+			Candidates: gproto.Uint32(uint32(len(candidates))),
+		}
+	case proto.GameQuery_TEXT:
+		return text_query(id, pcgl, summaries, qry, trace)
+	case proto.GameQuery_AGGREGATE:
+		return aggregate(id, pcgl, summaries, qry, trace)
+	}
+
+	return team_query(id, pcgl, qry, trace)
+}
+
+// Team queries count how often one team has beaten another.
 //
 // Two values need to be computed: the MATCHING games and the ELIGIBLE games.
 //   - Matching games are those that have all of the requested players
@@ -150,110 +309,200 @@ func main() {
 // Then do the same thing for all losing champions (find the winning set
 // for them). Then merge the output from the MATCHING set with the lists
 // from the ELIGIBLE set to produce the final ELIGIBLE set.
-func query_handler(input chan query.GameQueryRequest, pcgl *libcleo.LivePCGL, output chan query.GameQueryResponse, qm *query.QueryManager) {
-	for {
-		request := <-input
+func team_query(id string, pcgl *libcleo.LivePCGL, qry *proto.GameQuery, trace *tracer) *proto.QueryResponse {
+	matching_gamelist, eligible_gamelist := evaluate(id, pcgl, qry.Winners, qry.Losers, trace)
+	trace.sample_list(matching_gamelist)
+
+	// The baseline is the same set of allies with no enemy constraint.
+	// If there aren't any enemies then the query is its own baseline.
+	baseline_matching, baseline_eligible := matching_gamelist, eligible_gamelist
+	if len(qry.Winners) > 0 && len(qry.Losers) > 0 {
+		log.Println(fmt.Sprintf("%s: computing baseline", id))
+		trace.set_phase("baseline")
+		baseline_matching, baseline_eligible = evaluate(id, pcgl, qry.Winners, nil, trace)
+	}
 
-		log.Println(fmt.Sprintf("%s: handling query", request.Id))
-		// Eligible gamelist contains all games that match, irrespective of team.
-		log.Println(fmt.Sprintf("%s: copying data", request.Id))
-
-		// TODO: this can be done asynchronously pretty easily.
-		eligible_wins_gamelist := list.New()
-		// Eligible losses are games that the Winners could have won but
-		// didn't.
-		eligible_losses_gamelist := list.New()
-		// Matching gamelist contains all games that match, respective of team.
-		matching_gamelist := list.New()
-
-		// Keep track of which lists have been initialized and which haven't.
-		mgl_initialized := false
-		ewgl_initialized := false
-		elgl_initialized := false
-
-		// Get every game that all of the Winner champions won.
-		// Get every game that all of the Winner champions lost.
-		// Counting winners only, ratio is: won / (won + lost)
-		log.Println(fmt.Sprintf("%s: winning overlap", request.Id))
-		if len(request.Query.Winners) > 0 {
-			// Merge all game ID's, first matching the winning parameters.
-			for _, champion := range request.Query.Winners {
-				// Either initialize the matching game list or measure the
-				// overlap if its already been initialized.
-				if !mgl_initialized {
-					mgl_initialized = initialize(matching_gamelist, pcgl.Champions[champion].Winning)
-				} else {
-					// Update the matching gamelist to include just the overlap between these two lists.
-					overlap(matching_gamelist, pcgl.Champions[champion].Winning)
-				}
+	response := proto.QueryResponse{
+		Successful: gproto.Bool(true),
+		Results: &proto.QueryResponse_Results{
+			Available: gproto.Uint32(uint32(eligible_gamelist.Len())),
+			Matching:  gproto.Uint32(uint32(matching_gamelist.Len())),
+			Total:     gproto.Uint32(uint32(len(pcgl.All))),
+		},
+	}
 
-				// Either initialize the eligible losses game list or measure
-				// the overlap if its already been initialized.
-				if !elgl_initialized {
-					elgl_initialized = initialize(eligible_losses_gamelist, pcgl.Champions[champion].Losing)
-				} else {
-					overlap(eligible_losses_gamelist, pcgl.Champions[champion].Losing)
-				}
-			}
-		} else {
-			eligible_losses_gamelist.Init()
-		}
+	// Statistics are only meaningful when there's a team to measure.
+	if len(qry.Winners) > 0 {
+		response.Stats = compute_statistics(
+			uint32(matching_gamelist.Len()),
+			uint32(eligible_gamelist.Len()),
+			uint32(baseline_matching.Len()),
+			uint32(baseline_eligible.Len()))
+	}
 
-		// If losers are specified we need to consider them as well.
-		// Get every game that all of the games that all Losers lost.
-		// Get every game that all of the games that all Losers won.
-		log.Println(fmt.Sprintf("%s: losing overlap data", request.Id))
-		// Then match all losers.
-		if len(request.Query.Losers) > 0 {
-			for _, champion := range request.Query.Losers {
-				if !mgl_initialized {
-					mgl_initialized = initialize(matching_gamelist, pcgl.Champions[champion].Losing)
-				} else {
-					overlap(matching_gamelist, pcgl.Champions[champion].Losing)
-				}
+	return &response
+}
 
-				if !ewgl_initialized {
-					ewgl_initialized = initialize(eligible_wins_gamelist, pcgl.Champions[champion].Winning)
-				} else {
-					overlap(eligible_wins_gamelist, pcgl.Champions[champion].Winning)
-				}
+// Text queries are written in the query language. They're parsed and
+// compiled into posting list operations that run directly on the PCGL.
+func text_query(id string, pcgl *libcleo.LivePCGL, summaries *libcleo.LiveSummaries, qry *proto.GameQuery, trace *tracer) *proto.QueryResponse {
+	matching, available, sided, err := evaluate_text(id, pcgl, summaries, qry.GetText())
+	if err != nil {
+		return &proto.QueryResponse{Successful: gproto.Bool(false), Error: gproto.String(err.Error())}
+	}
+	trace.sample(matching)
+
+	response := proto.QueryResponse{
+		Successful: gproto.Bool(true),
+		Results: &proto.QueryResponse_Results{
+			Available: gproto.Uint32(uint32(len(available))),
+			Matching:  gproto.Uint32(uint32(len(matching))),
+			Total:     gproto.Uint32(uint32(len(pcgl.All))),
+		},
+	}
+
+	// Queries that don't refer to either team match every game they're
+	// available in, so there's no win rate.
+	if sided {
+		response.Stats = compute_statistics(uint32(len(matching)), uint32(len(available)), 0, 0)
+	}
+
+	return &response
+}
+
+// Evaluate_text runs a query language query and returns the MATCHING and
+// AVAILABLE game lists, both sorted, and whether the query refers to a
+// team (see query.CompiledQuery).
+func evaluate_text(id string, pcgl *libcleo.LivePCGL, summaries *libcleo.LiveSummaries, text string) ([]libcleo.GameId, []libcleo.GameId, bool, error) {
+	parsed, err := query.Parse(text)
+	if err != nil {
+		log.Println(fmt.Sprintf("%s: parse error: %s", id, err))
+		return nil, nil, false, err
+	}
+
+	compiled, err := query.Compile(parsed)
+	if err != nil {
+		log.Println(fmt.Sprintf("%s: planning error: %s", id, err))
+		return nil, nil, false, err
+	}
+
+	index := plugins.LeagueIndex{PCGL: pcgl}
+	if summaries != nil {
+		index.Summaries = plugins.ColumnSummaries(summaries)
+	}
+
+	log.Println(fmt.Sprintf("%s: evaluating %s", id, compiled.Matching))
+	matching, available, err := compiled.Evaluate(&index)
+	if err != nil {
+		log.Println(fmt.Sprintf("%s: evaluation error: %s", id, err))
+		return nil, nil, false, err
+	}
+
+	return matching, available, compiled.Sided, nil
+}
+
+// Evaluate computes the MATCHING and ELIGIBLE game lists (see query_handler)
+// for a single combination of winners and losers.
+func evaluate(id string, pcgl *libcleo.LivePCGL, winners []proto.ChampionType, losers []proto.ChampionType, trace *tracer) (*list.List, *list.List) {
+	// Eligible gamelist contains all games that match, irrespective of team.
+	log.Println(fmt.Sprintf("%s: copying data", id))
+
+	// TODO: this can be done asynchronously pretty easily.
+	eligible_wins_gamelist := list.New()
+	// Eligible losses are games that the Winners could have won but
+	// didn't.
+	eligible_losses_gamelist := list.New()
+	// Matching gamelist contains all games that match, respective of team.
+	matching_gamelist := list.New()
+
+	// Keep track of which lists have been initialized and which haven't.
+	mgl_initialized := false
+	ewgl_initialized := false
+	elgl_initialized := false
+
+	// Get every game that all of the Winner champions won.
+	// Get every game that all of the Winner champions lost.
+	// Counting winners only, ratio is: won / (won + lost)
+	log.Println(fmt.Sprintf("%s: winning overlap", id))
+	if len(winners) > 0 {
+		// Merge all game ID's, first matching the winning parameters.
+		for _, champion := range winners {
+			// Either initialize the matching game list or measure the
+			// overlap if its already been initialized.
+			began, before := time.Now(), matching_gamelist.Len()
+			if !mgl_initialized {
+				mgl_initialized = initialize(matching_gamelist, pcgl.Champions[champion].Winning)
+				trace.step("initialize", "matching", champion.Enum(), "winning", before, len(pcgl.Champions[champion].Winning), matching_gamelist.Len(), began)
+			} else {
+				// Update the matching gamelist to include just the overlap between these two lists.
+				overlap(matching_gamelist, pcgl.Champions[champion].Winning)
+				trace.step("overlap", "matching", champion.Enum(), "winning", before, len(pcgl.Champions[champion].Winning), matching_gamelist.Len(), began)
 			}
-		} else {
-			eligible_wins_gamelist.Init()
 
+			// Either initialize the eligible losses game list or measure
+			// the overlap if its already been initialized.
+			began, before = time.Now(), eligible_losses_gamelist.Len()
+			if !elgl_initialized {
+				elgl_initialized = initialize(eligible_losses_gamelist, pcgl.Champions[champion].Losing)
+				trace.step("initialize", "eligible losses", champion.Enum(), "losing", before, len(pcgl.Champions[champion].Losing), eligible_losses_gamelist.Len(), began)
+			} else {
+				overlap(eligible_losses_gamelist, pcgl.Champions[champion].Losing)
+				trace.step("overlap", "eligible losses", champion.Enum(), "losing", before, len(pcgl.Champions[champion].Losing), eligible_losses_gamelist.Len(), began)
+			}
+		}
+	} else {
+		eligible_losses_gamelist.Init()
+	}
+
+	// If losers are specified we need to consider them as well.
+	// Get every game that all of the games that all Losers lost.
+	// Get every game that all of the games that all Losers won.
+	log.Println(fmt.Sprintf("%s: losing overlap data", id))
+	// Then match all losers.
+	if len(losers) > 0 {
+		for _, champion := range losers {
+			began, before := time.Now(), matching_gamelist.Len()
 			if !mgl_initialized {
-				matching_gamelist.Init()
+				mgl_initialized = initialize(matching_gamelist, pcgl.Champions[champion].Losing)
+				trace.step("initialize", "matching", champion.Enum(), "losing", before, len(pcgl.Champions[champion].Losing), matching_gamelist.Len(), began)
+			} else {
+				overlap(matching_gamelist, pcgl.Champions[champion].Losing)
+				trace.step("overlap", "matching", champion.Enum(), "losing", before, len(pcgl.Champions[champion].Losing), matching_gamelist.Len(), began)
+			}
+
+			began, before = time.Now(), eligible_wins_gamelist.Len()
+			if !ewgl_initialized {
+				ewgl_initialized = initialize(eligible_wins_gamelist, pcgl.Champions[champion].Winning)
+				trace.step("initialize", "eligible wins", champion.Enum(), "winning", before, len(pcgl.Champions[champion].Winning), eligible_wins_gamelist.Len(), began)
+			} else {
+				overlap(eligible_wins_gamelist, pcgl.Champions[champion].Winning)
+				trace.step("overlap", "eligible wins", champion.Enum(), "winning", before, len(pcgl.Champions[champion].Winning), eligible_wins_gamelist.Len(), began)
 			}
 		}
+	} else {
+		eligible_wins_gamelist.Init()
 
-		// Get a list of all games that the winners won and losers lost (matching_gamelist)
-		// Get a list of all games that the winners lost and losers won => merge(eligible_wins, eligible_losses)
-		// Merge the two to get a list of all available games.
+		if !mgl_initialized {
+			matching_gamelist.Init()
+		}
+	}
 
-		// Step #2: Eligible set includes all that matched and all those that contained
-		//   the proposed champions in the teams provided (victory status ignored).
-		log.Println(fmt.Sprintf("%s: merging", request.Id))
-		eligible_gamelist := merge(eligible_wins_gamelist, eligible_losses_gamelist)
-		eligible_gamelist = merge(matching_gamelist, eligible_gamelist)
+	// Get a list of all games that the winners won and losers lost (matching_gamelist)
+	// Get a list of all games that the winners lost and losers won => merge(eligible_wins, eligible_losses)
+	// Merge the two to get a list of all available games.
 
-		// Prepare the response.
-		response := query.GameQueryResponse{}
-		response.Request = &request
+	// Step #2: Eligible set includes all that matched and all those that contained
+	//   the proposed champions in the teams provided (victory status ignored).
+	log.Println(fmt.Sprintf("%s: merging", id))
+	began := time.Now()
+	eligible_gamelist := merge(eligible_wins_gamelist, eligible_losses_gamelist)
+	trace.step("merge", "eligible", nil, "", eligible_wins_gamelist.Len(), eligible_losses_gamelist.Len(), eligible_gamelist.Len(), began)
 
-		response.Response = &proto.QueryResponse{
-			Successful: gproto.Bool(true),
-			Results: &proto.QueryResponse_Results{
-				Available: gproto.Uint32(uint32(eligible_gamelist.Len())),
-				Matching:  gproto.Uint32(uint32(matching_gamelist.Len())),
-				Total:     gproto.Uint32(uint32(len(pcgl.All))),
-			},
-		}
+	began, before := time.Now(), eligible_gamelist.Len()
+	eligible_gamelist = merge(matching_gamelist, eligible_gamelist)
+	trace.step("merge", "eligible", nil, "", before, matching_gamelist.Len(), eligible_gamelist.Len(), began)
 
-		log.Println(fmt.Sprintf("%s: response generated", request.Id))
-		// Send it to the query responder queue to take care of the
-		// actual transmission and associated events.
-		qm.Respond(&response)
-	}
+	return matching_gamelist, eligible_gamelist
 }
 
 func initialize(dest *list.List, src []libcleo.GameId) bool {
@@ -1,8 +1,10 @@
 package main
 
+import gproto "code.google.com/p/goprotobuf/proto"
 import "container/list"
 import "testing"
 import "libcleo"
+import "proto"
 import "fmt"
 import "log"
 import "strings"
@@ -202,3 +204,12 @@ func TestMerge4(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestTextQueryStats(t *testing.T) {
+	// Ahri beat Thresh in game 1 and lost to him in game 3.
+	qry := proto.GameQuery{Text: gproto.String("select winner:champion(ahri) loser:champion(thresh)")}
+	response := text_query("test", recommend_pcgl(), nil, &qry, nil)
+	if response.Results.GetMatching() != 1 || response.Results.GetAvailable() != 2 || response.Stats.GetWinRate() != 0.5 {
+		t.Error("Unexpected response:", response)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+// Recommendation queries answer "which champion would be the best addition
+// to this team?" for every candidate champion at once. Instead of issuing
+// one team query per candidate, the current team is evaluated a single
+// time and every candidate's game lists are then checked against the
+// result in one pass.
+
+import (
+	gproto "code.google.com/p/goprotobuf/proto"
+	"container/list"
+	"fmt"
+	"libcleo"
+	"log"
+	"proto"
+	"sort"
+)
+
+// Games are marked with the side of the current query that they belong to.
+const (
+	MARK_NONE    = iota
+	MARK_WINNING = iota
+	MARK_LOSING  = iota
+)
+
+// The number of candidates returned if the query doesn't specify a limit.
+const DEFAULT_RECOMMENDATION_LIMIT = 20
+
+type candidateList []*proto.QueryResponse_ExploratoryChampionSubquery
+
+func (x candidateList) Len() int {
+	return len(x)
+}
+
+// Candidates are ranked by the lower bound of their confidence interval so
+// that a handful of lucky games doesn't outrank a large, solid record.
+func (x candidateList) Less(i, j int) bool {
+	return x[i].Stats.GetLowerBound() > x[j].Stats.GetLowerBound()
+}
+
+func (x candidateList) Swap(i, j int) {
+	x[i], x[j] = x[j], x[i]
+}
+
+// Enemy candidates carry the winners' record against them, so the best
+// addition to the losers is the one the winners do worst against: the
+// lowest upper bound (the highest lower bound of the losers' win rate).
+type enemyCandidateList struct {
+	candidateList
+}
+
+func (x enemyCandidateList) Less(i, j int) bool {
+	return x.candidateList[i].Stats.GetUpperBound() < x.candidateList[j].Stats.GetUpperBound()
+}
+
+// Recommend computes the results of adding each champion that isn't
+// already part of the query to the allied (winning) or enemy (losing)
+// team and returns the best candidates, ranked.
+//
+// A game counts toward a candidate's record if the candidate was on the
+// same side as the team they're joining:
+//   - Winning games are games that the allies won and the enemies lost.
+//   - Losing games are games that the allies lost and the enemies won.
+//
+// Records are always from the winners' point of view, so for enemies
+// Matching is the number of games the winners won against the candidate.
+// Enemies are still ranked best for the losers first.
+//
+// Every candidate is returned; handle_query applies the query's limit.
+func recommend(id string, pcgl *libcleo.LivePCGL, qry *proto.GameQuery) []*proto.QueryResponse_ExploratoryChampionSubquery {
+	as_enemy := qry.GetType() == proto.GameQuery_RECOMMEND_ENEMY
+
+	winning, losing := sides(id, pcgl, qry.Winners, qry.Losers)
+	// With no champions in the query every game is fair game and each
+	// candidate's record is simply their own.
+	unconstrained := len(qry.Winners) == 0 && len(qry.Losers) == 0
+
+	// Mark every game by which side of the query it's on. Compact game
+	// ID's are tightly packed so a slice is much faster than a map here.
+	marks := make([]uint8, max_game_id(pcgl)+1)
+	for iter := winning.Front(); iter != nil; iter = iter.Next() {
+		marks[iter.Value.(libcleo.GameId)] = MARK_WINNING
+	}
+	for iter := losing.Front(); iter != nil; iter = iter.Next() {
+		marks[iter.Value.(libcleo.GameId)] = MARK_LOSING
+	}
+
+	// Champions that are already in the query can't be added again.
+	taken := make(map[proto.ChampionType]bool)
+	for _, champion := range qry.Winners {
+		taken[champion] = true
+	}
+	for _, champion := range qry.Losers {
+		taken[champion] = true
+	}
+
+	log.Println(fmt.Sprintf("%s: scoring candidates", id))
+	candidates := make(candidateList, 0, len(pcgl.Champions))
+
+	for champion, record := range pcgl.Champions {
+		if taken[champion] || champion == proto.ChampionType_UNKNOWN {
+			continue
+		}
+
+		// Allies are on the winners' side; the winners win the games that
+		// enemies lose.
+		joined_wins, joined_losses := record.Winning, record.Losing
+		if as_enemy {
+			joined_wins, joined_losses = record.Losing, record.Winning
+		}
+
+		matching := uint32(len(joined_wins))
+		available := matching + uint32(len(joined_losses))
+		if !unconstrained {
+			matching = count_marked(marks, joined_wins, MARK_WINNING)
+			available = matching + count_marked(marks, joined_losses, MARK_LOSING)
+		}
+
+		if available < qry.GetMinAvailable() {
+			continue
+		}
+
+		candidates = append(candidates, &proto.QueryResponse_ExploratoryChampionSubquery{
+			Explorer: champion.Enum(),
+			Valid:    gproto.Bool(true),
+			Results: &proto.QueryResponse_Results{
+				Matching:  gproto.Uint32(matching),
+				Available: gproto.Uint32(available),
+				Total:     gproto.Uint32(uint32(len(pcgl.All))),
+			},
+			Stats: compute_statistics(matching, available, uint32(winning.Len()), uint32(winning.Len()+losing.Len())),
+		})
+	}
+
+	if as_enemy {
+		sort.Stable(enemyCandidateList{candidates})
+	} else {
+		sort.Stable(candidates)
+	}
+
+	return candidates
+}
+
+// Limit_candidates returns the first of CANDIDATES up to the query's limit,
+// or FALLBACK if it doesn't have one.
+func limit_candidates(candidates []*proto.QueryResponse_ExploratoryChampionSubquery, qry *proto.GameQuery, fallback int) []*proto.QueryResponse_ExploratoryChampionSubquery {
+	limit := int(qry.GetLimit())
+	if limit == 0 {
+		limit = fallback
+	}
+	if len(candidates) > limit {
+		return candidates[:limit]
+	}
+	return candidates
+}
+
+// Sides returns the list of games that the winners won against the losers
+// and the list of games that the winners lost to the losers. Either team
+// may be empty, but not both.
+func sides(id string, pcgl *libcleo.LivePCGL, winners []proto.ChampionType, losers []proto.ChampionType) (*list.List, *list.List) {
+	winning := list.New()
+	losing := list.New()
+
+	initialized := false
+	for _, champion := range winners {
+		if !initialized {
+			initialized = initialize(winning, pcgl.Champions[champion].Winning)
+			initialize(losing, pcgl.Champions[champion].Losing)
+		} else {
+			overlap(winning, pcgl.Champions[champion].Winning)
+			overlap(losing, pcgl.Champions[champion].Losing)
+		}
+	}
+
+	for _, champion := range losers {
+		if !initialized {
+			initialized = initialize(winning, pcgl.Champions[champion].Losing)
+			initialize(losing, pcgl.Champions[champion].Winning)
+		} else {
+			overlap(winning, pcgl.Champions[champion].Losing)
+			overlap(losing, pcgl.Champions[champion].Winning)
+		}
+	}
+
+	log.Println(fmt.Sprintf("%s: %d winning, %d losing", id, winning.Len(), losing.Len()))
+	return winning, losing
+}
+
+// Count the number of games in GAMES that have been marked with MARK.
+func count_marked(marks []uint8, games []libcleo.GameId, mark uint8) uint32 {
+	var count uint32 = 0
+
+	for _, gid := range games {
+		if int(gid) < len(marks) && marks[gid] == mark {
+			count += 1
+		}
+	}
+
+	return count
+}
+
+// The largest compact game ID in the PCGL. pcgl.All is sorted.
+func max_game_id(pcgl *libcleo.LivePCGL) libcleo.GameId {
+	if len(pcgl.All) == 0 {
+		return 0
+	}
+
+	return pcgl.All[len(pcgl.All)-1]
+}
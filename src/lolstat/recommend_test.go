@@ -0,0 +1,140 @@
+package main
+
+import gproto "code.google.com/p/goprotobuf/proto"
+import "libcleo"
+import "proto"
+import "testing"
+
+// Build a tiny PCGL where Ahri and Zed were allies in games 0-3 (winning
+// 0-2), Jinx joined them in games 0 and 3, and Thresh was their enemy in
+// games 1 and 3.
+func recommend_pcgl() *libcleo.LivePCGL {
+	pcgl := libcleo.LivePCGL{}
+	pcgl.All = []libcleo.GameId{0, 1, 2, 3}
+	pcgl.Champions = map[proto.ChampionType]libcleo.LivePCGLRecord{
+		proto.ChampionType_AHRI:   {Winning: []libcleo.GameId{0, 1, 2}, Losing: []libcleo.GameId{3}},
+		proto.ChampionType_ZED:    {Winning: []libcleo.GameId{0, 1, 2}, Losing: []libcleo.GameId{3}},
+		proto.ChampionType_JINX:   {Winning: []libcleo.GameId{0}, Losing: []libcleo.GameId{3}},
+		proto.ChampionType_THRESH: {Winning: []libcleo.GameId{3}, Losing: []libcleo.GameId{1}},
+	}
+
+	return &pcgl
+}
+
+func find_candidate(candidates []*proto.QueryResponse_ExploratoryChampionSubquery, champion proto.ChampionType) *proto.QueryResponse_ExploratoryChampionSubquery {
+	for _, candidate := range candidates {
+		if candidate.GetExplorer() == champion {
+			return candidate
+		}
+	}
+
+	return nil
+}
+
+func TestRecommendAlly(t *testing.T) {
+	qry := proto.GameQuery{
+		Winners: []proto.ChampionType{proto.ChampionType_AHRI},
+		Type:    proto.GameQuery_RECOMMEND_ALLY.Enum(),
+	}
+
+	candidates := recommend("test", recommend_pcgl(), &qry)
+
+	if find_candidate(candidates, proto.ChampionType_AHRI) != nil {
+		t.Error("Champions already in the query shouldn't be recommended.")
+	}
+
+	zed := find_candidate(candidates, proto.ChampionType_ZED)
+	if zed == nil || zed.Results.GetMatching() != 3 || zed.Results.GetAvailable() != 4 {
+		t.Error("Unexpected record for Zed:", zed)
+	}
+
+	jinx := find_candidate(candidates, proto.ChampionType_JINX)
+	if jinx == nil || jinx.Results.GetMatching() != 1 || jinx.Results.GetAvailable() != 2 {
+		t.Error("Unexpected record for Jinx:", jinx)
+	}
+
+	// Zed has the stronger record and should be ranked first.
+	if candidates[0].GetExplorer() != proto.ChampionType_ZED {
+		t.Error("Expected Zed to be ranked first.")
+	}
+}
+
+func TestRecommendEnemy(t *testing.T) {
+	qry := proto.GameQuery{
+		Winners: []proto.ChampionType{proto.ChampionType_AHRI},
+		Type:    proto.GameQuery_RECOMMEND_ENEMY.Enum(),
+	}
+
+	candidates := recommend("test", recommend_pcgl(), &qry)
+
+	// Ahri beat Thresh in game 1 and lost to him in game 3.
+	thresh := find_candidate(candidates, proto.ChampionType_THRESH)
+	if thresh == nil || thresh.Results.GetMatching() != 1 || thresh.Results.GetAvailable() != 2 {
+		t.Error("Unexpected record for Thresh:", thresh)
+	}
+}
+
+func TestRecommendMinAvailable(t *testing.T) {
+	qry := proto.GameQuery{
+		Winners:      []proto.ChampionType{proto.ChampionType_AHRI},
+		Type:         proto.GameQuery_RECOMMEND_ALLY.Enum(),
+		MinAvailable: gproto.Uint32(3),
+	}
+
+	candidates := recommend("test", recommend_pcgl(), &qry)
+
+	if len(candidates) != 1 || candidates[0].GetExplorer() != proto.ChampionType_ZED {
+		t.Error("Only Zed has enough games to be recommended.")
+	}
+}
+
+func TestRecommendEnemyRanking(t *testing.T) {
+	pcgl := recommend_pcgl()
+	pcgl.All = append(pcgl.All, 4, 5)
+	// Ahri lost games 3, 4 and 5; Lux beat her in all of them, and Ahri
+	// beat Garen in every game they played.
+	pcgl.Champions[proto.ChampionType_AHRI] = libcleo.LivePCGLRecord{Winning: []libcleo.GameId{0, 1, 2}, Losing: []libcleo.GameId{3, 4, 5}}
+	pcgl.Champions[proto.ChampionType_LUX] = libcleo.LivePCGLRecord{Winning: []libcleo.GameId{3, 4, 5}}
+	pcgl.Champions[proto.ChampionType_GAREN] = libcleo.LivePCGLRecord{Losing: []libcleo.GameId{0, 1, 2}}
+
+	qry := proto.GameQuery{
+		Winners:      []proto.ChampionType{proto.ChampionType_AHRI},
+		Type:         proto.GameQuery_RECOMMEND_ENEMY.Enum(),
+		MinAvailable: gproto.Uint32(1),
+	}
+	candidates := recommend("test", pcgl, &qry)
+
+	if len(candidates) < 3 || candidates[0].GetExplorer() != proto.ChampionType_LUX {
+		t.Fatal("Expected Lux, who always beats Ahri, to be ranked first:", candidates)
+	}
+	if last := candidates[len(candidates)-1]; last.GetExplorer() != proto.ChampionType_GAREN {
+		t.Error("Expected Garen, who always loses to Ahri, to be ranked last:", last)
+	}
+	if lux := candidates[0]; lux.Results.GetMatching() != 0 || lux.Results.GetAvailable() != 3 {
+		t.Error("Unexpected record for Lux:", lux)
+	}
+}
+
+func TestRecommendLimit(t *testing.T) {
+	qry := proto.GameQuery{
+		Winners: []proto.ChampionType{proto.ChampionType_AHRI},
+		Type:    proto.GameQuery_RECOMMEND_ALLY.Enum(),
+		Limit:   gproto.Uint32(1),
+	}
+
+	// The response is limited, but says how many candidates there were
+	// so that callers can paginate.
+	response := handle_query("test", recommend_pcgl(), nil, &qry, nil)
+	if len(response.NextChamp) != 1 || response.NextChamp[0].GetExplorer() != proto.ChampionType_ZED {
+		t.Error("Expected only Zed, got", response.NextChamp)
+	}
+	if response.GetCandidates() != 3 {
+		t.Error("Expected 3 candidates, got", response.GetCandidates())
+	}
+
+	qry.Type = proto.GameQuery_DRAFT.Enum()
+	response = handle_query("test", recommend_pcgl(), nil, &qry, nil)
+	if len(response.NextChamp) != 1 || len(response.SuggestedBans) != 1 || response.GetCandidates() != 3 {
+		t.Error("Unexpected draft response:", response)
+	}
+}
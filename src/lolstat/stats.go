@@ -0,0 +1,87 @@
+package main
+
+// Statistics that help users interpret the raw counts that come out of a
+// query. A 2-of-3 record and a 2000-of-3000 record have the same win rate
+// but very different amounts of evidence behind them, so every response
+// also includes a confidence interval and a comparison against a baseline.
+
+import (
+	gproto "code.google.com/p/goprotobuf/proto"
+	"math"
+	"proto"
+)
+
+// The z value for a two-sided 95% confidence level.
+const CONFIDENCE_Z = 1.96
+
+// Wilson computes the Wilson score interval for a binomial proportion with
+// the given number of successes out of trials. Unlike the normal
+// approximation it behaves sensibly for small samples and for rates close
+// to zero or one. An empty sample returns the uninformative [0, 1].
+func wilson(successes uint32, trials uint32, z float64) (float64, float64) {
+	if trials == 0 {
+		return 0, 1
+	}
+
+	n := float64(trials)
+	p := float64(successes) / n
+	z2 := z * z
+
+	center := p + z2/(2*n)
+	spread := z * math.Sqrt(p*(1-p)/n+z2/(4*n*n))
+	denominator := 1 + z2/n
+
+	lower := (center - spread) / denominator
+	upper := (center + spread) / denominator
+
+	return math.Max(0, lower), math.Min(1, upper)
+}
+
+// Significance returns the z score of the observed win rate against the
+// baseline rate, treating the baseline as the expected proportion. A z
+// score of zero is returned if either side has no data or the baseline
+// is degenerate (0% or 100%).
+func significance(successes uint32, trials uint32, baseline float64) float64 {
+	if trials == 0 || baseline <= 0 || baseline >= 1 {
+		return 0
+	}
+
+	p := float64(successes) / float64(trials)
+	stderr := math.Sqrt(baseline * (1 - baseline) / float64(trials))
+
+	return (p - baseline) / stderr
+}
+
+// Build the Statistics message for a query given its matching and
+// available counts along with the same counts for the baseline query.
+func compute_statistics(matching uint32, available uint32, baseline_matching uint32, baseline_available uint32) *proto.QueryResponse_Statistics {
+	stats := proto.QueryResponse_Statistics{}
+	lower, upper := wilson(matching, available, CONFIDENCE_Z)
+
+	stats.SampleSize = gproto.Uint32(available)
+	stats.LowerBound = gproto.Float64(lower)
+	stats.UpperBound = gproto.Float64(upper)
+
+	win_rate := 0.0
+	if available > 0 {
+		win_rate = float64(matching) / float64(available)
+	}
+	stats.WinRate = gproto.Float64(win_rate)
+
+	stats.BaselineSampleSize = gproto.Uint32(baseline_available)
+	// Without any baseline games there's nothing to compare against.
+	if baseline_available == 0 {
+		stats.Significant = gproto.Bool(false)
+		return &stats
+	}
+
+	baseline := float64(baseline_matching) / float64(baseline_available)
+	z := significance(matching, available, baseline)
+
+	stats.BaselineWinRate = gproto.Float64(baseline)
+	stats.Lift = gproto.Float64(win_rate - baseline)
+	stats.ZScore = gproto.Float64(z)
+	stats.Significant = gproto.Bool(math.Abs(z) >= CONFIDENCE_Z)
+
+	return &stats
+}
@@ -0,0 +1,54 @@
+package main
+
+import "math"
+import "testing"
+
+func close_to(a float64, b float64) bool {
+	return math.Abs(a-b) < 0.001
+}
+
+func TestWilsonEmpty(t *testing.T) {
+	lower, upper := wilson(0, 0, CONFIDENCE_Z)
+
+	if lower != 0 || upper != 1 {
+		t.Fail()
+	}
+}
+
+func TestWilsonSmallSample(t *testing.T) {
+	// 2 of 3 should be far less certain than 2000 of 3000.
+	small_lower, small_upper := wilson(2, 3, CONFIDENCE_Z)
+	large_lower, large_upper := wilson(2000, 3000, CONFIDENCE_Z)
+
+	if !close_to(small_lower, 0.2077) || !close_to(small_upper, 0.9385) {
+		t.Error("Unexpected interval for 2/3:", small_lower, small_upper)
+	}
+
+	if small_upper-small_lower <= large_upper-large_lower {
+		t.Error("Small sample interval should be wider than large sample interval.")
+	}
+}
+
+func TestWilsonBounds(t *testing.T) {
+	lower, upper := wilson(10, 10, CONFIDENCE_Z)
+
+	if upper > 1 || lower < 0 || lower > 1 {
+		t.Error("Interval escaped [0, 1]:", lower, upper)
+	}
+}
+
+func TestSignificance(t *testing.T) {
+	// 600 of 1000 against a 50% baseline is very significant.
+	if significance(600, 1000, 0.5) < CONFIDENCE_Z {
+		t.Fail()
+	}
+
+	// 2 of 3 against a 50% baseline is not.
+	if significance(2, 3, 0.5) >= CONFIDENCE_Z {
+		t.Fail()
+	}
+
+	if significance(0, 0, 0.5) != 0 {
+		t.Fail()
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+// Tracers record how a debug query was evaluated: the size of each list
+// before and after every initialize, overlap and merge step, how long each
+// step took, and a sample of the games that matched. Non-debug queries get
+// a nil tracer, and every method is a no-op on a nil tracer so evaluators
+// don't need to check.
+
+import (
+	gproto "code.google.com/p/goprotobuf/proto"
+	"container/list"
+	"libcleo"
+	"proto"
+	"time"
+)
+
+type tracer struct {
+	trace   proto.QueryResponse_Trace
+	started time.Time
+	// Steps are labeled with the phase that's being evaluated.
+	phase       string
+	sample_size int
+}
+
+func new_tracer(qry *proto.GameQuery) *tracer {
+	if !qry.GetDebug() {
+		return nil
+	}
+
+	return &tracer{started: time.Now(), phase: "query", sample_size: int(qry.GetSampleSize())}
+}
+
+func (t *tracer) set_phase(phase string) {
+	if t == nil {
+		return
+	}
+	t.phase = phase
+}
+
+// Step records a single list operation that started at BEGAN. Champion and
+// source are only set for steps that read one of a champion's lists.
+func (t *tracer) step(operation string, target string, champion *proto.ChampionType, source string, input int, other int, output int, began time.Time) {
+	if t == nil {
+		return
+	}
+
+	s := proto.QueryResponse_Trace_Step{
+		Operation:  gproto.String(operation),
+		Phase:      gproto.String(t.phase),
+		Target:     gproto.String(target),
+		Champion:   champion,
+		InputSize:  gproto.Uint32(uint32(input)),
+		OtherSize:  gproto.Uint32(uint32(other)),
+		OutputSize: gproto.Uint32(uint32(output)),
+		DurationUs: gproto.Uint64(uint64(time.Since(began) / time.Microsecond)),
+	}
+	if len(source) > 0 {
+		s.Source = gproto.String(source)
+	}
+
+	t.trace.Steps = append(t.trace.Steps, &s)
+}
+
+// Sample keeps the first few matching games.
+func (t *tracer) sample(matching []libcleo.GameId) {
+	if t == nil {
+		return
+	}
+
+	t.trace.SampleGames = nil
+	for i := 0; i < len(matching) && i < t.sample_size; i++ {
+		t.trace.SampleGames = append(t.trace.SampleGames, uint32(matching[i]))
+	}
+}
+
+func (t *tracer) sample_list(matching *list.List) {
+	if t == nil {
+		return
+	}
+
+	ids := make([]libcleo.GameId, 0, t.sample_size)
+	for e := matching.Front(); e != nil && len(ids) < t.sample_size; e = e.Next() {
+		ids = append(ids, e.Value.(libcleo.GameId))
+	}
+	t.sample(ids)
+}
+
+// Finish returns the completed trace. GAME_IDS is packer's map from compact
+// ID's to Riot game ID's; if it's missing then only compact ID's are
+// returned.
+func (t *tracer) finish(game_ids []uint64) *proto.QueryResponse_Trace {
+	if t == nil {
+		return nil
+	}
+
+	// Keep the two sample lists aligned; games the map doesn't know about
+	// get a Riot ID of zero.
+	if len(game_ids) > 0 {
+		for _, id := range t.trace.SampleGames {
+			riot_id := uint64(0)
+			if int(id) < len(game_ids) {
+				riot_id = game_ids[id]
+			}
+			t.trace.SampleRiotIds = append(t.trace.SampleRiotIds, riot_id)
+		}
+	}
+	t.trace.DurationUs = gproto.Uint64(uint64(time.Since(t.started) / time.Microsecond))
+
+	return &t.trace
+}
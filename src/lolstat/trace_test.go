@@ -0,0 +1,62 @@
+package main
+
+import gproto "code.google.com/p/goprotobuf/proto"
+import "proto"
+import "time"
+import "testing"
+
+func TestTeamQueryTrace(t *testing.T) {
+	qry := proto.GameQuery{
+		Winners:    []proto.ChampionType{proto.ChampionType_AHRI, proto.ChampionType_JINX},
+		Losers:     []proto.ChampionType{proto.ChampionType_THRESH},
+		Debug:      gproto.Bool(true),
+		SampleSize: gproto.Uint32(1),
+	}
+
+	trace := new_tracer(&qry)
+	team_query("test", recommend_pcgl(), &qry, trace)
+	result := trace.finish([]uint64{100, 101, 102, 103})
+
+	// Ahri's and Jinx's winning lists overlap in game 0, but Thresh
+	// didn't lose that game.
+	first := result.Steps[0]
+	if first.GetOperation() != "initialize" || first.GetChampion() != proto.ChampionType_AHRI || first.GetOutputSize() != 3 {
+		t.Error("Unexpected first step:", first)
+	}
+	// Steps alternate between the matching and eligible lists.
+	second := result.Steps[2]
+	if second.GetOperation() != "overlap" || second.GetTarget() != "matching" || second.GetInputSize() != 3 || second.GetOutputSize() != 1 {
+		t.Error("Unexpected second step:", second)
+	}
+
+	baseline := false
+	for _, step := range result.Steps {
+		baseline = baseline || step.GetPhase() == "baseline"
+	}
+	if !baseline {
+		t.Error("Expected the baseline evaluation to be traced")
+	}
+
+	// Thresh didn't lose game 0, so nothing matches.
+	if len(result.SampleGames) != 0 || len(result.SampleRiotIds) != 0 {
+		t.Error("Unexpected sample:", result.SampleGames, result.SampleRiotIds)
+	}
+
+	qry.Losers = nil
+	trace = new_tracer(&qry)
+	team_query("test", recommend_pcgl(), &qry, trace)
+	result = trace.finish([]uint64{100, 101, 102, 103})
+
+	if len(result.SampleGames) != 1 || result.SampleGames[0] != 0 || result.SampleRiotIds[0] != 100 {
+		t.Error("Unexpected sample:", result.SampleGames, result.SampleRiotIds)
+	}
+}
+
+func TestNoTrace(t *testing.T) {
+	trace := new_tracer(&proto.GameQuery{})
+	trace.step("merge", "eligible", nil, "", 1, 1, 1, time.Now())
+
+	if trace.finish(nil) != nil {
+		t.Error("Non-debug queries shouldn't be traced")
+	}
+}
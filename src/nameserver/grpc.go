@@ -0,0 +1,82 @@
+package main
+
+// The nameserver also serves lookups as a gRPC service (see the Lookup
+// service in nameserver.proto), including a streaming call for resolving
+// many names at once.
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"log"
+	"net"
+	"proto"
+	"switchboard"
+)
+
+const GRPC_PORT = 14104
+
+type lookupService struct {
+	live *liveIndex
+}
+
+// The service is secured the same way as the switchboard port.
+func serve_grpc(port int, live *liveIndex, security switchboard.Security) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.Println("Couldn't open gRPC port:", err)
+		return
+	}
+
+	server := grpc.NewServer(security.GRPCServerOptions()...)
+	proto.RegisterLookupServer(server, &lookupService{live: live})
+
+	log.Println(fmt.Sprintf("gRPC lookup service listening on port %d", port))
+	log.Println("gRPC server stopped:", server.Serve(listener))
+}
+
+func (s *lookupService) Resolve(ctx context.Context, request *proto.NameRequest) (*proto.NameResponse, error) {
+	if len(request.GetName()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "no name provided")
+	}
+
+	response := s.live.get().name_response(&proto.NameRequest{Name: request.Name})
+	if response.GetId() == 0 {
+		return nil, status.Errorf(codes.NotFound, "unknown summoner '%s'", request.GetName())
+	}
+
+	return response, nil
+}
+
+func (s *lookupService) ResolveAll(stream proto.Lookup_ResolveAllServer) error {
+	for {
+		request, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Unknown names get an ID of zero so that one miss doesn't end
+		// the stream.
+		response := s.live.get().name_response(&proto.NameRequest{Name: request.Name})
+		if err := stream.Send(response); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *lookupService) Search(ctx context.Context, request *proto.NameRequest) (*proto.NameResponse, error) {
+	if len(normalize_name(request.GetName())) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "no name provided")
+	}
+	if request.GetMode() == proto.NameRequest_EXACT {
+		return nil, status.Error(codes.InvalidArgument, "searches need a PREFIX or FUZZY mode; use Resolve for exact names")
+	}
+
+	return s.live.get().name_response(request), nil
+}
@@ -0,0 +1,403 @@
+package main
+
+// The name index answers exact, prefix and fuzzy lookups of summoner
+// names. Names are normalized the way Riot does it (case and spaces don't
+// matter), kept sorted so that prefix matches are a binary search away,
+// and indexed by their bigrams so that fuzzy matching only compares names
+// that could be close enough.
+
+import (
+	gproto "code.google.com/p/goprotobuf/proto"
+	"proto"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const DEFAULT_MATCH_LIMIT = 10
+const MAX_MATCH_LIMIT = 50
+
+// Queries shorter than this only get exact and prefix matches; anything
+// else is within a typo or two of far too many names.
+const MIN_FUZZY_LENGTH = 3
+
+// Each edit changes at most this many of a name's bigrams: a transposition
+// of "xaby" to "xbay" replaces xa, ab and by.
+const GRAMS_PER_EDIT = 3
+
+// Keys are padded with these so that their first and last runes are part
+// of two bigrams, like every other rune.
+const (
+	GRAM_START rune = -1
+	GRAM_END   rune = -2
+)
+
+type nameEntry struct {
+	// The normalized name.
+	key  string
+	name string
+	id   uint32
+	// Set for names the summoner used to go by; current is the name
+	// they go by now.
+	renamed bool
+	current string
+}
+
+type nameIndex struct {
+	// Sorted by key.
+	entries []nameEntry
+	// Positions in entries, by the number of runes in the key.
+	by_length map[int][]int
+	// Positions in entries, by the bigrams in the padded key. Each list is
+	// in order and has a position at most once.
+	by_gram map[[2]rune][]int
+}
+
+type nameMatch struct {
+	entry    nameEntry
+	kind     proto.NameRequest_Mode
+	distance int
+}
+
+// Normalize_name follows Riot's rules for comparing summoner names: case
+// and whitespace are ignored.
+func normalize_name(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, name)
+}
+
+// New_index builds an index from summoner names to ID's.
+func new_index(summoners map[string]uint32) *nameIndex {
+	entries := make([]nameEntry, 0, len(summoners))
+	for name, id := range summoners {
+		entries = append(entries, nameEntry{name: name, id: id})
+	}
+	return build_index(entries)
+}
+
+// Build_index indexes ENTRIES by their normalized names. When several
+// entries normalize to the same key, current names win over former ones
+// and lower ID's win after that.
+func build_index(entries []nameEntry) *nameIndex {
+	for i := range entries {
+		entries[i].key = normalize_name(entries[i].name)
+	}
+	sort.Sort(byKey(entries))
+
+	index := empty_index(len(entries))
+	for _, entry := range entries {
+		if len(entry.key) == 0 {
+			continue
+		}
+		if last := len(index.entries) - 1; last >= 0 && index.entries[last].key == entry.key {
+			continue
+		}
+		index.add(entry)
+	}
+
+	return index
+}
+
+func empty_index(size int) *nameIndex {
+	return &nameIndex{
+		entries:   make([]nameEntry, 0, size),
+		by_length: make(map[int][]int),
+		by_gram:   make(map[[2]rune][]int),
+	}
+}
+
+// Add appends ENTRY, which has to sort after every entry already in the
+// index.
+func (x *nameIndex) add(entry nameEntry) {
+	position := len(x.entries)
+	x.entries = append(x.entries, entry)
+
+	key := []rune(entry.key)
+	x.by_length[len(key)] = append(x.by_length[len(key)], position)
+	for gram := range grams(key) {
+		x.by_gram[gram] = append(x.by_gram[gram], position)
+	}
+}
+
+// Grams returns the distinct bigrams of KEY, padded at both ends.
+func grams(key []rune) map[[2]rune]bool {
+	padded := make([]rune, 0, len(key)+2)
+	padded = append(padded, GRAM_START)
+	padded = append(padded, key...)
+	padded = append(padded, GRAM_END)
+
+	out := make(map[[2]rune]bool, len(padded)-1)
+	for i := 1; i < len(padded); i++ {
+		out[[2]rune{padded[i-1], padded[i]}] = true
+	}
+	return out
+}
+
+// Merge returns a copy of the index where the entries for each of KEYS
+// have been replaced by ENTRIES, which must already be normalized and hold
+// at most one entry per key. Keys without an entry are dropped. Nothing
+// else is normalized or sorted again, so this is a single pass over the
+// index, and X is left as it was for anyone still reading it.
+func (x *nameIndex) merge(keys map[string]bool, entries []nameEntry) *nameIndex {
+	sort.Sort(byKey(entries))
+
+	index := empty_index(len(x.entries) + len(entries))
+	i, j := 0, 0
+	for i < len(x.entries) || j < len(entries) {
+		if i < len(x.entries) && keys[x.entries[i].key] {
+			i++
+		} else if j == len(entries) || (i < len(x.entries) && x.entries[i].key < entries[j].key) {
+			index.add(x.entries[i])
+			i++
+		} else {
+			index.add(entries[j])
+			j++
+		}
+	}
+	return index
+}
+
+type byKey []nameEntry
+
+func (x byKey) Len() int { return len(x) }
+func (x byKey) Less(i, j int) bool {
+	if x[i].key != x[j].key {
+		return x[i].key < x[j].key
+	}
+	if x[i].renamed != x[j].renamed {
+		return !x[i].renamed
+	}
+	return x[i].id < x[j].id
+}
+func (x byKey) Swap(i, j int) { x[i], x[j] = x[j], x[i] }
+
+func (x *nameIndex) Len() int {
+	return len(x.entries)
+}
+
+// Resolve looks up a single summoner name.
+func (x *nameIndex) resolve(name string) (uint32, bool) {
+	entry, ok := x.lookup(name)
+	return entry.id, ok
+}
+
+// Lookup finds the entry for a single summoner name, which may be a name
+// the summoner used to go by.
+func (x *nameIndex) lookup(name string) (nameEntry, bool) {
+	key := normalize_name(name)
+	i := sort.Search(len(x.entries), func(i int) bool { return x.entries[i].key >= key })
+	if i < len(x.entries) && x.entries[i].key == key {
+		return x.entries[i], true
+	}
+	return nameEntry{}, false
+}
+
+// Search returns up to LIMIT matches for NAME, best first: the exact
+// match, then prefix matches (shortest first), then fuzzy matches (fewest
+// edits first). Ties are broken alphabetically, and each summoner only
+// shows up once.
+func (x *nameIndex) search(name string, mode proto.NameRequest_Mode, limit int) []nameMatch {
+	key := normalize_name(name)
+	if len(key) == 0 {
+		return nil
+	}
+
+	matches := make([]nameMatch, 0)
+	found := make(map[int]bool)
+
+	// Everything starting with the key, including the key itself.
+	start := sort.Search(len(x.entries), func(i int) bool { return x.entries[i].key >= key })
+	for i := start; i < len(x.entries) && strings.HasPrefix(x.entries[i].key, key); i++ {
+		if x.entries[i].key == key {
+			matches = append(matches, nameMatch{entry: x.entries[i], kind: proto.NameRequest_EXACT})
+		} else if mode != proto.NameRequest_EXACT {
+			matches = append(matches, nameMatch{entry: x.entries[i], kind: proto.NameRequest_PREFIX})
+		}
+		found[i] = true
+	}
+
+	query := []rune(key)
+	if mode == proto.NameRequest_FUZZY && len(query) >= MIN_FUZZY_LENGTH {
+		max_distance := max_edits(len(query))
+		for _, i := range x.fuzzy_candidates(query, max_distance) {
+			if found[i] {
+				continue
+			}
+
+			distance := edit_distance(query, []rune(x.entries[i].key), max_distance)
+			if distance <= max_distance {
+				matches = append(matches, nameMatch{entry: x.entries[i], kind: proto.NameRequest_FUZZY, distance: distance})
+			}
+		}
+	}
+
+	// A summoner can match under both their current and former names;
+	// only keep the better of the two.
+	sort.Sort(byRank(matches))
+	results := make([]nameMatch, 0, len(matches))
+	seen := make(map[uint32]bool)
+	for _, match := range matches {
+		if len(results) == limit {
+			break
+		}
+		if !seen[match.entry.id] {
+			seen[match.entry.id] = true
+			results = append(results, match)
+		}
+	}
+	return results
+}
+
+// Fuzzy_candidates returns the positions of every entry that could be
+// within MAX_DISTANCE edits of QUERY, and hopefully not many more. Each
+// edit takes away at most GRAMS_PER_EDIT of the query's bigrams, so a
+// close enough name has to share the rest of them. Short queries with
+// several edits allowed might not have any bigrams left over; those fall
+// back to every name of a close enough length.
+func (x *nameIndex) fuzzy_candidates(query []rune, max_distance int) []int {
+	candidates := make([]int, 0)
+
+	query_grams := grams(query)
+	threshold := len(query_grams) - GRAMS_PER_EDIT*max_distance
+	if threshold <= 0 {
+		for length := len(query) - max_distance; length <= len(query)+max_distance; length++ {
+			candidates = append(candidates, x.by_length[length]...)
+		}
+		return candidates
+	}
+
+	shared := make(map[int]int)
+	for gram := range query_grams {
+		for _, i := range x.by_gram[gram] {
+			shared[i] += 1
+		}
+	}
+	for i, count := range shared {
+		if count < threshold {
+			continue
+		}
+		if length := utf8.RuneCountInString(x.entries[i].key); length >= len(query)-max_distance && length <= len(query)+max_distance {
+			candidates = append(candidates, i)
+		}
+	}
+	return candidates
+}
+
+// Max_edits is how many typos are tolerated in a name of LENGTH runes.
+func max_edits(length int) int {
+	if length <= 5 {
+		return 1
+	}
+	return 2
+}
+
+type byRank []nameMatch
+
+func (x byRank) Len() int      { return len(x) }
+func (x byRank) Swap(i, j int) { x[i], x[j] = x[j], x[i] }
+func (x byRank) Less(i, j int) bool {
+	if x[i].kind != x[j].kind {
+		return x[i].kind < x[j].kind
+	}
+	if x[i].distance != x[j].distance {
+		return x[i].distance < x[j].distance
+	}
+	if len(x[i].entry.key) != len(x[j].entry.key) {
+		return len(x[i].entry.key) < len(x[j].entry.key)
+	}
+	return x[i].entry.key < x[j].entry.key
+}
+
+// Edit_distance is the optimal string alignment distance between A and B:
+// the number of insertions, deletions, substitutions and transpositions of
+// adjacent runes needed to turn one into the other. Once it's clear that
+// the distance is more than MAX, it gives up and returns MAX + 1.
+func edit_distance(a []rune, b []rune, max int) int {
+	// Three rows of the usual dynamic programming table.
+	previous2 := make([]int, len(b)+1)
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		row_min := current[0]
+
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			current[j] = min_int(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				current[j] = min_int(current[j], previous2[j-2]+1)
+			}
+			row_min = min_int(row_min, current[j])
+		}
+
+		if row_min > max {
+			return max + 1
+		}
+		previous2, previous, current = previous, current, previous2
+	}
+
+	if previous[len(b)] > max {
+		return max + 1
+	}
+	return previous[len(b)]
+}
+
+func min_int(first int, rest ...int) int {
+	for _, value := range rest {
+		if value < first {
+			first = value
+		}
+	}
+	return first
+}
+
+// Name_response builds the response to REQUEST.
+func (x *nameIndex) name_response(request *proto.NameRequest) *proto.NameResponse {
+	response := proto.NameResponse{Name: request.Name, Id: gproto.Uint32(0)}
+	if entry, ok := x.lookup(request.GetName()); ok {
+		response.Id = gproto.Uint32(entry.id)
+		if entry.renamed {
+			response.Renamed = gproto.Bool(true)
+			response.CurrentName = gproto.String(entry.current)
+		}
+	}
+
+	if request.GetMode() == proto.NameRequest_EXACT {
+		return &response
+	}
+
+	limit := int(request.GetLimit())
+	if limit == 0 {
+		limit = DEFAULT_MATCH_LIMIT
+	} else if limit > MAX_MATCH_LIMIT {
+		limit = MAX_MATCH_LIMIT
+	}
+
+	for _, match := range x.search(request.GetName(), request.GetMode(), limit) {
+		result := proto.NameResponse_Match{
+			Name:     gproto.String(match.entry.name),
+			Id:       gproto.Uint32(match.entry.id),
+			Kind:     match.kind.Enum(),
+			Distance: gproto.Uint32(uint32(match.distance)),
+		}
+		if match.entry.renamed {
+			result.Renamed = gproto.Bool(true)
+			result.CurrentName = gproto.String(match.entry.current)
+		}
+		response.Matches = append(response.Matches, &result)
+	}
+	return &response
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	gproto "code.google.com/p/goprotobuf/proto"
+	"math/rand"
+	"proto"
+	"testing"
+)
+
+func test_index() *nameIndex {
+	return new_index(map[string]uint32{
+		"Brigado":      1,
+		"Brig":         2,
+		"Brigadoon":    3,
+		"Bri gade":     4,
+		"Dyrus":        5,
+		"Doublelift":   6,
+		"Double Lift2": 7,
+		"ÉLISE":        8,
+	})
+}
+
+func names(matches []nameMatch) []string {
+	out := make([]string, 0, len(matches))
+	for _, match := range matches {
+		out = append(out, match.entry.name)
+	}
+	return out
+}
+
+func same(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestNormalize(t *testing.T) {
+	index := test_index()
+
+	for name, expected := range map[string]uint32{
+		"brigado":     1,
+		"BRIGADO":     1,
+		" b r i gado": 1,
+		"bri\tgade":   4,
+		"élise":       8,
+		"nobody":      0,
+	} {
+		if sid, _ := index.resolve(name); sid != expected {
+			t.Error(name, "resolved to", sid, "instead of", expected)
+		}
+	}
+}
+
+func TestPrefixSearch(t *testing.T) {
+	index := test_index()
+
+	// The exact match comes first, then shorter names.
+	matches := index.search("Brig", proto.NameRequest_PREFIX, 10)
+	if !same(names(matches), []string{"Brig", "Bri gade", "Brigado", "Brigadoon"}) {
+		t.Error("Unexpected prefix matches:", names(matches))
+	}
+	if matches[0].kind != proto.NameRequest_EXACT || matches[1].kind != proto.NameRequest_PREFIX {
+		t.Error("Matches have the wrong kinds")
+	}
+
+	if matches := index.search("brig", proto.NameRequest_PREFIX, 2); len(matches) != 2 {
+		t.Error("Limit wasn't applied:", names(matches))
+	}
+	if matches := index.search("brig", proto.NameRequest_EXACT, 10); !same(names(matches), []string{"Brig"}) {
+		t.Error("Exact searches should only return the exact match:", names(matches))
+	}
+	if matches := index.search("  ", proto.NameRequest_PREFIX, 10); len(matches) != 0 {
+		t.Error("Empty searches should return nothing:", names(matches))
+	}
+}
+
+func TestFuzzySearch(t *testing.T) {
+	index := test_index()
+
+	// One substitution, one transposition and one missing letter.
+	for query, expected := range map[string]string{
+		"Dyrys":     "Dyrus",
+		"Dryus":     "Dyrus",
+		"doublelft": "Doublelift",
+	} {
+		matches := index.search(query, proto.NameRequest_FUZZY, 10)
+		if len(matches) == 0 || matches[0].entry.name != expected || matches[0].kind != proto.NameRequest_FUZZY || matches[0].distance != 1 {
+			t.Error(query, "matched", names(matches))
+		}
+	}
+
+	// Prefix matches outrank fuzzy ones.
+	matches := index.search("doublelift", proto.NameRequest_FUZZY, 10)
+	if !same(names(matches), []string{"Doublelift", "Double Lift2"}) {
+		t.Error("Unexpected matches:", names(matches))
+	}
+
+	// Short queries and far-off names don't match.
+	if matches := index.search("xy", proto.NameRequest_FUZZY, 10); len(matches) != 0 {
+		t.Error("Short query matched", names(matches))
+	}
+	if matches := index.search("dyrusxyz", proto.NameRequest_FUZZY, 10); len(matches) != 0 {
+		t.Error("Distant name matched", names(matches))
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		max      int
+		expected int
+	}{
+		{"kitten", "sitting", 5, 3},
+		{"ab", "ba", 2, 1},
+		{"", "abc", 5, 3},
+		{"abcdef", "uvwxyz", 2, 3},
+	}
+
+	for _, c := range cases {
+		if distance := edit_distance([]rune(c.a), []rune(c.b), c.max); distance != c.expected {
+			t.Error(c.a, c.b, "had distance", distance, "instead of", c.expected)
+		}
+	}
+}
+
+func TestNameResponse(t *testing.T) {
+	index := test_index()
+
+	response := index.name_response(&proto.NameRequest{Name: gproto.String("brigado")})
+	if response.GetId() != 1 || len(response.Matches) != 0 {
+		t.Error("Exact requests should only set the ID:", response)
+	}
+
+	response = index.name_response(&proto.NameRequest{
+		Name:  gproto.String("brigadooon"),
+		Mode:  proto.NameRequest_FUZZY.Enum(),
+		Limit: gproto.Uint32(1000),
+	})
+	if response.GetId() != 0 || len(response.Matches) != 1 || response.Matches[0].GetId() != 3 || response.Matches[0].GetDistance() != 1 {
+		t.Error("Unexpected fuzzy response:", response)
+	}
+}
+
+// Random_names makes up COUNT summoner names of 4 to 14 letters and
+// digits.
+func random_names(count int, seed int64) map[string]uint32 {
+	const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+	random := rand.New(rand.NewSource(seed))
+
+	summoners := make(map[string]uint32, count)
+	for len(summoners) < count {
+		name := make([]byte, 4+random.Intn(11))
+		for i := range name {
+			name[i] = letters[random.Intn(len(letters))]
+		}
+		summoners[string(name)] = uint32(len(summoners) + 1)
+	}
+	return summoners
+}
+
+// Typo swaps, drops or replaces one of NAME's letters.
+func typo(name string, random *rand.Rand) string {
+	runes := []rune(name)
+	i := random.Intn(len(runes) - 1)
+	switch random.Intn(3) {
+	case 0:
+		runes[i], runes[i+1] = runes[i+1], runes[i]
+	case 1:
+		runes = append(runes[:i], runes[i+1:]...)
+	default:
+		runes[i] = 'z'
+	}
+	return string(runes)
+}
+
+// Fuzzy searches have to find the same names as comparing the query with
+// every name in the index would.
+func TestFuzzyCandidates(t *testing.T) {
+	index := new_index(random_names(5000, 1))
+	random := rand.New(rand.NewSource(2))
+
+	for n := 0; n < 200; n++ {
+		query := []rune(typo(index.entries[random.Intn(len(index.entries))].key, random))
+		if len(query) < MIN_FUZZY_LENGTH {
+			continue
+		}
+
+		max_distance := max_edits(len(query))
+		expected := make(map[string]bool)
+		for _, entry := range index.entries {
+			if edit_distance(query, []rune(entry.key), max_distance) <= max_distance {
+				expected[entry.key] = true
+			}
+		}
+
+		found := make(map[string]bool)
+		for _, match := range index.search(string(query), proto.NameRequest_FUZZY, len(index.entries)) {
+			found[match.entry.key] = true
+		}
+		for key := range expected {
+			if !found[key] {
+				t.Error(string(query), "didn't match", key)
+			}
+		}
+	}
+}
+
+func BenchmarkFuzzySearch(b *testing.B) {
+	index := new_index(random_names(200000, 1))
+	random := rand.New(rand.NewSource(2))
+
+	queries := make([]string, 100)
+	for i := range queries {
+		queries[i] = typo(index.entries[random.Intn(len(index.entries))].key, random)
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		index.search(queries[n%len(queries)], proto.NameRequest_FUZZY, DEFAULT_MATCH_LIMIT)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+// The nameserver keeps its index up to date by polling Mongo for summoner
+// records that have been stored since the last poll. Each poll merges the
+// names that changed into a copy of the current index and swaps it in, so
+// requests always see a complete index and never wait on a refresh.
+//
+// Summoners that change their names keep resolving under their old names
+// (flagged as renamed) for as long as the nameserver is up; nothing
+// records old names in Mongo, so a restart forgets them.
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const DEFAULT_REFRESH_INTERVAL = time.Minute
+
+// A summoner's name as of the last time their record was stored.
+type nameUpdate struct {
+	id      uint32
+	name    string
+	updated uint64
+}
+
+// LiveIndex holds the index that requests are currently answered from.
+type liveIndex struct {
+	lock  sync.RWMutex
+	index *nameIndex
+}
+
+func (l *liveIndex) get() *nameIndex {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.index
+}
+
+func (l *liveIndex) set(index *nameIndex) {
+	l.lock.Lock()
+	l.index = index
+	l.lock.Unlock()
+}
+
+// NameTable is every name the nameserver knows about. It's only touched by
+// the goroutine doing the refreshing.
+type nameTable struct {
+	// The name each summoner goes by now.
+	current map[uint32]string
+	// Names summoners used to go by, by normalized name.
+	former map[string]nameEntry
+	// The summoners going by each normalized name now.
+	holders map[string]map[uint32]bool
+	// The normalized names each summoner used to go by.
+	renames map[uint32]map[string]bool
+	// Normalized names whose index entries may have changed since the
+	// table was last indexed.
+	touched map[string]bool
+}
+
+func new_name_table() *nameTable {
+	return &nameTable{
+		current: make(map[uint32]string),
+		former:  make(map[string]nameEntry),
+		holders: make(map[string]map[uint32]bool),
+		renames: make(map[uint32]map[string]bool),
+		touched: make(map[string]bool),
+	}
+}
+
+// Update records that summoner ID is now called NAME, and returns whether
+// that's news.
+func (t *nameTable) update(id uint32, name string) bool {
+	if id == 0 || len(normalize_name(name)) == 0 {
+		return false
+	}
+
+	old, known := t.current[id]
+	if known && old == name {
+		return false
+	}
+	t.current[id] = name
+
+	key := normalize_name(name)
+	if known {
+		t.remove_holder(normalize_name(old), id)
+	}
+	t.add_holder(key, id)
+
+	// Going back to a former name makes it current again.
+	if former, ok := t.former[key]; ok && former.id == id {
+		t.remove_former(key)
+	}
+	// Changes in case or spacing aren't renames.
+	if known && normalize_name(old) != key {
+		t.add_former(normalize_name(old), nameEntry{name: old, id: id, renamed: true})
+	}
+
+	// Entries for old names point at the current one.
+	for former := range t.renames[id] {
+		t.touched[former] = true
+	}
+	return true
+}
+
+func (t *nameTable) add_holder(key string, id uint32) {
+	if t.holders[key] == nil {
+		t.holders[key] = make(map[uint32]bool)
+	}
+	t.holders[key][id] = true
+	t.touched[key] = true
+}
+
+func (t *nameTable) remove_holder(key string, id uint32) {
+	delete(t.holders[key], id)
+	if len(t.holders[key]) == 0 {
+		delete(t.holders, key)
+	}
+	t.touched[key] = true
+}
+
+func (t *nameTable) add_former(key string, entry nameEntry) {
+	if _, ok := t.former[key]; ok {
+		t.remove_former(key)
+	}
+	t.former[key] = entry
+	if t.renames[entry.id] == nil {
+		t.renames[entry.id] = make(map[string]bool)
+	}
+	t.renames[entry.id][key] = true
+	t.touched[key] = true
+}
+
+func (t *nameTable) remove_former(key string) {
+	id := t.former[key].id
+	delete(t.former, key)
+	delete(t.renames[id], key)
+	if len(t.renames[id]) == 0 {
+		delete(t.renames, id)
+	}
+	t.touched[key] = true
+}
+
+// Entry picks the entry that KEY should resolve to, if any. Current names
+// take priority over former ones if another summoner has since taken an
+// old name.
+func (t *nameTable) entry(key string) (nameEntry, bool) {
+	candidates := make([]nameEntry, 0, len(t.holders[key])+1)
+	for id := range t.holders[key] {
+		candidates = append(candidates, nameEntry{key: key, name: t.current[id], id: id})
+	}
+	if entry, ok := t.former[key]; ok {
+		entry.key = key
+		entry.current = t.current[entry.id]
+		candidates = append(candidates, entry)
+	}
+	if len(candidates) == 0 {
+		return nameEntry{}, false
+	}
+
+	best := 0
+	for i := range candidates {
+		if byKey(candidates).Less(i, best) {
+			best = i
+		}
+	}
+	return candidates[best], true
+}
+
+// Reindex returns a new index with the names that changed since the last
+// call merged into INDEX.
+func (t *nameTable) reindex(index *nameIndex) *nameIndex {
+	entries := make([]nameEntry, 0, len(t.touched))
+	for key := range t.touched {
+		if entry, ok := t.entry(key); ok {
+			entries = append(entries, entry)
+		}
+	}
+	merged := index.merge(t.touched, entries)
+	t.touched = make(map[string]bool)
+	return merged
+}
+
+// Index builds a new index from the whole table.
+func (t *nameTable) index() *nameIndex {
+	entries := make([]nameEntry, 0, len(t.current)+len(t.former))
+	for id, name := range t.current {
+		entries = append(entries, nameEntry{name: name, id: id})
+	}
+	for _, entry := range t.former {
+		entry.current = t.current[entry.id]
+		entries = append(entries, entry)
+	}
+	return build_index(entries)
+}
+
+// Refresher polls for updated summoners and keeps a live index current.
+type refresher struct {
+	live  *liveIndex
+	table *nameTable
+	// Fetches every summoner stored at or after the given time, in any
+	// order.
+	load func(since uint64) ([]nameUpdate, error)
+	// The newest update seen so far.
+	since uint64
+}
+
+func new_refresher(load func(since uint64) ([]nameUpdate, error)) *refresher {
+	return &refresher{
+		live:  &liveIndex{index: build_index(nil)},
+		table: new_name_table(),
+		load:  load,
+	}
+}
+
+// Refresh applies every update since the last refresh and swaps in a new
+// index if anything changed. It returns the number of names that changed.
+// If the updates can't all be loaded none of them are applied, since the
+// ones that were missed could be older than the ones that weren't.
+func (r *refresher) refresh() (int, error) {
+	updates, err := r.load(r.since)
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for _, update := range updates {
+		if r.table.update(update.id, update.name) {
+			changed++
+		}
+		if update.updated > r.since {
+			r.since = update.updated
+		}
+	}
+
+	if changed > 0 {
+		r.live.set(r.table.reindex(r.live.get()))
+	}
+	return changed, nil
+}
+
+// Run refreshes the index every INTERVAL, forever.
+func (r *refresher) run(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		changed, err := r.refresh()
+		if err != nil {
+			log.Println("Couldn't refresh summoner names:", err)
+		} else if changed > 0 {
+			log.Println(fmt.Sprintf("Refreshed %d summoner names; %d names indexed.", changed, r.live.get().Len()))
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	gproto "code.google.com/p/goprotobuf/proto"
+	"errors"
+	"fmt"
+	"proto"
+	"sync"
+	"testing"
+)
+
+// A fake backend: every update is stored at a later time than the last,
+// and like Mongo only the latest update for each summoner is kept.
+type fakeSummoners struct {
+	lock    sync.Mutex
+	updates []nameUpdate
+	// The since values passed to load.
+	polls []uint64
+	// Returned by load if set.
+	err error
+}
+
+func (f *fakeSummoners) store(id uint32, name string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.updates = append(f.updates, nameUpdate{id: id, name: name, updated: uint64(len(f.updates) + 1)})
+}
+
+func (f *fakeSummoners) load(since uint64) ([]nameUpdate, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.polls = append(f.polls, since)
+
+	// Updates come back newest first, since Mongo doesn't promise any
+	// order.
+	updates := make([]nameUpdate, 0)
+	seen := make(map[uint32]bool)
+	for i := len(f.updates) - 1; i >= 0; i-- {
+		update := f.updates[i]
+		if update.updated >= since && !seen[update.id] {
+			updates = append(updates, update)
+		}
+		seen[update.id] = true
+	}
+	if f.err != nil {
+		return updates[:len(updates)/2], f.err
+	}
+	return updates, nil
+}
+
+func TestRefresh(t *testing.T) {
+	summoners := fakeSummoners{}
+	summoners.store(1, "Brigado")
+	summoners.store(2, "Dyrus")
+
+	refresher := new_refresher(summoners.load)
+	if changed, _ := refresher.refresh(); changed != 2 {
+		t.Error("Expected two new names, got", changed)
+	}
+	before := refresher.live.get()
+
+	// Nothing new; the index shouldn't be rebuilt.
+	if changed, _ := refresher.refresh(); changed != 0 || refresher.live.get() != before {
+		t.Error("Index was rebuilt without any changes")
+	}
+
+	summoners.store(3, "Doublelift")
+	if changed, _ := refresher.refresh(); changed != 1 {
+		t.Error("Expected one new name, got", changed)
+	}
+	if sid, _ := refresher.live.get().resolve("doublelift"); sid != 3 {
+		t.Error("New summoner wasn't indexed")
+	}
+	// The old index is left alone for anyone still using it.
+	if _, ok := before.resolve("doublelift"); ok {
+		t.Error("Old index was modified")
+	}
+
+	// Polls pick up from the newest update seen.
+	if polls := summoners.polls; polls[0] != 0 || polls[1] != 2 || polls[2] != 2 {
+		t.Error("Unexpected polls:", polls)
+	}
+
+	// Failed polls aren't applied and are tried again from the same
+	// point.
+	summoners.store(4, "Bjergsen")
+	summoners.store(5, "Scarra")
+	summoners.err = errors.New("cursor lost")
+	if changed, err := refresher.refresh(); changed != 0 || err == nil {
+		t.Error("Expected the failed poll to be skipped, got", changed, err)
+	}
+	summoners.err = nil
+	if changed, _ := refresher.refresh(); changed != 2 {
+		t.Error("Expected two new names after the failed poll, got", changed)
+	}
+	if polls := summoners.polls; polls[3] != 3 || polls[4] != 3 {
+		t.Error("Failed poll moved the starting point:", polls)
+	}
+}
+
+func TestRenames(t *testing.T) {
+	summoners := fakeSummoners{}
+	summoners.store(1, "Brigado")
+	refresher := new_refresher(summoners.load)
+	refresher.refresh()
+
+	summoners.store(1, "Brigadoon")
+	refresher.refresh()
+	summoners.store(1, "Brigadier")
+	refresher.refresh()
+	index := refresher.live.get()
+
+	// Both old names still resolve to the summoner's current name.
+	for _, name := range []string{"brigado", "brigadoon"} {
+		response := index.name_response(&proto.NameRequest{Name: &name})
+		if response.GetId() != 1 || !response.GetRenamed() || response.GetCurrentName() != "Brigadier" {
+			t.Error("Unexpected response for", name, response)
+		}
+	}
+	if response := index.name_response(&proto.NameRequest{Name: gproto.String("Brigadier")}); response.GetId() != 1 || response.GetRenamed() {
+		t.Error("Unexpected response for the current name:", response)
+	}
+
+	// Searches only list the summoner once, under their best match.
+	matches := index.search("brigad", proto.NameRequest_PREFIX, 10)
+	if len(matches) != 1 || matches[0].entry.name != "Brigado" || !matches[0].entry.renamed {
+		t.Error("Unexpected matches:", names(matches))
+	}
+
+	// Somebody else takes an old name.
+	summoners.store(2, "Brigado")
+	refresher.refresh()
+	if entry, _ := refresher.live.get().lookup("brigado"); entry.id != 2 || entry.renamed {
+		t.Error("Current names should win over old ones:", entry)
+	}
+
+	// Changing back to an old name, or just its case, isn't a rename.
+	summoners.store(1, "Brigadoon")
+	refresher.refresh()
+	summoners.store(1, "BrigaDoon")
+	refresher.refresh()
+	if entry, _ := refresher.live.get().lookup("brigadoon"); entry.id != 1 || entry.renamed || entry.name != "BrigaDoon" {
+		t.Error("Unexpected entry:", entry)
+	}
+	if entry, _ := refresher.live.get().lookup("brigadier"); entry.id != 1 || !entry.renamed || entry.current != "BrigaDoon" {
+		t.Error("Unexpected entry:", entry)
+	}
+}
+
+// Run with -race: requests shouldn't be affected by refreshes.
+func TestConcurrentRefresh(t *testing.T) {
+	summoners := fakeSummoners{}
+	summoners.store(1, "Brigado")
+	refresher := new_refresher(summoners.load)
+	refresher.refresh()
+
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		go func() {
+			for j := 0; j < 200; j++ {
+				if sid, _ := refresher.live.get().resolve("brigado"); sid != 1 {
+					t.Error("Lookup failed during a refresh")
+				}
+			}
+			done <- true
+		}()
+	}
+
+	for i := uint32(2); i < 50; i++ {
+		summoners.store(i, fmt.Sprintf("Summoner%d", i))
+		refresher.refresh()
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+}
+
+// Merging changes into the index should give the same index as building it
+// from scratch.
+func TestIncrementalIndex(t *testing.T) {
+	summoners := fakeSummoners{}
+	refresher := new_refresher(summoners.load)
+
+	names := []string{"Brigado", "Dyrus", "Brigadoon", "dyrus", "Doublelift", "Bjergsen", "Brig Ado"}
+	for i := 0; i < 60; i++ {
+		summoners.store(uint32(i%7+1), names[(i*3+i/7)%len(names)])
+		if i%4 == 3 {
+			refresher.refresh()
+			merged, built := refresher.live.get(), refresher.table.index()
+			if fmt.Sprint(merged.entries) != fmt.Sprint(built.entries) || fmt.Sprint(merged.by_length) != fmt.Sprint(built.by_length) || fmt.Sprint(merged.by_gram) != fmt.Sprint(built.by_gram) {
+				t.Fatal("Merged index doesn't match a rebuilt one:", merged.entries, built.entries)
+			}
+		}
+	}
+}
@@ -3,23 +3,32 @@ package main
 import (
 	gproto "code.google.com/p/goprotobuf/proto"
 	data "datamodel"
+	"flag"
 	"fmt"
 	"log"
 	"proto"
 	"query"
-	"strings"
+	"registry"
+	"switchboard"
 )
 
+var SECURITY = switchboard.RegisterSecurityFlags()
+var ADVERTISE = flag.String("advertise", "", "Address to register in the service registry; defaults to this host")
+var REFRESH = flag.Duration("refresh", DEFAULT_REFRESH_INTERVAL, "How often to check for new and renamed summoners")
+
+const PORT = 14004
+
 /**
- * Load the list of known summoners from MongoDB. If the summoner
- * isn't labeled with a name in the backend then it won't be
- * user-retrievable.
+ * Load the summoners that have been stored in MongoDB since the provided
+ * time (zero loads everyone). If the summoner isn't labeled with a name in
+ * the backend then it won't be user-retrievable. Names are returned as
+ * they're displayed; the index takes care of normalizing them.
  */
-func load_summoners() map[string]uint32 {
+func load_summoners(since uint64) ([]nameUpdate, error) {
 	retriever := data.LoLRetriever{}
 
-	summoners_iter := retriever.GetKnownSummonersIter()
-	summoners := make(map[string]uint32)
+	summoners_iter := retriever.GetSummonersUpdatedSinceIter(since)
+	summoners := make([]nameUpdate, 0)
 
 	for summoners_iter.HasNext() {
 		summoner := summoners_iter.Next()
@@ -27,50 +36,84 @@ func load_summoners() map[string]uint32 {
 		// If we've got a valid summoner and their name is set, store it
 		// in the lookup table.
 		if summoner.SummonerId > 0 && len(summoner.Metadata.SummonerName) > 0 {
-			summoners[strings.ToLower(summoner.Metadata.SummonerName)] = summoner.SummonerId
+			summoners = append(summoners, nameUpdate{
+				id:      summoner.SummonerId,
+				name:    summoner.Metadata.SummonerName,
+				updated: summoner.LastUpdated,
+			})
 		}
 	}
 
-	summoners["brigado"] = 36142441
-	return summoners
+	return summoners, summoners_iter.Err()
 }
 
-func handle_request(request *query.QueryRequest, summoners map[string]uint32, qm *query.QueryManager) {
+func handle_request(request *query.QueryRequest, live *liveIndex, qm *query.QueryManager) {
 	// The data structure stores the Query generically so we need to cast it to the application-spceific
 	// query type.
 	name_request := request.Query.(*proto.NameRequest)
-	lc_name := strings.ToLower(*name_request.Name)
 
-	log.Println("Request received:", *name_request.Name)
+	log.Println("Request received:", name_request.GetName())
 
-	sid, ok := summoners[lc_name]
-	// Found the name
-	response := proto.NameResponse{}
-	response.Name = name_request.Name
+	response := live.get().name_response(name_request)
 
-	if ok {
-		response.Id = gproto.Uint32(sid)
-		log.Println( fmt.Sprintf("Found mapping [%s = %d]", *name_request.Name, sid) )
-		// Didn't find the name
+	if response.GetId() != 0 {
+		// Found the name
+		log.Println( fmt.Sprintf("Found mapping [%s = %d]", name_request.GetName(), response.GetId()) )
 	} else {
-		response.Id = gproto.Uint32(0)
-		log.Println( fmt.Sprintf("Mapping not found [%s = ?]", *name_request.Name) )
+		// Didn't find the name
+		log.Println( fmt.Sprintf("Mapping not found [%s = ?]", name_request.GetName()) )
 	}
-	qm.Reply(request, &response)
+	if len(response.Matches) > 0 {
+		log.Println( fmt.Sprintf("%d matches for [%s]", len(response.Matches), name_request.GetName()) )
+	}
+	qm.Reply(request, response)
 }
 
 func main() {
-	// Load all summoner data
-	summoner_map := load_summoners()
-	log.Println(fmt.Sprintf("Loaded %d summoners from backend.", len(summoner_map)))
+	flag.Parse()
+	security, serr := SECURITY.Server()
+	if serr != nil {
+		log.Fatal("Invalid switchboard security settings:", serr)
+	}
+
+	client_security, cserr := SECURITY.Client()
+	if cserr != nil {
+		log.Fatal("Invalid switchboard security settings:", cserr)
+	}
+	reg, rerr := registry.OpenDefault(client_security)
+	if rerr != nil {
+		log.Fatal("Couldn't open the service registry:", rerr)
+	}
+
+	if err := (&data.LoLRetriever{}).Init(); err != nil {
+		log.Fatal("Couldn't open the game store:", err)
+	}
+
+	// Load all summoner data, then keep checking for new and renamed
+	// summoners.
+	refresher := new_refresher(load_summoners)
+	if _, err := refresher.refresh(); err != nil {
+		log.Fatal("Couldn't load summoners:", err)
+	}
+	log.Println(fmt.Sprintf("Loaded %d summoners from backend.", refresher.live.get().Len()))
+	go refresher.run(*REFRESH)
+
+	go serve_grpc(GRPC_PORT, refresher.live, security)
 
 	log.Println("Opening port...")
-	manager := query.QueryManager{}
-	manager.Connect(14004)
+	manager := query.QueryManager{Security: security}
+	manager.Connect(PORT)
+
+	service := registry.Service{Name: "nameserver", Address: *ADVERTISE}
+	if len(service.Address) == 0 {
+		service.Address = registry.LocalAddress(PORT)
+	}
+	registry.Announce(reg, service, nil, 0)
 
 	log.Println("Nameserver ready.")
-	for {
-		request := manager.Listen(&proto.NameRequest{})
-		go handle_request(&request, summoner_map, &manager)
+	requests := manager.Requests(func() gproto.Message { return &proto.NameRequest{} })
+	for request := range requests {
+		request := request
+		go handle_request(&request, refresher.live, &manager)
 	}
 }
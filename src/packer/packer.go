@@ -6,6 +6,7 @@ package main
 
 import (
 	gproto "code.google.com/p/goprotobuf/proto"
+	data "datamodel"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -17,12 +18,14 @@ import (
 	"net/http"
 	"proto"
 	"regexp"
+	"registry"
 	"strings"
 	"time"
 )
 
 var API_KEY = flag.String("apikey", "", "Riot API key")
 var RECORD_COUNT = flag.Int("records", 0, "Maximum number of records retrieved")
+var WRITE_SUMMARIES = flag.Bool("summaries", false, "Also write the game summaries side-store to all.summaries")
 
 /**
  * StaticRequestInfo defines the data that should be extracted from the
@@ -110,6 +113,65 @@ func write_statics(filename string, pcgl libcleo.LivePCGL) {
 	log.Println(fmt.Sprintf("Written static champion file to %s", filename))
 }
 
+/**
+ * The summary of each player in a game, for the game summaries side-store
+ * (see summaries.proto), which lets lolstat look at more than just wins
+ * and losses.
+ */
+func summary_players(game *data.GameRecord) []libcleo.SummaryPlayer {
+	players := make([]libcleo.SummaryPlayer, 0, 10)
+	for _, team := range game.Teams {
+		for _, player := range team.Players {
+			players = append(players, libcleo.SummaryPlayer{
+				Champion: libcleo.Rid2Cleo(player.Champion),
+				Victory:  team.Victory,
+				HasStats: player.IsSet,
+				Kills:    player.Kills,
+				Deaths:   player.Deaths,
+				Assists:  player.Assists,
+				Gold:     player.GoldEarned,
+				Minions:  player.Minions,
+			})
+		}
+	}
+	return players
+}
+
+/**
+ * Writes the game summaries side-store. The summaries are built while the
+ * games are packed, one per compact game ID, so only their columns are
+ * ever kept in memory.
+ */
+func write_summaries(filename string, summaries *libcleo.LiveSummaries) {
+	bytes, _ := gproto.Marshal(summaries.Columns)
+	if err := ioutil.WriteFile(filename, bytes, 0644); err != nil {
+		log.Println("Could not write game summaries:", err)
+		return
+	}
+	log.Println(fmt.Sprintf("Written %d game summaries to %s", len(summaries.Columns.Duration), filename))
+}
+
+/**
+ * Writes the map from compact game ID's back to Riot's game ID's. Lolstat
+ * uses it to label the sample games in debug traces so that they can be
+ * looked up in the game store.
+ */
+func write_game_ids(filename string, gid_map map[uint64]libcleo.GameId) {
+	packed := proto.PackedGameIdMap{}
+	packed.RiotId = make([]uint64, len(gid_map))
+
+	for riot_id, gid := range gid_map {
+		packed.RiotId[gid] = riot_id
+	}
+
+	bytes, _ := gproto.Marshal(&packed)
+	if err := ioutil.WriteFile(filename, bytes, 0644); err != nil {
+		log.Println("Could not write game ID map:", err)
+		return
+	}
+	log.Println(fmt.Sprintf("Written %d game ID's to %s", len(packed.RiotId), filename))
+}
+
 func main() {
 	// TODO: Make this part optional via a command line flag.
 	flag.Parse()
@@ -123,69 +185,73 @@ func main() {
 	pcgl.All = make([]libcleo.GameId, 0, 100)
 
 	// Read all records from Mongo.
-	session, _ := mgo.Dial("127.0.0.1:27017")
+	address, rerr := registry.Lookup("mongo-local")
+	if rerr != nil {
+		log.Fatal("Couldn't find Mongo in the service registry:", rerr)
+	}
+	session, _ := mgo.Dial(address)
 	games_collection := session.DB("lolstat").C("games")
 	defer session.Close()
 	log.Println("Connection to MongoDB instance established.")
 
 	gid_map := make(map[uint64]libcleo.GameId)
 	var next_gid libcleo.GameId = 0
+	summaries := libcleo.LiveSummaries{Columns: &proto.PackedGameSummaries{}}
 
 	// For each record:
 	//	- Get all champions. For each champion:
 	//		- If team won, add game id to pcgl.Champions[champion].Winning
 	//		- If loss, add to .Losing
 	//		- In all cases add to pcgl.All
-	result := libcleo.RecordContainer{}
 	query := games_collection.Find(bson.M{})
 	result_iter := query.Iter()
 	total_count, _ := query.Count()
 	current := 1
 
-	for result_iter.Next(&result) {
+	for {
+		game := data.GameRecord{}
+		if !result_iter.Next(&game) {
+			break
+		}
 		fmt.Print(fmt.Sprintf("Packing %d of %d...", current, total_count), "\r")
 
-		game := proto.GameRecord{}
-		gproto.Unmarshal(result.GameData, &game)
-
 		// Map game ID's to something much closer to zero (and tightly
 		// packed). This will make it possible to work in 32-bit land
 		// at serving time until we get beyond 4B games. That's far away.
-		gid, exists := gid_map[*game.GameId]
-		if exists {
-			game.GameId = gproto.Uint64(uint64(gid))
-		} else {
-			gid_map[*game.GameId] = next_gid
-			game.GameId = gproto.Uint64(uint64(next_gid))
+		gid, exists := gid_map[game.GameId]
+		if !exists {
+			gid = next_gid
+			gid_map[game.GameId] = gid
 
 			next_gid += 1
+
+			// Summaries are appended in game ID order.
+			if *WRITE_SUMMARIES {
+				summaries.Append(game.Timestamp, game.Duration, summary_players(&game))
+			}
 		}
 
 		for _, team := range game.Teams {
 			for _, player := range team.Players {
-				_, exists := pcgl.Champions[*player.Champion]
-
-				if !exists {
-					pcgl.Champions[*player.Champion] = libcleo.LivePCGLRecord{}
-				}
+				champion := libcleo.Rid2Cleo(player.Champion)
 				// Copy this value out. We'll need to reassign a bit later once
 				// the necessary modifications have been made.
-				r := pcgl.Champions[*player.Champion]
+				r := pcgl.Champions[champion]
 
 				// If the team won, add this game to this champion's win
 				// pool.
-				if *team.Victory {
-					r.Winning = append(pcgl.Champions[*player.Champion].Winning, libcleo.GameId(*game.GameId))
+				if team.Victory {
+					r.Winning = append(r.Winning, gid)
 					// If they lost, add it to the loss pool.
 				} else {
-					r.Losing = append(pcgl.Champions[*player.Champion].Losing, libcleo.GameId(*game.GameId))
+					r.Losing = append(r.Losing, gid)
 				}
 				// Reassign to the master struct
-				pcgl.Champions[*player.Champion] = r
+				pcgl.Champions[champion] = r
 			}
 		}
 
-		pcgl.All = append(pcgl.All, libcleo.GameId(*game.GameId))
+		pcgl.All = append(pcgl.All, gid)
 
 		// Optional: once RECORD_COUNT records have been written, stop writing more. If this value
 		// isn't provided then it defaults to zero, which will never be hit in this loop.
@@ -231,5 +297,10 @@ func main() {
 		log.Println(fmt.Sprintf("Successfully wrote %d records to all.pcgl.", len(packed_pcgl.All)))
 	}
 
+	write_game_ids("all.gidmap", gid_map)
+	if *WRITE_SUMMARIES {
+		write_summaries("all.summaries", &summaries)
+	}
+
 	write_statics("html/static/data/metadata.json", pcgl)
 }
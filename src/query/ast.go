@@ -0,0 +1,130 @@
+package query
+
+// The abstract syntax tree produced by Parse(). A query is a boolean
+// expression over filters, each of which may be scoped to a team with a
+// selector:
+//
+//   select winner:champion(thresh) and not loser:champion(leona);
+//
+// Here "winner" is the selector, "champion" is the filter and "thresh" is
+// its only argument.
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type Node interface {
+	Pos() Position
+	String() string
+}
+
+type Query struct {
+	Where Node
+
+	// The registry the query was parsed with, which is also used to
+	// compile it.
+	registry *Registry
+}
+
+type AndNode struct {
+	Left  Node
+	Right Node
+}
+
+type OrNode struct {
+	Left  Node
+	Right Node
+}
+
+type NotNode struct {
+	Operand Node
+	Start   Position
+}
+
+type FilterNode struct {
+	// The team the filter applies to. Empty for game-level filters.
+	Selector string
+	Name     string
+	Args     []Arg
+
+	Start Position
+}
+
+type ArgType int
+
+const (
+	ARG_NAME   ArgType = iota
+	ARG_NUMBER ArgType = iota
+	ARG_DATE   ArgType = iota
+	// Durations are written like 25m or 1h30m.
+	ARG_DURATION ArgType = iota
+)
+
+var arg_type_names = map[ArgType]string{
+	ARG_NAME:     "name",
+	ARG_NUMBER:   "number",
+	ARG_DATE:     "date (YYYY-MM-DD)",
+	ARG_DURATION: "duration (e.g. 25m)",
+}
+
+func (t ArgType) String() string {
+	return arg_type_names[t]
+}
+
+// Arg is a single typed filter argument. Only the field matching Type is
+// set, though Text always holds the original text.
+type Arg struct {
+	Type     ArgType
+	Text     string
+	Number   float64
+	Date     time.Time
+	Duration time.Duration
+
+	Start Position
+}
+
+func (q *Query) String() string {
+	return fmt.Sprintf("select %s", q.Where)
+}
+
+func (n *AndNode) Pos() Position {
+	return n.Left.Pos()
+}
+
+func (n *AndNode) String() string {
+	return fmt.Sprintf("(and %s %s)", n.Left, n.Right)
+}
+
+func (n *OrNode) Pos() Position {
+	return n.Left.Pos()
+}
+
+func (n *OrNode) String() string {
+	return fmt.Sprintf("(or %s %s)", n.Left, n.Right)
+}
+
+func (n *NotNode) Pos() Position {
+	return n.Start
+}
+
+func (n *NotNode) String() string {
+	return fmt.Sprintf("(not %s)", n.Operand)
+}
+
+func (n *FilterNode) Pos() Position {
+	return n.Start
+}
+
+func (n *FilterNode) String() string {
+	args := make([]string, 0, len(n.Args))
+	for _, arg := range n.Args {
+		args = append(args, arg.Text)
+	}
+
+	if len(n.Selector) > 0 {
+		return fmt.Sprintf("%s:%s(%s)", n.Selector, n.Name, strings.Join(args, ","))
+	}
+	return fmt.Sprintf("%s(%s)", n.Name, strings.Join(args, ","))
+}
@@ -0,0 +1,168 @@
+package query
+
+// Messages between cleo services are sent as frames:
+//
+//   [version: 1 byte] [kind: 1 byte] [length: uvarint] [payload: length bytes]
+//
+// The payload is a serialized protobuf: the request or response itself for
+// FRAME_MESSAGE, or a proto.WireError for FRAME_ERROR. Unlike the old
+// '|'-terminated format, payloads can contain any bytes.
+
+import (
+	gproto "code.google.com/p/goprotobuf/proto"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"proto"
+	"time"
+)
+
+const PROTOCOL_VERSION byte = 1
+
+const (
+	FRAME_MESSAGE byte = iota
+	FRAME_ERROR   byte = iota
+)
+
+// Frames larger than this are rejected without being read.
+const MAX_FRAME_SIZE = 16 * 1024 * 1024
+
+const DEFAULT_READ_TIMEOUT = 30 * time.Second
+const DEFAULT_WRITE_TIMEOUT = 10 * time.Second
+
+var ErrFrameTooLarge = errors.New("frame is larger than the maximum frame size")
+
+// UnsupportedVersionError is returned when a frame was written with a
+// protocol version this end doesn't speak.
+type UnsupportedVersionError struct {
+	Version byte
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("unsupported protocol version %d (expected %d)", e.Version, PROTOCOL_VERSION)
+}
+
+// RemoteError is returned by ReadMessage when the other end replied with an
+// error frame.
+type RemoteError struct {
+	Code    proto.WireError_Code
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// WriteMessage writes MSG as a single frame. A TIMEOUT of zero means no
+// deadline.
+func WriteMessage(conn net.Conn, msg gproto.Message, timeout time.Duration) error {
+	payload, err := gproto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return write_frame(conn, FRAME_MESSAGE, payload, timeout)
+}
+
+// WriteError writes an error frame in place of a response.
+func WriteError(conn net.Conn, code proto.WireError_Code, message string, timeout time.Duration) error {
+	payload, err := gproto.Marshal(&proto.WireError{Code: code.Enum(), Message: gproto.String(message)})
+	if err != nil {
+		return err
+	}
+
+	return write_frame(conn, FRAME_ERROR, payload, timeout)
+}
+
+// ReadMessage reads a single frame into MSG. If the frame is an error frame
+// then MSG is left alone and a *RemoteError is returned.
+func ReadMessage(conn net.Conn, msg gproto.Message, timeout time.Duration) error {
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	// Reading one byte at a time for the header means nothing past the end
+	// of this frame is consumed.
+	reader := byteReader{conn: conn}
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != PROTOCOL_VERSION {
+		return &UnsupportedVersionError{Version: header[0]}
+	}
+
+	length, err := binary.ReadUvarint(&reader)
+	if err != nil {
+		return err
+	}
+	if length > MAX_FRAME_SIZE {
+		return ErrFrameTooLarge
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return err
+	}
+
+	switch header[1] {
+	case FRAME_MESSAGE:
+		return gproto.Unmarshal(payload, msg)
+	case FRAME_ERROR:
+		wire_error := proto.WireError{}
+		if err := gproto.Unmarshal(payload, &wire_error); err != nil {
+			return err
+		}
+		return &RemoteError{Code: wire_error.GetCode(), Message: wire_error.GetMessage()}
+	}
+
+	return fmt.Errorf("unknown frame kind %d", header[1])
+}
+
+// Call sends a request on CONN and waits for the response. Timeouts of
+// zero use the defaults.
+func Call(conn net.Conn, request gproto.Message, response gproto.Message, timeout time.Duration) error {
+	if timeout == 0 {
+		timeout = DEFAULT_READ_TIMEOUT
+	}
+
+	if err := WriteMessage(conn, request, DEFAULT_WRITE_TIMEOUT); err != nil {
+		return err
+	}
+	return ReadMessage(conn, response, timeout)
+}
+
+func write_frame(conn net.Conn, kind byte, payload []byte, timeout time.Duration) error {
+	if len(payload) > MAX_FRAME_SIZE {
+		return ErrFrameTooLarge
+	}
+
+	if timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+
+	frame := make([]byte, 2+binary.MaxVarintLen64, 2+binary.MaxVarintLen64+len(payload))
+	frame[0] = PROTOCOL_VERSION
+	frame[1] = kind
+	n := binary.PutUvarint(frame[2:], uint64(len(payload)))
+	frame = append(frame[:2+n], payload...)
+
+	_, err := conn.Write(frame)
+	return err
+}
+
+type byteReader struct {
+	conn net.Conn
+	buf  [1]byte
+}
+
+func (r *byteReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(r.conn, r.buf[:]); err != nil {
+		return 0, err
+	}
+	return r.buf[0], nil
+}
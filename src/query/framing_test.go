@@ -0,0 +1,66 @@
+package query
+
+import gproto "code.google.com/p/goprotobuf/proto"
+import "net"
+import "proto"
+import "testing"
+import "time"
+
+func TestFrameRoundTrip(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// 0x7C is '|', which used to end a message early.
+	sent := proto.NameRequest{Name: gproto.String("a|b\x7c")}
+	go WriteMessage(client, &sent, time.Second)
+
+	received := proto.NameRequest{}
+	if err := ReadMessage(server, &received, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if received.GetName() != sent.GetName() {
+		t.Error("Unexpected name:", received.GetName())
+	}
+}
+
+func TestFrameErrors(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go WriteError(server, proto.WireError_BAD_REQUEST, "no thanks", time.Second)
+
+	err := ReadMessage(client, &proto.NameResponse{}, time.Second)
+	remote, ok := err.(*RemoteError)
+	if !ok || remote.Code != proto.WireError_BAD_REQUEST || remote.Message != "no thanks" {
+		t.Error("Expected a bad request error, got", err)
+	}
+
+	// Frames from an unknown protocol version are rejected.
+	go client.Write([]byte{PROTOCOL_VERSION + 1, FRAME_MESSAGE, 0})
+	if _, ok := ReadMessage(server, &proto.NameRequest{}, time.Second).(*UnsupportedVersionError); !ok {
+		t.Error("Expected an unsupported version error")
+	}
+
+	// As are frames that claim to be huge.
+	client, server = net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go client.Write([]byte{PROTOCOL_VERSION, FRAME_MESSAGE, 0xff, 0xff, 0xff, 0xff, 0x0f})
+	if err := ReadMessage(server, &proto.NameRequest{}, time.Second); err != ErrFrameTooLarge {
+		t.Error("Expected a frame size error, got", err)
+	}
+}
+
+func TestFrameDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	err := ReadMessage(server, &proto.NameRequest{}, 10*time.Millisecond)
+	if net_err, ok := err.(net.Error); !ok || !net_err.Timeout() {
+		t.Error("Expected a timeout, got", err)
+	}
+}
@@ -0,0 +1,187 @@
+package query
+
+// The lexer splits query text into tokens. Each token remembers where it
+// came from so that parse errors can point at the offending text.
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type TokenType int
+
+const (
+	TOKEN_EOF    TokenType = iota
+	TOKEN_IDENT  TokenType = iota
+	TOKEN_NUMBER TokenType = iota
+	TOKEN_STRING TokenType = iota
+	TOKEN_LPAREN TokenType = iota
+	TOKEN_RPAREN TokenType = iota
+	TOKEN_COMMA  TokenType = iota
+	TOKEN_COLON  TokenType = iota
+	TOKEN_SEMI   TokenType = iota
+	// Keywords
+	TOKEN_SELECT TokenType = iota
+	TOKEN_AND    TokenType = iota
+	TOKEN_OR     TokenType = iota
+	TOKEN_NOT    TokenType = iota
+)
+
+var token_names = map[TokenType]string{
+	TOKEN_EOF:    "end of query",
+	TOKEN_IDENT:  "name",
+	TOKEN_NUMBER: "number",
+	TOKEN_STRING: "string",
+	TOKEN_LPAREN: "'('",
+	TOKEN_RPAREN: "')'",
+	TOKEN_COMMA:  "','",
+	TOKEN_COLON:  "':'",
+	TOKEN_SEMI:   "';'",
+	TOKEN_SELECT: "'select'",
+	TOKEN_AND:    "'and'",
+	TOKEN_OR:     "'or'",
+	TOKEN_NOT:    "'not'",
+}
+
+var keywords = map[string]TokenType{
+	"select": TOKEN_SELECT,
+	"and":    TOKEN_AND,
+	"or":     TOKEN_OR,
+	"not":    TOKEN_NOT,
+}
+
+func (t TokenType) String() string {
+	return token_names[t]
+}
+
+// Position identifies a location in the query text. Lines and columns
+// both start at one.
+type Position struct {
+	Line   int
+	Column int
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("line %d, column %d", p.Line, p.Column)
+}
+
+type Token struct {
+	Type  TokenType
+	Text  string
+	Start Position
+}
+
+func (t Token) String() string {
+	if t.Type == TOKEN_EOF {
+		return t.Type.String()
+	}
+
+	return fmt.Sprintf("'%s'", t.Text)
+}
+
+// ParseError describes a problem with the query text and where it is.
+type ParseError struct {
+	Position Position
+	Message  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Position, e.Message)
+}
+
+func errorf(pos Position, format string, args ...interface{}) *ParseError {
+	return &ParseError{Position: pos, Message: fmt.Sprintf(format, args...)}
+}
+
+// Tokenize converts query text into a list of tokens that always ends
+// with a TOKEN_EOF. Comments start with '#' and run to the end of the
+// line.
+func tokenize(text string) ([]Token, error) {
+	tokens := make([]Token, 0, 32)
+	runes := []rune(text)
+	pos := Position{Line: 1, Column: 1}
+
+	i := 0
+	// Advance past N runes, keeping track of the line and column.
+	advance := func(n int) {
+		for ; n > 0; n-- {
+			if runes[i] == '\n' {
+				pos.Line += 1
+				pos.Column = 1
+			} else {
+				pos.Column += 1
+			}
+			i += 1
+		}
+	}
+
+	for i < len(runes) {
+		r := runes[i]
+		start := pos
+
+		switch {
+		case unicode.IsSpace(r):
+			advance(1)
+		case r == '#':
+			for i < len(runes) && runes[i] != '\n' {
+				advance(1)
+			}
+		case r == '(':
+			tokens = append(tokens, Token{TOKEN_LPAREN, "(", start})
+			advance(1)
+		case r == ')':
+			tokens = append(tokens, Token{TOKEN_RPAREN, ")", start})
+			advance(1)
+		case r == ',':
+			tokens = append(tokens, Token{TOKEN_COMMA, ",", start})
+			advance(1)
+		case r == ':':
+			tokens = append(tokens, Token{TOKEN_COLON, ":", start})
+			advance(1)
+		case r == ';':
+			tokens = append(tokens, Token{TOKEN_SEMI, ";", start})
+			advance(1)
+		case r == '"' || r == '\'':
+			// Quoted strings can contain anything except their own quote
+			// character and can't span lines.
+			j := i + 1
+			for j < len(runes) && runes[j] != r && runes[j] != '\n' {
+				j += 1
+			}
+			if j >= len(runes) || runes[j] != r {
+				return nil, errorf(start, "unterminated string")
+			}
+			tokens = append(tokens, Token{TOKEN_STRING, string(runes[i+1 : j]), start})
+			advance(j - i + 1)
+		case unicode.IsDigit(r):
+			// Numbers can carry a unit suffix (25m) and dates are
+			// written as numbers with dashes (2014-09-01), so both are
+			// lexed as a single NUMBER token.
+			j := i
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '.' || runes[j] == '-') {
+				j += 1
+			}
+			tokens = append(tokens, Token{TOKEN_NUMBER, string(runes[i:j]), start})
+			advance(j - i)
+		case unicode.IsLetter(r) || r == '_':
+			j := i
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_') {
+				j += 1
+			}
+			word := string(runes[i:j])
+
+			if kw, exists := keywords[strings.ToLower(word)]; exists {
+				tokens = append(tokens, Token{kw, word, start})
+			} else {
+				tokens = append(tokens, Token{TOKEN_IDENT, word, start})
+			}
+			advance(j - i)
+		default:
+			return nil, errorf(start, "unexpected character '%c'", r)
+		}
+	}
+
+	tokens = append(tokens, Token{TOKEN_EOF, "", pos})
+	return tokens, nil
+}
@@ -1,11 +1,74 @@
 package query
 
-import "testing"
 import "io/ioutil"
+import "strings"
+import "testing"
 
 func TestParse1(t *testing.T) {
-	fp := io.Open("queries/thresh.lkg")
-	query_text := string(ioutil.ReadAll(fp))
+	query_text, err := ioutil.ReadFile("queries/thresh.lkg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parse_tree, perr := ParseWith(string(query_text), test_registry())
+	if perr != nil {
+		t.Fatal(perr)
+	}
+
+	if parse_tree.String() != "select (and winner:champion(thresh) (not loser:champion(leona)))" {
+		t.Error("Unexpected parse tree:", parse_tree)
+	}
+}
+
+func TestParsePrecedence(t *testing.T) {
+	parse_tree, err := ParseWith("select ally:champion(ahri) or ally:champion(zed) and not enemy:champion(lux)", test_registry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// "and" binds more tightly than "or".
+	if parse_tree.String() != "select (or ally:champion(ahri) (and ally:champion(zed) (not enemy:champion(lux))))" {
+		t.Error("Unexpected parse tree:", parse_tree)
+	}
+}
+
+func TestParseGroups(t *testing.T) {
+	parse_tree, err := ParseWith("SELECT (ally:champion(ahri) or ally:champion(zed)) and queue(ranked) date(2014-09-01, 2014-09-30);", test_registry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parse_tree.String() != "select (and (and (or ally:champion(ahri) ally:champion(zed)) queue(ranked)) date(2014-09-01,2014-09-30))" {
+		t.Error("Unexpected parse tree:", parse_tree)
+	}
+}
+
+// Each bad query should fail with an error that mentions the given text.
+func TestParseErrors(t *testing.T) {
+	cases := map[string]string{
+		"winner:champion(thresh)":                 "expected 'select'",
+		"select":                                  "at least one filter",
+		"select winner:champion(thresh":           "expected ')'",
+		"select captain:champion(thresh)":         "unknown selector 'captain'",
+		"select winner:hero(thresh)":              "unknown filter 'hero'",
+		"select champion(thresh)":                 "needs a selector",
+		"select winner:queue(ranked)":             "can't have a selector",
+		"select date(2014-09-01)":                 "expects 2 argument(s)",
+		"select date(yesterday, today)":           "expects a date",
+		"select (winner:champion(thresh)":         "to close the group opened at line 1, column 8",
+		"select winner:champion(thresh) )":        "unexpected ')'",
+		"select winner:champion(thresh) $":        "unexpected character '$'",
+		"select winner:champion(\"thresh)":        "unterminated string",
+		"select\n  winner:champion(thresh)\n  or": "line 3, column 5",
+	}
+
+	for text, expected := range cases {
+		_, err := ParseWith(text, test_registry())
 
-	parse_tree := Parse(query_text)
+		if err == nil {
+			t.Error("Expected an error for:", text)
+		} else if !strings.Contains(err.Error(), expected) {
+			t.Error("Error for", text, "was", err, "; expected it to contain", expected)
+		}
+	}
 }
@@ -1,58 +1,274 @@
 package query
 
-/*
-import "errors"
+// Parse converts query text into an AST. The grammar is:
+//
+//   query    := "select" or_expr [";"]
+//   or_expr  := and_expr { "or" and_expr }
+//   and_expr := not_expr { ["and"] not_expr }
+//   not_expr := "not" not_expr | "(" or_expr ")" | filter
+//   filter   := [selector ":"] name "(" [arg { "," arg }] ")"
+//
+// Filters that follow each other without an operator are joined with an
+// implicit "and", so a query can be written one filter per line.
 
-const ParseOperation (
-	PARSE_SELECT = iota
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
-type ParseTree struct {
-	Operation ParseOperation
+type parser struct {
+	tokens   []Token
+	next     int
+	registry *Registry
 }
 
-func Parse(text string) ParseTree {
-	tokens := tokenize(text)
+// Parse parses a query using the selectors and filters in the
+// DefaultRegistry.
+func Parse(text string) (*Query, error) {
+	return ParseWith(text, DefaultRegistry)
+}
+
+func ParseWith(text string, registry *Registry) (*Query, error) {
+	tokens, err := tokenize(text)
+	if err != nil {
+		return nil, err
+	}
+
+	p := parser{tokens: tokens, registry: registry}
+	return p.query()
+}
 
-	parse_tree := ParseTree{}
-	err := pStart(tokens, &parse_tree)
+func (p *parser) peek() Token {
+	return p.tokens[p.next]
+}
+
+func (p *parser) consume() Token {
+	tok := p.tokens[p.next]
 
-	return parse_tree
+	// Never move past the EOF token.
+	if tok.Type != TOKEN_EOF {
+		p.next += 1
+	}
+	return tok
 }
 
-func pStart() (tokens []string, parse_tree *ParseTree) *ParseTree, errors.error {
-	// The only valid pStart token is "select"
-	if tokens[0] == "select" {
-		parse_tree.Operation = PARSE_SELECT
+func (p *parser) expect(tt TokenType, context string) (Token, error) {
+	tok := p.consume()
+
+	if tok.Type != tt {
+		return tok, errorf(tok.Start, "expected %s %s but found %s", tt, context, tok)
+	}
+	return tok, nil
+}
+
+func (p *parser) query() (*Query, error) {
+	if _, err := p.expect(TOKEN_SELECT, "at the start of the query"); err != nil {
+		return nil, err
+	}
+
+	if p.peek().Type == TOKEN_EOF || p.peek().Type == TOKEN_SEMI {
+		return nil, errorf(p.peek().Start, "expected at least one filter after 'select'")
+	}
+
+	where, err := p.or_expr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peek().Type == TOKEN_SEMI {
+		p.consume()
+	}
+
+	if tok := p.peek(); tok.Type != TOKEN_EOF {
+		return nil, errorf(tok.Start, "unexpected %s after the end of the query", tok)
+	}
+
+	return &Query{Where: where, registry: p.registry}, nil
+}
+
+func (p *parser) or_expr() (Node, error) {
+	left, err := p.and_expr()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().Type == TOKEN_OR {
+		p.consume()
+
+		right, err := p.and_expr()
+		if err != nil {
+			return nil, err
+		}
+		left = &OrNode{Left: left, Right: right}
+	}
+
+	return left, nil
+}
+
+// Starts_operand returns true if the token can begin a not_expr, which is
+// how implicit "and"s are detected.
+func starts_operand(tok Token) bool {
+	return tok.Type == TOKEN_NOT || tok.Type == TOKEN_LPAREN || tok.Type == TOKEN_IDENT
+}
+
+func (p *parser) and_expr() (Node, error) {
+	left, err := p.not_expr()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().Type == TOKEN_AND || starts_operand(p.peek()) {
+		if p.peek().Type == TOKEN_AND {
+			p.consume()
+		}
 
-		pt, err = pSelectors(tokens[1:])
-		if pt == nil {
-			return _, err
+		right, err := p.not_expr()
+		if err != nil {
+			return nil, err
 		}
-	} else {
-		return nil, errors.New("Invalid starting token.")
+		left = &AndNode{Left: left, Right: right}
 	}
+
+	return left, nil
 }
 
-func pSelectors(tokens []string, parse_tree *ParseTree) *ParseTree, errors.error {
-	if tokens[1] == "contains" || tokens[1] == "has" || {
+func (p *parser) not_expr() (Node, error) {
+	tok := p.peek()
+
+	switch tok.Type {
+	case TOKEN_NOT:
+		p.consume()
 
-	} else {
+		operand, err := p.not_expr()
+		if err != nil {
+			return nil, err
+		}
+		return &NotNode{Operand: operand, Start: tok.Start}, nil
+	case TOKEN_LPAREN:
+		p.consume()
 
+		inner, err := p.or_expr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(TOKEN_RPAREN, "to close the group opened at "+tok.Start.String()); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	case TOKEN_IDENT:
+		return p.filter()
 	}
 
+	return nil, errorf(tok.Start, "expected a filter, 'not' or '(' but found %s", tok)
 }
 
-func pEnd(tokens []string, parse_tree *ParseTree) *ParseTree, errors.error {
-	if tokens[0] == ";" {
-		return parse_tree, nil
-	} else {
-		return nil, nil
+func (p *parser) filter() (Node, error) {
+	first := p.consume()
+	node := FilterNode{Start: first.Start}
+
+	// A colon means the first name was a selector.
+	if p.peek().Type == TOKEN_COLON {
+		p.consume()
+		node.Selector = strings.ToLower(first.Text)
+
+		if _, exists := p.registry.Selector(node.Selector); !exists {
+			return nil, errorf(first.Start, "unknown selector '%s'; expected one of %s", first.Text, p.registry.Selectors())
+		}
+
+		name, err := p.expect(TOKEN_IDENT, "after '"+first.Text+":'")
+		if err != nil {
+			return nil, err
+		}
+		first = name
 	}
+	node.Name = strings.ToLower(first.Text)
+
+	spec, exists := p.registry.Filter(node.Name)
+	if !exists {
+		return nil, errorf(first.Start, "unknown filter '%s'; expected one of %s", first.Text, p.registry.Filters())
+	}
+	if spec.Team && len(node.Selector) == 0 {
+		return nil, errorf(first.Start, "filter '%s' applies to a team and needs a selector, e.g. winner:%s(...)", node.Name, node.Name)
+	}
+	if !spec.Team && len(node.Selector) > 0 {
+		return nil, errorf(node.Start, "filter '%s' applies to the whole game and can't have a selector", node.Name)
+	}
+
+	if _, err := p.expect(TOKEN_LPAREN, "after filter '"+node.Name+"'"); err != nil {
+		return nil, err
+	}
+
+	// Read the (possibly empty) argument list.
+	for p.peek().Type != TOKEN_RPAREN {
+		if p.peek().Type == TOKEN_EOF {
+			return nil, errorf(p.peek().Start, "expected ')' to close the arguments to '%s' but found %s", node.Name, p.peek())
+		}
+
+		if len(node.Args) > 0 {
+			if _, err := p.expect(TOKEN_COMMA, "or ')' after an argument to '"+node.Name+"'"); err != nil {
+				return nil, err
+			}
+		}
+
+		tok := p.consume()
+		if tok.Type != TOKEN_IDENT && tok.Type != TOKEN_STRING && tok.Type != TOKEN_NUMBER {
+			return nil, errorf(tok.Start, "expected an argument to '%s' but found %s", node.Name, tok)
+		}
+		if len(node.Args) >= len(spec.Params) {
+			return nil, errorf(tok.Start, "too many arguments to '%s'; expected %d", node.Name, len(spec.Params))
+		}
+
+		arg, err := convert_arg(tok, spec.Params[len(node.Args)], node.Name)
+		if err != nil {
+			return nil, err
+		}
+		node.Args = append(node.Args, arg)
+	}
+	rparen := p.consume()
+
+	if len(node.Args) != len(spec.Params) {
+		return nil, errorf(rparen.Start, "'%s' expects %d argument(s) but got %d", node.Name, len(spec.Params), len(node.Args))
+	}
+
+	return &node, nil
 }
 
+// Convert_arg checks that a token can be used as an argument of the given
+// type and converts it.
+func convert_arg(tok Token, at ArgType, filter string) (Arg, error) {
+	arg := Arg{Type: at, Text: tok.Text, Start: tok.Start}
+
+	switch at {
+	case ARG_NAME:
+		if tok.Type == TOKEN_NUMBER {
+			return arg, errorf(tok.Start, "'%s' expects a %s but found %s", filter, at, tok)
+		}
+	case ARG_NUMBER:
+		value, err := strconv.ParseFloat(tok.Text, 64)
+		if tok.Type != TOKEN_NUMBER || err != nil {
+			return arg, errorf(tok.Start, "'%s' expects a %s but found %s", filter, at, tok)
+		}
+		arg.Number = value
+	case ARG_DATE:
+		value, err := time.Parse("2006-01-02", tok.Text)
+		if err != nil {
+			return arg, errorf(tok.Start, "'%s' expects a %s but found %s", filter, at, tok)
+		}
+		arg.Date = value
+	case ARG_DURATION:
+		value, err := time.ParseDuration(tok.Text)
+		if tok.Type != TOKEN_NUMBER || err != nil {
+			return arg, errorf(tok.Start, "'%s' expects a %s but found %s", filter, at, tok)
+		}
+		arg.Duration = value
+	}
+
+	return arg, nil
+}
 
-func tokenize(full string) []string {
-	return nil
+func sorted_list(names []string) string {
+	sort.Strings(names)
+	return strings.Join(names, ", ")
 }
-*/
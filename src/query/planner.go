@@ -0,0 +1,405 @@
+package query
+
+// The planner compiles a parsed query into a tree of posting list
+// operations (intersections, unions and differences over sorted lists of
+// game ID's) that can be evaluated against an index like lolstat's PCGL.
+// The posting lists themselves come from the filters in the registry.
+//
+// Each query is compiled twice: once as written (the MATCHING plan) and
+// once mirrored, with every team swapped so that the winners' filters
+// apply to the losers and vice versa (the OPPOSITE plan). The games a query is AVAILABLE in are the union of the two, which mirrors
+// the matching / available counts of a team query. Queries that don't
+// refer to either team have no opposite, and so no win rate.
+
+import (
+	"fmt"
+	"libcleo"
+)
+
+type PlanOp int
+
+const (
+	// Every game in the index.
+	PLAN_ALL PlanOp = iota
+	// The games that pass a single filter.
+	PLAN_FILTER    PlanOp = iota
+	PLAN_INTERSECT PlanOp = iota
+	PLAN_UNION     PlanOp = iota
+	// The first child minus all of the others.
+	PLAN_DIFFERENCE PlanOp = iota
+)
+
+// Side is the absolute team a posting list refers to once a selector has
+// been resolved.
+type Side int
+
+const (
+	SIDE_GAME    Side = iota
+	SIDE_WINNING Side = iota
+	SIDE_LOSING  Side = iota
+)
+
+var side_names = map[Side]string{
+	SIDE_GAME:    "game",
+	SIDE_WINNING: "winning",
+	SIDE_LOSING:  "losing",
+}
+
+func (s Side) String() string {
+	return side_names[s]
+}
+
+// PostingKey identifies a single filter applied to a side of the game.
+type PostingKey struct {
+	Filter string
+	Side   Side
+	Args   []Arg
+
+	Start Position
+}
+
+func (k PostingKey) String() string {
+	args := ""
+	for i, arg := range k.Args {
+		if i > 0 {
+			args += ","
+		}
+		args += arg.Text
+	}
+	return fmt.Sprintf("%s:%s(%s)", k.Side, k.Filter, args)
+}
+
+type Plan struct {
+	Op       PlanOp
+	Key      PostingKey
+	Spec     FilterSpec
+	Children []*Plan
+}
+
+func (p *Plan) String() string {
+	switch p.Op {
+	case PLAN_ALL:
+		return "all"
+	case PLAN_FILTER:
+		return p.Key.String()
+	}
+
+	names := map[PlanOp]string{PLAN_INTERSECT: "intersect", PLAN_UNION: "union", PLAN_DIFFERENCE: "difference"}
+	out := "(" + names[p.Op]
+	for _, child := range p.Children {
+		out += " " + child.String()
+	}
+	return out + ")"
+}
+
+// Index is the data a plan is evaluated against. The planner only needs
+// the full list of games; filters know how to get anything else they need
+// out of the game-specific index they were registered for.
+type Index interface {
+	All() []libcleo.GameId
+}
+
+type CompiledQuery struct {
+	Matching *Plan
+	Opposite *Plan
+	// Whether the query refers to either team. If not, the opposite plan
+	// is identical to the matching plan, every available game matches and
+	// there's no win rate to speak of.
+	Sided bool
+}
+
+// Compile plans a query using the registry it was parsed with.
+func Compile(q *Query) (*CompiledQuery, error) {
+	c := compiler{registry: q.registry}
+	if c.registry == nil {
+		c.registry = DefaultRegistry
+	}
+
+	cq := CompiledQuery{}
+	cq.Sided = c.uses_sides(q.Where)
+
+	var err error
+	if cq.Matching, err = c.compile_node(q.Where, false); err != nil {
+		return nil, err
+	}
+	if cq.Opposite, err = c.compile_node(q.Where, true); err != nil {
+		return nil, err
+	}
+
+	return &cq, nil
+}
+
+type compiler struct {
+	registry *Registry
+}
+
+// Evaluate runs the compiled query against the index and returns the
+// matching games and the available games.
+func (cq *CompiledQuery) Evaluate(index Index) ([]libcleo.GameId, []libcleo.GameId, error) {
+	matching, err := cq.Matching.Evaluate(index)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !cq.Sided {
+		return matching, matching, nil
+	}
+
+	opposite, err := cq.Opposite.Evaluate(index)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return matching, union_ids(matching, opposite), nil
+}
+
+func (c *compiler) uses_sides(node Node) bool {
+	switch n := node.(type) {
+	case *AndNode:
+		return c.uses_sides(n.Left) || c.uses_sides(n.Right)
+	case *OrNode:
+		return c.uses_sides(n.Left) || c.uses_sides(n.Right)
+	case *NotNode:
+		return c.uses_sides(n.Operand)
+	case *FilterNode:
+		spec, _ := c.registry.Selector(n.Selector)
+		return len(n.Selector) > 0 && spec.Side != SIDE_GAME
+	}
+	return false
+}
+
+// Compile_node converts an AST node into a plan. If MIRRORED is set every
+// team is swapped.
+func (c *compiler) compile_node(node Node, mirrored bool) (*Plan, error) {
+	switch n := node.(type) {
+	case *AndNode:
+		left, err := c.compile_node(n.Left, mirrored)
+		if err != nil {
+			return nil, err
+		}
+		right, err := c.compile_node(n.Right, mirrored)
+		if err != nil {
+			return nil, err
+		}
+		return and_plan(left, right), nil
+	case *OrNode:
+		left, err := c.compile_node(n.Left, mirrored)
+		if err != nil {
+			return nil, err
+		}
+		right, err := c.compile_node(n.Right, mirrored)
+		if err != nil {
+			return nil, err
+		}
+		return combine(PLAN_UNION, left, right), nil
+	case *NotNode:
+		operand, err := c.compile_node(n.Operand, mirrored)
+		if err != nil {
+			return nil, err
+		}
+		return &Plan{Op: PLAN_DIFFERENCE, Children: []*Plan{&Plan{Op: PLAN_ALL}, operand}}, nil
+	case *FilterNode:
+		side, err := c.resolve_side(n, mirrored)
+		if err != nil {
+			return nil, err
+		}
+
+		spec, exists := c.registry.Filter(n.Name)
+		if !exists {
+			return nil, errorf(n.Start, "unknown filter '%s'", n.Name)
+		}
+
+		return &Plan{Op: PLAN_FILTER, Key: PostingKey{Filter: n.Name, Side: side, Args: n.Args, Start: n.Start}, Spec: spec}, nil
+	}
+
+	return nil, errorf(node.Pos(), "can't plan %s", node)
+}
+
+// Resolve_side converts a filter's selector into an absolute side, which
+// is flipped if the query is being MIRRORED.
+func (c *compiler) resolve_side(n *FilterNode, mirrored bool) (Side, error) {
+	if len(n.Selector) == 0 {
+		return SIDE_GAME, nil
+	}
+
+	spec, exists := c.registry.Selector(n.Selector)
+	if !exists {
+		return SIDE_GAME, errorf(n.Start, "unknown selector '%s'", n.Selector)
+	}
+
+	if mirrored {
+		return opposite(spec.Side), nil
+	}
+	return spec.Side, nil
+}
+
+func opposite(side Side) Side {
+	switch side {
+	case SIDE_WINNING:
+		return SIDE_LOSING
+	case SIDE_LOSING:
+		return SIDE_WINNING
+	}
+	return side
+}
+
+// And_plan intersects two plans. "x and not y" is planned as a difference
+// so that it never has to materialize the (large) complement of y.
+func and_plan(left *Plan, right *Plan) *Plan {
+	if is_complement(right) {
+		return combine(PLAN_DIFFERENCE, left, right.Children[1])
+	}
+	if is_complement(left) {
+		return combine(PLAN_DIFFERENCE, right, left.Children[1])
+	}
+
+	return combine(PLAN_INTERSECT, left, right)
+}
+
+func is_complement(p *Plan) bool {
+	return p.Op == PLAN_DIFFERENCE && len(p.Children) == 2 && p.Children[0].Op == PLAN_ALL
+}
+
+// Combine joins two plans with OP, flattening nested operations of the
+// same kind so that "a and b and c" becomes a single three-way
+// intersection. Differences only flatten along their first child.
+func combine(op PlanOp, left *Plan, right *Plan) *Plan {
+	plan := Plan{Op: op}
+
+	if left.Op == op {
+		plan.Children = append(plan.Children, left.Children...)
+	} else {
+		plan.Children = append(plan.Children, left)
+	}
+
+	if right.Op == op && op != PLAN_DIFFERENCE {
+		plan.Children = append(plan.Children, right.Children...)
+	} else {
+		plan.Children = append(plan.Children, right)
+	}
+
+	return &plan
+}
+
+// Evaluate runs the plan against an index and returns a sorted list of
+// game ID's.
+func (p *Plan) Evaluate(index Index) ([]libcleo.GameId, error) {
+	switch p.Op {
+	case PLAN_ALL:
+		return index.All(), nil
+	case PLAN_FILTER:
+		if p.Spec.Postings != nil {
+			ids, err := p.Spec.Postings(index, p.Key.Side, p.Key.Args)
+			return ids, p.locate(err)
+		}
+		// Predicate filters on their own have to scan every game.
+		return p.apply(index, index.All())
+	case PLAN_INTERSECT:
+		return p.intersect(index)
+	}
+
+	lists := make([][]libcleo.GameId, 0, len(p.Children))
+	for _, child := range p.Children {
+		ids, err := child.Evaluate(index)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, ids)
+	}
+
+	switch p.Op {
+	case PLAN_UNION:
+		result := lists[0]
+		for _, ids := range lists[1:] {
+			result = union_ids(result, ids)
+		}
+		return result, nil
+	case PLAN_DIFFERENCE:
+		result := lists[0]
+		for _, ids := range lists[1:] {
+			result = difference_ids(result, ids)
+		}
+		return result, nil
+	}
+
+	return nil, fmt.Errorf("unknown plan operation %d", p.Op)
+}
+
+// Intersect evaluates every child that produces a list first, then runs
+// any predicate filters over just the games that are left.
+func (p *Plan) intersect(index Index) ([]libcleo.GameId, error) {
+	lists := make([][]libcleo.GameId, 0, len(p.Children))
+	predicates := make([]*Plan, 0, len(p.Children))
+
+	for _, child := range p.Children {
+		if child.Op == PLAN_FILTER && child.Spec.Predicate != nil {
+			predicates = append(predicates, child)
+			continue
+		}
+
+		ids, err := child.Evaluate(index)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, ids)
+	}
+
+	var result []libcleo.GameId
+	if len(lists) == 0 {
+		result = index.All()
+	} else {
+		// Start with the shortest list so each step does as little work
+		// as possible.
+		shortest := 0
+		for i := range lists {
+			if len(lists[i]) < len(lists[shortest]) {
+				shortest = i
+			}
+		}
+		result = lists[shortest]
+		for i := range lists {
+			if i != shortest {
+				result = intersect_ids(result, lists[i])
+			}
+		}
+	}
+
+	for _, predicate := range predicates {
+		var err error
+		if result, err = predicate.apply(index, result); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// Apply runs a predicate filter over a list of games and keeps the ones
+// that pass.
+func (p *Plan) apply(index Index, ids []libcleo.GameId) ([]libcleo.GameId, error) {
+	matcher, err := p.Spec.Predicate(index, p.Key.Side, p.Key.Args)
+	if err != nil {
+		return nil, p.locate(err)
+	}
+
+	result := make([]libcleo.GameId, 0, len(ids))
+	for _, id := range ids {
+		if matcher(id) {
+			result = append(result, id)
+		}
+	}
+
+	return result, nil
+}
+
+// Locate attaches the filter's position in the query text to errors that
+// don't already have one.
+func (p *Plan) locate(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, located := err.(*ParseError); located {
+		return err
+	}
+	return errorf(p.Key.Start, "%s: %s", p.Key.Filter, err)
+}
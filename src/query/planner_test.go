@@ -0,0 +1,223 @@
+package query
+
+import "errors"
+import "libcleo"
+import "reflect"
+import "strings"
+import "testing"
+
+// A small index with six games. Thresh won 0-2 and lost 3-4, Leona won 3
+// and lost 0 and 5, and Ahri won 1 and 4 and lost 2. Games 0, 2 and 4 were
+// short.
+type testIndex struct {
+	all      []libcleo.GameId
+	postings map[string][]libcleo.GameId
+	short    map[libcleo.GameId]bool
+}
+
+func (idx *testIndex) All() []libcleo.GameId {
+	return idx.all
+}
+
+func planner_index() *testIndex {
+	idx := testIndex{}
+	idx.all = []libcleo.GameId{0, 1, 2, 3, 4, 5}
+	idx.postings = map[string][]libcleo.GameId{
+		"winning:thresh": {0, 1, 2},
+		"losing:thresh":  {3, 4},
+		"winning:leona":  {3},
+		"losing:leona":   {0, 5},
+		"winning:ahri":   {1, 4},
+		"losing:ahri":    {2},
+	}
+	idx.short = map[libcleo.GameId]bool{0: true, 2: true, 4: true}
+
+	return &idx
+}
+
+// The selectors and filters the tests are parsed with.
+func test_registry() *Registry {
+	r := NewRegistry()
+	r.RegisterSelector("winner", SelectorSpec{Side: SIDE_WINNING})
+	r.RegisterSelector("loser", SelectorSpec{Side: SIDE_LOSING})
+	r.RegisterSelector("ally", SelectorSpec{Side: SIDE_WINNING})
+	r.RegisterSelector("enemy", SelectorSpec{Side: SIDE_LOSING})
+
+	r.RegisterFilter("champion", FilterSpec{
+		Params: []ArgType{ARG_NAME},
+		Team:   true,
+		Postings: func(index Index, side Side, args []Arg) ([]libcleo.GameId, error) {
+			ids, exists := index.(*testIndex).postings[side.String()+":"+args[0].Text]
+			if !exists {
+				return nil, errors.New("unknown champion '" + args[0].Text + "'")
+			}
+			return ids, nil
+		},
+	})
+	r.RegisterFilter("short", FilterSpec{
+		Predicate: func(index Index, side Side, args []Arg) (Matcher, error) {
+			idx := index.(*testIndex)
+			return func(id libcleo.GameId) bool { return idx.short[id] }, nil
+		},
+	})
+	r.RegisterFilter("queue", FilterSpec{
+		Params: []ArgType{ARG_NAME},
+		Predicate: func(index Index, side Side, args []Arg) (Matcher, error) {
+			return nil, errors.New("queues aren't recorded")
+		},
+	})
+	r.RegisterFilter("date", FilterSpec{
+		Params: []ArgType{ARG_DATE, ARG_DATE},
+		Predicate: func(index Index, side Side, args []Arg) (Matcher, error) {
+			return nil, errors.New("dates aren't recorded")
+		},
+	})
+
+	return r
+}
+
+func compile_text(t *testing.T, text string) *CompiledQuery {
+	parsed, err := ParseWith(text, test_registry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compiled, err := Compile(parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return compiled
+}
+
+func TestPlanAndNot(t *testing.T) {
+	compiled := compile_text(t, "select winner:champion(thresh) not loser:champion(leona)")
+
+	// "and not" should become a difference instead of a complement.
+	if compiled.Matching.String() != "(difference winning:champion(thresh) losing:champion(leona))" {
+		t.Error("Unexpected plan:", compiled.Matching)
+	}
+
+	matching, available, err := compiled.Evaluate(planner_index())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Mirrored, Thresh lost games 3 and 4 and Leona won game 3.
+	if !reflect.DeepEqual(matching, []libcleo.GameId{1, 2}) || !reflect.DeepEqual(available, []libcleo.GameId{1, 2, 4}) {
+		t.Error("Unexpected results:", matching, available)
+	}
+}
+
+func TestPlanMirrorsAbsoluteSides(t *testing.T) {
+	compiled := compile_text(t, "select winner:champion(thresh) loser:champion(leona)")
+	matching, available, err := compiled.Evaluate(planner_index())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Thresh beat Leona in game 0 and lost to her in game 3.
+	if !compiled.Sided || !reflect.DeepEqual(matching, []libcleo.GameId{0}) || !reflect.DeepEqual(available, []libcleo.GameId{0, 3}) {
+		t.Error("Unexpected results:", matching, available)
+	}
+
+	// Without a team there's nothing to mirror.
+	if compiled := compile_text(t, "select short()"); compiled.Sided {
+		t.Error("A query without teams shouldn't be sided")
+	}
+}
+
+func TestPlanFlattens(t *testing.T) {
+	compiled := compile_text(t, "select winner:champion(thresh) and winner:champion(ahri) and winner:champion(leona)")
+
+	if len(compiled.Matching.Children) != 3 {
+		t.Error("Intersections should be flattened:", compiled.Matching)
+	}
+}
+
+func TestPlanRelative(t *testing.T) {
+	compiled := compile_text(t, "select ally:champion(thresh) ally:champion(ahri)")
+
+	matching, available, err := compiled.Evaluate(planner_index())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Thresh and Ahri won game 1 together and never lost together.
+	if !reflect.DeepEqual(matching, []libcleo.GameId{1}) || !reflect.DeepEqual(available, []libcleo.GameId{1}) {
+		t.Error("Unexpected results:", matching, available)
+	}
+
+	compiled = compile_text(t, "select ally:champion(thresh) enemy:champion(leona)")
+	matching, available, err = compiled.Evaluate(planner_index())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(matching, []libcleo.GameId{0}) || !reflect.DeepEqual(available, []libcleo.GameId{0, 3}) {
+		t.Error("Unexpected results:", matching, available)
+	}
+}
+
+func TestPlanOr(t *testing.T) {
+	compiled := compile_text(t, "select winner:champion(leona) or winner:champion(ahri)")
+
+	matching, _, err := compiled.Evaluate(planner_index())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(matching, []libcleo.GameId{1, 3, 4}) {
+		t.Error("Unexpected results:", matching)
+	}
+}
+
+func TestPlanPredicate(t *testing.T) {
+	compiled := compile_text(t, "select winner:champion(thresh) short()")
+
+	// Predicates only run over the games the posting lists leave.
+	if compiled.Matching.String() != "(intersect winning:champion(thresh) game:short())" {
+		t.Error("Unexpected plan:", compiled.Matching)
+	}
+
+	matching, _, err := compiled.Evaluate(planner_index())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(matching, []libcleo.GameId{0, 2}) {
+		t.Error("Unexpected results:", matching)
+	}
+
+	compiled = compile_text(t, "select short() or winner:champion(leona)")
+	matching, _, err = compiled.Evaluate(planner_index())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(matching, []libcleo.GameId{0, 2, 3, 4}) {
+		t.Error("Unexpected results:", matching)
+	}
+}
+
+func TestPlanFilterErrors(t *testing.T) {
+	compiled := compile_text(t, "select winner:champion(thresh) queue(ranked)")
+
+	if _, _, err := compiled.Evaluate(planner_index()); err == nil || !strings.Contains(err.Error(), "line 1, column 32: queue: queues aren't recorded") {
+		t.Error("Expected a located filter error, got", err)
+	}
+}
+
+func TestRegistryConflicts(t *testing.T) {
+	r := test_registry()
+
+	if r.RegisterSelector("winner", SelectorSpec{}) == nil {
+		t.Error("Expected an error registering a duplicate selector")
+	}
+	if r.RegisterFilter("short", FilterSpec{Predicate: nil}) == nil {
+		t.Error("Expected an error registering a duplicate filter")
+	}
+	if r.RegisterFilter("long", FilterSpec{}) == nil {
+		t.Error("Expected an error registering a filter with no evaluator")
+	}
+}
@@ -1,5 +1,104 @@
-package lolstat
+package plugins
 
-type QueryAdapter interface {
-	Produce(filter_name string, params ...string)
+// Plugins adapt the game-agnostic query package to a particular game. Each
+// adapter registers its selectors and filters with query.DefaultRegistry
+// from an init() function, so importing this package is enough to make
+// them available to query.Parse and query.Compile.
+//
+// Adding a filter only requires registering it with its parameter types
+// and either a posting list function (if the index has a list for it) or
+// a predicate (if each game needs to be inspected). For example:
+//
+//   query.RegisterFilter("duration_under", query.FilterSpec{
+//       Params:    []query.ArgType{query.ARG_DURATION},
+//       Predicate: duration_under,
+//   })
+
+import (
+	"errors"
+	"libcleo"
+	"proto"
+	"query"
+)
+
+var ErrNoSummaries = errors.New("this index doesn't include game summaries")
+
+// Summaries looks up the stored details for a single game. It returns false
+// if there's nothing stored for the game.
+type Summaries func(id libcleo.GameId) (*GameSummary, bool)
+
+// GameSummary holds the per-game details that predicate filters can look
+// at. It's a compact copy of the fields in a stored GameRecord.
+type GameSummary struct {
+	// Milliseconds since the epoch.
+	Timestamp uint64
+	// Seconds.
+	Duration uint32
+
+	Teams []TeamSummary
+}
+
+type TeamSummary struct {
+	Victory bool
+	Players []PlayerSummary
+}
+
+type PlayerSummary struct {
+	Champion proto.ChampionType
+	// Whether the stats below are known for this player.
+	HasStats bool
+	Kills    uint32
+	Deaths   uint32
+	Assists  uint32
+	Gold     uint32
+	Minions  uint32
+}
+
+// Side returns the team in the game that's on SIDE, or nil for a game-level
+// side or if the team isn't present.
+func (g *GameSummary) Side(side query.Side) *TeamSummary {
+	for i := range g.Teams {
+		if side == query.SIDE_WINNING && g.Teams[i].Victory {
+			return &g.Teams[i]
+		}
+		if side == query.SIDE_LOSING && !g.Teams[i].Victory {
+			return &g.Teams[i]
+		}
+	}
+
+	return nil
+}
+
+// ColumnSummaries looks up summaries in the side-store that packer writes.
+func ColumnSummaries(summaries *libcleo.LiveSummaries) Summaries {
+	return func(id libcleo.GameId) (*GameSummary, bool) {
+		if !summaries.Has(id) {
+			return nil, false
+		}
+
+		c := summaries.Columns
+		game := GameSummary{Timestamp: c.Timestamp[id], Duration: c.Duration[id]}
+		game.Teams = []TeamSummary{TeamSummary{Victory: true}, TeamSummary{Victory: false}}
+
+		start, end := summaries.Players(id)
+		for i := start; i < end; i++ {
+			player := PlayerSummary{
+				Champion: c.Champion[i],
+				HasStats: c.HasStats[i],
+				Kills:    c.Kills[i],
+				Deaths:   c.Deaths[i],
+				Assists:  c.Assists[i],
+				Gold:     c.Gold[i],
+				Minions:  c.Minions[i],
+			}
+
+			if c.Victory[i] {
+				game.Teams[0].Players = append(game.Teams[0].Players, player)
+			} else {
+				game.Teams[1].Players = append(game.Teams[1].Players, player)
+			}
+		}
+
+		return &game, true
+	}
 }
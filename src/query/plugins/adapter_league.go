@@ -1,76 +1,151 @@
-package query
-
-import "gamelog"
-import "query"
-
-type LeagueFilter func(team *gamelog.Team, filter_text string) bool
-type LeagueSelector func(record *gamelog.GameRecord) *gamelog.Team
-
-// Selectors are used to select a component from the GameRecord that filters
-// should apply to. For example, selectors are used to identify what team
-// "winner" refers to.
-func Select() map[string]func {
-	selectors = make( map[string]func )
-	
-	selectors["winner"] = func(record *gamelog.GameRecord) {
-		for _, team := range record.Teams {
-			if team.Victory {
-				return team
-			}
-		}
-		return nil
-	}
+package plugins
 
-	selectors["loser"] = func(record *gamelog.GameRecord) {
-		for _, team := range record.Teams {
-			if !team.Victory {
-				return team
-			}
-		}
-		return nil
+// The League of Legends adapter. Champion filters are answered from the
+// PCGL's posting lists; everything else needs per-game summaries.
+
+import (
+	"errors"
+	"fmt"
+	"libcleo"
+	"proto"
+	"query"
+	"time"
+)
+
+// LeagueIndex is the index League queries are evaluated against.
+type LeagueIndex struct {
+	PCGL *libcleo.LivePCGL
+	// Optional. Filters that need to inspect individual games fail
+	// with ErrNoSummaries if this isn't set.
+	Summaries Summaries
+}
+
+func (idx *LeagueIndex) All() []libcleo.GameId {
+	return idx.PCGL.All
+}
+
+func init() {
+	// Selectors. Ally and enemy are other names for winner and loser: the
+	// query's teams are the winners, and the mirrored plan covers the
+	// games they lost.
+	query.RegisterSelector("winner", query.SelectorSpec{Side: query.SIDE_WINNING})
+	query.RegisterSelector("loser", query.SelectorSpec{Side: query.SIDE_LOSING})
+	query.RegisterSelector("ally", query.SelectorSpec{Side: query.SIDE_WINNING})
+	query.RegisterSelector("enemy", query.SelectorSpec{Side: query.SIDE_LOSING})
+
+	// Filters
+	query.RegisterFilter("champion", query.FilterSpec{
+		Params:   []query.ArgType{query.ARG_NAME},
+		Team:     true,
+		Postings: champion,
+	})
+	query.RegisterFilter("date", query.FilterSpec{
+		Params:    []query.ArgType{query.ARG_DATE, query.ARG_DATE},
+		Predicate: date,
+	})
+	query.RegisterFilter("duration_under", query.FilterSpec{
+		Params:    []query.ArgType{query.ARG_DURATION},
+		Predicate: duration_under,
+	})
+	query.RegisterFilter("kda_above", query.FilterSpec{
+		Params:    []query.ArgType{query.ARG_NUMBER},
+		Team:      true,
+		Predicate: kda_above,
+	})
+
+	// There are no role or queue filters: the fetcher doesn't record
+	// either for League games, and until it does they're out of scope.
+}
+
+func league_index(index query.Index) (*LeagueIndex, error) {
+	idx, ok := index.(*LeagueIndex)
+	if !ok {
+		return nil, errors.New("not a League index")
 	}
-		
-	return selectors
+	return idx, nil
 }
 
-// Filters on selected components determine whether they should be included
-// in filtered and labeled sets. Produce generates functions that can be
-// used to filter selectors.
-func Produce(filter_name string, params ...string) LeagueFilter {
-	switch {
-		// Return a function that can be used to identify whether a particular
-		// team won.
-		case filter_name == "champion":
-			return func(team *gamelog.Team, cid uint32) bool {
-				for _, player := team.Players {
-					if player.champion_id == cid {
-						return true
-					}
-				}
-				return false
-			}
-			// return a function that accepts a single string param and returns a bool		
+// Returns a matcher that looks up each game's summary and passes it to
+// TEST. Games without a summary never match.
+func summary_matcher(index query.Index, test func(game *GameSummary) bool) (query.Matcher, error) {
+	idx, err := league_index(index)
+	if err != nil {
+		return nil, err
+	}
+	if idx.Summaries == nil {
+		return nil, ErrNoSummaries
 	}
+
+	return func(id libcleo.GameId) bool {
+		game, exists := idx.Summaries(id)
+		return exists && test(game)
+	}, nil
 }
 
-func ParseText(filename string) {
-	fp := io.Open(filename)
-	
-	new_query := query.Query()
-	selectors = Select()
-	
-	line, err := fp.ReadString("\n")
-	for err == nil {
-		// Parse out the target
-		segments := strings.Split(line, ":")
-		selector := selectors[segments[0]]
-		
-		// Then get the filter
-		split_loc := strings.Index(segments[1], "(")
-		filter = Produce(segments[1][:split_loc], segments[1][split_loc+1:-1])
-		
-		new_query.QueryPairs = append(new_query.Statements, QueryStatement{selector, filter})
-		
-		line, err = fp.ReadString("\n")
+// champion(name): games where the champion played on the selected team.
+func champion(index query.Index, side query.Side, args []query.Arg) ([]libcleo.GameId, error) {
+	idx, err := league_index(index)
+	if err != nil {
+		return nil, err
 	}
+
+	ct := libcleo.String2ChampionType(args[0].Text)
+	if ct == proto.ChampionType_UNKNOWN {
+		return nil, fmt.Errorf("unknown champion '%s'", args[0].Text)
+	}
+
+	if side == query.SIDE_LOSING {
+		return idx.PCGL.Champions[ct].Losing, nil
+	}
+	return idx.PCGL.Champions[ct].Winning, nil
+}
+
+// date(start, end): games played on or between two dates.
+func date(index query.Index, side query.Side, args []query.Arg) (query.Matcher, error) {
+	start := uint64(args[0].Date.Unix() * 1000)
+	end := uint64(args[1].Date.Add(24*time.Hour).Unix() * 1000)
+
+	return summary_matcher(index, func(game *GameSummary) bool {
+		return game.Timestamp >= start && game.Timestamp < end
+	})
+}
+
+// duration_under(25m): games that ended in less than the given time.
+func duration_under(index query.Index, side query.Side, args []query.Arg) (query.Matcher, error) {
+	limit := uint32(args[0].Duration.Seconds())
+
+	return summary_matcher(index, func(game *GameSummary) bool {
+		return game.Duration < limit
+	})
+}
+
+// kda_above(3): games where the selected team's combined
+// (kills + assists) / deaths was above the threshold. Only games with stats
+// for every player on the team can match.
+func kda_above(index query.Index, side query.Side, args []query.Arg) (query.Matcher, error) {
+	threshold := args[0].Number
+
+	return summary_matcher(index, func(game *GameSummary) bool {
+		team := game.Side(side)
+		if team == nil {
+			return false
+		}
+
+		var kills, deaths, assists uint32
+		for _, player := range team.Players {
+			// Partial totals would understate the KDA.
+			if !player.HasStats {
+				return false
+			}
+			kills += player.Kills
+			deaths += player.Deaths
+			assists += player.Assists
+		}
+
+		// A deathless team's KDA is conventionally its kills + assists.
+		if deaths == 0 {
+			deaths = 1
+		}
+		return float64(kills+assists)/float64(deaths) > threshold
+	})
 }
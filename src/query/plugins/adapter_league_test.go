@@ -0,0 +1,116 @@
+package plugins
+
+import "libcleo"
+import "proto"
+import "query"
+import "reflect"
+import "strings"
+import "testing"
+
+// Thresh won 0-2 and lost 3, Leona won 3 and lost 0.
+func test_index() *LeagueIndex {
+	pcgl := libcleo.LivePCGL{}
+	pcgl.All = []libcleo.GameId{0, 1, 2, 3}
+	pcgl.Champions = map[proto.ChampionType]libcleo.LivePCGLRecord{
+		proto.ChampionType_THRESH: {Winning: []libcleo.GameId{0, 1, 2}, Losing: []libcleo.GameId{3}},
+		proto.ChampionType_LEONA:  {Winning: []libcleo.GameId{3}, Losing: []libcleo.GameId{0}},
+	}
+
+	return &LeagueIndex{PCGL: &pcgl}
+}
+
+// Games 0 and 1 were 20 minutes long and the winners went 10/2/10; game 2
+// was 40 minutes long and the winners went 2/4/2.
+func summaries() Summaries {
+	games := map[libcleo.GameId]*GameSummary{
+		0: summary(20*60, 10, 2, 10),
+		1: summary(20*60, 10, 2, 10),
+		2: summary(40*60, 2, 4, 2),
+	}
+
+	return func(id libcleo.GameId) (*GameSummary, bool) {
+		game, exists := games[id]
+		return game, exists
+	}
+}
+
+func summary(duration uint32, kills uint32, deaths uint32, assists uint32) *GameSummary {
+	winners := TeamSummary{Victory: true, Players: []PlayerSummary{{HasStats: true, Kills: kills, Deaths: deaths, Assists: assists}}}
+	losers := TeamSummary{Victory: false, Players: []PlayerSummary{{HasStats: true, Kills: deaths, Deaths: kills}}}
+
+	return &GameSummary{Timestamp: 1409529600000, Duration: duration, Teams: []TeamSummary{winners, losers}}
+}
+
+func run(t *testing.T, text string, index *LeagueIndex) ([]libcleo.GameId, error) {
+	parsed, err := query.Parse(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compiled, err := query.Compile(parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matching, _, err := compiled.Evaluate(index)
+	return matching, err
+}
+
+func TestChampion(t *testing.T) {
+	matching, err := run(t, "select winner:champion(thresh) not loser:champion(leona)", test_index())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(matching, []libcleo.GameId{1, 2}) {
+		t.Error("Unexpected results:", matching)
+	}
+
+	if _, err := run(t, "select winner:champion(nobody)", test_index()); err == nil || !strings.Contains(err.Error(), "unknown champion 'nobody'") {
+		t.Error("Expected an unknown champion error, got", err)
+	}
+}
+
+func TestSummaryFilters(t *testing.T) {
+	index := test_index()
+
+	if _, err := run(t, "select winner:champion(thresh) duration_under(25m)", index); err == nil || !strings.Contains(err.Error(), ErrNoSummaries.Error()) {
+		t.Error("Expected a missing summaries error, got", err)
+	}
+
+	index.Summaries = summaries()
+
+	matching, err := run(t, "select winner:champion(thresh) duration_under(25m)", index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(matching, []libcleo.GameId{0, 1}) {
+		t.Error("Unexpected duration results:", matching)
+	}
+
+	matching, err = run(t, "select winner:kda_above(3)", index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(matching, []libcleo.GameId{0, 1}) {
+		t.Error("Unexpected KDA results:", matching)
+	}
+
+	matching, err = run(t, "select date(2014-09-01, 2014-09-01)", index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(matching, []libcleo.GameId{0, 1, 2}) {
+		t.Error("Unexpected date results:", matching)
+	}
+}
+
+// Roles and queues aren't recorded, so asking for them is a parse error
+// rather than a query that fails later.
+func TestUnrecordedFilters(t *testing.T) {
+	for _, text := range []string{"select winner:role(support)", "select queue(ranked)"} {
+		if _, err := query.Parse(text); err == nil || !strings.Contains(err.Error(), "unknown filter") {
+			t.Error("Expected", text, "not to parse, got", err)
+		}
+	}
+}
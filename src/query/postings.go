@@ -0,0 +1,78 @@
+package query
+
+// Operations on sorted posting lists of game ID's.
+
+import (
+	"libcleo"
+)
+
+// Intersect_ids returns the ID's that appear in both lists. Both lists
+// must be sorted.
+func intersect_ids(first []libcleo.GameId, second []libcleo.GameId) []libcleo.GameId {
+	result := make([]libcleo.GameId, 0, min_int(len(first), len(second)))
+	i, j := 0, 0
+
+	for i < len(first) && j < len(second) {
+		if first[i] < second[j] {
+			i += 1
+		} else if first[i] > second[j] {
+			j += 1
+		} else {
+			result = append(result, first[i])
+			i += 1
+			j += 1
+		}
+	}
+
+	return result
+}
+
+// Union_ids returns the ID's that appear in either list, without
+// duplicates. Both lists must be sorted.
+func union_ids(first []libcleo.GameId, second []libcleo.GameId) []libcleo.GameId {
+	result := make([]libcleo.GameId, 0, len(first)+len(second))
+	i, j := 0, 0
+
+	for i < len(first) && j < len(second) {
+		if first[i] < second[j] {
+			result = append(result, first[i])
+			i += 1
+		} else if first[i] > second[j] {
+			result = append(result, second[j])
+			j += 1
+		} else {
+			result = append(result, first[i])
+			i += 1
+			j += 1
+		}
+	}
+
+	result = append(result, first[i:]...)
+	return append(result, second[j:]...)
+}
+
+// Difference_ids returns the ID's in FIRST that aren't in SECOND. Both
+// lists must be sorted.
+func difference_ids(first []libcleo.GameId, second []libcleo.GameId) []libcleo.GameId {
+	result := make([]libcleo.GameId, 0, len(first))
+	j := 0
+
+	for _, id := range first {
+		for j < len(second) && second[j] < id {
+			j += 1
+		}
+
+		if j >= len(second) || second[j] != id {
+			result = append(result, id)
+		}
+	}
+
+	return result
+}
+
+func min_int(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -1,12 +1,11 @@
 package query
 
 import (
-	"bufio"
 	gproto "code.google.com/p/goprotobuf/proto"
 	"fmt"
 	"log"
 	"net"
-	//	"proto"
+	"proto"
 	"switchboard"
 	"time"
 )
@@ -38,19 +37,29 @@ type QueryManager struct {
 	ActiveCount uint32
 
 	//	Listener *net.TCPListener
-	Switchboard switchboard.SwitchboardServer
+	Switchboard *switchboard.SwitchboardServer
+
+	// Deadlines for reading a request and writing a response. Zero uses
+	// DEFAULT_READ_TIMEOUT and DEFAULT_WRITE_TIMEOUT.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// TLS and token settings for the switchboard, usually from
+	// switchboard.RegisterSecurityFlags.
+	Security switchboard.Security
 }
 
-/*
 func GetQueryId(qry proto.GameQuery) string {
-	return fmt.Sprintf("Q%d.%d", qry.QueryProcess, qry.QueryId)
+	return fmt.Sprintf("Q%d.%d", qry.GetQueryProcess(), qry.GetQueryId())
 }
-*/
+
 func (q *QueryManager) Connect(port int) {
 	q.ActiveCount = 0
 	cerr := error(nil)
 
-	q.Switchboard, cerr = switchboard.NewServer("tcp", &net.TCPAddr{IP: net.IPv4zero, Port: port})
+	q.Switchboard, cerr = switchboard.NewServerWithOptions("tcp",
+		&net.TCPAddr{IP: net.IPv4zero, Port: port},
+		switchboard.ServerOptions{Security: q.Security})
 
 	if cerr != nil {
 		log.Fatal("Couldn't open port for listening.")
@@ -59,34 +68,82 @@ func (q *QueryManager) Connect(port int) {
 	log.Println(fmt.Sprintf("Query server listening on port %d", port))
 }
 
-func (q *QueryManager) Listen(query_type gproto.Message) QueryRequest {
-	query := QueryRequest{}
-
-	conn, _ := q.Switchboard.GetStream()
-	query.Conn = conn
-	rw := bufio.NewReadWriter(bufio.NewReader(*conn), bufio.NewWriter(*conn))
+// Requests accepts query streams in the background and delivers every
+// well-formed request on the returned channel; NEW_QUERY makes the message
+// each request is read into. Each stream is read in its own goroutine, so
+// a client that's slow to send its request only holds up itself. Requests
+// that can't be read or parsed are answered with an error frame and
+// dropped, so a single bad client can't take the server down.
+func (q *QueryManager) Requests(new_query func() gproto.Message) <-chan QueryRequest {
+	requests := make(chan QueryRequest)
+
+	go func() {
+		for {
+			conn, err := q.Switchboard.GetStream()
+			if err == switchboard.ErrClosed {
+				return
+			}
+			if err != nil {
+				log.Println("Couldn't accept a query stream:", err)
+				time.Sleep(time.Second)
+				continue
+			}
+
+			go q.read_request(conn, new_query(), requests)
+		}
+	}()
+
+	return requests
+}
 
-	msg, _ := rw.ReadString('|')
-	merr := gproto.Unmarshal([]byte(msg[:len(msg)-1]), query_type)
+// Read_request reads a single request from CONN into QUERY_TYPE and hands
+// it to REQUESTS, or answers with an error if it can't.
+func (q *QueryManager) read_request(conn *net.Conn, query_type gproto.Message, requests chan<- QueryRequest) {
+	err := ReadMessage(*conn, query_type, q.read_timeout())
+	if err == nil {
+		requests <- QueryRequest{Query: query_type, Conn: conn, TimeReceived: time.Now().Unix()}
+		return
+	}
 
-	if merr != nil {
-		log.Fatal("Error unmarshaling query; are you sure you sending a properly formatted proto?")
+	log.Println("Couldn't read query:", err)
+	if _, unsupported := err.(*UnsupportedVersionError); unsupported {
+		WriteError(*conn, proto.WireError_UNSUPPORTED_VERSION, err.Error(), q.write_timeout())
+	} else {
+		WriteError(*conn, proto.WireError_BAD_REQUEST, err.Error(), q.write_timeout())
 	}
+	(*conn).Close()
+}
 
-	query.Query = query_type
-	query.TimeReceived = time.Now().Unix()
+func (q *QueryManager) Reply(request *QueryRequest, response gproto.Message) {
+	defer (*request.Conn).Close()
 
-	return query
+	// Send the data back to the requester.
+	if err := WriteMessage(*request.Conn, response, q.write_timeout()); err != nil {
+		log.Println("Couldn't send response:", err)
+		return
+	}
+	log.Println("response sent")
 }
 
-func (q *QueryManager) Reply(request *QueryRequest, response gproto.Message) {
+// ReplyError answers a request with an error instead of a response.
+func (q *QueryManager) ReplyError(request *QueryRequest, code proto.WireError_Code, message string) {
 	defer (*request.Conn).Close()
 
-	data, _ := gproto.Marshal(response)
+	if err := WriteError(*request.Conn, code, message, q.write_timeout()); err != nil {
+		log.Println("Couldn't send error response:", err)
+	}
+}
+
+func (q *QueryManager) read_timeout() time.Duration {
+	if q.ReadTimeout == 0 {
+		return DEFAULT_READ_TIMEOUT
+	}
+	return q.ReadTimeout
+}
 
-	// Send the data back to the responder and decrement the # of active queries.
-	rw := bufio.NewReadWriter(bufio.NewReader(*request.Conn), bufio.NewWriter(*request.Conn))
-	rw.WriteString(string(data) + "|")
-	rw.Flush()
-	log.Println("response sent")
+func (q *QueryManager) write_timeout() time.Duration {
+	if q.WriteTimeout == 0 {
+		return DEFAULT_WRITE_TIMEOUT
+	}
+	return q.WriteTimeout
 }
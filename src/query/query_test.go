@@ -0,0 +1,45 @@
+package query
+
+import gproto "code.google.com/p/goprotobuf/proto"
+import "proto"
+import "switchboard"
+import "testing"
+import "time"
+
+func TestIdleClient(t *testing.T) {
+	manager := QueryManager{ReadTimeout: 10 * time.Second}
+	manager.Connect(0)
+	defer manager.Switchboard.Close()
+	requests := manager.Requests(func() gproto.Message { return &proto.NameRequest{} })
+
+	client, err := switchboard.NewClient("tcp", manager.Switchboard.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// A client that opens a stream and never sends anything...
+	idle, err := client.GetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (*idle).Close()
+	time.Sleep(50 * time.Millisecond)
+
+	// ...doesn't hold up anyone else.
+	conn, err := client.GetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (*conn).Close()
+	go WriteMessage(*conn, &proto.NameRequest{Name: gproto.String("brigado")}, time.Second)
+
+	select {
+	case request := <-requests:
+		if name := request.Query.(*proto.NameRequest).GetName(); name != "brigado" {
+			t.Error("Unexpected request:", name)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("An idle client held up another request")
+	}
+}
@@ -0,0 +1,144 @@
+package query
+
+// The registry holds the selectors and filters that queries can use. The
+// query package itself doesn't know about any particular game; game
+// adapters (see query/plugins) register their selectors and filters,
+// usually from an init() function, and the parser and planner look them
+// up by name.
+
+import (
+	"fmt"
+	"libcleo"
+	"sync"
+)
+
+// SelectorSpec describes which team a selector refers to: SIDE in the
+// matching plan, and the other side in the mirrored one (see planner.go).
+type SelectorSpec struct {
+	Side Side
+}
+
+// PostingsFunc returns the sorted posting list for a filter applied to a
+// side of the game.
+type PostingsFunc func(index Index, side Side, args []Arg) ([]libcleo.GameId, error)
+
+// Matcher reports whether a single game passes a filter.
+type Matcher func(id libcleo.GameId) bool
+
+// PredicateFunc prepares a Matcher for a filter applied to a side of the
+// game. It's called once per query, so any expensive setup (and any
+// checks that the index can support the filter) belong here.
+type PredicateFunc func(index Index, side Side, args []Arg) (Matcher, error)
+
+// FilterSpec describes a filter: the types of its parameters, whether it
+// applies to a team or the whole game, and how to evaluate it. Filters
+// that have a posting list in the index should set Postings; filters that
+// need to look at each game should set Predicate. Predicates are only run
+// on games that survive the other filters they're intersected with.
+type FilterSpec struct {
+	Params []ArgType
+	// Team filters need a selector; game filters can't have one.
+	Team bool
+
+	Postings  PostingsFunc
+	Predicate PredicateFunc
+}
+
+type Registry struct {
+	selectors map[string]SelectorSpec
+	filters   map[string]FilterSpec
+
+	lock sync.RWMutex
+}
+
+// The registry used by Parse and Compile.
+var DefaultRegistry = NewRegistry()
+
+func NewRegistry() *Registry {
+	r := Registry{}
+	r.selectors = make(map[string]SelectorSpec)
+	r.filters = make(map[string]FilterSpec)
+
+	return &r
+}
+
+func (r *Registry) RegisterSelector(name string, spec SelectorSpec) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, exists := r.selectors[name]; exists {
+		return fmt.Errorf("selector '%s' is already registered", name)
+	}
+
+	r.selectors[name] = spec
+	return nil
+}
+
+func (r *Registry) RegisterFilter(name string, spec FilterSpec) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, exists := r.filters[name]; exists {
+		return fmt.Errorf("filter '%s' is already registered", name)
+	}
+	if (spec.Postings == nil) == (spec.Predicate == nil) {
+		return fmt.Errorf("filter '%s' needs exactly one of Postings or Predicate", name)
+	}
+
+	r.filters[name] = spec
+	return nil
+}
+
+func (r *Registry) Selector(name string) (SelectorSpec, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	spec, exists := r.selectors[name]
+	return spec, exists
+}
+
+func (r *Registry) Filter(name string) (FilterSpec, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	spec, exists := r.filters[name]
+	return spec, exists
+}
+
+// Selectors returns the sorted names of all registered selectors.
+func (r *Registry) Selectors() string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	names := make([]string, 0, len(r.selectors))
+	for name := range r.selectors {
+		names = append(names, name)
+	}
+	return sorted_list(names)
+}
+
+// Filters returns the sorted names of all registered filters.
+func (r *Registry) Filters() string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	names := make([]string, 0, len(r.filters))
+	for name := range r.filters {
+		names = append(names, name)
+	}
+	return sorted_list(names)
+}
+
+// RegisterSelector and RegisterFilter add to the DefaultRegistry. They
+// panic on conflicts since they're meant to be called from init().
+func RegisterSelector(name string, spec SelectorSpec) {
+	if err := DefaultRegistry.RegisterSelector(name, spec); err != nil {
+		panic(err)
+	}
+}
+
+func RegisterFilter(name string, spec FilterSpec) {
+	if err := DefaultRegistry.RegisterFilter(name, spec); err != nil {
+		panic(err)
+	}
+}
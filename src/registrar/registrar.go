@@ -0,0 +1,48 @@
+package main
+
+// Registrar serves the service registry that Cleo's binaries use to find
+// each other (see src/registry). Services register themselves and send
+// heartbeats; anything that can't, like Mongo and beanstalkd, can be listed
+// in a static registry file passed with -static.
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"query"
+	"registry"
+	"switchboard"
+)
+
+var PORT = flag.Int("port", registry.REGISTRY_PORT, "Port to serve the registry on")
+var TTL = flag.Duration("ttl", registry.DEFAULT_TTL, "How long services last without a heartbeat")
+var STATIC = flag.String("static", "", "Registry file of services that never expire")
+var SECURITY = switchboard.RegisterSecurityFlags()
+
+func main() {
+	flag.Parse()
+
+	security, serr := SECURITY.Server()
+	if serr != nil {
+		log.Fatal("Invalid switchboard security settings:", serr)
+	}
+
+	table := registry.NewTable(*TTL)
+	if len(*STATIC) > 0 {
+		static, err := registry.LoadStatic(*STATIC)
+		if err != nil {
+			log.Fatal("Couldn't load static services:", err)
+		}
+
+		for _, service := range static.Services() {
+			table.Pin(service)
+		}
+		log.Println(fmt.Sprintf("Loaded %d static services.", len(static.Services())))
+	}
+
+	manager := query.QueryManager{Security: security}
+	manager.Connect(*PORT)
+
+	log.Println("Registry ready.")
+	registry.Serve(table, &manager)
+}
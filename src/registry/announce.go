@@ -0,0 +1,81 @@
+package registry
+
+import (
+	"log"
+	"time"
+)
+
+// Announcer keeps a service registered until it's stopped.
+type Announcer struct {
+	reg        Registry
+	service    Service
+	generation func() int64
+	stopped    chan bool
+	done       chan bool
+}
+
+// Announce registers SERVICE and sends a heartbeat every INTERVAL (or
+// DEFAULT_HEARTBEAT). GENERATION, if not nil, is called before each
+// heartbeat so that clients can see which index the service has loaded.
+// Failures are logged and retried on the next heartbeat.
+func Announce(reg Registry, service Service, generation func() int64, interval time.Duration) *Announcer {
+	if interval == 0 {
+		interval = DEFAULT_HEARTBEAT
+	}
+
+	a := Announcer{reg: reg, service: service, generation: generation, stopped: make(chan bool), done: make(chan bool)}
+	registered := a.register()
+
+	go func() {
+		defer close(a.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-a.stopped:
+				return
+			case <-ticker.C:
+			}
+
+			if !registered {
+				registered = a.register()
+				continue
+			}
+
+			a.update_generation()
+			if err := reg.Heartbeat(a.service); err != nil {
+				log.Println("Registry: heartbeat for", a.service.Name, "failed:", err)
+				// The registry may have restarted; register again.
+				registered = a.register()
+			}
+		}
+	}()
+
+	return &a
+}
+
+// Stop stops the heartbeats and deregisters the service.
+func (a *Announcer) Stop() {
+	close(a.stopped)
+	<-a.done
+
+	if err := a.reg.Deregister(a.service); err != nil {
+		log.Println("Registry: couldn't deregister", a.service.Name, ":", err)
+	}
+}
+
+func (a *Announcer) register() bool {
+	a.update_generation()
+	if err := a.reg.Register(a.service); err != nil {
+		log.Println("Registry: couldn't register", a.service.Name, ":", err)
+		return false
+	}
+	return true
+}
+
+func (a *Announcer) update_generation() {
+	if a.generation != nil {
+		a.service.Generation = a.generation()
+	}
+}
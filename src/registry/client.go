@@ -0,0 +1,138 @@
+package registry
+
+import (
+	"log"
+	"proto"
+	"query"
+	"switchboard"
+	"sync"
+	"time"
+
+	gproto "code.google.com/p/goprotobuf/proto"
+)
+
+// Registry servers listen on this port unless told otherwise.
+const REGISTRY_PORT = 14000
+
+const CALL_TIMEOUT = 5 * time.Second
+
+// Client is a registry served by one or more registry servers. Registry
+// servers don't share their tables, so every call goes to the same one
+// until it fails; the client then moves on to the next, where announcers
+// find out that they need to register again.
+type Client struct {
+	registrars []*switchboard.SwitchboardClient
+	addresses  []string
+
+	current int
+	lock    sync.Mutex
+}
+
+func NewClient(addresses []string, security switchboard.Security) (*Client, error) {
+	if len(addresses) == 0 {
+		return nil, switchboard.ErrNoBackends
+	}
+
+	c := Client{addresses: addresses}
+	for _, address := range addresses {
+		sb, err := switchboard.NewClientWithOptions("tcp", switchboard.ClientOptions{Security: security}, address)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.registrars = append(c.registrars, sb)
+	}
+	return &c, nil
+}
+
+func (c *Client) Close() {
+	for _, sb := range c.registrars {
+		sb.Close()
+	}
+}
+
+func (c *Client) Register(service Service) error {
+	_, err := c.call(proto.RegistryRequest_REGISTER, &proto.RegistryRequest{Service: to_record(service)})
+	return err
+}
+
+func (c *Client) Heartbeat(service Service) error {
+	response, err := c.call(proto.RegistryRequest_HEARTBEAT, &proto.RegistryRequest{Service: to_record(service)})
+	if err != nil {
+		return err
+	}
+	if response.GetUnknown() {
+		return ErrUnknownService
+	}
+	return nil
+}
+
+func (c *Client) Deregister(service Service) error {
+	_, err := c.call(proto.RegistryRequest_DEREGISTER, &proto.RegistryRequest{Service: to_record(service)})
+	return err
+}
+
+func (c *Client) Resolve(name string) ([]Service, error) {
+	response, err := c.call(proto.RegistryRequest_RESOLVE, &proto.RegistryRequest{Name: gproto.String(name)})
+	if err != nil {
+		return nil, err
+	}
+	if len(response.GetServices()) == 0 {
+		return nil, ErrNotFound
+	}
+
+	services := make([]Service, 0, len(response.GetServices()))
+	for _, record := range response.GetServices() {
+		services = append(services, from_record(record))
+	}
+	return services, nil
+}
+
+// Call sends the request to the current registry server, failing over to
+// the others in turn if it can't be reached. Errors from a server that
+// answered are returned as they are.
+func (c *Client) call(kind proto.RegistryRequest_Type, request *proto.RegistryRequest) (*proto.RegistryResponse, error) {
+	request.Type = kind.Enum()
+
+	c.lock.Lock()
+	start := c.current
+	c.lock.Unlock()
+
+	err := error(nil)
+	for i := 0; i < len(c.registrars); i++ {
+		index := (start + i) % len(c.registrars)
+
+		response := proto.RegistryResponse{}
+		err = call_registrar(c.registrars[index], request, &response)
+		if err == nil {
+			if index != start {
+				c.fail_over(start, index)
+			}
+			return &response, nil
+		}
+		if _, remote := err.(*query.RemoteError); remote {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+func (c *Client) fail_over(from int, to int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.current == from {
+		log.Println("Registry: switching from", c.addresses[from], "to", c.addresses[to])
+		c.current = to
+	}
+}
+
+func call_registrar(sb *switchboard.SwitchboardClient, request *proto.RegistryRequest, response *proto.RegistryResponse) error {
+	conn, err := sb.GetStream()
+	if err != nil {
+		return err
+	}
+	defer (*conn).Close()
+
+	return query.Call(*conn, request, response, CALL_TIMEOUT)
+}
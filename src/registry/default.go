@@ -0,0 +1,91 @@
+package registry
+
+import (
+	"flag"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"switchboard"
+	"sync"
+)
+
+var REGISTRY = flag.String("registry", "registry.json", "Service registry: a static JSON file, or comma-separated registry server addresses")
+
+var default_registry Registry
+var default_lock sync.Mutex
+
+// Open returns the registry described by SPEC: a static registry if SPEC
+// names a JSON file, and otherwise a client for the registry servers it
+// lists.
+func Open(spec string, security switchboard.Security) (Registry, error) {
+	if _, err := os.Stat(spec); err == nil || strings.HasSuffix(spec, ".json") {
+		return LoadStatic(spec)
+	}
+
+	addresses, err := switchboard.SplitAddresses(spec)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(addresses, security)
+}
+
+// Default returns the registry chosen with the -registry flag, opening it
+// (without any switchboard security) on first use. Binaries that secure
+// their switchboards should call SetDefault with their own registry first.
+func Default() (Registry, error) {
+	default_lock.Lock()
+	defer default_lock.Unlock()
+
+	if default_registry == nil {
+		reg, err := Open(*REGISTRY, switchboard.Security{})
+		if err != nil {
+			return nil, err
+		}
+		default_registry = reg
+	}
+	return default_registry, nil
+}
+
+func SetDefault(reg Registry) {
+	default_lock.Lock()
+	defer default_lock.Unlock()
+
+	default_registry = reg
+}
+
+// OpenDefault opens the registry chosen with the -registry flag using
+// SECURITY and makes it the default.
+func OpenDefault(security switchboard.Security) (Registry, error) {
+	reg, err := Open(*REGISTRY, security)
+	if err != nil {
+		return nil, err
+	}
+	SetDefault(reg)
+	return reg, nil
+}
+
+// LocalAddress is the address a service listening on PORT should announce
+// if it wasn't given one: this host's name and the port.
+func LocalAddress(port int) string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	return net.JoinHostPort(hostname, strconv.Itoa(port))
+}
+
+// Lookup returns the first address registered for NAME in the default
+// registry. It's meant for services with a single instance, like Mongo.
+func Lookup(name string) (string, error) {
+	reg, err := Default()
+	if err != nil {
+		return "", err
+	}
+
+	addresses, err := Addresses(reg, name)
+	if err != nil {
+		return "", err
+	}
+	return addresses[0], nil
+}
@@ -0,0 +1,60 @@
+package registry
+
+import (
+	"log"
+	"switchboard"
+	"time"
+)
+
+// How often Follow checks the registry unless told otherwise.
+const DEFAULT_FOLLOW_INTERVAL = 10 * time.Second
+
+// Follower keeps a switchboard client's backends up to date until it's
+// stopped.
+type Follower struct {
+	stopped chan bool
+	done    chan bool
+}
+
+// Follow resolves NAME every INTERVAL (or DEFAULT_FOLLOW_INTERVAL) and
+// gives CLIENT the addresses it finds, so that backends that come and go
+// are picked up without restarting. If the registry can't be reached or
+// has nothing registered the current backends are kept, since the services
+// are likely just waiting to register again with a restarted registry
+// server.
+func Follow(reg Registry, name string, client *switchboard.SwitchboardClient, interval time.Duration) *Follower {
+	if interval == 0 {
+		interval = DEFAULT_FOLLOW_INTERVAL
+	}
+
+	f := Follower{stopped: make(chan bool), done: make(chan bool)}
+	go func() {
+		defer close(f.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-f.stopped:
+				return
+			case <-ticker.C:
+			}
+
+			addresses, err := Addresses(reg, name)
+			if err != nil {
+				log.Println("Registry: couldn't resolve", name, ":", err)
+				continue
+			}
+			if err := client.SetBackends(addresses...); err != nil {
+				log.Println("Registry: invalid address registered for", name, ":", err)
+			}
+		}
+	}()
+
+	return &f
+}
+
+func (f *Follower) Stop() {
+	close(f.stopped)
+	<-f.done
+}
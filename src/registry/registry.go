@@ -0,0 +1,120 @@
+package registry
+
+// The registry keeps track of where Cleo's backends live so that binaries
+// can find each other by name ("lolstat", "nameserver", "mongo", ...)
+// instead of hard-coding addresses. There are three implementations:
+//
+//   - Table, an in-memory registry that expires services that stop sending
+//     heartbeats. Registry servers (cmd registrar) serve one of these.
+//   - Client, which talks to a registry server over switchboard.
+//   - Static, which is read from a JSON file and never changes. This is
+//     the default, and is all that's needed for local development.
+//
+// Services that can come and go register themselves with Announce, and
+// clients look them up with Resolve.
+
+import (
+	"errors"
+	"proto"
+	"sort"
+	"time"
+
+	gproto "code.google.com/p/goprotobuf/proto"
+)
+
+// Services that haven't sent a heartbeat in this long are dropped.
+const DEFAULT_TTL = 15 * time.Second
+
+// How often Announce sends heartbeats.
+const DEFAULT_HEARTBEAT = 5 * time.Second
+
+var ErrNotFound = errors.New("no services registered with that name")
+var ErrUnknownService = errors.New("service isn't registered")
+var ErrInvalidService = errors.New("services need a name and an address")
+
+type Service struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Shard   uint32 `json:"shard"`
+	// Generation of the index the service is serving, if any.
+	Generation int64 `json:"generation,omitempty"`
+	// Zero for entries that never expire.
+	LastHeartbeat time.Time `json:"-"`
+}
+
+type Registry interface {
+	// Register adds a service, or updates it if it's already registered.
+	// Services are identified by name and address.
+	Register(service Service) error
+	// Heartbeat keeps a service alive and updates its generation. It
+	// returns ErrUnknownService if the service needs to register again.
+	Heartbeat(service Service) error
+	Deregister(service Service) error
+	// Resolve returns every live service with the given name, ordered by
+	// shard and then address, or ErrNotFound.
+	Resolve(name string) ([]Service, error)
+}
+
+func (s Service) valid() bool {
+	return len(s.Name) > 0 && len(s.Address) > 0
+}
+
+func (s Service) key() string {
+	return s.Name + "/" + s.Address
+}
+
+func to_record(s Service) *proto.ServiceRecord {
+	record := proto.ServiceRecord{
+		Name:       gproto.String(s.Name),
+		Address:    gproto.String(s.Address),
+		Shard:      gproto.Uint32(s.Shard),
+		Generation: gproto.Int64(s.Generation),
+	}
+	if !s.LastHeartbeat.IsZero() {
+		record.LastHeartbeat = gproto.Int64(s.LastHeartbeat.UnixNano())
+	}
+	return &record
+}
+
+func from_record(record *proto.ServiceRecord) Service {
+	s := Service{
+		Name:       record.GetName(),
+		Address:    record.GetAddress(),
+		Shard:      record.GetShard(),
+		Generation: record.GetGeneration(),
+	}
+	if record.GetLastHeartbeat() != 0 {
+		s.LastHeartbeat = time.Unix(0, record.GetLastHeartbeat())
+	}
+	return s
+}
+
+type byShard []Service
+
+func (x byShard) Len() int      { return len(x) }
+func (x byShard) Swap(i, j int) { x[i], x[j] = x[j], x[i] }
+func (x byShard) Less(i, j int) bool {
+	if x[i].Shard != x[j].Shard {
+		return x[i].Shard < x[j].Shard
+	}
+	return x[i].Address < x[j].Address
+}
+
+func sorted(services []Service) []Service {
+	sort.Sort(byShard(services))
+	return services
+}
+
+// Addresses resolves NAME and returns just the addresses.
+func Addresses(reg Registry, name string) ([]string, error) {
+	services, err := reg.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := make([]string, 0, len(services))
+	for _, s := range services {
+		addresses = append(addresses, s.Address)
+	}
+	return addresses, nil
+}
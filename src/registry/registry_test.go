@@ -0,0 +1,264 @@
+package registry
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"query"
+	"switchboard"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTableExpiry(t *testing.T) {
+	now := time.Now()
+	table := NewTable(10 * time.Second)
+	table.now = func() time.Time { return now }
+
+	table.Register(Service{Name: "lolstat", Address: "b:1", Shard: 1})
+	table.Register(Service{Name: "lolstat", Address: "a:1", Shard: 1})
+	table.Register(Service{Name: "lolstat", Address: "c:1", Shard: 0})
+	table.Pin(Service{Name: "mongo", Address: "db:27017"})
+
+	services, err := table.Resolve("lolstat")
+	if err != nil || len(services) != 3 {
+		t.Fatal("Expected three services, got", services, err)
+	}
+	if services[0].Address != "c:1" || services[1].Address != "a:1" || services[2].Address != "b:1" {
+		t.Error("Services aren't ordered by shard and address:", services)
+	}
+
+	// Only a:1 keeps sending heartbeats.
+	now = now.Add(8 * time.Second)
+	if err := table.Heartbeat(Service{Name: "lolstat", Address: "a:1", Generation: 7}); err != nil {
+		t.Error("Heartbeat failed:", err)
+	}
+	now = now.Add(8 * time.Second)
+
+	services, _ = table.Resolve("lolstat")
+	if len(services) != 1 || services[0].Address != "a:1" || services[0].Generation != 7 {
+		t.Error("Expected only a:1 at generation 7, got", services)
+	}
+	if err := table.Heartbeat(Service{Name: "lolstat", Address: "b:1"}); err != ErrUnknownService {
+		t.Error("Heartbeat for an expired service returned", err)
+	}
+
+	// Pinned services never expire.
+	now = now.Add(time.Hour)
+	if services, err := table.Resolve("mongo"); err != nil || services[0].Address != "db:27017" {
+		t.Error("Pinned service expired:", services, err)
+	}
+	if _, err := table.Resolve("lolstat"); err != ErrNotFound {
+		t.Error("Expected ErrNotFound, got", err)
+	}
+
+	if err := table.Register(Service{Name: "lolstat"}); err != ErrInvalidService {
+		t.Error("Service without an address was accepted")
+	}
+}
+
+func TestStatic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "registry.json")
+	content := `{"services": [
+		{"name": "lolstat", "address": "127.0.0.1:14012", "shard": 1},
+		{"name": "lolstat", "address": "127.0.0.1:14002", "shard": 0},
+		{"name": "beanstalk", "address": "localhost:11300"}
+	]}`
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reg, err := Open(filename, switchboard.Security{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addresses, err := Addresses(reg, "lolstat")
+	if err != nil || len(addresses) != 2 || addresses[0] != "127.0.0.1:14002" {
+		t.Error("Unexpected lolstat addresses:", addresses, err)
+	}
+
+	// Registering is a no-op.
+	if err := reg.Register(Service{Name: "nameserver", Address: "x:1"}); err != nil {
+		t.Error(err)
+	}
+	if _, err := reg.Resolve("nameserver"); err != ErrNotFound {
+		t.Error("Static registry accepted a registration")
+	}
+
+	if _, err := Open(filepath.Join(dir, "missing.json"), switchboard.Security{}); err == nil {
+		t.Error("Missing registry file didn't fail")
+	}
+}
+
+// Starts a registry server on a free port and returns a client for it.
+func test_server(t *testing.T) (*Table, *Client, *query.QueryManager) {
+	table, manager := test_registrar()
+
+	client, err := NewClient([]string{manager.Switchboard.Listener.Addr().String()}, switchboard.Security{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return table, client, manager
+}
+
+func test_registrar() (*Table, *query.QueryManager) {
+	table := NewTable(time.Second)
+	manager := query.QueryManager{}
+	manager.Connect(0)
+	go Serve(table, &manager)
+
+	return table, &manager
+}
+
+func TestClient(t *testing.T) {
+	table, client, manager := test_server(t)
+	defer manager.Switchboard.Close()
+	defer client.Close()
+
+	service := Service{Name: "nameserver", Address: "127.0.0.1:14004", Shard: 2, Generation: 5}
+	if err := client.Register(service); err != nil {
+		t.Fatal(err)
+	}
+
+	services, err := client.Resolve("nameserver")
+	if err != nil || len(services) != 1 {
+		t.Fatal("Couldn't resolve the service:", services, err)
+	}
+	if services[0].Shard != 2 || services[0].Generation != 5 || services[0].LastHeartbeat.IsZero() {
+		t.Error("Service didn't survive the round trip:", services[0])
+	}
+
+	if _, err := client.Resolve("lolstat"); err != ErrNotFound {
+		t.Error("Expected ErrNotFound, got", err)
+	}
+
+	// The registry forgets everything, as if it restarted.
+	table.Deregister(service)
+	if err := client.Heartbeat(service); err != ErrUnknownService {
+		t.Error("Expected ErrUnknownService, got", err)
+	}
+
+	if err := client.Register(Service{Name: "nameserver"}); err == nil {
+		t.Error("Invalid service was accepted")
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	table, client, manager := test_server(t)
+	defer manager.Switchboard.Close()
+	defer client.Close()
+
+	generation := int64(1)
+	service := Service{Name: "lolstat", Address: "127.0.0.1:14002"}
+	announcer := Announce(client, service, func() int64 { return atomic.LoadInt64(&generation) }, 20*time.Millisecond)
+
+	if services, err := table.Resolve("lolstat"); err != nil || services[0].Generation != 1 {
+		t.Fatal("Service wasn't registered:", services, err)
+	}
+
+	// Announcers register again if the registry forgets them.
+	table.Deregister(service)
+	atomic.StoreInt64(&generation, 2)
+	time.Sleep(100 * time.Millisecond)
+	if services, err := table.Resolve("lolstat"); err != nil || services[0].Generation != 2 {
+		t.Error("Service didn't register again:", services, err)
+	}
+
+	announcer.Stop()
+	if _, err := table.Resolve("lolstat"); err != ErrNotFound {
+		t.Error("Service wasn't deregistered")
+	}
+}
+
+func TestClientFailover(t *testing.T) {
+	first_table, first := test_registrar()
+	second_table, second := test_registrar()
+	defer second.Switchboard.Close()
+
+	client, err := NewClient([]string{
+		first.Switchboard.Listener.Addr().String(),
+		second.Switchboard.Listener.Addr().String(),
+	}, switchboard.Security{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Every call goes to the same registry server.
+	service := Service{Name: "lolstat", Address: "127.0.0.1:14002"}
+	for i := 0; i < 3; i++ {
+		if err := client.Register(service); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Heartbeat(service); err != nil {
+			t.Error("Heartbeat", i, "failed:", err)
+		}
+	}
+	if _, err := second_table.Resolve("lolstat"); err != ErrNotFound {
+		t.Error("Calls weren't pinned to the first registry server")
+	}
+	if _, err := first_table.Resolve("lolstat"); err != nil {
+		t.Error("Service wasn't registered with the first registry server:", err)
+	}
+
+	// Once it goes away the client moves to the second, which doesn't
+	// know the service yet.
+	first.Switchboard.Close()
+	if err := client.Heartbeat(service); err != ErrUnknownService {
+		t.Error("Expected ErrUnknownService after failing over, got", err)
+	}
+	if err := client.Register(service); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := second_table.Resolve("lolstat"); err != nil {
+		t.Error("Service wasn't registered with the second registry server:", err)
+	}
+}
+
+func TestFollow(t *testing.T) {
+	table := NewTable(time.Minute)
+	backend := query.QueryManager{}
+	backend.Connect(0)
+	defer backend.Switchboard.Close()
+
+	client, err := switchboard.NewClient("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	follower := Follow(table, "lolstat", client, 10*time.Millisecond)
+	defer follower.Stop()
+
+	// The backend is picked up once it registers.
+	table.Register(Service{Name: "lolstat", Address: backend.Switchboard.Listener.Addr().String()})
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := client.GetStream()
+		if err == nil {
+			(*conn).Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Client never picked up the registered backend:", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Backends are kept if the registry forgets about them.
+	table.Deregister(Service{Name: "lolstat", Address: backend.Switchboard.Listener.Addr().String()})
+	time.Sleep(50 * time.Millisecond)
+	conn, err := client.GetStream()
+	if err != nil {
+		t.Fatal("Backend was dropped when the registry forgot it:", err)
+	}
+	(*conn).Close()
+}
@@ -0,0 +1,63 @@
+package registry
+
+import (
+	"fmt"
+	"log"
+	"proto"
+	"query"
+
+	gproto "code.google.com/p/goprotobuf/proto"
+)
+
+// Serve answers registry requests from MANAGER's switchboard using TABLE.
+// It never returns.
+func Serve(table *Table, manager *query.QueryManager) {
+	requests := manager.Requests(func() gproto.Message { return &proto.RegistryRequest{} })
+	for request := range requests {
+		request := request
+		go handle_request(table, manager, &request)
+	}
+}
+
+func handle_request(table *Table, manager *query.QueryManager, request *query.QueryRequest) {
+	req := request.Query.(*proto.RegistryRequest)
+	response := proto.RegistryResponse{}
+
+	err := error(nil)
+	switch req.GetType() {
+	case proto.RegistryRequest_REGISTER:
+		service := from_record(req.GetService())
+		err = table.Register(service)
+		if err == nil {
+			log.Println(fmt.Sprintf("Registered %s at %s (shard %d, generation %d)",
+				service.Name, service.Address, service.Shard, service.Generation))
+		}
+	case proto.RegistryRequest_HEARTBEAT:
+		err = table.Heartbeat(from_record(req.GetService()))
+		if err == ErrUnknownService {
+			response.Unknown = gproto.Bool(true)
+			err = nil
+		}
+	case proto.RegistryRequest_DEREGISTER:
+		service := from_record(req.GetService())
+		err = table.Deregister(service)
+		log.Println(fmt.Sprintf("Deregistered %s at %s", service.Name, service.Address))
+	case proto.RegistryRequest_RESOLVE:
+		services, rerr := table.Resolve(req.GetName())
+		// An empty response means not found.
+		if rerr == nil {
+			for _, service := range services {
+				response.Services = append(response.Services, to_record(service))
+			}
+		}
+	default:
+		manager.ReplyError(request, proto.WireError_BAD_REQUEST, "unknown registry request type")
+		return
+	}
+
+	if err != nil {
+		manager.ReplyError(request, proto.WireError_BAD_REQUEST, err.Error())
+		return
+	}
+	manager.Reply(request, &response)
+}
@@ -0,0 +1,60 @@
+package registry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+)
+
+// Static is a fixed registry read from a JSON file listing services:
+//
+//	{"services": [{"name": "lolstat", "address": "127.0.0.1:14002", "shard": 0}]}
+//
+// Registering with a static registry does nothing, so services can
+// announce themselves without caring which kind they've been given.
+type Static struct {
+	table *Table
+}
+
+type staticFile struct {
+	Services []Service `json:"services"`
+}
+
+func LoadStatic(filename string) (*Static, error) {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	file := staticFile{}
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return nil, err
+	}
+
+	static := Static{table: NewTable(0)}
+	for _, service := range file.Services {
+		if err := static.table.Pin(service); err != nil {
+			return nil, err
+		}
+	}
+	return &static, nil
+}
+
+// Services returns every entry, for seeding a Table.
+func (s *Static) Services() []Service {
+	s.table.lock.Lock()
+	defer s.table.lock.Unlock()
+
+	services := make([]Service, 0, len(s.table.services))
+	for _, service := range s.table.services {
+		services = append(services, service)
+	}
+	return sorted(services)
+}
+
+func (s *Static) Register(service Service) error   { return nil }
+func (s *Static) Heartbeat(service Service) error  { return nil }
+func (s *Static) Deregister(service Service) error { return nil }
+
+func (s *Static) Resolve(name string) ([]Service, error) {
+	return s.table.Resolve(name)
+}
@@ -0,0 +1,104 @@
+package registry
+
+import (
+	"sync"
+	"time"
+)
+
+// Table is an in-memory registry. Registered services expire TTL after
+// their last heartbeat; pinned services never do.
+type Table struct {
+	ttl      time.Duration
+	services map[string]Service
+	lock     sync.Mutex
+
+	// Replaceable for tests.
+	now func() time.Time
+}
+
+func NewTable(ttl time.Duration) *Table {
+	if ttl == 0 {
+		ttl = DEFAULT_TTL
+	}
+	return &Table{ttl: ttl, services: make(map[string]Service), now: time.Now}
+}
+
+// Pin adds a service that never expires, like Mongo or beanstalkd, which
+// can't register themselves.
+func (t *Table) Pin(service Service) error {
+	if !service.valid() {
+		return ErrInvalidService
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	service.LastHeartbeat = time.Time{}
+	t.services[service.key()] = service
+	return nil
+}
+
+func (t *Table) Register(service Service) error {
+	if !service.valid() {
+		return ErrInvalidService
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	service.LastHeartbeat = t.now()
+	t.services[service.key()] = service
+	return nil
+}
+
+func (t *Table) Heartbeat(service Service) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	current, ok := t.services[service.key()]
+	if !ok || t.expired(current) {
+		return ErrUnknownService
+	}
+	if current.LastHeartbeat.IsZero() {
+		// Pinned.
+		return nil
+	}
+
+	current.Generation = service.Generation
+	current.LastHeartbeat = t.now()
+	t.services[service.key()] = current
+	return nil
+}
+
+func (t *Table) Deregister(service Service) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.services, service.key())
+	return nil
+}
+
+func (t *Table) Resolve(name string) ([]Service, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	services := make([]Service, 0)
+	for key, service := range t.services {
+		if t.expired(service) {
+			delete(t.services, key)
+			continue
+		}
+		if service.Name == name {
+			services = append(services, service)
+		}
+	}
+
+	if len(services) == 0 {
+		return nil, ErrNotFound
+	}
+	return sorted(services), nil
+}
+
+func (t *Table) expired(service Service) bool {
+	return !service.LastHeartbeat.IsZero() && t.now().Sub(service.LastHeartbeat) > t.ttl
+}
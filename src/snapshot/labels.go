@@ -0,0 +1,286 @@
+package snapshot
+
+/**
+ * Snapshot labels. A label says which days a snapshot covers, where it's
+ * stored in the summoner record and how many of them to keep. There are
+ * two sorts:
+ *
+ *   calendar labels (daily, weekly, monthly) cover the day, week or month
+ *   containing the target date and are keyed by its first day.
+ *
+ *   rolling labels (last7days, last20games, ...) cover the days leading up
+ *   to and including the target date and are keyed by the target date.
+ *   They can also be limited to the summoner's most recent games.
+ *
+ * cac uses the labels to decide which quickdates go in each job, and
+ * join-summoners uses them to decide where to put the result.
+ */
+
+import (
+	data "datamodel"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const DATE_FORMAT = "2006-01-02"
+
+// The number of days searched for a summoner's most recent games.
+const GAME_LOOKBACK_DAYS = 30
+
+type Label struct {
+	Name string
+	// The days covered by a snapshot for the given date.
+	Days func(date time.Time) []time.Time
+	// Rolling snapshots are keyed by the last day they cover rather than
+	// the first.
+	Rolling bool
+	// If set, only the summoner's most recent games in those days are used.
+	Games int
+	// The number of snapshots to keep, newest first; zero keeps them all.
+	Retain int
+	// The summoner's snapshots for this label, by key. The map is created
+	// if it doesn't exist yet.
+	Bucket func(summoner *data.SummonerRecord) map[string]*data.PlayerSnapshot
+}
+
+var labels = make(map[string]Label)
+
+func init() {
+	RegisterLabel(Label{Name: "daily", Days: calendar_day, Retain: 90, Bucket: daily_bucket})
+	RegisterLabel(Label{Name: "weekly", Days: calendar_week, Retain: 52, Bucket: weekly_bucket})
+	RegisterLabel(Label{Name: "monthly", Days: calendar_month, Retain: 24, Bucket: monthly_bucket})
+
+	RegisterLabel(Label{Name: "last7days", Days: trailing_days(7), Rolling: true, Retain: 30, Bucket: window_bucket("last7days")})
+	RegisterLabel(Label{Name: "last30days", Days: trailing_days(30), Rolling: true, Retain: 30, Bucket: window_bucket("last30days")})
+	RegisterLabel(Label{Name: "last20games", Days: trailing_days(GAME_LOOKBACK_DAYS), Rolling: true, Games: 20, Retain: 30, Bucket: window_bucket("last20games")})
+}
+
+/**
+ * Adds a label. Labels are registered from init() functions, so mistakes
+ * here panic.
+ */
+func RegisterLabel(label Label) {
+	if len(label.Name) == 0 || label.Days == nil || label.Bucket == nil {
+		panic(fmt.Sprintf("Incomplete definition for label '%s'", label.Name))
+	}
+	if _, exists := labels[label.Name]; exists {
+		panic(fmt.Sprintf("Label '%s' registered twice", label.Name))
+	}
+
+	labels[label.Name] = label
+}
+
+func LookupLabel(name string) (Label, bool) {
+	label, exists := labels[name]
+	return label, exists
+}
+
+/**
+ * Every registered label, sorted by name.
+ */
+func Labels() []Label {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	all := make([]Label, 0, len(names))
+	for _, name := range names {
+		all = append(all, labels[name])
+	}
+	return all
+}
+
+/**
+ * The quickdates (YYYY-MM-DD) covered by a snapshot for the given date,
+ * in order.
+ */
+func (l Label) Dates(date string) ([]string, error) {
+	target, err := time.Parse(DATE_FORMAT, date)
+	if err != nil {
+		return nil, err
+	}
+
+	dates := make([]string, 0)
+	for _, day := range l.Days(target) {
+		dates = append(dates, day.Format(DATE_FORMAT))
+	}
+	return dates, nil
+}
+
+/**
+ * The key a snapshot covering QUICKDATES is stored under.
+ */
+func (l Label) Key(quickdates []string) string {
+	sorted := make([]string, len(quickdates))
+	copy(sorted, quickdates)
+	sort.Strings(sorted)
+
+	if l.Rolling {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[0]
+}
+
+/**
+ * Whether the summoner already has an up-to-date snapshot covering
+ * QUICKDATES: one that was built or verified after the last of them was
+ * over, and whose metrics are all current. Games can still be added to a
+ * day after it's over, so this can't be sure; join-summoners is the one
+ * that checks the games themselves.
+ */
+func (l Label) UpToDate(summoner data.SummonerRecord, quickdates []string) bool {
+	if len(quickdates) == 0 {
+		return false
+	}
+
+	snap, exists := l.Bucket(&summoner)[l.Key(quickdates)]
+	if !exists || snap == nil || !Current(*snap) {
+		return false
+	}
+
+	checked := snap.CreationTimestamp
+	if snap.VerifiedTimestamp > checked {
+		checked = snap.VerifiedTimestamp
+	}
+	return l.Over(quickdates, time.Unix(int64(checked), 0))
+}
+
+/**
+ * Whether the last of QUICKDATES was over at time AT. Quickdates are in
+ * local time.
+ */
+func (l Label) Over(quickdates []string, at time.Time) bool {
+	if len(quickdates) == 0 {
+		return false
+	}
+
+	sorted := make([]string, len(quickdates))
+	copy(sorted, quickdates)
+	sort.Strings(sorted)
+
+	last, err := time.ParseInLocation(DATE_FORMAT, sorted[len(sorted)-1], time.Local)
+	if err != nil {
+		return false
+	}
+	return !at.Before(last.AddDate(0, 0, 1))
+}
+
+/**
+ * Narrows GAMES down to the ones this label's snapshots should cover: the
+ * summoner's most recent ones, if the label has a limit.
+ */
+func (l Label) Select(sid uint32, games []*data.GameRecord) []*data.GameRecord {
+	if l.Games == 0 || len(games) <= l.Games {
+		return games
+	}
+
+	found := player_games(data.PlayerSnapshot{SummonerId: sid}, games)
+	if len(found) > l.Games {
+		found = found[len(found)-l.Games:]
+	}
+
+	selected := make([]*data.GameRecord, 0, len(found))
+	for _, pg := range found {
+		selected = append(selected, pg.game)
+	}
+	return selected
+}
+
+/**
+ * Applies the retention policy, removing all but the newest snapshots.
+ * Returns the keys that were removed.
+ */
+func (l Label) Trim(summoner *data.SummonerRecord) []string {
+	bucket := l.Bucket(summoner)
+	if l.Retain == 0 || len(bucket) <= l.Retain {
+		return nil
+	}
+
+	keys := make([]string, 0, len(bucket))
+	for key := range bucket {
+		keys = append(keys, key)
+	}
+	// Keys are dates, so they sort oldest first.
+	sort.Strings(keys)
+
+	removed := keys[:len(keys)-l.Retain]
+	for _, key := range removed {
+		delete(bucket, key)
+	}
+	return removed
+}
+
+/*******************
+ *** Date ranges ***
+ ******************/
+
+func calendar_day(date time.Time) []time.Time {
+	return []time.Time{date}
+}
+
+// Weeks start on Sunday.
+func calendar_week(date time.Time) []time.Time {
+	week_start := date.AddDate(0, 0, -(int)(date.Weekday()))
+	return days_from(week_start, 7)
+}
+
+func calendar_month(date time.Time) []time.Time {
+	month_start := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return days_from(month_start, month_start.AddDate(0, 1, -1).Day())
+}
+
+// The N days ending on (and including) the date.
+func trailing_days(n int) func(time.Time) []time.Time {
+	return func(date time.Time) []time.Time {
+		return days_from(date.AddDate(0, 0, 1-n), n)
+	}
+}
+
+func days_from(start time.Time, n int) []time.Time {
+	days := make([]time.Time, 0, n)
+	for i := 0; i < n; i++ {
+		days = append(days, start.AddDate(0, 0, i))
+	}
+	return days
+}
+
+/***************
+ *** Buckets ***
+ **************/
+
+func daily_bucket(summoner *data.SummonerRecord) map[string]*data.PlayerSnapshot {
+	if summoner.Daily == nil {
+		summoner.Daily = make(map[string]*data.PlayerSnapshot)
+	}
+	return summoner.Daily
+}
+
+func weekly_bucket(summoner *data.SummonerRecord) map[string]*data.PlayerSnapshot {
+	if summoner.Weekly == nil {
+		summoner.Weekly = make(map[string]*data.PlayerSnapshot)
+	}
+	return summoner.Weekly
+}
+
+func monthly_bucket(summoner *data.SummonerRecord) map[string]*data.PlayerSnapshot {
+	if summoner.Monthly == nil {
+		summoner.Monthly = make(map[string]*data.PlayerSnapshot)
+	}
+	return summoner.Monthly
+}
+
+// Rolling windows are stored together, by label name.
+func window_bucket(name string) func(*data.SummonerRecord) map[string]*data.PlayerSnapshot {
+	return func(summoner *data.SummonerRecord) map[string]*data.PlayerSnapshot {
+		if summoner.Windows == nil {
+			summoner.Windows = make(map[string]map[string]*data.PlayerSnapshot)
+		}
+		if summoner.Windows[name] == nil {
+			summoner.Windows[name] = make(map[string]*data.PlayerSnapshot)
+		}
+		return summoner.Windows[name]
+	}
+}
@@ -0,0 +1,152 @@
+package snapshot
+
+import (
+	data "datamodel"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func dates(t *testing.T, name string, date string) []string {
+	label, known := LookupLabel(name)
+	if !known {
+		t.Fatal("Unknown label", name)
+	}
+
+	dates, err := label.Dates(date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dates
+}
+
+func TestCalendarLabels(t *testing.T) {
+	if days := dates(t, "daily", "2014-09-18"); len(days) != 1 || days[0] != "2014-09-18" {
+		t.Error("Unexpected daily dates:", days)
+	}
+
+	// 2014-09-18 was a Thursday.
+	if days := dates(t, "weekly", "2014-09-18"); len(days) != 7 || days[0] != "2014-09-14" || days[6] != "2014-09-20" {
+		t.Error("Unexpected weekly dates:", days)
+	}
+	if days := dates(t, "weekly", "2014-09-14"); days[0] != "2014-09-14" {
+		t.Error("Sundays should start their own week:", days)
+	}
+
+	if days := dates(t, "monthly", "2014-09-18"); len(days) != 30 || days[0] != "2014-09-01" || days[29] != "2014-09-30" {
+		t.Error("Unexpected monthly dates:", days)
+	}
+	if days := dates(t, "monthly", "2012-02-10"); len(days) != 29 {
+		t.Error("Leap years have 29 days in February:", days)
+	}
+
+	label, _ := LookupLabel("weekly")
+	if key := label.Key(dates(t, "weekly", "2014-09-18")); key != "2014-09-14" {
+		t.Error("Calendar snapshots should be keyed by their first day, not", key)
+	}
+	if _, err := label.Dates("yesterday"); err == nil {
+		t.Error("Expected an error for an invalid date")
+	}
+}
+
+func TestRollingLabels(t *testing.T) {
+	days := dates(t, "last7days", "2014-09-03")
+	if len(days) != 7 || days[0] != "2014-08-28" || days[6] != "2014-09-03" {
+		t.Error("Unexpected last7days dates:", days)
+	}
+
+	label, _ := LookupLabel("last7days")
+	if key := label.Key(days); key != "2014-09-03" {
+		t.Error("Rolling snapshots should be keyed by their last day, not", key)
+	}
+}
+
+func TestSelectRecentGames(t *testing.T) {
+	label := Label{Name: "last2games", Games: 2}
+
+	games := []*data.GameRecord{
+		game(1, 300, 1800, true, fellow(ME, 1)),
+		game(2, 100, 1800, true, fellow(ME, 1)),
+		game(3, 400, 1800, true, fellow(2, 1)),
+		game(4, 200, 1800, true, fellow(ME, 1)),
+	}
+
+	selected := label.Select(ME, games)
+	if len(selected) != 2 || selected[0].GameId != 4 || selected[1].GameId != 1 {
+		t.Error("Expected the two most recent games, got", selected)
+	}
+
+	if selected := (Label{}).Select(ME, games); len(selected) != 4 {
+		t.Error("Labels without a limit should keep every game")
+	}
+}
+
+func TestRetention(t *testing.T) {
+	label, _ := LookupLabel("last7days")
+	label.Retain = 3
+
+	summoner := data.SummonerRecord{}
+	bucket := label.Bucket(&summoner)
+	for day := 1; day <= 5; day++ {
+		bucket[fmt.Sprintf("2014-09-%02d", day)] = &data.PlayerSnapshot{}
+	}
+
+	removed := label.Trim(&summoner)
+	if len(removed) != 2 || removed[0] != "2014-09-01" || removed[1] != "2014-09-02" {
+		t.Error("Expected the two oldest snapshots to be removed, got", removed)
+	}
+	if len(summoner.Windows["last7days"]) != 3 {
+		t.Error("Unexpected snapshots left:", summoner.Windows)
+	}
+
+	// Other labels are left alone.
+	if summoner.Daily != nil || len(summoner.Windows) != 1 {
+		t.Error("Trimming touched other labels:", summoner)
+	}
+	if removed := label.Trim(&summoner); len(removed) != 0 {
+		t.Error("Nothing else should be removed:", removed)
+	}
+}
+
+func TestUpToDate(t *testing.T) {
+	label, _ := LookupLabel("weekly")
+	quickdates := dates(t, "weekly", "2014-09-18")
+
+	snap := data.PlayerSnapshot{}
+	Update(&snap, nil, true)
+	end, _ := time.ParseInLocation(DATE_FORMAT, "2014-09-21", time.Local)
+
+	summoner := data.SummonerRecord{}
+	if label.UpToDate(summoner, quickdates) {
+		t.Error("A summoner without a snapshot isn't up to date")
+	}
+
+	// Built before the week was over.
+	snap.CreationTimestamp = uint64(end.Unix() - 1)
+	label.Bucket(&summoner)["2014-09-14"] = &snap
+	if label.UpToDate(summoner, quickdates) {
+		t.Error("A snapshot built during the week isn't up to date")
+	}
+
+	built := snap
+	built.CreationTimestamp = uint64(end.Unix())
+	label.Bucket(&summoner)["2014-09-14"] = &built
+	if !label.UpToDate(summoner, quickdates) {
+		t.Error("A current snapshot built after the week should be up to date")
+	}
+
+	// Verified after the week, without being rebuilt.
+	verified := snap
+	verified.VerifiedTimestamp = uint64(end.Unix())
+	label.Bucket(&summoner)["2014-09-14"] = &verified
+	if !label.UpToDate(summoner, quickdates) {
+		t.Error("A current snapshot verified after the week should be up to date")
+	}
+
+	stale := built
+	stale.Stats = map[string]data.Metric{"kda": data.RatioMetric(1, 1)}
+	label.Bucket(&summoner)["2014-09-14"] = &stale
+	if label.UpToDate(summoner, quickdates) {
+		t.Error("A snapshot with missing metrics isn't up to date")
+	}
+}
@@ -0,0 +1,145 @@
+package snapshot
+
+/**
+ * The registry of snapshot metrics. Each metric is registered with a name,
+ * a kind (see datamodel/metric.go) and a version. Bump the version
+ * whenever a computation changes and join-summoners will recompute that
+ * metric in existing snapshots, leaving the rest alone.
+ */
+
+import (
+	data "datamodel"
+	"fmt"
+	"log"
+	"sort"
+)
+
+type SnapshotFunction func(snapshot data.PlayerSnapshot, games []*data.GameRecord) data.Metric
+
+type MetricDefinition struct {
+	Name string
+	Kind string
+	// Starts at 1; zero is reserved for metrics stored before versions
+	// existed.
+	Version uint32
+	Compute SnapshotFunction
+}
+
+var definitions = make(map[string]MetricDefinition)
+
+/**
+ * Adds a metric to the registry. Metrics are registered from init()
+ * functions, so mistakes here panic.
+ */
+func Register(def MetricDefinition) {
+	if len(def.Name) == 0 || def.Compute == nil || def.Version == 0 {
+		panic(fmt.Sprintf("Incomplete definition for metric '%s'", def.Name))
+	}
+	if _, exists := definitions[def.Name]; exists {
+		panic(fmt.Sprintf("Metric '%s' registered twice", def.Name))
+	}
+	switch def.Kind {
+	case data.METRIC_SCALAR, data.METRIC_RATIO, data.METRIC_DISTRIBUTION, data.METRIC_CHAMPIONS:
+	default:
+		panic(fmt.Sprintf("Metric '%s' has unknown kind '%s'", def.Name, def.Kind))
+	}
+
+	definitions[def.Name] = def
+}
+
+/**
+ * Every registered metric, sorted by name.
+ */
+func Metrics() []MetricDefinition {
+	names := make([]string, 0, len(definitions))
+	for name := range definitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	defs := make([]MetricDefinition, 0, len(names))
+	for _, name := range names {
+		defs = append(defs, definitions[name])
+	}
+	return defs
+}
+
+func Lookup(name string) (MetricDefinition, bool) {
+	def, exists := definitions[name]
+	return def, exists
+}
+
+/**
+ * Runs the computation and stamps the result with the metric's version.
+ * A computation that returns the wrong kind of metric is a bug; the
+ * result is logged and stored as no data.
+ */
+func (def MetricDefinition) Run(snapshot data.PlayerSnapshot, games []*data.GameRecord) data.Metric {
+	metric := def.Compute(snapshot, games)
+	if metric.Type() != def.Kind {
+		log.Println(fmt.Sprintf("Metric %s returned a %s instead of a %s", def.Name, metric.Type(), def.Kind))
+		metric = data.NoDataMetric(def.Kind)
+	}
+
+	metric.Version = def.Version
+	return metric
+}
+
+/**
+ * Whether STORED is out of date with respect to the definition.
+ */
+func (def MetricDefinition) Stale(stored data.Metric) bool {
+	return stored.Version != def.Version || stored.Type() != def.Kind
+}
+
+/**
+ * Brings a snapshot's metrics up to date: metrics that are missing or
+ * were computed by another version are recomputed, and metrics that are
+ * no longer registered are removed. If ALL is set then every metric is
+ * recomputed, which is what's needed when the snapshot's games change.
+ *
+ * Returns the names of the metrics that changed.
+ */
+func Update(snapshot *data.PlayerSnapshot, games []*data.GameRecord, all bool) []string {
+	if snapshot.Stats == nil {
+		snapshot.Stats = make(map[string]data.Metric)
+	}
+
+	changed := make([]string, 0)
+	for name := range snapshot.Stats {
+		if _, exists := definitions[name]; !exists {
+			delete(snapshot.Stats, name)
+			changed = append(changed, name)
+		}
+	}
+
+	for _, def := range Metrics() {
+		stored, exists := snapshot.Stats[def.Name]
+		if all || !exists || def.Stale(stored) {
+			snapshot.Stats[def.Name] = def.Run(*snapshot, games)
+			changed = append(changed, def.Name)
+		}
+	}
+
+	sort.Strings(changed)
+	return changed
+}
+
+/**
+ * Whether every registered metric in the snapshot is up to date, and no
+ * other metrics are stored; that is, whether Update() would leave it
+ * alone if its games haven't changed.
+ */
+func Current(snapshot data.PlayerSnapshot) bool {
+	if len(snapshot.Stats) != len(definitions) {
+		return false
+	}
+
+	for _, def := range definitions {
+		stored, exists := snapshot.Stats[def.Name]
+		if !exists || def.Stale(stored) {
+			return false
+		}
+	}
+	return true
+}
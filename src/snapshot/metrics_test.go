@@ -0,0 +1,138 @@
+package snapshot
+
+import (
+	data "datamodel"
+	"testing"
+)
+
+// Swaps in a registry containing only DEFS for the duration of a test.
+func with_definitions(defs []MetricDefinition, test func()) {
+	saved := definitions
+	definitions = make(map[string]MetricDefinition)
+	defer func() { definitions = saved }()
+
+	for _, def := range defs {
+		Register(def)
+	}
+	test()
+}
+
+// A metric that counts how many times it's been computed.
+func counter(name string, version uint32, runs *int) MetricDefinition {
+	return MetricDefinition{Name: name, Kind: data.METRIC_SCALAR, Version: version, Compute: func(snapshot data.PlayerSnapshot, games []*data.GameRecord) data.Metric {
+		*runs++
+		return data.ScalarMetric(float64(len(games)))
+	}}
+}
+
+func TestUpdate(t *testing.T) {
+	first, second := 0, 0
+	snap := data.PlayerSnapshot{}
+	games := []*data.GameRecord{{GameId: 1}}
+
+	with_definitions([]MetricDefinition{counter("first", 1, &first), counter("second", 1, &second)}, func() {
+		if changed := Update(&snap, games, false); len(changed) != 2 || first != 1 || second != 1 {
+			t.Error("Expected both metrics to be computed:", changed)
+		}
+		if metric := snap.Stats["first"]; metric.Version != 1 || metric.Value != 1 {
+			t.Error("Unexpected metric:", metric)
+		}
+
+		// Nothing's changed.
+		if changed := Update(&snap, games, false); len(changed) != 0 || first != 1 {
+			t.Error("Up-to-date metrics were recomputed:", changed)
+		}
+
+		// Unless the games did.
+		if changed := Update(&snap, games, true); len(changed) != 2 || first != 2 {
+			t.Error("Expected everything to be recomputed:", changed)
+		}
+	})
+
+	// A new version of one metric and the other one removed.
+	with_definitions([]MetricDefinition{counter("first", 2, &first)}, func() {
+		changed := Update(&snap, games, false)
+		if len(changed) != 2 || changed[0] != "first" || changed[1] != "second" || first != 3 {
+			t.Error("Unexpected changes:", changed)
+		}
+		if _, exists := snap.Stats["second"]; exists || snap.Stats["first"].Version != 2 {
+			t.Error("Unexpected stats:", snap.Stats)
+		}
+	})
+}
+
+func TestLegacyMetricsAreStale(t *testing.T) {
+	runs := 0
+	snap := data.PlayerSnapshot{Stats: map[string]data.Metric{
+		// As stored before metrics had kinds or versions.
+		"first": {Value: 11},
+	}}
+
+	with_definitions([]MetricDefinition{counter("first", 1, &runs)}, func() {
+		if changed := Update(&snap, nil, false); len(changed) != 1 || runs != 1 {
+			t.Error("Legacy metric wasn't recomputed:", changed)
+		}
+	})
+}
+
+func TestWrongKind(t *testing.T) {
+	def := MetricDefinition{Name: "wrong", Kind: data.METRIC_RATIO, Version: 4, Compute: func(snapshot data.PlayerSnapshot, games []*data.GameRecord) data.Metric {
+		return data.ScalarMetric(1)
+	}}
+
+	if metric := def.Run(data.PlayerSnapshot{}, nil); !metric.NoData || metric.Type() != data.METRIC_RATIO || metric.Version != 4 {
+		t.Error("Unexpected metric:", metric)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	runs := 0
+	bad := []MetricDefinition{
+		counter("", 1, &runs),
+		counter("unversioned", 0, &runs),
+		{Name: "uncomputable", Kind: data.METRIC_SCALAR, Version: 1},
+		{Name: "unknown", Kind: "histogram", Version: 1, Compute: counter("", 1, &runs).Compute},
+		counter("kda", 1, &runs),
+	}
+
+	for _, def := range bad {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("Registering", def.Name, "should have panicked")
+				}
+			}()
+			Register(def)
+		}()
+	}
+
+	if _, exists := Lookup("kda"); !exists {
+		t.Error("The built-in metrics should be registered")
+	}
+}
+
+func TestCurrent(t *testing.T) {
+	runs := 0
+	with_definitions([]MetricDefinition{counter("first", 1, &runs), counter("second", 2, &runs)}, func() {
+		snap := data.PlayerSnapshot{}
+		if Current(snap) {
+			t.Error("An empty snapshot isn't current")
+		}
+
+		Update(&snap, nil, true)
+		if !Current(snap) {
+			t.Error("A snapshot that was just updated should be current")
+		}
+
+		snap.Stats["second"] = data.Metric{Kind: data.METRIC_SCALAR, Version: 1}
+		if Current(snap) {
+			t.Error("A metric from an older version isn't current")
+		}
+
+		Update(&snap, nil, false)
+		snap.Stats["retired"] = data.ScalarMetric(1)
+		if Current(snap) {
+			t.Error("A metric that's no longer registered isn't current")
+		}
+	})
+}
@@ -2,68 +2,323 @@ package snapshot
 
 import (
 	data "datamodel"
+	"sort"
 )
 
-// TODO: Handle return values of NaN correctly.
-
-type SnapshotFunction func(snapshot data.PlayerSnapshot, games []*data.GameRecord) (string, data.Metric)
-
-// List containing a bunch of pointers to functions. Each function will
-// be called on snapshots to generate a stat.
-var Computations = make([]SnapshotFunction, 0, 10)
-
 func init() {
-	Computations = append(Computations, kda)
-	Computations = append(Computations, minionKills)
+	Register(MetricDefinition{Name: "kda", Kind: data.METRIC_RATIO, Version: 1, Compute: kda})
+	Register(MetricDefinition{Name: "minionKills", Kind: data.METRIC_SCALAR, Version: 2, Compute: minionKills})
+
+	Register(MetricDefinition{Name: "winRate", Kind: data.METRIC_RATIO, Version: 1, Compute: winRate})
+	Register(MetricDefinition{Name: "championWinRate", Kind: data.METRIC_CHAMPIONS, Version: 1, Compute: championWinRate})
+	Register(MetricDefinition{Name: "championGames", Kind: data.METRIC_CHAMPIONS, Version: 1, Compute: championGames})
+	Register(MetricDefinition{Name: "goldPerMinute", Kind: data.METRIC_RATIO, Version: 1, Compute: goldPerMinute})
+	Register(MetricDefinition{Name: "csPerMinute", Kind: data.METRIC_RATIO, Version: 1, Compute: csPerMinute})
+	Register(MetricDefinition{Name: "killParticipation", Kind: data.METRIC_RATIO, Version: 1, Compute: killParticipation})
+	Register(MetricDefinition{Name: "deathShare", Kind: data.METRIC_RATIO, Version: 1, Compute: deathShare})
+	Register(MetricDefinition{Name: "longestWinStreak", Kind: data.METRIC_SCALAR, Version: 1, Compute: longestWinStreak})
+	Register(MetricDefinition{Name: "longestLossStreak", Kind: data.METRIC_SCALAR, Version: 1, Compute: longestLossStreak})
+	Register(MetricDefinition{Name: "currentStreak", Kind: data.METRIC_SCALAR, Version: 1, Compute: currentStreak})
 }
 
 /**
- * Computes the mean KDA for a given snapshot.
+ * Computes the KDA for a given snapshot: kills and assists over deaths.
  */
-func kda(snapshot data.PlayerSnapshot, games []*data.GameRecord) (string, data.Metric) {
+func kda(snapshot data.PlayerSnapshot, games []*data.GameRecord) data.Metric {
 	var num_kills uint32 = 0
 	var num_deaths uint32 = 0
 	var num_assists uint32 = 0
+	var num_set_games = 0
 
-	for _, game := range games {
-		for _, team := range game.Teams {
-			for _, player := range team.Players {
-				if snapshot.SummonerId == player.Player.SummonerId && player.IsSet {
-					num_kills += player.Kills
-					num_deaths += player.Deaths
-					num_assists += player.Assists
-				}
-			}
+	for _, pg := range player_games(snapshot, games) {
+		if pg.player.IsSet {
+			num_kills += pg.player.Kills
+			num_deaths += pg.player.Deaths
+			num_assists += pg.player.Assists
+			num_set_games += 1
 		}
 	}
 
-	if num_deaths > 0 {
-		return "kda", data.SimpleNumberMetric{(float64)(num_kills+num_assists) / (float64)(num_deaths)}
+	if num_set_games > 0 {
+		return data.RatioMetric((float64)(num_kills+num_assists), (float64)(num_deaths))
 	} else {
-		return "kda", data.SimpleNumberMetric{}
+		return data.NoDataMetric(data.METRIC_RATIO)
 	}
 }
 
 /**
  * Computes the mean # of minion kills for a given snapshot.
  */
-func minionKills(snapshot data.PlayerSnapshot, games []*data.GameRecord) (string, data.Metric) {
+func minionKills(snapshot data.PlayerSnapshot, games []*data.GameRecord) data.Metric {
 	var num_minions uint32 = 0
 	var num_set_games = 0
 
+	for _, pg := range player_games(snapshot, games) {
+		if pg.player.IsSet {
+			num_minions += pg.player.Minions
+			num_set_games += 1
+		}
+	}
+	// Only games with stats count; the summoner's other games would
+	// otherwise drag the mean down.
+	if num_set_games > 0 {
+		return data.ScalarMetric((float64)(num_minions) / (float64)(num_set_games))
+	} else {
+		return data.NoDataMetric(data.METRIC_SCALAR)
+	}
+}
+
+/**
+ * A game from the point of view of the snapshot's summoner.
+ */
+type playerGame struct {
+	game   *data.GameRecord
+	team   *data.Team
+	player *data.PlayerStats
+}
+
+/**
+ * Finds the summoner in each of the games, oldest game first. Games they
+ * didn't play in are skipped.
+ */
+func player_games(snapshot data.PlayerSnapshot, games []*data.GameRecord) []playerGame {
+	found := make([]playerGame, 0, len(games))
+
 	for _, game := range games {
 		for _, team := range game.Teams {
 			for _, player := range team.Players {
-				if snapshot.SummonerId == player.Player.SummonerId && player.IsSet {
-					num_minions += player.Minions
-					num_set_games += 1
+				if player.Player != nil && snapshot.SummonerId == player.Player.SummonerId {
+					found = append(found, playerGame{game: game, team: team, player: player})
 				}
 			}
 		}
 	}
-	if num_set_games > 0 && len(games) > 0 {
-		return "minionKills", data.SimpleNumberMetric{(float64)(num_minions) / (float64)(len(games))}
-	} else {
-		return "minionKills", data.SimpleNumberMetric{}
+
+	sort.Sort(byTimestamp(found))
+	return found
+}
+
+type byTimestamp []playerGame
+
+func (x byTimestamp) Len() int           { return len(x) }
+func (x byTimestamp) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+func (x byTimestamp) Less(i, j int) bool { return x[i].game.Timestamp < x[j].game.Timestamp }
+
+/**
+ * Whether the stats for everyone on the team are known, which is needed
+ * for anything that compares the summoner to the rest of their team.
+ * Games only have everyone's stats once every player on the team has
+ * been fetched.
+ */
+func (pg playerGame) team_complete() bool {
+	for _, player := range pg.team.Players {
+		if !player.IsSet {
+			return false
+		}
+	}
+	return len(pg.team.Players) > 0
+}
+
+/**
+ * Fraction of games won. The outcome is known for every game, even ones
+ * without stats for the summoner.
+ */
+func winRate(snapshot data.PlayerSnapshot, games []*data.GameRecord) data.Metric {
+	found := player_games(snapshot, games)
+	if len(found) == 0 {
+		return data.NoDataMetric(data.METRIC_RATIO)
+	}
+
+	wins := 0
+	for _, pg := range found {
+		if pg.team.Victory {
+			wins += 1
+		}
+	}
+	return data.RatioMetric((float64)(wins), (float64)(len(found)))
+}
+
+/**
+ * Wins and games played on each champion.
+ */
+func champion_records(snapshot data.PlayerSnapshot, games []*data.GameRecord) (map[uint32]int, map[uint32]int) {
+	wins := make(map[uint32]int)
+	played := make(map[uint32]int)
+
+	for _, pg := range player_games(snapshot, games) {
+		// Champion zero means we don't know who they played.
+		if pg.player.Champion == 0 {
+			continue
+		}
+
+		played[pg.player.Champion] += 1
+		if pg.team.Victory {
+			wins[pg.player.Champion] += 1
+		}
+	}
+	return wins, played
+}
+
+/**
+ * Fraction of games won on each champion the summoner played.
+ */
+func championWinRate(snapshot data.PlayerSnapshot, games []*data.GameRecord) data.Metric {
+	wins, played := champion_records(snapshot, games)
+
+	champions := make(map[uint32]data.Metric)
+	for champion, count := range played {
+		champions[champion] = data.RatioMetric((float64)(wins[champion]), (float64)(count))
+	}
+	return data.ChampionMetric(champions)
+}
+
+/**
+ * Number of games played on each champion.
+ */
+func championGames(snapshot data.PlayerSnapshot, games []*data.GameRecord) data.Metric {
+	_, played := champion_records(snapshot, games)
+
+	champions := make(map[uint32]data.Metric)
+	for champion, count := range played {
+		champions[champion] = data.ScalarMetric((float64)(count))
+	}
+	return data.ChampionMetric(champions)
+}
+
+/**
+ * Sums a per-game stat over the minutes played, for games where the
+ * summoner's stats and the game's length are both known. Durations are
+ * stored in seconds.
+ */
+func per_minute(snapshot data.PlayerSnapshot, games []*data.GameRecord, stat func(*data.PlayerStats) uint32) data.Metric {
+	var total uint64 = 0
+	var seconds uint64 = 0
+
+	for _, pg := range player_games(snapshot, games) {
+		if pg.player.IsSet && pg.game.Duration > 0 {
+			total += (uint64)(stat(pg.player))
+			seconds += (uint64)(pg.game.Duration)
+		}
+	}
+
+	if seconds == 0 {
+		return data.NoDataMetric(data.METRIC_RATIO)
+	}
+	return data.RatioMetric((float64)(total), (float64)(seconds)/60)
+}
+
+/**
+ * Gold earned per minute played.
+ */
+func goldPerMinute(snapshot data.PlayerSnapshot, games []*data.GameRecord) data.Metric {
+	return per_minute(snapshot, games, func(player *data.PlayerStats) uint32 { return player.GoldEarned })
+}
+
+/**
+ * Minions killed per minute played.
+ */
+func csPerMinute(snapshot data.PlayerSnapshot, games []*data.GameRecord) data.Metric {
+	return per_minute(snapshot, games, func(player *data.PlayerStats) uint32 { return player.Minions })
+}
+
+/**
+ * Compares the summoner's share of a stat to their team's total, over the
+ * games where the whole team's stats are known.
+ */
+func team_share(snapshot data.PlayerSnapshot, games []*data.GameRecord, mine func(*data.PlayerStats) uint32, team func(*data.PlayerStats) uint32) data.Metric {
+	var num_mine uint32 = 0
+	var num_team uint32 = 0
+	var num_complete_games = 0
+
+	for _, pg := range player_games(snapshot, games) {
+		if !pg.team_complete() {
+			continue
+		}
+
+		num_complete_games += 1
+		num_mine += mine(pg.player)
+		for _, player := range pg.team.Players {
+			num_team += team(player)
+		}
+	}
+
+	if num_complete_games == 0 {
+		return data.NoDataMetric(data.METRIC_RATIO)
+	}
+	return data.RatioMetric((float64)(num_mine), (float64)(num_team))
+}
+
+/**
+ * Fraction of the team's kills that the summoner took part in (killed or
+ * assisted).
+ */
+func killParticipation(snapshot data.PlayerSnapshot, games []*data.GameRecord) data.Metric {
+	return team_share(snapshot, games,
+		func(player *data.PlayerStats) uint32 { return player.Kills + player.Assists },
+		func(player *data.PlayerStats) uint32 { return player.Kills })
+}
+
+/**
+ * Fraction of the team's deaths that were the summoner's.
+ */
+func deathShare(snapshot data.PlayerSnapshot, games []*data.GameRecord) data.Metric {
+	return team_share(snapshot, games,
+		func(player *data.PlayerStats) uint32 { return player.Deaths },
+		func(player *data.PlayerStats) uint32 { return player.Deaths })
+}
+
+/**
+ * Walks through the summoner's games in order and returns their longest
+ * winning and losing streaks, and their current streak: positive if
+ * they're on a winning streak and negative if they're on a losing one.
+ */
+func streaks(snapshot data.PlayerSnapshot, games []*data.GameRecord) (int, int, int, bool) {
+	found := player_games(snapshot, games)
+	if len(found) == 0 {
+		return 0, 0, 0, false
+	}
+
+	longest_win, longest_loss, current := 0, 0, 0
+	for _, pg := range found {
+		if pg.team.Victory {
+			if current < 0 {
+				current = 0
+			}
+			current += 1
+		} else {
+			if current > 0 {
+				current = 0
+			}
+			current -= 1
+		}
+
+		if current > longest_win {
+			longest_win = current
+		}
+		if -current > longest_loss {
+			longest_loss = -current
+		}
+	}
+	return longest_win, longest_loss, current, true
+}
+
+func longestWinStreak(snapshot data.PlayerSnapshot, games []*data.GameRecord) data.Metric {
+	if longest, _, _, ok := streaks(snapshot, games); ok {
+		return data.ScalarMetric((float64)(longest))
+	}
+	return data.NoDataMetric(data.METRIC_SCALAR)
+}
+
+func longestLossStreak(snapshot data.PlayerSnapshot, games []*data.GameRecord) data.Metric {
+	if _, longest, _, ok := streaks(snapshot, games); ok {
+		return data.ScalarMetric((float64)(longest))
+	}
+	return data.NoDataMetric(data.METRIC_SCALAR)
+}
+
+func currentStreak(snapshot data.PlayerSnapshot, games []*data.GameRecord) data.Metric {
+	if _, _, current, ok := streaks(snapshot, games); ok {
+		return data.ScalarMetric((float64)(current))
 	}
+	return data.NoDataMetric(data.METRIC_SCALAR)
 }
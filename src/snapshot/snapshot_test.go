@@ -0,0 +1,214 @@
+package snapshot
+
+import (
+	data "datamodel"
+	"testing"
+)
+
+const ME = 1
+
+// A player with stats.
+func stats(sid uint32, champion uint32, kills uint32, deaths uint32, assists uint32) *data.PlayerStats {
+	return &data.PlayerStats{
+		IsSet:      true,
+		Player:     &data.PlayerType{SummonerId: sid},
+		Champion:   champion,
+		Kills:      kills,
+		Deaths:     deaths,
+		Assists:    assists,
+		GoldEarned: 10000,
+		Minions:    150,
+	}
+}
+
+// A player seen in someone else's game, without stats.
+func fellow(sid uint32, champion uint32) *data.PlayerStats {
+	return &data.PlayerStats{Player: &data.PlayerType{SummonerId: sid}, Champion: champion}
+}
+
+// A game that ME played, with MINE as their stats, against a team of
+// strangers.
+func game(gid uint64, timestamp uint64, duration uint32, victory bool, mine *data.PlayerStats, teammates ...*data.PlayerStats) *data.GameRecord {
+	return &data.GameRecord{
+		GameId:    gid,
+		Timestamp: timestamp,
+		Duration:  duration,
+		Teams: []*data.Team{
+			{Victory: victory, Players: append([]*data.PlayerStats{mine}, teammates...)},
+			{Victory: !victory, Players: []*data.PlayerStats{fellow(100, 1), fellow(101, 2)}},
+		},
+	}
+}
+
+var me = data.PlayerSnapshot{SummonerId: ME}
+
+func check_ratio(t *testing.T, name string, metric data.Metric, numerator float64, denominator float64) {
+	if metric.NoData || metric.Type() != data.METRIC_RATIO || metric.Numerator != numerator || metric.Denominator != denominator {
+		t.Errorf("Expected %s to be %v / %v, got %#v", name, numerator, denominator, metric)
+	}
+}
+
+func check_scalar(t *testing.T, name string, metric data.Metric, value float64) {
+	if metric.NoData || metric.Type() != data.METRIC_SCALAR || metric.Value != value {
+		t.Errorf("Expected %s to be %v, got %#v", name, value, metric)
+	}
+}
+
+func check_no_data(t *testing.T, name string, metric data.Metric) {
+	if !metric.NoData {
+		t.Errorf("Expected %s to have no data, got %#v", name, metric)
+	}
+}
+
+func TestKDA(t *testing.T) {
+	games := []*data.GameRecord{
+		game(1, 1, 1800, true, stats(ME, 1, 5, 2, 3)),
+		game(2, 2, 1800, false, stats(ME, 1, 1, 2, 1)),
+		// No stats for this one.
+		game(3, 3, 1800, false, fellow(ME, 1)),
+	}
+
+	check_ratio(t, "kda", kda(me, games), 10, 4)
+	check_no_data(t, "kda", kda(me, games[2:]))
+}
+
+func TestMinionKills(t *testing.T) {
+	games := []*data.GameRecord{
+		game(1, 1, 1800, true, stats(ME, 1, 0, 0, 0)),
+		game(2, 2, 1800, true, fellow(ME, 1)),
+	}
+
+	// The game without stats doesn't count.
+	check_scalar(t, "minionKills", minionKills(me, games), 150)
+	check_no_data(t, "minionKills", minionKills(me, games[1:]))
+}
+
+// Players that were never looked up don't have a PlayerType.
+func TestUnknownPlayers(t *testing.T) {
+	games := []*data.GameRecord{game(1, 1, 1800, true, stats(ME, 1, 5, 2, 3), &data.PlayerStats{})}
+	snap := data.PlayerSnapshot{SummonerId: ME}
+
+	Update(&snap, games, true)
+	check_ratio(t, "kda", snap.Stats["kda"], 8, 2)
+	check_scalar(t, "minionKills", snap.Stats["minionKills"], 150)
+}
+
+func TestWinRate(t *testing.T) {
+	games := []*data.GameRecord{
+		game(1, 1, 1800, true, stats(ME, 1, 0, 0, 0)),
+		game(2, 2, 1800, false, stats(ME, 1, 0, 0, 0)),
+		// Outcomes count even without stats.
+		game(3, 3, 1800, true, fellow(ME, 1)),
+		// Games the summoner wasn't in are ignored.
+		game(4, 4, 1800, true, stats(2, 1, 0, 0, 0)),
+	}
+
+	check_ratio(t, "winRate", winRate(me, games), 2, 3)
+	check_no_data(t, "winRate", winRate(me, games[3:]))
+}
+
+func TestChampionStats(t *testing.T) {
+	games := []*data.GameRecord{
+		game(1, 1, 1800, true, stats(ME, 7, 0, 0, 0)),
+		game(2, 2, 1800, false, stats(ME, 7, 0, 0, 0)),
+		game(3, 3, 1800, true, fellow(ME, 7)),
+		game(4, 4, 1800, false, stats(ME, 12, 0, 0, 0)),
+		// Unknown champion.
+		game(5, 5, 1800, true, stats(ME, 0, 0, 0, 0)),
+	}
+
+	rates := championWinRate(me, games)
+	played := championGames(me, games)
+	if len(rates.Champions) != 2 || len(played.Champions) != 2 {
+		t.Fatal("Expected two champions:", rates, played)
+	}
+
+	rate, _ := rates.Champion(7)
+	check_ratio(t, "champion 7 win rate", rate, 2, 3)
+	rate, _ = rates.Champion(12)
+	check_ratio(t, "champion 12 win rate", rate, 0, 1)
+
+	count, _ := played.Champion(7)
+	check_scalar(t, "champion 7 games", count, 3)
+	count, _ = played.Champion(12)
+	check_scalar(t, "champion 12 games", count, 1)
+
+	check_no_data(t, "championWinRate", championWinRate(me, nil))
+	check_no_data(t, "championGames", championGames(me, games[4:]))
+}
+
+func TestPerMinute(t *testing.T) {
+	slow := stats(ME, 1, 0, 0, 0)
+	slow.GoldEarned = 12000
+	slow.Minions = 240
+
+	games := []*data.GameRecord{
+		// 10,000 gold and 150 minions in 20 minutes.
+		game(1, 1, 1200, true, stats(ME, 1, 0, 0, 0)),
+		// 12,000 gold and 240 minions in 40 minutes.
+		game(2, 2, 2400, true, slow),
+		// Unknown duration and unknown stats are both skipped.
+		game(3, 3, 0, true, stats(ME, 1, 0, 0, 0)),
+		game(4, 4, 1800, true, fellow(ME, 1)),
+	}
+
+	check_ratio(t, "goldPerMinute", goldPerMinute(me, games), 22000, 60)
+	check_ratio(t, "csPerMinute", csPerMinute(me, games), 390, 60)
+	if value, _ := csPerMinute(me, games).Float(); value != 6.5 {
+		t.Error("Expected 6.5 CS per minute, got", value)
+	}
+	check_no_data(t, "goldPerMinute", goldPerMinute(me, games[2:]))
+}
+
+func TestTeamShare(t *testing.T) {
+	games := []*data.GameRecord{
+		// Team: 10 kills and 6 deaths; I had 4 kills, 3 assists and 2 deaths.
+		game(1, 1, 1800, true, stats(ME, 1, 4, 2, 3), stats(2, 2, 6, 4, 1)),
+		// Team: 2 kills and 4 deaths; I had 1 kill, 1 assist and 1 death.
+		game(2, 2, 1800, false, stats(ME, 1, 1, 1, 1), stats(2, 2, 1, 3, 0)),
+		// My teammate's stats aren't known, so this game is skipped.
+		game(3, 3, 1800, false, stats(ME, 1, 9, 9, 9), fellow(2, 2)),
+	}
+
+	check_ratio(t, "killParticipation", killParticipation(me, games), 9, 12)
+	check_ratio(t, "deathShare", deathShare(me, games), 3, 10)
+	check_no_data(t, "killParticipation", killParticipation(me, games[2:]))
+
+	// A team that didn't kill anyone has data, but no value.
+	shutout := []*data.GameRecord{game(1, 1, 1800, false, stats(ME, 1, 0, 3, 0))}
+	if metric := killParticipation(me, shutout); metric.NoData || metric.Denominator != 0 {
+		t.Error("Unexpected kill participation:", metric)
+	}
+}
+
+func TestStreaks(t *testing.T) {
+	// W W L W W W L L, out of order.
+	outcomes := []bool{true, true, false, true, true, true, false, false}
+	games := make([]*data.GameRecord, 0, len(outcomes))
+	for i := len(outcomes) - 1; i >= 0; i-- {
+		games = append(games, game(uint64(i), uint64(1000+i), 1800, outcomes[i], fellow(ME, 1)))
+	}
+
+	check_scalar(t, "longestWinStreak", longestWinStreak(me, games), 3)
+	check_scalar(t, "longestLossStreak", longestLossStreak(me, games), 2)
+	check_scalar(t, "currentStreak", currentStreak(me, games), -2)
+
+	// Ending on a win.
+	games = append(games, game(99, 2000, 1800, true, fellow(ME, 1)))
+	check_scalar(t, "currentStreak", currentStreak(me, games), 1)
+
+	check_no_data(t, "currentStreak", currentStreak(me, nil))
+}
+
+func TestAllMetrics(t *testing.T) {
+	games := []*data.GameRecord{game(1, 1, 1800, true, stats(ME, 1, 5, 2, 3))}
+	snap := data.PlayerSnapshot{SummonerId: ME}
+
+	// Every registered metric returns the kind it was registered with.
+	Update(&snap, games, true)
+	for _, def := range Metrics() {
+		if metric := snap.Stats[def.Name]; metric.NoData || metric.Version != def.Version {
+			t.Errorf("Unexpected %s: %#v", def.Name, metric)
+		}
+	}
+}
@@ -1,141 +1,99 @@
 package main
 
 import (
-	"bufio"
 //	"bytes"
 	gproto "code.google.com/p/goprotobuf/proto"
 	data "datamodel"
-	"encoding/json"
-	"fmt"
+	"flag"
+//	"fmt"
 //	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
 	"proto"
+	"query"
+	"registry"
 	"switchboard"
 //	"text/template"
 )
 
-type FrontendStatsRequest struct {
-	KnownSummoner bool
-	Player        data.PlayerType
-	Records       data.SummonerRecord
-}
-
 //type IndexTemplate struct {
 //	OverviewTab		string
 //}
 
 // Switchboard to be used by all of the goroutines.
-var lookup switchboard.SwitchboardClient
+var lookup *switchboard.SwitchboardClient
 var cerr = error(nil)
 
-func init() {
-	conn, _ := net.ResolveTCPAddr("tcp", "lookup.loltracker.com:14004")
-	lookup, cerr = switchboard.NewClient("tcp", conn)
+var NAMESERVERS = flag.String("nameservers", "", "Comma-separated nameserver addresses; looked up in the registry if empty")
+var SECURITY = switchboard.RegisterSecurityFlags()
+
+func connect_nameservers() {
+	security, serr := SECURITY.Client()
+	if serr != nil {
+		log.Fatal("Invalid switchboard security settings:", serr)
+	}
+
+	reg, rerr := registry.OpenDefault(security)
+	if rerr != nil {
+		log.Fatal("Couldn't open the service registry:", rerr)
+	}
+
+	// Nameservers from the registry are followed so that ones that
+	// register later are picked up.
+	addresses, aerr := []string(nil), error(nil)
+	following := len(*NAMESERVERS) == 0
+	if following {
+		addresses, aerr = registry.Addresses(reg, "nameserver")
+		if aerr == registry.ErrNotFound {
+			log.Println("No nameservers are registered yet.")
+			aerr = nil
+		}
+	} else {
+		addresses, aerr = switchboard.SplitAddresses(*NAMESERVERS)
+	}
+	if aerr != nil {
+		log.Fatal("Couldn't find nameservers:", aerr)
+	}
+
+	lookup, cerr = switchboard.NewClientWithOptions("tcp", switchboard.ClientOptions{Security: security}, addresses...)
 
 	if cerr != nil {
-		log.Fatal("Couldn't find any available backends.")
+		log.Fatal("Couldn't connect to the nameservers:", cerr)
 	} else {
 		log.Println("Connected to nameserver.")
 	}
+	if following {
+		registry.Follow(reg, "nameserver", lookup, 0)
+	}
 }
 
 /**
  * Make a call to the lookup server to convert a summoner name into a
- * summoner ID. This function will return the summoner ID as well as
- * a boolean flag indicating whether the summoner was found by the
- * lookup server. If !valid, the value of the summoner ID can be
- * assumed to be unusable.
+ * summoner ID. Returns ErrUnknownSummoner if the lookup server doesn't
+ * know the name, and other errors if the lookup couldn't be made.
  */
-func lookup_summoner(name string) (uint32, bool) {
+func lookup_summoner(name string) (uint32, error) {
 	// Get a stream to the lookup server.
-	conn, _ := lookup.GetStream()
+	conn, err := lookup.GetStream()
+	if err != nil {
+		log.Println("Couldn't reach the nameserver:", err)
+		return 0, err
+	}
+	defer (*conn).Close()
 
 	request := proto.NameRequest{}
 	request.Name = gproto.String(name)
 
-	// Send a request
-	rw := bufio.NewReadWriter(bufio.NewReader(*conn), bufio.NewWriter(*conn))
-	data, _ := gproto.Marshal(&request)
-	rw.WriteString(string(data) + "|")
-	rw.Flush()
-
-	// Receive a response
 	response := proto.NameResponse{}
-	reply, _ := rw.ReadString('|')
-	gproto.Unmarshal([]byte(reply[:len(reply)-1]), &response)
-
-	return *response.Id, (*response.Id != 0)
-}
-
-func summoner_handler(w http.ResponseWriter, r *http.Request) {
-	log.Println("summoner requested")
-
-	name := r.FormValue("name")
-	// Lookup the summoner ID from a lookup server.
-	summoner_id, valid := lookup_summoner(name)
-
-	stat_request := FrontendStatsRequest{}
-	stat_request.KnownSummoner = valid
-	stat_request.Player.Name = name
-	stat_request.Player.SummonerId = summoner_id
-
-	retriever := data.LoLRetriever{}
-
-	if valid {
-		// Make a request to the backend to get the snapshot data for
-		// this summoner.
-		stat_request.Records, _ = retriever.GetSummoner(summoner_id)
+	if err := query.Call(*conn, &request, &response, 0); err != nil {
+		log.Println("Name lookup failed:", err)
+		return 0, err
 	}
 
-	// TODO: Remove this once everything works well.
-	if name == "brigado" {
-		stat_request.Records.Daily = make(map[string]*data.PlayerSnapshot)
-		stat_request.Records.Daily["2014-09-17"] = &data.PlayerSnapshot {
-			SummonerId: stat_request.Player.SummonerId,
-			GamesList: []uint64{5, 10, 11, 19},
-			Stats: make(map[string]data.Metric),
-			CreationTimestamp: 0,
-		}
-		
-		stat_request.Records.Daily["2014-09-17"].Stats["kda"] = data.SimpleNumberMetric { Value: 11 }
-		stat_request.Records.Daily["2014-09-17"].Stats["minionKills"] = data.SimpleNumberMetric { Value: 20 }
-
-		// Add data for 9/18
-		stat_request.Records.Daily["2014-09-18"] = &data.PlayerSnapshot {
-			SummonerId: stat_request.Player.SummonerId,
-			GamesList: []uint64{5, 10, 11, 19},
-			Stats: make(map[string]data.Metric),
-			CreationTimestamp: 0,
-		}
-		
-		stat_request.Records.Daily["2014-09-18"].Stats["kda"] = data.SimpleNumberMetric { Value: 13 }
-		stat_request.Records.Daily["2014-09-18"].Stats["minionKills"] = data.SimpleNumberMetric { Value: 24 }
-
-	// Add data for 9/19
-		stat_request.Records.Daily["2014-09-19"] = &data.PlayerSnapshot {
-			SummonerId: stat_request.Player.SummonerId,
-			GamesList: []uint64{5, 10, 11, 19},
-			Stats: make(map[string]data.Metric),
-			CreationTimestamp: 0,
-		}
-		
-		stat_request.Records.Daily["2014-09-19"].Stats["kda"] = data.SimpleNumberMetric { Value: 14.1 }
-		stat_request.Records.Daily["2014-09-19"].Stats["minionKills"] = data.SimpleNumberMetric { Value: 37 }
+	if response.GetId() == 0 {
+		return 0, ErrUnknownSummoner
 	}
-
-	log.Println(stat_request)
-	response_string, jerr := json.Marshal(stat_request)
-
-	if jerr != nil {
-		log.Fatal("fatal error:", jerr)
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, string(response_string))
-	
-	log.Println("Response sent")
+	return response.GetId(), nil
 }
 
 func index_handler(w http.ResponseWriter, r *http.Request) {
@@ -159,8 +117,18 @@ func index_handler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	flag.Parse()
+	connect_nameservers()
+
+	// The retriever is shared by every request, so it's connected before
+	// any of them can race to do it.
+	retriever := data.LoLRetriever{}
+	if err := retriever.Init(); err != nil {
+		log.Fatal("Couldn't open the game store:", err)
+	}
+
 	http.HandleFunc("/", index_handler)
-	http.HandleFunc("/summoner/", summoner_handler)
+	http.Handle(PROFILE_PREFIX, &profileServer{store: &retriever, resolve: lookup_summoner})
 	// No-op handler for favicon.ico, since it'll otherwise generate an extra call to index_handler.
 	http.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {})
 	//        http.HandleFunc("/summoner/", simple_summoner)
@@ -0,0 +1,342 @@
+package main
+
+// The summoner profile API (/api/v1/summoners/<name>). A profile is built
+// from the summoner's record, which join-summoners keeps up to date with
+// daily, weekly and monthly snapshots, and from the games listed in those
+// snapshots. Errors are returned as JSON bodies of the form
+// {"error": {"code": ..., "message": ...}} with a matching HTTP status,
+// like the team frontend's API.
+
+import (
+	data "datamodel"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"libcleo"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const PROFILE_PREFIX = "/api/v1/summoners/"
+
+// The number of recent games returned, and the number of games that
+// champion win rates are computed over.
+const RECENT_GAMES = 10
+const CHAMPION_GAMES = 100
+const TOP_CHAMPIONS = 10
+
+var ErrUnknownSummoner = errors.New("unknown summoner")
+
+// SummonerStore is the part of data.LoLRetriever that profiles need. Errors
+// mean the store couldn't be reached.
+type summonerStore interface {
+	FindSummoner(sid uint32) (data.SummonerRecord, bool, error)
+	GetRecentGames(ids []uint64, limit int) ([]data.GameRecord, error)
+}
+
+type profileServer struct {
+	store summonerStore
+	// Resolves a summoner name to an ID; lookup_summoner except in tests.
+	resolve func(name string) (uint32, error)
+}
+
+type profileError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type Profile struct {
+	Summoner  ProfileSummoner   `json:"summoner"`
+	Rank      *ProfileRank      `json:"rank"`
+	Snapshots ProfileSnapshots  `json:"snapshots"`
+	Recent    []ProfileGame     `json:"recent_games"`
+	Champions []ProfileChampion `json:"champions"`
+}
+
+type ProfileSummoner struct {
+	Id          uint32 `json:"id"`
+	Name        string `json:"name"`
+	LastUpdated uint64 `json:"last_updated"`
+}
+
+type ProfileRank struct {
+	League string `json:"league"`
+	Level  uint32 `json:"level"`
+}
+
+type ProfileSnapshots struct {
+	Daily   []ProfileSnapshot `json:"daily"`
+	Weekly  []ProfileSnapshot `json:"weekly"`
+	Monthly []ProfileSnapshot `json:"monthly"`
+	// Rolling windows like last7days, by label.
+	Windows map[string][]ProfileSnapshot `json:"windows"`
+}
+
+type ProfileSnapshot struct {
+	// The first day covered by the snapshot, as YYYY-MM-DD. Rolling
+	// windows use the last day instead.
+	Date    string                 `json:"date"`
+	Games   int                    `json:"games"`
+	Metrics map[string]data.Metric `json:"metrics"`
+	Created uint64                 `json:"created"`
+}
+
+type ProfileGame struct {
+	GameId    uint64 `json:"game_id"`
+	Timestamp uint64 `json:"timestamp"`
+	Duration  uint32 `json:"duration"`
+	Champion  string `json:"champion"`
+	Victory   bool   `json:"victory"`
+	// Only set if the game's stats were recorded.
+	Kills   *uint32 `json:"kills,omitempty"`
+	Deaths  *uint32 `json:"deaths,omitempty"`
+	Assists *uint32 `json:"assists,omitempty"`
+}
+
+type ProfileChampion struct {
+	Champion string  `json:"champion"`
+	Games    int     `json:"games"`
+	Wins     int     `json:"wins"`
+	WinRate  float64 `json:"win_rate"`
+}
+
+var league_names = map[int]string{
+	data.LEAGUETYPE_BRONZE:   "bronze",
+	data.LEAGUETYPE_SILVER:   "silver",
+	data.LEAGUETYPE_GOLD:     "gold",
+	data.LEAGUETYPE_PLATINUM: "platinum",
+	data.LEAGUETYPE_DIAMOND:  "diamond",
+}
+
+func (p *profileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		write_error(w, &profileError{Status: http.StatusMethodNotAllowed, Code: "method_not_allowed", Message: "Only GET is supported."})
+		return
+	}
+
+	name := strings.TrimSpace(strings.TrimPrefix(r.URL.Path, PROFILE_PREFIX))
+	if len(name) == 0 {
+		write_error(w, &profileError{Status: http.StatusBadRequest, Code: "invalid_parameter", Message: "A summoner name is required."})
+		return
+	}
+
+	profile, perr := p.profile(name)
+	if perr != nil {
+		write_error(w, perr)
+		return
+	}
+
+	out, err := json.Marshal(profile)
+	if err != nil {
+		log.Println("Couldn't serialize profile:", err)
+		write_error(w, &profileError{Status: http.StatusInternalServerError, Code: "internal_error", Message: "Couldn't serialize the profile."})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
+func write_error(w http.ResponseWriter, perr *profileError) {
+	out, _ := json.Marshal(map[string]*profileError{"error": perr})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(perr.Status)
+	w.Write(out)
+}
+
+func (p *profileServer) profile(name string) (*Profile, *profileError) {
+	sid, err := p.resolve(name)
+	if err == ErrUnknownSummoner {
+		return nil, &profileError{Status: http.StatusNotFound, Code: "not_found", Message: fmt.Sprintf("Unknown summoner '%s'.", name)}
+	} else if err != nil {
+		return nil, &profileError{Status: http.StatusServiceUnavailable, Code: "backend_unavailable", Message: "The nameserver isn't available."}
+	}
+
+	record, exists, err := p.store.FindSummoner(sid)
+	if err != nil {
+		return nil, store_unavailable(err)
+	}
+	if !exists {
+		return nil, &profileError{Status: http.StatusNotFound, Code: "not_found", Message: fmt.Sprintf("There are no records for '%s' yet.", name)}
+	}
+
+	profile := Profile{
+		Summoner: ProfileSummoner{Id: sid, Name: record.Metadata.SummonerName, LastUpdated: record.LastUpdated},
+		Snapshots: ProfileSnapshots{
+			Daily:   snapshot_series(record.Daily),
+			Weekly:  snapshot_series(record.Weekly),
+			Monthly: snapshot_series(record.Monthly),
+			Windows: make(map[string][]ProfileSnapshot),
+		},
+	}
+	for label, snapshots := range record.Windows {
+		profile.Snapshots.Windows[label] = snapshot_series(snapshots)
+	}
+	if len(profile.Summoner.Name) == 0 {
+		profile.Summoner.Name = name
+	}
+
+	games, err := p.recent_games(record, CHAMPION_GAMES)
+	if err != nil {
+		return nil, store_unavailable(err)
+	}
+	profile.Recent = make([]ProfileGame, 0, RECENT_GAMES)
+	for _, game := range games {
+		player, team := find_player(game, sid)
+		if player == nil {
+			continue
+		}
+
+		if len(profile.Recent) < RECENT_GAMES {
+			profile.Recent = append(profile.Recent, profile_game(game, player, team))
+		}
+		if profile.Rank == nil && player.Player.Ranking != (data.PlayerRank{}) {
+			profile.Rank = &ProfileRank{League: league_names[player.Player.Ranking.League], Level: player.Player.Ranking.Level}
+		}
+	}
+	profile.Champions = most_played(games, sid, TOP_CHAMPIONS)
+
+	return &profile, nil
+}
+
+// Store_unavailable is the error for a summoner or game lookup that failed
+// because the store couldn't be reached.
+func store_unavailable(err error) *profileError {
+	log.Println("Couldn't read from the summoner store:", err)
+	return &profileError{Status: http.StatusServiceUnavailable, Code: "backend_unavailable", Message: "The summoner store isn't available."}
+}
+
+// Snapshot_series orders snapshots by date. Dates are YYYY-MM-DD, so
+// sorting them as strings works.
+func snapshot_series(snapshots map[string]*data.PlayerSnapshot) []ProfileSnapshot {
+	dates := make([]string, 0, len(snapshots))
+	for date := range snapshots {
+		dates = append(dates, date)
+	}
+	sort.Strings(dates)
+
+	series := make([]ProfileSnapshot, 0, len(dates))
+	for _, date := range dates {
+		snapshot := snapshots[date]
+		if snapshot == nil {
+			continue
+		}
+
+		// Metrics serialize themselves; see datamodel/metric.go.
+		metrics := snapshot.Stats
+		if metrics == nil {
+			metrics = make(map[string]data.Metric)
+		}
+
+		series = append(series, ProfileSnapshot{
+			Date:    date,
+			Games:   len(snapshot.GamesList),
+			Metrics: metrics,
+			Created: snapshot.CreationTimestamp,
+		})
+	}
+	return series
+}
+
+// Recent_games returns up to LIMIT of the summoner's most recent games
+// from their snapshots, newest first. The rolling windows are included
+// since they're usually the freshest snapshots a summoner has.
+func (p *profileServer) recent_games(record data.SummonerRecord, limit int) ([]data.GameRecord, error) {
+	all := []map[string]*data.PlayerSnapshot{record.Daily, record.Weekly, record.Monthly}
+	for _, window := range record.Windows {
+		all = append(all, window)
+	}
+
+	ids := make(map[uint64]bool)
+	for _, series := range all {
+		for _, snapshot := range series {
+			if snapshot == nil {
+				continue
+			}
+			for _, id := range snapshot.GamesList {
+				ids[id] = true
+			}
+		}
+	}
+
+	unique := make([]uint64, 0, len(ids))
+	for id := range ids {
+		unique = append(unique, id)
+	}
+	return p.store.GetRecentGames(unique, limit)
+}
+
+func find_player(game data.GameRecord, sid uint32) (*data.PlayerStats, *data.Team) {
+	for _, team := range game.Teams {
+		for _, player := range team.Players {
+			if player != nil && player.Player != nil && player.Player.SummonerId == sid {
+				return player, team
+			}
+		}
+	}
+	return nil, nil
+}
+
+func profile_game(game data.GameRecord, player *data.PlayerStats, team *data.Team) ProfileGame {
+	pg := ProfileGame{
+		GameId:    game.GameId,
+		Timestamp: game.Timestamp,
+		Duration:  game.Duration,
+		Champion:  libcleo.Rid2Cleo(player.Champion).String(),
+		Victory:   team.Victory,
+	}
+	if player.IsSet {
+		kills, deaths, assists := player.Kills, player.Deaths, player.Assists
+		pg.Kills, pg.Deaths, pg.Assists = &kills, &deaths, &assists
+	}
+	return pg
+}
+
+// Most_played returns the LIMIT champions the summoner played most in
+// GAMES, with their win rates. Ties are broken by name so the order is
+// stable.
+func most_played(games []data.GameRecord, sid uint32, limit int) []ProfileChampion {
+	counts := make(map[string]*ProfileChampion)
+	for _, game := range games {
+		player, team := find_player(game, sid)
+		if player == nil {
+			continue
+		}
+
+		name := libcleo.Rid2Cleo(player.Champion).String()
+		if _, exists := counts[name]; !exists {
+			counts[name] = &ProfileChampion{Champion: name}
+		}
+		counts[name].Games += 1
+		if team.Victory {
+			counts[name].Wins += 1
+		}
+	}
+
+	champions := make(byGamesPlayed, 0, len(counts))
+	for _, champion := range counts {
+		champion.WinRate = float64(champion.Wins) / float64(champion.Games)
+		champions = append(champions, *champion)
+	}
+	sort.Sort(champions)
+
+	if len(champions) > limit {
+		champions = champions[:limit]
+	}
+	return champions
+}
+
+type byGamesPlayed []ProfileChampion
+
+func (x byGamesPlayed) Len() int      { return len(x) }
+func (x byGamesPlayed) Swap(i, j int) { x[i], x[j] = x[j], x[i] }
+func (x byGamesPlayed) Less(i, j int) bool {
+	if x[i].Games != x[j].Games {
+		return x[i].Games > x[j].Games
+	}
+	return x[i].Champion < x[j].Champion
+}
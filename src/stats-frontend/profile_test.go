@@ -0,0 +1,261 @@
+package main
+
+import (
+	data "datamodel"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+)
+
+const TEST_SUMMONER = 36142441
+
+type fakeStore struct {
+	summoners map[uint32]data.SummonerRecord
+	games     map[uint64]data.GameRecord
+	// The number of times games have been fetched.
+	game_queries int
+	// Returned by every lookup if set.
+	err error
+}
+
+func (s *fakeStore) FindSummoner(sid uint32) (data.SummonerRecord, bool, error) {
+	if s.err != nil {
+		return data.SummonerRecord{}, false, s.err
+	}
+	record, exists := s.summoners[sid]
+	return record, exists, nil
+}
+
+func (s *fakeStore) GetRecentGames(ids []uint64, limit int) ([]data.GameRecord, error) {
+	s.game_queries += 1
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	sorted := make([]uint64, len(ids))
+	copy(sorted, ids)
+	sort.Sort(sort.Reverse(uint64List(sorted)))
+
+	games := make([]data.GameRecord, 0, limit)
+	for _, id := range sorted {
+		if game, exists := s.games[id]; exists && len(games) < limit {
+			games = append(games, game)
+		}
+	}
+	return games, nil
+}
+
+type uint64List []uint64
+
+func (x uint64List) Len() int           { return len(x) }
+func (x uint64List) Less(i, j int) bool { return x[i] < x[j] }
+func (x uint64List) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+
+// Game builds a game in which the test summoner played CHAMPION (a Riot
+// champion ID) and either won or lost.
+func game(id uint64, champion uint32, victory bool) data.GameRecord {
+	me := &data.PlayerStats{
+		IsSet:    true,
+		Player:   &data.PlayerType{SummonerId: TEST_SUMMONER, Ranking: data.PlayerRank{Level: 2, League: data.LEAGUETYPE_GOLD}},
+		Kills:    uint32(id),
+		Champion: champion,
+	}
+	other := &data.PlayerStats{Player: &data.PlayerType{SummonerId: 1}, Champion: 3}
+
+	return data.GameRecord{
+		GameId:    id,
+		Timestamp: id * 1000,
+		Teams: []*data.Team{
+			{Victory: victory, Players: []*data.PlayerStats{me}},
+			{Victory: !victory, Players: []*data.PlayerStats{other}},
+		},
+	}
+}
+
+func test_server() *profileServer {
+	store := &fakeStore{summoners: make(map[uint32]data.SummonerRecord), games: make(map[uint64]data.GameRecord)}
+
+	// Annie (1) is played three times and wins twice; Olaf (2) once.
+	store.games[10] = game(10, 1, true)
+	store.games[11] = game(11, 1, false)
+	store.games[12] = game(12, 2, true)
+	store.games[13] = game(13, 1, true)
+
+	store.summoners[TEST_SUMMONER] = data.SummonerRecord{
+		SummonerId: TEST_SUMMONER,
+		Metadata:   data.SummonerMetadata{SummonerName: "Brigado"},
+		Daily: map[string]*data.PlayerSnapshot{
+			"2014-09-18": {GamesList: []uint64{12, 13}, Stats: map[string]data.Metric{
+				// As stored before metrics had kinds.
+				"kda": {Value: 13},
+			}},
+			"2014-09-17": {GamesList: []uint64{10, 11, 99}, Stats: map[string]data.Metric{
+				"kda":         data.RatioMetric(22, 2),
+				"minionKills": data.NoDataMetric(data.METRIC_SCALAR),
+			}},
+		},
+		Windows: map[string]map[string]*data.PlayerSnapshot{
+			"last7days": {"2014-09-18": {GamesList: []uint64{10, 11, 12, 13}}},
+		},
+	}
+
+	return &profileServer{
+		store: store,
+		resolve: func(name string) (uint32, error) {
+			switch name {
+			case "brigado":
+				return TEST_SUMMONER, nil
+			case "offline":
+				return 0, errors.New("connection refused")
+			case "unjoined":
+				return 7, nil
+			}
+			return 0, ErrUnknownSummoner
+		},
+	}
+}
+
+func serve(p *profileServer, url string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", url, nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	return w
+}
+
+func TestProfile(t *testing.T) {
+	server := test_server()
+	w := serve(server, PROFILE_PREFIX+"brigado")
+	if w.Code != http.StatusOK {
+		t.Fatal("Profile returned", w.Code, w.Body.String())
+	}
+
+	profile := Profile{}
+	if err := json.Unmarshal(w.Body.Bytes(), &profile); err != nil {
+		t.Fatal(err)
+	}
+
+	if profile.Summoner.Name != "Brigado" || profile.Rank == nil || profile.Rank.League != "gold" {
+		t.Error("Unexpected summoner or rank:", profile.Summoner, profile.Rank)
+	}
+
+	daily := profile.Snapshots.Daily
+	if len(daily) != 2 || daily[0].Date != "2014-09-17" || daily[0].Games != 3 {
+		t.Fatal("Daily snapshots aren't in order:", daily)
+	}
+	if value, _ := daily[0].Metrics["kda"].Float(); value != 11 || daily[0].Metrics["kda"].Type() != data.METRIC_RATIO {
+		t.Error("Unexpected metric:", daily[0].Metrics["kda"])
+	}
+	if value, _ := daily[1].Metrics["kda"].Float(); value != 13 || daily[1].Metrics["kda"].Type() != data.METRIC_SCALAR {
+		t.Error("Unexpected legacy metric:", daily[1].Metrics["kda"])
+	}
+	if !daily[0].Metrics["minionKills"].NoData {
+		t.Error("Missing data wasn't kept:", daily[0].Metrics["minionKills"])
+	}
+	if profile.Snapshots.Weekly == nil || len(profile.Snapshots.Weekly) != 0 {
+		t.Error("Missing series should be empty lists")
+	}
+	if window := profile.Snapshots.Windows["last7days"]; len(window) != 1 || window[0].Date != "2014-09-18" || window[0].Games != 4 {
+		t.Error("Unexpected rolling windows:", profile.Snapshots.Windows)
+	}
+
+	// Games are fetched all at once, and game 99 doesn't exist and is
+	// skipped.
+	if queries := server.store.(*fakeStore).game_queries; queries != 1 {
+		t.Error("Expected a single query for games, got", queries)
+	}
+	if len(profile.Recent) != 4 || profile.Recent[0].GameId != 13 || profile.Recent[0].Champion != "ANNIE" || !profile.Recent[0].Victory {
+		t.Error("Unexpected recent games:", profile.Recent)
+	}
+	if profile.Recent[0].Kills == nil || *profile.Recent[0].Kills != 13 {
+		t.Error("Recent games are missing their stats")
+	}
+
+	champions := profile.Champions
+	if len(champions) != 2 || champions[0].Champion != "ANNIE" || champions[0].Games != 3 || champions[0].Wins != 2 {
+		t.Error("Unexpected most-played champions:", champions)
+	}
+}
+
+// Games only in a rolling window count as recent, and games the summoner
+// wasn't found in don't take up any of the recent slots.
+func TestRecentGames(t *testing.T) {
+	p := test_server()
+	store := p.store.(*fakeStore)
+
+	window := make([]uint64, 0)
+	for id := uint64(100); id < 120; id++ {
+		store.games[id] = game(id, 1, true)
+		window = append(window, id)
+	}
+	// The newest games are someone else's.
+	for id := uint64(120); id < 125; id++ {
+		g := game(id, 1, true)
+		g.Teams = g.Teams[1:]
+		store.games[id] = g
+		window = append(window, id)
+	}
+
+	record := store.summoners[TEST_SUMMONER]
+	record.Windows = map[string]map[string]*data.PlayerSnapshot{"last20games": {"2014-09-20": {GamesList: window}}}
+	store.summoners[TEST_SUMMONER] = record
+
+	profile, perr := p.profile("brigado")
+	if perr != nil {
+		t.Fatal(perr)
+	}
+	if len(profile.Recent) != RECENT_GAMES || profile.Recent[0].GameId != 119 || profile.Recent[RECENT_GAMES-1].GameId != 110 {
+		t.Error("Unexpected recent games:", profile.Recent)
+	}
+}
+
+func TestProfileErrors(t *testing.T) {
+	p := test_server()
+
+	cases := map[string]int{
+		PROFILE_PREFIX + "nobody":   http.StatusNotFound,
+		PROFILE_PREFIX + "unjoined": http.StatusNotFound,
+		PROFILE_PREFIX + "offline":  http.StatusServiceUnavailable,
+		PROFILE_PREFIX:              http.StatusBadRequest,
+	}
+
+	for url, status := range cases {
+		w := serve(p, url)
+		body := map[string]profileError{}
+		if w.Code != status || json.Unmarshal(w.Body.Bytes(), &body) != nil || len(body["error"].Code) == 0 {
+			t.Error(url, "returned", w.Code, w.Body.String())
+		}
+	}
+}
+
+// A store outage isn't the same as a summoner without records.
+func TestProfileStoreDown(t *testing.T) {
+	p := test_server()
+	p.store.(*fakeStore).err = errors.New("no reachable servers")
+
+	w := serve(p, PROFILE_PREFIX+"brigado")
+	body := map[string]profileError{}
+	if w.Code != http.StatusServiceUnavailable || json.Unmarshal(w.Body.Bytes(), &body) != nil || body["error"].Code != "backend_unavailable" {
+		t.Error("Expected the outage to be reported, got", w.Code, w.Body.String())
+	}
+}
+
+func TestMetricSerialization(t *testing.T) {
+	// Every metric has a type and version, and a value when it has one.
+	w := serve(test_server(), PROFILE_PREFIX+"brigado")
+	body := map[string]interface{}{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+
+	daily := body["snapshots"].(map[string]interface{})["daily"].([]interface{})
+	metrics := daily[0].(map[string]interface{})["metrics"].(map[string]interface{})
+	kda := metrics["kda"].(map[string]interface{})
+	if kda["type"] != "ratio" || kda["value"] != 11.0 || kda["numerator"] != 22.0 || kda["denominator"] != 2.0 {
+		t.Error("Unexpected JSON for kda:", kda)
+	}
+	minions := metrics["minionKills"].(map[string]interface{})
+	if _, exists := minions["value"]; exists || minions["no_data"] != true {
+		t.Error("Unexpected JSON for minionKills:", minions)
+	}
+}
@@ -0,0 +1,82 @@
+package switchboard
+
+// The same security settings also protect the gRPC services that some
+// backends serve next to their switchboard port. TLS is used as the
+// transport credentials and the token travels in each call's metadata
+// under TOKEN_METADATA_KEY.
+
+import "context"
+import "crypto/subtle"
+import "google.golang.org/grpc"
+import "google.golang.org/grpc/codes"
+import "google.golang.org/grpc/credentials"
+import "google.golang.org/grpc/metadata"
+import "google.golang.org/grpc/status"
+
+const TOKEN_METADATA_KEY = "switchboard-token"
+
+// GRPCServerOptions returns the options a gRPC server needs to require
+// the same TLS and token as switchboard sessions.
+func (s Security) GRPCServerOptions() []grpc.ServerOption {
+	options := make([]grpc.ServerOption, 0, 3)
+	if s.TLS != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(s.TLS)))
+	}
+	if len(s.Token) > 0 {
+		options = append(options,
+			grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+				if err := s.check_grpc_token(ctx); err != nil {
+					return nil, err
+				}
+				return handler(ctx, req)
+			}),
+			grpc.StreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				if err := s.check_grpc_token(stream.Context()); err != nil {
+					return err
+				}
+				return handler(srv, stream)
+			}),
+		)
+	}
+
+	return options
+}
+
+// GRPCDialOptions returns the options for calling a server that was set up
+// with GRPCServerOptions.
+func (s Security) GRPCDialOptions() []grpc.DialOption {
+	options := make([]grpc.DialOption, 0, 2)
+	if s.TLS != nil {
+		options = append(options, grpc.WithTransportCredentials(credentials.NewTLS(s.TLS)))
+	} else {
+		options = append(options, grpc.WithInsecure())
+	}
+	if len(s.Token) > 0 {
+		options = append(options, grpc.WithPerRPCCredentials(grpcToken{token: s.Token, secure: s.TLS != nil}))
+	}
+
+	return options
+}
+
+func (s Security) check_grpc_token(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, token := range md.Get(TOKEN_METADATA_KEY) {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, ErrAuthRejected.Error())
+}
+
+type grpcToken struct {
+	token  string
+	secure bool
+}
+
+func (t grpcToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{TOKEN_METADATA_KEY: t.token}, nil
+}
+
+func (t grpcToken) RequireTransportSecurity() bool {
+	return t.secure
+}
@@ -0,0 +1,34 @@
+package switchboard
+
+import "context"
+import "google.golang.org/grpc/codes"
+import "google.golang.org/grpc/metadata"
+import "google.golang.org/grpc/status"
+import "testing"
+
+func TestGRPCToken(t *testing.T) {
+	security := Security{Token: "secret"}
+	with_token := func(token string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(TOKEN_METADATA_KEY, token))
+	}
+
+	if err := security.check_grpc_token(with_token("secret")); err != nil {
+		t.Error("Expected the token to be accepted:", err)
+	}
+	if err := security.check_grpc_token(with_token("wrong")); status.Code(err) != codes.Unauthenticated {
+		t.Error("Expected a wrong token to be rejected, got", err)
+	}
+	if err := security.check_grpc_token(context.Background()); status.Code(err) != codes.Unauthenticated {
+		t.Error("Expected a missing token to be rejected, got", err)
+	}
+
+	// The client sends the same key the server checks.
+	md, _ := grpcToken{token: "secret"}.GetRequestMetadata(context.Background())
+	if err := security.check_grpc_token(metadata.NewIncomingContext(context.Background(), metadata.New(md))); err != nil {
+		t.Error("Expected the client's metadata to be accepted:", err)
+	}
+
+	if len(Security{}.GRPCServerOptions()) != 0 {
+		t.Error("Expected no server options without TLS or a token")
+	}
+}
@@ -0,0 +1,209 @@
+package switchboard
+
+// Sessions can optionally be secured with TLS (mutual, if a CA is given to
+// verify the other end's certificate) and a shared-secret token. Both are
+// applied when a connection is set up, before the yamux session starts:
+//
+//   1. TLS handshake, if Security.TLS is set.
+//   2. The client sends [length: 1 byte][token] and the server replies
+//      with a single byte, AUTH_OK or AUTH_REJECTED, if Security.Token is
+//      set.
+//
+// Both ends have to agree on whether each step happens.
+
+import "crypto/subtle"
+import "crypto/tls"
+import "crypto/x509"
+import "errors"
+import "flag"
+import "io"
+import "io/ioutil"
+import "net"
+import "strings"
+import "time"
+
+const (
+	AUTH_OK       byte = iota
+	AUTH_REJECTED byte = iota
+)
+
+// How long a new connection has to finish the TLS and token handshakes.
+const HANDSHAKE_TIMEOUT = 10 * time.Second
+
+var ErrAuthRejected = errors.New("switchboard token was rejected")
+
+type Security struct {
+	TLS   *tls.Config
+	Token string
+}
+
+type ServerOptions struct {
+	Security Security
+}
+
+// Secure_client runs the client side of the handshakes on a new connection
+// to ADDRESS, the host:port it was dialed at, and returns the connection to
+// run the session over.
+func secure_client(conn net.Conn, security Security, address string) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	if security.TLS != nil {
+		config := security.TLS
+		// Without an explicit server name, verify the backend's certificate
+		// against the host it was configured with, before it was resolved.
+		if len(config.ServerName) == 0 && !config.InsecureSkipVerify {
+			config = config.Clone()
+			config.ServerName, _, _ = net.SplitHostPort(address)
+		}
+
+		tls_conn := tls.Client(conn, config)
+		if err := tls_conn.Handshake(); err != nil {
+			return nil, err
+		}
+		conn = tls_conn
+	}
+
+	if len(security.Token) > 0 {
+		if len(security.Token) > 255 {
+			return nil, errors.New("switchboard tokens can't be longer than 255 bytes")
+		}
+
+		if _, err := conn.Write(append([]byte{byte(len(security.Token))}, security.Token...)); err != nil {
+			return nil, err
+		}
+
+		reply := make([]byte, 1)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return nil, err
+		}
+		if reply[0] != AUTH_OK {
+			return nil, ErrAuthRejected
+		}
+	}
+
+	return conn, nil
+}
+
+// Secure_server runs the server side of the handshakes.
+func secure_server(conn net.Conn, security Security) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	if security.TLS != nil {
+		tls_conn := tls.Server(conn, security.TLS)
+		if err := tls_conn.Handshake(); err != nil {
+			return nil, err
+		}
+		conn = tls_conn
+	}
+
+	if len(security.Token) > 0 {
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+		token := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, token); err != nil {
+			return nil, err
+		}
+
+		if subtle.ConstantTimeCompare(token, []byte(security.Token)) != 1 {
+			conn.Write([]byte{AUTH_REJECTED})
+			return nil, ErrAuthRejected
+		}
+		if _, err := conn.Write([]byte{AUTH_OK}); err != nil {
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// SecurityFlags are the command line flags every binary that uses
+// switchboard registers with RegisterSecurityFlags.
+type SecurityFlags struct {
+	cert       *string
+	key        *string
+	ca         *string
+	server     *string
+	token_file *string
+}
+
+func RegisterSecurityFlags() *SecurityFlags {
+	return &SecurityFlags{
+		cert:       flag.String("tls_cert", "", "PEM certificate for switchboard connections; enables TLS"),
+		key:        flag.String("tls_key", "", "PEM private key for -tls_cert"),
+		ca:         flag.String("tls_ca", "", "PEM CA used to verify the other end's certificate; enables mutual TLS"),
+		server:     flag.String("tls_server_name", "", "Expected server name in backend certificates; defaults to the backend host (clients only)"),
+		token_file: flag.String("auth_token_file", "", "File containing the shared switchboard token"),
+	}
+}
+
+// Client returns the security settings for dialing backends.
+func (f *SecurityFlags) Client() (Security, error) {
+	security, err := f.security()
+	if err != nil || security.TLS == nil {
+		return security, err
+	}
+
+	security.TLS.ServerName = *f.server
+	if security.TLS.ClientCAs != nil {
+		security.TLS.RootCAs = security.TLS.ClientCAs
+		security.TLS.ClientCAs = nil
+	}
+	return security, nil
+}
+
+// Server returns the security settings for accepting sessions.
+func (f *SecurityFlags) Server() (Security, error) {
+	security, err := f.security()
+	if err != nil || security.TLS == nil {
+		return security, err
+	}
+
+	if security.TLS.ClientCAs != nil {
+		security.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return security, nil
+}
+
+func (f *SecurityFlags) security() (Security, error) {
+	security := Security{}
+
+	if len(*f.token_file) > 0 {
+		token, err := ioutil.ReadFile(*f.token_file)
+		if err != nil {
+			return security, err
+		}
+		security.Token = strings.TrimSpace(string(token))
+	}
+
+	if len(*f.cert) == 0 {
+		if len(*f.ca) > 0 {
+			return security, errors.New("-tls_ca needs -tls_cert and -tls_key")
+		}
+		return security, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(*f.cert, *f.key)
+	if err != nil {
+		return security, err
+	}
+	security.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if len(*f.ca) > 0 {
+		pem, err := ioutil.ReadFile(*f.ca)
+		if err != nil {
+			return security, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return security, errors.New("no certificates found in " + *f.ca)
+		}
+		security.TLS.ClientCAs = pool
+	}
+
+	return security, nil
+}
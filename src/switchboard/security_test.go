@@ -0,0 +1,267 @@
+package switchboard
+
+import "crypto/ecdsa"
+import "crypto/elliptic"
+import "crypto/rand"
+import "crypto/tls"
+import "crypto/x509"
+import "crypto/x509/pkix"
+import "encoding/pem"
+import "io/ioutil"
+import "math/big"
+import "net"
+import "os"
+import "path/filepath"
+import "strconv"
+import "testing"
+import "time"
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+	der  []byte
+}
+
+// New_cert generates a certificate valid for 127.0.0.1, signed by PARENT or
+// self-signed as a CA if PARENT is nil.
+func new_cert(t *testing.T, name string, parent *testCert) *testCert {
+	return new_host_cert(t, name, parent, "127.0.0.1")
+}
+
+// New_host_cert generates a certificate that's only valid for HOST, which
+// is either an IP or a host name.
+func new_host_cert(t *testing.T, name string, parent *testCert, host string) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	signer, signer_key := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signer_key = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signer_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{
+		cert: cert,
+		key:  key,
+		der:  der,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+func (c *testCert) pair() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func (c *testCert) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(c.cert)
+	return pool
+}
+
+// Mutual_tls returns matching server and client settings for mutual TLS.
+func mutual_tls(t *testing.T) (Security, Security) {
+	ca := new_cert(t, "ca", nil)
+	server := new_cert(t, "server", ca)
+	client := new_cert(t, "client", ca)
+
+	return Security{TLS: &tls.Config{
+		Certificates: []tls.Certificate{server.pair()},
+		ClientCAs:    ca.pool(),
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}}, Security{TLS: &tls.Config{
+		Certificates: []tls.Certificate{client.pair()},
+		RootCAs:      ca.pool(),
+	}}
+}
+
+// Try_client connects with the given settings and makes one round trip.
+func try_client(t *testing.T, server *SwitchboardServer, security Security) error {
+	return try_address(t, server.Listener.Addr().String(), security)
+}
+
+func try_address(t *testing.T, address string, security Security) error {
+	options := test_options
+	options.Security = security
+
+	client, err := NewClientWithOptions("tcp", options, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	return round_trip(client)
+}
+
+func TestMutualTLS(t *testing.T) {
+	server_security, client_security := mutual_tls(t)
+	server := secure_echo_server(t, loopback(), ServerOptions{Security: server_security})
+	defer server.Close()
+
+	if err := try_client(t, server, client_security); err != nil {
+		t.Error("Client with a valid certificate failed:", err)
+	}
+
+	// No TLS at all, and TLS without a client certificate.
+	if err := try_client(t, server, Security{}); err == nil {
+		t.Error("Plaintext client was accepted")
+	}
+	no_cert := Security{TLS: &tls.Config{RootCAs: client_security.TLS.RootCAs}}
+	if err := try_client(t, server, no_cert); err == nil {
+		t.Error("Client without a certificate was accepted")
+	}
+
+	// A certificate from a different CA.
+	_, other := mutual_tls(t)
+	other.TLS.RootCAs = client_security.TLS.RootCAs
+	if err := try_client(t, server, other); err == nil {
+		t.Error("Client with an untrusted certificate was accepted")
+	}
+}
+
+func TestTLSServerName(t *testing.T) {
+	ca := new_cert(t, "ca", nil)
+	server_cert := new_host_cert(t, "server", ca, "localhost")
+	server := secure_echo_server(t, loopback(), ServerOptions{Security: Security{TLS: &tls.Config{
+		Certificates: []tls.Certificate{server_cert.pair()},
+	}}})
+	defer server.Close()
+
+	client_security := Security{TLS: &tls.Config{RootCAs: ca.pool()}}
+	port := strconv.Itoa(server.Listener.Addr().(*net.TCPAddr).Port)
+
+	// The certificate is checked against the configured host name rather
+	// than the address it resolved to.
+	if err := try_address(t, net.JoinHostPort("localhost", port), client_security); err != nil {
+		t.Error("Client dialing the certificate's host name failed:", err)
+	}
+	if err := try_address(t, net.JoinHostPort("127.0.0.1", port), client_security); err == nil {
+		t.Error("Certificate for localhost was accepted for 127.0.0.1")
+	}
+}
+
+func TestToken(t *testing.T) {
+	server := secure_echo_server(t, loopback(), ServerOptions{Security: Security{Token: "secret"}})
+	defer server.Close()
+
+	if err := try_client(t, server, Security{Token: "secret"}); err != nil {
+		t.Error("Client with the right token failed:", err)
+	}
+	if err := try_client(t, server, Security{Token: "guess"}); err == nil {
+		t.Error("Client with the wrong token was accepted")
+	}
+	if err := try_client(t, server, Security{}); err == nil {
+		t.Error("Client without a token was accepted")
+	}
+}
+
+func TestTLSAndToken(t *testing.T) {
+	server_security, client_security := mutual_tls(t)
+	server_security.Token = "secret"
+	server := secure_echo_server(t, loopback(), ServerOptions{Security: server_security})
+	defer server.Close()
+
+	client_security.Token = "secret"
+	if err := try_client(t, server, client_security); err != nil {
+		t.Error("Client failed:", err)
+	}
+	client_security.Token = "guess"
+	if err := try_client(t, server, client_security); err == nil {
+		t.Error("Client with the wrong token was accepted")
+	}
+}
+
+func TestSecurityFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "switchboard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := new_cert(t, "ca", nil)
+	leaf := new_cert(t, "leaf", ca)
+	key, err := x509.MarshalECPrivateKey(leaf.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{
+		"ca.pem":    ca.pem,
+		"cert.pem":  leaf.pem,
+		"key.pem":   pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}),
+		"token.txt": []byte("secret\n"),
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := func(name string) *string {
+		full := filepath.Join(dir, name)
+		return &full
+	}
+	empty := ""
+	flags := SecurityFlags{
+		cert:       path("cert.pem"),
+		key:        path("key.pem"),
+		ca:         path("ca.pem"),
+		server:     &empty,
+		token_file: path("token.txt"),
+	}
+
+	server_security, err := flags.Server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_security, err := flags.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if server_security.Token != "secret" {
+		t.Error("Token wasn't trimmed:", server_security.Token)
+	}
+	if server_security.TLS.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Error("Server doesn't require client certificates")
+	}
+
+	server := secure_echo_server(t, loopback(), ServerOptions{Security: server_security})
+	defer server.Close()
+	if err := try_client(t, server, client_security); err != nil {
+		t.Error("Client built from flags failed:", err)
+	}
+
+	// Without any flags, nothing is secured.
+	none := SecurityFlags{cert: &empty, key: &empty, ca: &empty, server: &empty, token_file: &empty}
+	if security, err := none.Client(); err != nil || security.TLS != nil || len(security.Token) > 0 {
+		t.Error("Empty flags produced", security, err)
+	}
+}
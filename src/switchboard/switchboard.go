@@ -1,82 +1,517 @@
 package switchboard
 
+// Switchboard multiplexes many short-lived streams (one per query) over a
+// few long-lived TCP connections using yamux. Clients keep a session open
+// to each of their backends, reconnecting with backoff whenever one drops,
+// and spread new streams across the healthy ones. Servers accept sessions
+// from any number of clients and hand out their streams one at a time.
+
 import yamux "github.com/hashicorp/yamux"
+import "errors"
+import "log"
 import "net"
+import "strings"
+import "sync"
+import "time"
+
+var ErrNoBackends = errors.New("no backends are available")
+var ErrClosed = errors.New("switchboard has been closed")
+
+const DEFAULT_MIN_BACKOFF = 100 * time.Millisecond
+const DEFAULT_MAX_BACKOFF = 30 * time.Second
+const DEFAULT_HEALTH_INTERVAL = 5 * time.Second
+const DEFAULT_DIAL_TIMEOUT = 5 * time.Second
+
+type ClientOptions struct {
+	// After a backend fails, wait MinBackoff before reconnecting, doubling
+	// after each failure up to MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// How often to ping each backend.
+	HealthInterval time.Duration
+	// How long to wait for a backend to accept a connection.
+	DialTimeout time.Duration
+	// TLS and token settings; see security.go.
+	Security Security
+}
+
+type backend struct {
+	// The host:port the backend was configured with. It's resolved again
+	// on every reconnect, and its host is the name TLS expects.
+	address string
+	session *yamux.Session
+
+	// Consecutive failures, which determine the backoff.
+	failures int
+	retry_at time.Time
+	lock     sync.Mutex
+
+	// Held while reconnecting so that only one caller dials at a time.
+	dialing sync.Mutex
+	// Set once SetBackends drops the backend, so that callers still
+	// holding it don't reconnect.
+	removed bool
+}
 
 type SwitchboardClient struct {
-	Connection *net.TCPConn
-	Session    *yamux.Session
+	network string
+	options ClientOptions
+
+	// Guarded by lock, since SetBackends can replace the list.
+	backends []*backend
+	next     int
+	lock     sync.Mutex
+	closed   chan bool
 }
 
 type SwitchboardServer struct {
-	Connection *net.TCPConn
-	Session    *yamux.Session
-	Listener   *net.TCPListener
+	Listener *net.TCPListener
+	options  ServerOptions
+
+	streams  chan net.Conn
+	closed   chan bool
+	sessions map[*yamux.Session]bool
+	lock     sync.Mutex
 }
 
 /**
- * Create a new Switchboard client. The client should establish a connection
- * to the desired network endpoint so that creating channels on the connection
- * is fast. The client won't exist if the connection can't be established.
+ * Create a new Switchboard client for host:port backends. The client tries
+ * to connect to every backend straight away so that creating streams is
+ * fast, but backends that aren't up yet are retried in the background
+ * rather than causing an error. A client can also start out without any
+ * backends and be given them later with SetBackends.
  */
-func NewClient(network string, address *net.TCPAddr) (SwitchboardClient, error) {
-	sbc := SwitchboardClient{}
-	// TODO: there must be a better way to take care of the net.Dial call...
-	cerr, serr := error(nil), error(nil)
-	sbc.Connection, cerr = net.DialTCP(network, nil, address)
+func NewClient(network string, addresses ...string) (*SwitchboardClient, error) {
+	return NewClientWithOptions(network, ClientOptions{}, addresses...)
+}
 
-	if cerr != nil {
-		return sbc, cerr
+func NewClientWithOptions(network string, options ClientOptions, addresses ...string) (*SwitchboardClient, error) {
+	if err := check_addresses(addresses); err != nil {
+		return nil, err
 	}
 
-	sbc.Session, serr = yamux.Client(sbc.Connection, nil)
+	if options.MinBackoff == 0 {
+		options.MinBackoff = DEFAULT_MIN_BACKOFF
+	}
+	if options.MaxBackoff == 0 {
+		options.MaxBackoff = DEFAULT_MAX_BACKOFF
+	}
+	if options.HealthInterval == 0 {
+		options.HealthInterval = DEFAULT_HEALTH_INTERVAL
+	}
+	if options.DialTimeout == 0 {
+		options.DialTimeout = DEFAULT_DIAL_TIMEOUT
+	}
 
-	if serr != nil {
-		return sbc, serr
+	sbc := SwitchboardClient{network: network, options: options, closed: make(chan bool)}
+	for _, address := range addresses {
+		b := backend{address: address}
+		if err := sbc.connect(&b); err != nil {
+			log.Println("Switchboard: backend", address, "isn't available yet:", err)
+		}
+		sbc.backends = append(sbc.backends, &b)
 	}
 
-	return sbc, nil
+	go sbc.check_health()
+
+	return &sbc, nil
 }
 
-func NewServer(network string, address *net.TCPAddr) (SwitchboardServer, error) {
-	sbs := SwitchboardServer{}
-	cerr, aerr, serr := error(nil), error(nil), error(nil)
-	sbs.Listener, cerr = net.ListenTCP(network, address)
+/**
+ * Replace the client's backends with ADDRESSES. Sessions to backends that
+ * are still listed are kept; new backends are connected to on first use
+ * or at the next health check, and the sessions of removed ones are
+ * closed once the switch has been made.
+ */
+func (c *SwitchboardClient) SetBackends(addresses ...string) error {
+	if err := check_addresses(addresses); err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	current := make(map[string]*backend)
+	for _, b := range c.backends {
+		current[b.address] = b
+	}
+
+	backends := make([]*backend, 0, len(addresses))
+	for _, address := range addresses {
+		if b, exists := current[address]; exists {
+			backends = append(backends, b)
+			delete(current, address)
+		} else {
+			log.Println("Switchboard: adding backend", address)
+			backends = append(backends, &backend{address: address})
+		}
+	}
+	c.backends = backends
+	c.lock.Unlock()
 
-	if cerr != nil {
-		return sbs, cerr
+	for _, b := range current {
+		log.Println("Switchboard: removing backend", b.address)
+		b.lock.Lock()
+		b.removed = true
+		if b.session != nil {
+			b.session.Close()
+			b.session = nil
+		}
+		b.lock.Unlock()
 	}
 
-	sbs.Connection, aerr = sbs.Listener.AcceptTCP()
+	return nil
+}
+
+// Get_backends returns a snapshot of the current backends.
+func (c *SwitchboardClient) get_backends() []*backend {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-	if aerr != nil {
-		return sbs, aerr
+	return c.backends
+}
+
+func check_addresses(addresses []string) error {
+	for _, address := range addresses {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	sbs.Session, serr = yamux.Server(sbs.Connection, nil)
+// SplitAddresses parses a comma-separated list of host:port addresses,
+// which is how binaries take their backends on the command line. Host
+// names are kept as they are; they're resolved when connecting.
+func SplitAddresses(list string) ([]string, error) {
+	addresses := make([]string, 0)
 
-	if serr != nil {
-		return sbs, serr
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		if _, _, err := net.SplitHostPort(entry); err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, entry)
 	}
 
-	return sbs, nil
+	return addresses, nil
 }
 
 /**
- * This method creates a new stream on the Client's connection.
+ * This method creates a new stream on one of the Client's backends. Backends
+ * are used in turn, skipping any that are down.
  */
 func (c *SwitchboardClient) GetStream() (*net.Conn, error) {
-	stream, err := c.Session.Open()
+	c.lock.Lock()
+	backends := c.backends
+	if len(backends) == 0 {
+		c.lock.Unlock()
+		return nil, ErrNoBackends
+	}
+	start := c.next % len(backends)
+	c.next = start + 1
+	c.lock.Unlock()
+
+	for i := 0; i < len(backends); i++ {
+		b := backends[(start+i)%len(backends)]
+
+		session := c.session(b)
+		if session == nil {
+			continue
+		}
+
+		stream, err := session.Open()
+		if err == nil {
+			return &stream, nil
+		}
+
+		log.Println("Switchboard: couldn't open a stream to", b.address, ":", err)
+		c.fail(b, session)
+	}
+
+	return nil, ErrNoBackends
+}
+
+// Close stops the health checks and closes every session.
+func (c *SwitchboardClient) Close() {
+	close(c.closed)
+
+	for _, b := range c.get_backends() {
+		b.lock.Lock()
+		if b.session != nil {
+			b.session.Close()
+			b.session = nil
+		}
+		b.lock.Unlock()
+	}
+}
+
+// Healthy returns the number of backends with an open session.
+func (c *SwitchboardClient) Healthy() int {
+	healthy := 0
+	for _, b := range c.get_backends() {
+		b.lock.Lock()
+		if b.session != nil && !b.session.IsClosed() {
+			healthy += 1
+		}
+		b.lock.Unlock()
+	}
+	return healthy
+}
+
+// Session returns the backend's session, reconnecting first if it's down
+// and its backoff has expired. Returns nil if the backend isn't usable.
+func (c *SwitchboardClient) session(b *backend) *yamux.Session {
+	if session, _ := b.current(); session != nil {
+		return session
+	}
+
+	// Callers that find the backend down at the same time wait for a single
+	// reconnect rather than each dialing their own.
+	b.dialing.Lock()
+	defer b.dialing.Unlock()
+
+	session, retry := b.current()
+	if session != nil || !retry {
+		return session
+	}
+
+	if err := c.connect(b); err != nil {
+		return nil
+	}
+
+	session, _ = b.current()
+	return session
+}
+
+// Current returns the backend's session if it's open, and whether its
+// backoff has expired.
+func (b *backend) current() (*yamux.Session, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.session != nil && !b.session.IsClosed() {
+		return b.session, true
+	}
+	return nil, time.Now().After(b.retry_at)
+}
 
-	return &stream, err
+func (c *SwitchboardClient) connect(b *backend) error {
+	tcp, err := net.DialTimeout(c.network, b.address, c.options.DialTimeout)
+	if err != nil {
+		c.fail(b, nil)
+		return err
+	}
+
+	conn, err := secure_client(tcp, c.options.Security, b.address)
+	if err != nil {
+		tcp.Close()
+		c.fail(b, nil)
+		return err
+	}
+
+	session, err := yamux.Client(conn, nil)
+	if err != nil {
+		conn.Close()
+		c.fail(b, nil)
+		return err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.removed {
+		session.Close()
+		return ErrClosed
+	}
+	if b.session != nil {
+		b.session.Close()
+	}
+	b.session = session
+	b.failures = 0
+
+	return nil
+}
+
+// Fail marks a backend as down and schedules its next reconnect. SESSION is
+// the session that failed; it's only closed if it's still current. A nil
+// SESSION means a reconnect failed, which leaves an open session alone.
+func (c *SwitchboardClient) fail(b *backend, session *yamux.Session) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if session == nil && b.session != nil && !b.session.IsClosed() {
+		return
+	}
+	if session != nil && b.session != session {
+		return
+	}
+	if b.session != nil {
+		b.session.Close()
+		b.session = nil
+	}
+
+	backoff := c.options.MinBackoff << uint(b.failures)
+	if backoff > c.options.MaxBackoff || backoff <= 0 {
+		backoff = c.options.MaxBackoff
+	} else {
+		b.failures += 1
+	}
+	b.retry_at = time.Now().Add(backoff)
+}
+
+// Check_health pings every backend periodically, and reconnects to any that
+// are down once their backoff expires.
+func (c *SwitchboardClient) check_health() {
+	ticker := time.NewTicker(c.options.HealthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+		}
+
+		for _, b := range c.get_backends() {
+			session := c.session(b)
+			if session == nil {
+				continue
+			}
+
+			if _, err := session.Ping(); err != nil {
+				log.Println("Switchboard: backend", b.address, "failed its health check:", err)
+				c.fail(b, session)
+			}
+		}
+	}
+}
+
+/**
+ * Create a new Switchboard server. It accepts sessions from any number of
+ * clients until it's closed.
+ */
+func NewServer(network string, address *net.TCPAddr) (*SwitchboardServer, error) {
+	return NewServerWithOptions(network, address, ServerOptions{})
+}
+
+func NewServerWithOptions(network string, address *net.TCPAddr, options ServerOptions) (*SwitchboardServer, error) {
+	listener, err := net.ListenTCP(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	sbs := SwitchboardServer{
+		Listener: listener,
+		options:  options,
+		streams:  make(chan net.Conn),
+		closed:   make(chan bool),
+		sessions: make(map[*yamux.Session]bool),
+	}
+	go sbs.accept_sessions()
+
+	return &sbs, nil
 }
 
 /**
- * This method listens on the Server's port until an inbound connection
- * arrives. When that happens, return a new stream.
+ * This method waits until a stream arrives on any of the Server's sessions
+ * and returns it.
  */
 func (s *SwitchboardServer) GetStream() (*net.Conn, error) {
-	stream, err := s.Session.Accept()
+	select {
+	case stream := <-s.streams:
+		return &stream, nil
+	case <-s.closed:
+		return nil, ErrClosed
+	}
+}
+
+// Close stops accepting new sessions and closes the existing ones.
+func (s *SwitchboardServer) Close() error {
+	close(s.closed)
+	err := s.Listener.Close()
 
-	return &stream, err
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for session := range s.sessions {
+		session.Close()
+	}
+
+	return err
+}
+
+func (s *SwitchboardServer) accept_sessions() {
+	for {
+		conn, err := s.Listener.AcceptTCP()
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+			}
+
+			log.Println("Switchboard: couldn't accept a connection:", err)
+			time.Sleep(DEFAULT_MIN_BACKOFF)
+			continue
+		}
+
+		// Handshakes can be slow, so they don't hold up the next client.
+		go s.start_session(conn)
+	}
+}
+
+func (s *SwitchboardServer) start_session(tcp *net.TCPConn) {
+	conn, err := secure_server(tcp, s.options.Security)
+	if err != nil {
+		log.Println("Switchboard: rejected a connection from", tcp.RemoteAddr(), ":", err)
+		tcp.Close()
+		return
+	}
+
+	session, err := yamux.Server(conn, nil)
+	if err != nil {
+		log.Println("Switchboard: couldn't start a session:", err)
+		conn.Close()
+		return
+	}
+
+	s.lock.Lock()
+	select {
+	case <-s.closed:
+		s.lock.Unlock()
+		session.Close()
+		return
+	default:
+	}
+	s.sessions[session] = true
+	s.lock.Unlock()
+
+	s.accept_streams(session)
+}
+
+func (s *SwitchboardServer) accept_streams(session *yamux.Session) {
+	defer func() {
+		s.lock.Lock()
+		delete(s.sessions, session)
+		s.lock.Unlock()
+
+		session.Close()
+	}()
+
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			// The client went away.
+			return
+		}
+
+		select {
+		case s.streams <- stream:
+		case <-s.closed:
+			stream.Close()
+			return
+		}
+	}
 }
@@ -0,0 +1,262 @@
+package switchboard
+
+import "io"
+import "net"
+import "testing"
+import "time"
+
+var test_options = ClientOptions{
+	MinBackoff:     10 * time.Millisecond,
+	MaxBackoff:     50 * time.Millisecond,
+	HealthInterval: 20 * time.Millisecond,
+}
+
+// Starts a server that echoes a single byte back on every stream.
+func echo_server(t *testing.T, address *net.TCPAddr) *SwitchboardServer {
+	return secure_echo_server(t, address, ServerOptions{})
+}
+
+func secure_echo_server(t *testing.T, address *net.TCPAddr, options ServerOptions) *SwitchboardServer {
+	server, err := NewServerWithOptions("tcp", address, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			stream, err := server.GetStream()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+				buf := make([]byte, 1)
+				if _, err := io.ReadFull(conn, buf); err == nil {
+					conn.Write(buf)
+				}
+			}(*stream)
+		}
+	}()
+
+	return server
+}
+
+func loopback() *net.TCPAddr {
+	return &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0}
+}
+
+// Round_trip opens a stream, sends a byte and waits for it to come back.
+func round_trip(client *SwitchboardClient) error {
+	stream, err := client.GetStream()
+	if err != nil {
+		return err
+	}
+	defer (*stream).Close()
+
+	(*stream).SetDeadline(time.Now().Add(time.Second))
+	if _, err := (*stream).Write([]byte{7}); err != nil {
+		return err
+	}
+	_, err = io.ReadFull(*stream, make([]byte, 1))
+	return err
+}
+
+func TestManyClients(t *testing.T) {
+	server := echo_server(t, loopback())
+	defer server.Close()
+	address := server.Listener.Addr().String()
+
+	// The server used to stop listening after its first connection.
+	for i := 0; i < 3; i++ {
+		client, err := NewClientWithOptions("tcp", test_options, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := round_trip(client); err != nil {
+			t.Error("Client", i, "failed:", err)
+		}
+		client.Close()
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	server := echo_server(t, loopback())
+	address := server.Listener.Addr().(*net.TCPAddr)
+
+	client, err := NewClientWithOptions("tcp", test_options, address.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := round_trip(client); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restart the backend on the same port.
+	server.Close()
+	time.Sleep(50 * time.Millisecond)
+	if err := round_trip(client); err == nil {
+		t.Error("Expected an error while the backend is down")
+	}
+
+	server = echo_server(t, address)
+	defer server.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for round_trip(client) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Client never reconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMultipleBackends(t *testing.T) {
+	first := echo_server(t, loopback())
+	defer first.Close()
+	second := echo_server(t, loopback())
+
+	client, err := NewClientWithOptions("tcp", test_options,
+		first.Listener.Addr().String(),
+		second.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if client.Healthy() != 2 {
+		t.Error("Expected both backends to be healthy, got", client.Healthy())
+	}
+
+	// Once the health checks notice the second backend is gone, every
+	// stream should go to the first.
+	second.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	if client.Healthy() != 1 {
+		t.Error("Expected one healthy backend, got", client.Healthy())
+	}
+	for i := 0; i < 4; i++ {
+		if err := round_trip(client); err != nil {
+			t.Error("Round trip", i, "failed:", err)
+		}
+	}
+}
+
+func TestNoBackends(t *testing.T) {
+	client, err := NewClientWithOptions("tcp", test_options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := round_trip(client); err != ErrNoBackends {
+		t.Error("Expected ErrNoBackends, got", err)
+	}
+	if _, err := NewClient("tcp", "no-port"); err == nil {
+		t.Error("Expected an error for an address without a port")
+	}
+}
+
+func TestSetBackends(t *testing.T) {
+	first := echo_server(t, loopback())
+	defer first.Close()
+	second := echo_server(t, loopback())
+	defer second.Close()
+
+	client, err := NewClientWithOptions("tcp", test_options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Backends that show up later are used.
+	client.SetBackends(first.Listener.Addr().String())
+	if err := round_trip(client); err != nil {
+		t.Fatal(err)
+	}
+	kept := client.backends[0]
+
+	client.SetBackends(first.Listener.Addr().String(), second.Listener.Addr().String())
+	if client.backends[0] != kept {
+		t.Error("Existing backend wasn't kept")
+	}
+	for i := 0; i < 4; i++ {
+		if err := round_trip(client); err != nil {
+			t.Error("Round trip", i, "failed:", err)
+		}
+	}
+	if client.Healthy() != 2 {
+		t.Error("Expected both backends to be healthy, got", client.Healthy())
+	}
+
+	// Removed backends have their sessions closed.
+	client.SetBackends(second.Listener.Addr().String())
+	kept.lock.Lock()
+	if kept.session != nil {
+		t.Error("Removed backend still has a session")
+	}
+	kept.lock.Unlock()
+	if client.Healthy() != 1 {
+		t.Error("Expected one healthy backend, got", client.Healthy())
+	}
+
+	client.SetBackends()
+	if err := round_trip(client); err != ErrNoBackends {
+		t.Error("Expected ErrNoBackends, got", err)
+	}
+}
+
+func TestConcurrentReconnect(t *testing.T) {
+	// Reserve a port for a backend that isn't up yet.
+	listener, err := net.ListenTCP("tcp", loopback())
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().(*net.TCPAddr)
+	listener.Close()
+
+	options := test_options
+	options.HealthInterval = time.Hour
+	client, err := NewClientWithOptions("tcp", options, address.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	server := echo_server(t, address)
+	defer server.Close()
+	time.Sleep(2 * options.MaxBackoff)
+
+	// Everyone finds the backend down at once, but it should only be
+	// dialed once.
+	done := make(chan bool)
+	for i := 0; i < 20; i++ {
+		go func() {
+			client.session(client.backends[0])
+			done <- true
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		<-done
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	server.lock.Lock()
+	sessions := len(server.sessions)
+	server.lock.Unlock()
+	if sessions != 1 {
+		t.Error("Expected a single session, got", sessions)
+	}
+
+	// A failed reconnect elsewhere mustn't close the good session.
+	client.fail(client.backends[0], nil)
+	if client.Healthy() != 1 {
+		t.Error("A failed reconnect closed an open session")
+	}
+	if err := round_trip(client); err != nil {
+		t.Error(err)
+	}
+}